@@ -0,0 +1,127 @@
+package accesslog
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseApache compiles an Apache LogFormat string such as
+//
+//	%h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-Agent}i" %D
+//
+// %D (microseconds) and %T (seconds, or %{ms}T / %{us}T) provide the
+// request duration. Request headers other than Referer, User-Agent and
+// Host are kept in Entry.Extra under their lower-cased name.
+func ParseApache(def string) (*Format, error) {
+	var b builder
+	for i := 0; i < len(def); {
+		if def[i] != '%' {
+			j := strings.IndexByte(def[i:], '%')
+			if j < 0 {
+				j = len(def) - i
+			}
+			b.literal(def[i : i+j])
+			i += j
+			continue
+		}
+
+		i++
+		if i < len(def) && def[i] == '%' {
+			b.literal("%")
+			i++
+			continue
+		}
+		// Skip the original/final request modifiers of %<s and %>s.
+		for i < len(def) && (def[i] == '<' || def[i] == '>') {
+			i++
+		}
+		arg := ""
+		if i < len(def) && def[i] == '{' {
+			end := strings.IndexByte(def[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated %%{ in log format")
+			}
+			arg = def[i+1 : i+end]
+			i += end + 1
+		}
+		if i >= len(def) {
+			return nil, fmt.Errorf("log format ends with a bare %%")
+		}
+		if err := apacheDirective(&b, def[i], arg); err != nil {
+			return nil, err
+		}
+		i++
+	}
+	return b.compile()
+}
+
+func apacheDirective(b *builder, d byte, arg string) error {
+	switch d {
+	case 'h', 'a':
+		b.capture("remote_addr", patToken, setString(func(e *Entry) *string { return &e.RemoteAddr }))
+	case 'l':
+		b.capture("remote_logname", patToken, setExtra("remote_logname"))
+	case 'u':
+		b.capture("remote_user", patAny, setString(func(e *Entry) *string { return &e.RemoteUser }))
+	case 't':
+		if arg != "" {
+			return fmt.Errorf("custom %%{...}t time formats are not supported")
+		}
+		b.literal("[")
+		b.capture("time", patTimeLocal, setTimeLocal)
+		b.literal("]")
+	case 'r':
+		b.capture("request", patAny, setRequest)
+	case 'm':
+		b.capture("method", patToken, setString(func(e *Entry) *string { return &e.Method }))
+	case 'U':
+		b.capture("path", patToken, func(e *Entry, v string) error {
+			e.URI = v + e.URI // %q may have been parsed first
+			return nil
+		})
+	case 'q':
+		b.capture("query", patToken, func(e *Entry, v string) error {
+			e.URI += v
+			return nil
+		})
+	case 'H':
+		b.capture("protocol", patToken, setString(func(e *Entry) *string { return &e.Protocol }))
+	case 's':
+		b.capture("status", `\d{3}|-`, setStatus)
+	case 'b', 'B', 'O':
+		b.capture("bytes_sent", patInt, setBytes)
+	case 'I':
+		b.capture("request_length", patInt, setRequestLength)
+	case 'D':
+		b.capture("request_time", patInt, setMicros)
+	case 'T':
+		switch arg {
+		case "", "s":
+			b.capture("request_time", patDecimal, setSeconds)
+		case "ms":
+			b.capture("request_time", patInt, setMillis)
+		case "us":
+			b.capture("request_time", patInt, setMicros)
+		default:
+			return fmt.Errorf("unsupported %%{%s}T unit", arg)
+		}
+	case 'v', 'V':
+		b.capture("host", patToken, setString(func(e *Entry) *string { return &e.Host }))
+	case 'i':
+		switch strings.ToLower(arg) {
+		case "referer":
+			b.capture("referer", patAny, setString(func(e *Entry) *string { return &e.Referer }))
+		case "user-agent":
+			b.capture("user_agent", patAny, setString(func(e *Entry) *string { return &e.UserAgent }))
+		case "host":
+			b.capture("host", patToken, setString(func(e *Entry) *string { return &e.Host }))
+		default:
+			name := strings.ToLower(arg)
+			b.capture(name, patAny, setExtra(name))
+		}
+	default:
+		name := "%" + string(d)
+		b.capture(name, patAny, setExtra(name))
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+// Package accesslog parses web server access logs in the common and
+// combined formats, in custom nginx log_format definitions and in Apache
+// LogFormat strings, so services without middleware can be tracked from
+// their proxy's logs.
+package accesslog
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Predefined formats, written as nginx log_format definitions. The combined
+// format is the same for nginx and Apache.
+const (
+	Common   = `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent`
+	Combined = `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"`
+	// CombinedTimed is the combined format with $request_time appended,
+	// a common nginx customization that provides request durations.
+	CombinedTimed = Combined + ` $request_time`
+)
+
+// ErrNoMatch is returned by Parse for lines that do not match the format.
+var ErrNoMatch = errors.New("line does not match log format")
+
+// Entry is a parsed access log line. Fields the format does not provide
+// are left zero.
+type Entry struct {
+	RemoteAddr  string
+	RemoteUser  string
+	Time        time.Time
+	Method      string
+	URI         string // path and query as requested
+	Protocol    string
+	Status      int
+	BytesSent   int64
+	Referer     string
+	UserAgent   string
+	Host        string
+	RequestTime time.Duration
+	// HasRequestTime is set when the format carries a duration, since a
+	// zero RequestTime is a valid measurement.
+	HasRequestTime bool
+	// RequestLength is the size of the whole request, headers included,
+	// from nginx $request_length or Apache %I.
+	RequestLength int64
+	// Extra holds variables the parser has no dedicated field for, keyed by
+	// variable name (e.g. "http_x_request_id").
+	Extra map[string]string
+}
+
+// field is a named capture in a compiled format.
+type field struct {
+	name  string
+	apply func(e *Entry, v string) error
+}
+
+// Format is a compiled log format.
+type Format struct {
+	re     *regexp.Regexp
+	fields []field
+}
+
+// Named returns the predefined format called name ("common", "combined" or
+// "combined_timed").
+func Named(name string) (*Format, error) {
+	switch strings.ToLower(name) {
+	case "common", "clf":
+		return ParseNginx(Common)
+	case "combined":
+		return ParseNginx(Combined)
+	case "combined_timed", "nginx_timed":
+		return ParseNginx(CombinedTimed)
+	}
+	return nil, fmt.Errorf("unknown log format %q", name)
+}
+
+// Parse parses one log line.
+func (f *Format) Parse(line string) (Entry, error) {
+	m := f.re.FindStringSubmatch(strings.TrimRight(line, "\r\n"))
+	if m == nil {
+		return Entry{}, ErrNoMatch
+	}
+	var e Entry
+	for i, fl := range f.fields {
+		v := m[i+1]
+		if v == "-" || v == "" {
+			continue
+		}
+		if err := fl.apply(&e, v); err != nil {
+			return Entry{}, fmt.Errorf("%s: %w", fl.name, err)
+		}
+	}
+	return e, nil
+}
+
+// Path returns the request path without the query string.
+func (e *Entry) Path() string {
+	if i := strings.IndexByte(e.URI, '?'); i >= 0 {
+		return e.URI[:i]
+	}
+	return e.URI
+}
+
+// builder assembles the regular expression for a format.
+type builder struct {
+	sb     strings.Builder
+	fields []field
+}
+
+func (b *builder) literal(s string) {
+	b.sb.WriteString(regexp.QuoteMeta(s))
+}
+
+func (b *builder) capture(name, pattern string, apply func(*Entry, string) error) {
+	b.sb.WriteString("(" + pattern + ")")
+	b.fields = append(b.fields, field{name: name, apply: apply})
+}
+
+func (b *builder) compile() (*Format, error) {
+	re, err := regexp.Compile("^" + b.sb.String() + "$")
+	if err != nil {
+		return nil, err
+	}
+	return &Format{re: re, fields: b.fields}, nil
+}
+
+// Value patterns. Free-form values are non-greedy so that the literal
+// that follows them in the format (usually a quote or space) ends them.
+const (
+	patToken   = `\S*`
+	patAny     = `.*?`
+	patInt     = `-|\d+`
+	patDecimal = `-|[\d.]+(?:, [\d.]+)*`
+	patTime    = `[^\]]+`
+)
+
+func setRequest(e *Entry, v string) error {
+	parts := strings.SplitN(v, " ", 3)
+	switch len(parts) {
+	case 3:
+		e.Method, e.URI, e.Protocol = parts[0], parts[1], parts[2]
+	case 2:
+		e.Method, e.URI = parts[0], parts[1]
+	default:
+		return errors.New("malformed request line")
+	}
+	return nil
+}
+
+func setStatus(e *Entry, v string) error {
+	n, err := strconv.Atoi(v)
+	e.Status = n
+	return err
+}
+
+func setBytes(e *Entry, v string) error {
+	n, err := strconv.ParseInt(v, 10, 64)
+	e.BytesSent = n
+	return err
+}
+
+func setRequestLength(e *Entry, v string) error {
+	n, err := strconv.ParseInt(v, 10, 64)
+	e.RequestLength = n
+	return err
+}
+
+// setSeconds parses nginx-style durations such as "0.123". Upstream
+// timings may list several values ("0.010, 0.020"); they are summed.
+func setSeconds(e *Entry, v string) error {
+	var total float64
+	for _, part := range strings.Split(v, ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return err
+		}
+		total += f
+	}
+	e.RequestTime = time.Duration(total * float64(time.Second))
+	e.HasRequestTime = true
+	return nil
+}
+
+func setMicros(e *Entry, v string) error {
+	n, err := strconv.ParseInt(v, 10, 64)
+	e.RequestTime = time.Duration(n) * time.Microsecond
+	e.HasRequestTime = true
+	return err
+}
+
+func setMillis(e *Entry, v string) error {
+	n, err := strconv.ParseInt(v, 10, 64)
+	e.RequestTime = time.Duration(n) * time.Millisecond
+	e.HasRequestTime = true
+	return err
+}
+
+func setTimeLocal(e *Entry, v string) error {
+	t, err := time.Parse("02/Jan/2006:15:04:05 -0700", v)
+	e.Time = t
+	return err
+}
+
+func setTimeISO(e *Entry, v string) error {
+	t, err := time.Parse(time.RFC3339, v)
+	e.Time = t
+	return err
+}
+
+// setMsec parses nginx $msec, seconds since the epoch with millisecond
+// resolution.
+func setMsec(e *Entry, v string) error {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return err
+	}
+	e.Time = time.UnixMilli(int64(f * 1000)).UTC()
+	return nil
+}
+
+func setExtra(name string) func(*Entry, string) error {
+	return func(e *Entry, v string) error {
+		if e.Extra == nil {
+			e.Extra = make(map[string]string)
+		}
+		e.Extra[name] = v
+		return nil
+	}
+}
+
+func setString(dst func(*Entry) *string) func(*Entry, string) error {
+	return func(e *Entry, v string) error {
+		*dst(e) = v
+		return nil
+	}
+}
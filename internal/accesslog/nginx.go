@@ -0,0 +1,94 @@
+package accesslog
+
+import (
+	"fmt"
+	"strings"
+)
+
+const patTimeLocal = `\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}`
+
+// ParseNginx compiles an nginx log_format definition such as
+//
+//	$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent" $request_time
+//
+// Variables without a dedicated Entry field are kept in Entry.Extra.
+func ParseNginx(def string) (*Format, error) {
+	var b builder
+	for i := 0; i < len(def); {
+		if def[i] != '$' {
+			j := strings.IndexByte(def[i:], '$')
+			if j < 0 {
+				j = len(def) - i
+			}
+			b.literal(def[i : i+j])
+			i += j
+			continue
+		}
+
+		i++
+		var name string
+		if i < len(def) && def[i] == '{' {
+			end := strings.IndexByte(def[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated ${ in log format")
+			}
+			name = def[i+1 : i+end]
+			i += end + 1
+		} else {
+			j := i
+			for j < len(def) && isVarChar(def[j]) {
+				j++
+			}
+			name = def[i:j]
+			i = j
+		}
+		if name == "" {
+			return nil, fmt.Errorf("empty variable name in log format")
+		}
+		nginxVariable(&b, name)
+	}
+	return b.compile()
+}
+
+func isVarChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func nginxVariable(b *builder, name string) {
+	switch name {
+	case "remote_addr", "realip_remote_addr":
+		b.capture(name, patToken, setString(func(e *Entry) *string { return &e.RemoteAddr }))
+	case "remote_user":
+		b.capture(name, patAny, setString(func(e *Entry) *string { return &e.RemoteUser }))
+	case "time_local":
+		b.capture(name, patTimeLocal, setTimeLocal)
+	case "time_iso8601":
+		b.capture(name, patToken, setTimeISO)
+	case "msec":
+		b.capture(name, `[\d.]+`, setMsec)
+	case "request":
+		b.capture(name, patAny, setRequest)
+	case "request_method":
+		b.capture(name, patToken, setString(func(e *Entry) *string { return &e.Method }))
+	case "request_uri", "uri", "document_uri":
+		b.capture(name, patToken, setString(func(e *Entry) *string { return &e.URI }))
+	case "server_protocol":
+		b.capture(name, patToken, setString(func(e *Entry) *string { return &e.Protocol }))
+	case "status":
+		b.capture(name, `\d{3}|-`, setStatus)
+	case "body_bytes_sent", "bytes_sent":
+		b.capture(name, patInt, setBytes)
+	case "request_length":
+		b.capture(name, patInt, setRequestLength)
+	case "http_referer":
+		b.capture(name, patAny, setString(func(e *Entry) *string { return &e.Referer }))
+	case "http_user_agent":
+		b.capture(name, patAny, setString(func(e *Entry) *string { return &e.UserAgent }))
+	case "host", "http_host", "server_name":
+		b.capture(name, patToken, setString(func(e *Entry) *string { return &e.Host }))
+	case "request_time":
+		b.capture(name, patDecimal, setSeconds)
+	default:
+		b.capture(name, patAny, setExtra(name))
+	}
+}
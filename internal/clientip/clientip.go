@@ -0,0 +1,181 @@
+// Package clientip normalizes and anonymizes the client IP addresses stored
+// on events, and derives a request's client address behind trusted
+// proxies.
+package clientip
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Policies for storing a client IP.
+const (
+	// PolicyFull stores the address unchanged.
+	PolicyFull = "full"
+	// PolicyTruncate zeroes the host part: IPv4 to /24, IPv6 to /48.
+	PolicyTruncate = "truncate"
+	// PolicyHash stores a keyed hash, so requests from one address can
+	// still be grouped without storing it.
+	PolicyHash = "hash"
+	// PolicyDrop stores no address.
+	PolicyDrop = "drop"
+)
+
+// Policies lists the policy names.
+var Policies = []string{PolicyFull, PolicyTruncate, PolicyHash, PolicyDrop}
+
+// ValidPolicy reports whether policy is one of Policies.
+func ValidPolicy(policy string) bool {
+	switch policy {
+	case PolicyFull, PolicyTruncate, PolicyHash, PolicyDrop:
+		return true
+	}
+	return false
+}
+
+// parse accepts an address with or without a port ("192.0.2.1:443",
+// "[2001:db8::1]:443") and unmaps IPv4-mapped IPv6 addresses.
+func parse(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return netip.Addr{}, false
+	}
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	addr, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// Normalize returns s in canonical form without a port or zone. Values
+// that are not IP addresses are returned trimmed.
+func Normalize(s string) string {
+	if addr, ok := parse(s); ok {
+		return addr.WithZone("").String()
+	}
+	return strings.TrimSpace(s)
+}
+
+// Anonymizer applies a policy to addresses.
+type Anonymizer struct {
+	key []byte
+}
+
+// NewAnonymizer returns an Anonymizer hashing with key.
+func NewAnonymizer(key string) *Anonymizer {
+	return &Anonymizer{key: []byte(key)}
+}
+
+// Apply returns the normalized s as stored under policy. Values that are
+// not IP addresses cannot be truncated and are dropped by PolicyTruncate.
+func (a *Anonymizer) Apply(policy, s string) string {
+	s = Normalize(s)
+	if s == "" {
+		return ""
+	}
+	switch policy {
+	case PolicyDrop:
+		return ""
+	case PolicyTruncate:
+		addr, ok := parse(s)
+		if !ok {
+			return ""
+		}
+		bits := 24
+		if addr.Is6() {
+			bits = 48
+		}
+		p, _ := addr.Prefix(bits)
+		return p.Addr().String()
+	case PolicyHash:
+		mac := hmac.New(sha256.New, a.key)
+		mac.Write([]byte(s))
+		return hex.EncodeToString(mac.Sum(nil)[:16])
+	default:
+		return s
+	}
+}
+
+// ParsePrefixes parses addresses and CIDR ranges such as "10.0.0.0/8".
+func ParsePrefixes(values []string) ([]netip.Prefix, error) {
+	out := make([]netip.Prefix, 0, len(values))
+	for _, v := range values {
+		if strings.Contains(v, "/") {
+			p, err := netip.ParsePrefix(v)
+			if err != nil {
+				return nil, fmt.Errorf("trusted proxy %q: %w", v, err)
+			}
+			out = append(out, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: %w", v, err)
+		}
+		addr = addr.Unmap()
+		out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return out, nil
+}
+
+func trusted(addr netip.Addr, proxies []netip.Prefix) bool {
+	for _, p := range proxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// FromRequest returns the client address of a request received from
+// remote. When remote is a trusted proxy, the Forwarded header (or, without
+// it, X-Forwarded-For) is walked from the nearest hop back and the first
+// address that is not a trusted proxy is the client. Headers from
+// untrusted peers are ignored.
+func FromRequest(remote netip.Addr, forwarded, xForwardedFor string, proxies []netip.Prefix) netip.Addr {
+	remote = remote.Unmap()
+	if !trusted(remote, proxies) {
+		return remote
+	}
+	var hops []string
+	if forwarded != "" {
+		hops = forwardedFor(forwarded)
+	} else {
+		hops = strings.Split(xForwardedFor, ",")
+	}
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parse(hops[i])
+		if !ok {
+			// An unknown or obfuscated hop ends the chain we can trust.
+			break
+		}
+		client = addr
+		if !trusted(addr, proxies) {
+			break
+		}
+	}
+	return client
+}
+
+// forwardedFor returns the for= values of an RFC 7239 Forwarded header,
+// one per hop, without quotes.
+func forwardedFor(header string) []string {
+	var out []string
+	for _, hop := range strings.Split(header, ",") {
+		for _, pair := range strings.Split(hop, ";") {
+			name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(name, "for") {
+				out = append(out, strings.Trim(value, `"`))
+			}
+		}
+	}
+	return out
+}
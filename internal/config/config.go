@@ -3,6 +3,8 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Config holds the core runtime configuration for the service.
@@ -14,6 +16,19 @@ type Config struct {
 
 	DatabaseURL string
 
+	// AutoMigrate applies pending schema migrations at startup. When off,
+	// the server refuses to start until "apiinsight migrate up" has run.
+	AutoMigrate bool
+
+	// EventsPartition partitions the PostgreSQL events table by creation
+	// time: "day", "week", or "none" (the default) for a single table.
+	// Retention then drops whole partitions once all their events have
+	// expired. A table holding events is converted by "apiinsight migrate
+	// partition-events".
+	EventsPartition string
+	// EventsPartitionsAhead is how many future partitions are kept created.
+	EventsPartitionsAhead int
+
 	// RetentionDays is the maximum retention (in days) that any individual
 	// API key is allowed to request. Per-key settings will be clamped to
 	// this value.
@@ -24,6 +39,119 @@ type Config struct {
 	// InternalAPIKey is used for self-reporting metrics from this API Insight instance.
 	// If empty, internal reporting is disabled.
 	InternalAPIKey string
+
+	// InternalReportingExclude lists request paths that internal reporting
+	// skips. An entry ending in "*" matches every path with that prefix.
+	InternalReportingExclude []string
+
+	// RouteAutoDetect controls whether numeric, UUID, hex and slug-like path
+	// segments are collapsed into placeholders (e.g. /users/{id}) when no
+	// per-project route template matches.
+	RouteAutoDetect bool
+
+	// RedactDetectors names the built-in detectors (email, jwt, card, ip)
+	// whose matches are replaced in paths, routes and attribute values of
+	// every ingested event.
+	RedactDetectors []string
+
+	// RedactDenyKeys lists attribute keys whose values are never stored.
+	// Matching ignores case, "-" and "_".
+	RedactDenyKeys []string
+
+	// RedactRouteReplacements are "pattern=>replacement" regex rewrites
+	// applied to the route of every ingested event.
+	RedactRouteReplacements []string
+
+	// IPPolicy is how client IPs of events are stored for keys without a
+	// policy of their own: full, truncate, hash or drop.
+	IPPolicy string
+
+	// IPHashKey is the secret for the hash IP policy. When empty a random
+	// key is used, so hashes change on every restart.
+	IPHashKey string
+
+	// TrustedProxies lists the addresses and CIDR ranges of reverse
+	// proxies whose Forwarded and X-Forwarded-For headers are trusted to
+	// name the client of this instance's own requests.
+	TrustedProxies []string
+
+	// GeoIPDatabases lists MaxMind database files (Country, City and/or
+	// ASN) used to look up the location and network of client IPs.
+	GeoIPDatabases []string
+
+	// GeoIPReloadInterval is how often the database files are checked for
+	// changes and reopened.
+	GeoIPReloadInterval time.Duration
+
+	// SessionTTL is the absolute lifetime of a dashboard login session.
+	SessionTTL time.Duration
+
+	// SessionIdleTimeout ends a session that has not been used for this long.
+	SessionIdleTimeout time.Duration
+
+	// CookieSecure controls the Secure attribute on the session cookie:
+	// "auto" sets it when the request arrived over HTTPS (directly or via
+	// X-Forwarded-Proto), "true" always sets it and "false" never does.
+	CookieSecure string
+
+	// IngestBufferSize is the maximum number of accepted events held in
+	// memory waiting to be written. When full, ingest answers 429.
+	IngestBufferSize int
+
+	// IngestWorkers is the number of goroutines writing queued events.
+	IngestWorkers int
+
+	// IngestBatchSize is the maximum number of rows per multi-row insert.
+	IngestBatchSize int
+
+	// IngestFlushInterval bounds how long a partial batch waits before it
+	// is written.
+	IngestFlushInterval time.Duration
+
+	// ShutdownTimeout bounds the graceful shutdown, including draining the
+	// ingest queue.
+	ShutdownTimeout time.Duration
+
+	// IngestMaxEventAge and IngestMaxClockSkew bound how far in the past or
+	// future an event timestamp may be before the event is rejected.
+	IngestMaxEventAge  time.Duration
+	IngestMaxClockSkew time.Duration
+
+	// IngestMaxAttributes, IngestMaxAttributeBytes and
+	// IngestMaxAttributeDepth limit the number of attribute keys, their
+	// JSON-encoded size and their nesting depth per event.
+	IngestMaxAttributes     int
+	IngestMaxAttributeBytes int
+	IngestMaxAttributeDepth int
+
+	// IngestMaxBodyBytes caps the size of an ingest request body after
+	// decompression. Larger bodies are refused with 413.
+	IngestMaxBodyBytes int64
+
+	// IngestIdempotencyWindow is how long the response to an ingest request
+	// with an Idempotency-Key header is kept for replay.
+	IngestIdempotencyWindow time.Duration
+
+	// IngestEventIDWindow is how long the event_id of a stored event is
+	// remembered to drop retried deliveries of it. It is cut short when the
+	// event itself expires earlier.
+	IngestEventIDWindow time.Duration
+
+	// SpoolDir enables the on-disk ingest spool when set. Accepted events
+	// are appended there before the 202 response and replayed into the
+	// database, surviving restarts and database outages.
+	SpoolDir string
+
+	// SpoolMaxBytes caps the unflushed spool size. When full, ingest
+	// answers 429.
+	SpoolMaxBytes int64
+
+	// SpoolSegmentBytes is the size at which spool segment files rotate.
+	SpoolSegmentBytes int64
+
+	// SpoolFsync fsyncs every append, so accepted events also survive a
+	// machine crash rather than only a process crash.
+	SpoolFsync bool
 }
 
 // Load reads configuration from environment variables and applies
@@ -35,6 +163,53 @@ func Load() *Config {
 		ListenAddr:     getenv("APP_LISTEN_ADDR", ":8080"),
 		RetentionDays:  30,
 		InternalAPIKey: getenv("APP_INTERNAL_API_KEY", ""),
+
+		AutoMigrate:           true,
+		EventsPartition:       getenv("APP_EVENTS_PARTITION", "none"),
+		EventsPartitionsAhead: 7,
+
+		InternalReportingExclude: []string{
+			"/v1/events", "/v1/otlp/traces", "/v1/metrics", "/metrics", "/healthz", "/healthz/ingest", "/login",
+		},
+
+		RouteAutoDetect: true,
+
+		IPPolicy:       getenv("APP_IP_POLICY", "full"),
+		IPHashKey:      os.Getenv("APP_IP_HASH_KEY"),
+		TrustedProxies: splitList(os.Getenv("APP_TRUSTED_PROXIES")),
+
+		GeoIPDatabases:      splitList(os.Getenv("APP_GEOIP_DATABASES")),
+		GeoIPReloadInterval: time.Minute,
+
+		RedactDetectors: []string{"email", "jwt", "card", "ip"},
+		RedactDenyKeys: []string{
+			"password", "passwd", "secret", "token", "access_token", "refresh_token",
+			"authorization", "cookie", "set-cookie", "api_key",
+		},
+
+		SessionTTL:         7 * 24 * time.Hour,
+		SessionIdleTimeout: 24 * time.Hour,
+		CookieSecure:       getenv("APP_COOKIE_SECURE", "auto"),
+
+		IngestBufferSize:    10000,
+		IngestWorkers:       4,
+		IngestBatchSize:     500,
+		IngestFlushInterval: time.Second,
+		ShutdownTimeout:     30 * time.Second,
+
+		IngestMaxEventAge:       7 * 24 * time.Hour,
+		IngestMaxClockSkew:      5 * time.Minute,
+		IngestMaxAttributes:     64,
+		IngestMaxAttributeBytes: 16 << 10,
+		IngestMaxAttributeDepth: 3,
+		IngestMaxBodyBytes:      16 << 20,
+		IngestIdempotencyWindow: 24 * time.Hour,
+		IngestEventIDWindow:     24 * time.Hour,
+
+		SpoolDir:          getenv("APP_SPOOL_DIR", ""),
+		SpoolMaxBytes:     1 << 30,
+		SpoolSegmentBytes: 64 << 20,
+		SpoolFsync:        true,
 	}
 
 	if v := os.Getenv("APP_RETENTION_DAYS"); v != "" {
@@ -43,6 +218,68 @@ func Load() *Config {
 		}
 	}
 
+	cfg.AutoMigrate = getenvBool("APP_AUTO_MIGRATE", cfg.AutoMigrate)
+	cfg.EventsPartitionsAhead = getenvPositiveInt("APP_EVENTS_PARTITIONS_AHEAD", cfg.EventsPartitionsAhead)
+
+	if v, ok := os.LookupEnv("APP_INTERNAL_REPORTING_EXCLUDE"); ok {
+		cfg.InternalReportingExclude = splitList(v)
+	}
+
+	cfg.RouteAutoDetect = getenvBool("APP_ROUTE_AUTO_DETECT", cfg.RouteAutoDetect)
+
+	if v, ok := os.LookupEnv("APP_REDACT_DETECTORS"); ok {
+		cfg.RedactDetectors = splitList(v)
+	}
+	if v, ok := os.LookupEnv("APP_REDACT_DENY_KEYS"); ok {
+		cfg.RedactDenyKeys = splitList(v)
+	}
+	// Regular expressions may contain commas, so replacements are
+	// separated by whitespace.
+	cfg.RedactRouteReplacements = strings.Fields(os.Getenv("APP_REDACT_ROUTE_REPLACEMENTS"))
+
+	if d := getenvDuration("APP_GEOIP_RELOAD_INTERVAL", cfg.GeoIPReloadInterval); d > 0 {
+		cfg.GeoIPReloadInterval = d
+	}
+
+	if d := getenvDuration("APP_SESSION_TTL", cfg.SessionTTL); d > 0 {
+		cfg.SessionTTL = d
+	}
+	if d := getenvDuration("APP_SESSION_IDLE_TIMEOUT", cfg.SessionIdleTimeout); d >= 0 {
+		cfg.SessionIdleTimeout = d
+	}
+
+	cfg.IngestBufferSize = getenvPositiveInt("APP_INGEST_BUFFER_SIZE", cfg.IngestBufferSize)
+	cfg.IngestWorkers = getenvPositiveInt("APP_INGEST_WORKERS", cfg.IngestWorkers)
+	cfg.IngestBatchSize = getenvPositiveInt("APP_INGEST_BATCH_SIZE", cfg.IngestBatchSize)
+	if d := getenvDuration("APP_INGEST_FLUSH_INTERVAL", cfg.IngestFlushInterval); d > 0 {
+		cfg.IngestFlushInterval = d
+	}
+	if d := getenvDuration("APP_SHUTDOWN_TIMEOUT", cfg.ShutdownTimeout); d > 0 {
+		cfg.ShutdownTimeout = d
+	}
+
+	if d := getenvDuration("APP_INGEST_MAX_EVENT_AGE", cfg.IngestMaxEventAge); d > 0 {
+		cfg.IngestMaxEventAge = d
+	}
+	if d := getenvDuration("APP_INGEST_MAX_CLOCK_SKEW", cfg.IngestMaxClockSkew); d > 0 {
+		cfg.IngestMaxClockSkew = d
+	}
+	cfg.IngestMaxAttributes = getenvPositiveInt("APP_INGEST_MAX_ATTRIBUTES", cfg.IngestMaxAttributes)
+	cfg.IngestMaxAttributeBytes = getenvPositiveInt("APP_INGEST_MAX_ATTRIBUTE_BYTES", cfg.IngestMaxAttributeBytes)
+	cfg.IngestMaxAttributeDepth = getenvPositiveInt("APP_INGEST_MAX_ATTRIBUTE_DEPTH", cfg.IngestMaxAttributeDepth)
+
+	cfg.IngestMaxBodyBytes = int64(getenvPositiveInt("APP_INGEST_MAX_BODY_BYTES", int(cfg.IngestMaxBodyBytes)))
+	if d := getenvDuration("APP_INGEST_IDEMPOTENCY_WINDOW", cfg.IngestIdempotencyWindow); d > 0 {
+		cfg.IngestIdempotencyWindow = d
+	}
+	if d := getenvDuration("APP_INGEST_EVENT_ID_WINDOW", cfg.IngestEventIDWindow); d > 0 {
+		cfg.IngestEventIDWindow = d
+	}
+
+	cfg.SpoolMaxBytes = int64(getenvPositiveInt("APP_SPOOL_MAX_BYTES", int(cfg.SpoolMaxBytes)))
+	cfg.SpoolSegmentBytes = int64(getenvPositiveInt("APP_SPOOL_SEGMENT_BYTES", int(cfg.SpoolSegmentBytes)))
+	cfg.SpoolFsync = getenvBool("APP_SPOOL_FSYNC", cfg.SpoolFsync)
+
 	return cfg
 }
 
@@ -52,3 +289,43 @@ func getenv(key, def string) string {
 	}
 	return def
 }
+
+// splitList splits a comma-separated value, dropping blank entries.
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+func getenvBool(key string, def bool) bool {
+	if v := os.Getenv(key); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return def
+}
+
+func getenvPositiveInt(key string, def int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return def
+}
+
+// getenvDuration parses a Go duration (e.g. "30s", "24h"). Invalid values
+// fall back to def.
+func getenvDuration(key string, def time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return def
+}
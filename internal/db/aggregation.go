@@ -2,60 +2,54 @@ package db
 
 import (
 	"log"
+	"math"
 	"sort"
 	"time"
 
 	"gorm.io/gorm"
 )
 
-// runAggregationOnce aggregates events for the given hour (bucketStart to bucketStart+1h)
+// Aggregate aggregates events for the given hour (bucketStart to bucketStart+1h)
 // into MetricBucket rows. Call with bucketStart = time in UTC truncated to hour.
-func runAggregationOnce(db *gorm.DB, bucketStart time.Time) error {
+func (s *sqlStore) Aggregate(bucketStart time.Time) error {
+	db := s.db
 	bucketEnd := bucketStart.Add(time.Hour)
 
 	var events []Event
 	if err := db.Where("created_at >= ? AND created_at < ?", bucketStart, bucketEnd).
-		Select("user_id", "project", "status", "duration_ms").
+		Select("user_id", "project", "status", "duration_ms", "request_bytes", "response_bytes", "sample_rate").
 		Find(&events).Error; err != nil {
 		return err
 	}
 
-	// Group by (user_id, project); collect status and duration_ms for percentiles.
+	// Group by (user_id, project); collect status, duration_ms, sizes and
+	// weight for percentiles. Sampled events count 1/sample_rate times.
 	type key struct {
 		UserID  string
 		Project string
 	}
-	groups := make(map[key][]struct {
-		status int
-		dur    int64
-	})
+	groups := make(map[key][]aggPoint)
 	for _, e := range events {
 		k := key{UserID: e.UserID, Project: e.Project}
-		groups[k] = append(groups[k], struct {
-			status int
-			dur    int64
-		}{e.Status, e.DurationMs})
+		groups[k] = append(groups[k], aggPoint{e.Status, e.DurationMs, e.RequestBytes, e.ResponseBytes, e.Weight()})
 	}
 
 	for k, list := range groups {
-		total := int64(len(list))
-		var errorCount int64
-		durations := make([]int64, 0, len(list))
+		var totalWeight, errorWeight, reqBytes, respBytes float64
 		for _, p := range list {
+			totalWeight += p.weight
 			if p.status >= 400 {
-				errorCount++
+				errorWeight += p.weight
 			}
-			durations = append(durations, p.dur)
-		}
-		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
-		p50 := int64(0)
-		p95 := int64(0)
-		p99 := int64(0)
-		if n := len(durations); n > 0 {
-			p50 = durations[(n*50)/100]
-			p95 = durations[(n*95)/100]
-			p99 = durations[(n*99)/100]
+			reqBytes += float64(p.reqBytes) * p.weight
+			respBytes += float64(p.respBytes) * p.weight
 		}
+		total := int64(math.Round(totalWeight))
+		errorCount := int64(math.Round(errorWeight))
+		sort.Slice(list, func(i, j int) bool { return list[i].dur < list[j].dur })
+		p50 := weightedPercentile(list, totalWeight, 0.50)
+		p95 := weightedPercentile(list, totalWeight, 0.95)
+		p99 := weightedPercentile(list, totalWeight, 0.99)
 
 		row := MetricBucket{
 			UserID:        k.UserID,
@@ -66,6 +60,8 @@ func runAggregationOnce(db *gorm.DB, bucketStart time.Time) error {
 			DurationP50Ms: p50,
 			DurationP95Ms: p95,
 			DurationP99Ms: p99,
+			RequestBytes:  int64(math.Round(reqBytes)),
+			ResponseBytes: int64(math.Round(respBytes)),
 		}
 		var existing MetricBucket
 		err := db.Where("user_id = ? AND project = ? AND bucket_start = ?", k.UserID, k.Project, bucketStart).First(&existing).Error
@@ -78,6 +74,8 @@ func runAggregationOnce(db *gorm.DB, bucketStart time.Time) error {
 				"duration_p50_ms": row.DurationP50Ms,
 				"duration_p95_ms": row.DurationP95Ms,
 				"duration_p99_ms": row.DurationP99Ms,
+				"request_bytes":   row.RequestBytes,
+				"response_bytes":  row.ResponseBytes,
 			}).Error
 		}
 		if err != nil {
@@ -87,15 +85,41 @@ func runAggregationOnce(db *gorm.DB, bucketStart time.Time) error {
 	return nil
 }
 
+// aggPoint is one event as seen by the aggregation.
+type aggPoint struct {
+	status    int
+	dur       int64
+	reqBytes  int64
+	respBytes int64
+	weight    float64
+}
+
+// weightedPercentile returns the duration at quantile q of sorted (ordered
+// by duration), where each point stands for its weight out of total.
+func weightedPercentile(sorted []aggPoint, total, q float64) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	target := total * q
+	var cum float64
+	for _, p := range sorted {
+		cum += p.weight
+		if cum > target {
+			return p.dur
+		}
+	}
+	return sorted[len(sorted)-1].dur
+}
+
 // StartAggregationWorker runs aggregation for the previous full hour at startup,
 // then every hour. Buckets are in UTC.
-func StartAggregationWorker(db *gorm.DB) {
+func StartAggregationWorker(store Store) {
 	go func() {
 		// Run for the last 24 completed hours at startup.
 		now := time.Now().UTC()
 		for i := 1; i <= 24; i++ {
 			bucketStart := now.Truncate(time.Hour).Add(-time.Duration(i) * time.Hour)
-			if err := runAggregationOnce(db, bucketStart); err != nil {
+			if err := store.Aggregate(bucketStart); err != nil {
 				log.Printf("aggregation error (startup) for %s: %v", bucketStart.Format(time.RFC3339), err)
 			}
 		}
@@ -104,7 +128,7 @@ func StartAggregationWorker(db *gorm.DB) {
 		defer ticker.Stop()
 		for t := range ticker.C {
 			bucketStart := t.UTC().Truncate(time.Hour).Add(-time.Hour)
-			if err := runAggregationOnce(db, bucketStart); err != nil {
+			if err := store.Aggregate(bucketStart); err != nil {
 				log.Printf("aggregation error for %s: %v", bucketStart.Format(time.RFC3339), err)
 			}
 		}
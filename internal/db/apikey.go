@@ -1,9 +1,44 @@
 package db
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
 	"time"
+
+	"gorm.io/gorm"
+)
+
+// apiKeyPrefixLen is the number of leading characters of a key that are
+// kept in plaintext for display and indexed lookup.
+const apiKeyPrefixLen = 12
+
+// API key scopes. A key may hold any combination of them.
+const (
+	// ScopeIngest allows sending events to /v1/events.
+	ScopeIngest = "ingest"
+	// ScopeMetricsRead allows reading the key's own project metrics, both
+	// the Prometheus exposition and the JSON /v1/metrics/* endpoints.
+	ScopeMetricsRead = "metrics:read"
+	// ScopeAdmin allows reading the JSON metrics API across every project
+	// of the key's owner, as if signed in to the dashboard.
+	ScopeAdmin = "admin"
 )
 
+// DefaultAPIKeyScopes is assigned to keys created without an explicit
+// scope list, matching what keys could do before scopes existed.
+const DefaultAPIKeyScopes = ScopeIngest + "," + ScopeMetricsRead
+
+// ValidScope reports whether scope is one of the known scope names.
+func ValidScope(scope string) bool {
+	switch scope {
+	case ScopeIngest, ScopeMetricsRead, ScopeAdmin:
+		return true
+	}
+	return false
+}
+
 // APIKey represents an API key for ingesting events from external services.
 // Each key belongs to a user and has a name and environment (production type).
 type APIKey struct {
@@ -21,8 +56,17 @@ type APIKey struct {
 	// Environment indicates the deployment environment (prod, staging, dev).
 	Environment string `gorm:"size:32;not null"`
 
-	// Key is the actual bearer token value (stored as-is, should be unique).
-	Key string `gorm:"uniqueIndex;size:255;not null"`
+	// KeyPrefix is the non-secret start of the bearer token, used to show
+	// which key is which and to narrow lookups before hash verification.
+	KeyPrefix string `gorm:"index;size:16"`
+
+	// KeyHash is the hex-encoded SHA-256 of the full bearer token. The
+	// plaintext token is only shown once, when the key is created.
+	KeyHash string `gorm:"size:64"`
+
+	// LegacyKey holds the plaintext token of keys created before hashing
+	// was introduced. MigrateAPIKeyHashes hashes and clears it on startup.
+	LegacyKey *string `gorm:"column:key;uniqueIndex;size:255"`
 
 	// RetentionDays is the number of days events ingested with this key
 	// should be retained for. A value of 0 means "use the global default"
@@ -32,6 +76,127 @@ type APIKey struct {
 	// Active indicates whether this key is currently enabled.
 	Active bool `gorm:"default:true"`
 
+	// Scopes is a comma-separated list of the scopes granted to this key
+	// (see ScopeIngest, ScopeMetricsRead and ScopeAdmin).
+	Scopes string `gorm:"size:128;not null;default:'ingest,metrics:read'"`
+
+	// StrictValidation rejects a whole ingest batch when any of its events
+	// fails validation, instead of accepting the valid ones.
+	StrictValidation bool `gorm:"not null;default:false"`
+
+	// RateLimitEvents and RateLimitBytes cap the ingest rate in events and
+	// request bytes per second; DailyEventQuota and MonthlyEventQuota cap
+	// the events accepted per UTC day and month. Zero means unlimited.
+	RateLimitEvents   int   `gorm:"not null;default:0"`
+	RateLimitBytes    int64 `gorm:"not null;default:0"`
+	DailyEventQuota   int64 `gorm:"not null;default:0"`
+	MonthlyEventQuota int64 `gorm:"not null;default:0"`
+
+	// IPPolicy is how client IPs of this key's events are stored (full,
+	// truncate, hash or drop). Empty means the global default from config.
+	IPPolicy string `gorm:"size:16;not null;default:''"`
+
 	// User is the owner of this API key.
 	User User `gorm:"foreignKey:UserID"`
 }
+
+// ScopeList returns the key's scopes as a slice.
+func (k *APIKey) ScopeList() []string {
+	var out []string
+	for _, s := range strings.Split(k.Scopes, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// HasScope reports whether the key was granted scope. The admin scope
+// implies metrics:read.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.ScopeList() {
+		if s == scope || (s == ScopeAdmin && scope == ScopeMetricsRead) {
+			return true
+		}
+	}
+	return false
+}
+
+// HashAPIKey returns the value stored in APIKey.KeyHash for a token.
+func HashAPIKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKeyPrefix returns the value stored in APIKey.KeyPrefix for a token.
+func APIKeyPrefix(token string) string {
+	if len(token) > apiKeyPrefixLen {
+		return token[:apiKeyPrefixLen]
+	}
+	return token
+}
+
+// SetToken stores the prefix and hash of token on the key.
+func (k *APIKey) SetToken(token string) {
+	k.KeyPrefix = APIKeyPrefix(token)
+	k.KeyHash = HashAPIKey(token)
+	k.LegacyKey = nil
+}
+
+// Matches reports whether token is this key's secret, in constant time.
+func (k *APIKey) Matches(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(k.KeyHash), []byte(HashAPIKey(token))) == 1
+}
+
+// FindActiveAPIKey resolves a bearer token to its active API key (with the
+// owning user preloaded). It returns gorm.ErrRecordNotFound when no active
+// key matches.
+func FindActiveAPIKey(db *gorm.DB, token string) (*APIKey, error) {
+	var candidates []APIKey
+	if err := db.Where("key_prefix = ? AND active = ?", APIKeyPrefix(token), true).
+		Preload("User").Find(&candidates).Error; err != nil {
+		return nil, err
+	}
+	for i := range candidates {
+		if candidates[i].Matches(token) {
+			return &candidates[i], nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+// FindAPIKeyByToken is like FindActiveAPIKey but also returns inactive keys
+// and does not preload the owner.
+func FindAPIKeyByToken(db *gorm.DB, token string) (*APIKey, error) {
+	var candidates []APIKey
+	if err := db.Where("key_prefix = ?", APIKeyPrefix(token)).Find(&candidates).Error; err != nil {
+		return nil, err
+	}
+	for i := range candidates {
+		if candidates[i].Matches(token) {
+			return &candidates[i], nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+// MigrateAPIKeyHashes hashes any keys still stored in plaintext and clears
+// the plaintext column, so upgraded installations stop keeping secrets at
+// rest. It is safe to run on every startup.
+func MigrateAPIKeyHashes(db *gorm.DB) error {
+	var legacy []APIKey
+	if err := db.Where("key IS NOT NULL AND key <> ''").Find(&legacy).Error; err != nil {
+		return err
+	}
+	for _, k := range legacy {
+		token := *k.LegacyKey
+		if err := db.Model(&APIKey{}).Where("id = ?", k.ID).Updates(map[string]interface{}{
+			"key_prefix": APIKeyPrefix(token),
+			"key_hash":   HashAPIKey(token),
+			"key":        nil,
+		}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
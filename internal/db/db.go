@@ -2,38 +2,85 @@ package db
 
 import (
 	"errors"
+	"fmt"
+	"log"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
-	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 
 	"apiinsight/internal/config"
 )
 
-// Connect opens a GORM database connection using APP_DATABASE_URL (PostgreSQL URL).
-func Connect(cfg *config.Config) (*gorm.DB, error) {
+// Open opens the store named by APP_DATABASE_URL: a postgres:// or
+// postgresql:// URL for PostgreSQL, or sqlite://<path> for an embedded
+// SQLite database (sqlite:///var/lib/apiinsight.db, sqlite://:memory:).
+// The schema is left as it is; see Connect.
+func Open(cfg *config.Config) (Store, error) {
 	dsn := strings.TrimSpace(cfg.DatabaseURL)
 	if dsn == "" {
-		return nil, errors.New("APP_DATABASE_URL is required (PostgreSQL URL)")
+		return nil, errors.New("APP_DATABASE_URL is required (postgres:// or sqlite:// URL)")
 	}
-	if !strings.HasPrefix(dsn, "postgres://") && !strings.HasPrefix(dsn, "postgresql://") {
-		return nil, errors.New("APP_DATABASE_URL must be a postgres:// or postgresql:// URL")
+
+	switch {
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		s, err := OpenPostgres(dsn, cfg.EventsPartition, cfg.EventsPartitionsAhead)
+		if err != nil {
+			return nil, err
+		}
+		s.eventIDWindow = cfg.IngestEventIDWindow
+		return s, nil
+	case strings.HasPrefix(dsn, "sqlite://"):
+		s, err := OpenSQLite(strings.TrimPrefix(dsn, "sqlite://"))
+		if err != nil {
+			return nil, err
+		}
+		s.eventIDWindow = cfg.IngestEventIDWindow
+		return s, nil
 	}
+	return nil, errors.New("APP_DATABASE_URL must be a postgres://, postgresql:// or sqlite:// URL")
+}
 
-	// PrepareStmt: true prevents the GORM postgres migrator from forcing simple protocol
-	// for "SELECT * FROM table LIMIT 1", which would otherwise trigger "insufficient arguments".
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{PrepareStmt: true})
+// Connect opens the store and readies its schema for the server. Pending
+// migrations are applied when cfg.AutoMigrate is set and are an error
+// otherwise, as is a schema migrated by a newer version.
+func Connect(cfg *config.Config) (Store, error) {
+	store, err := Open(cfg)
 	if err != nil {
 		return nil, err
 	}
-
-	// Auto-migrate the core tables.
-	if err := db.AutoMigrate(&Event{}, &User{}, &APIKey{}, &MetricBucket{}); err != nil {
+	if err := prepareSchema(store, cfg); err != nil {
+		store.Close()
 		return nil, err
 	}
+	return store, nil
+}
+
+func prepareSchema(store Store, cfg *config.Config) error {
+	pending, err := store.PendingMigrations()
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		if !cfg.AutoMigrate {
+			return fmt.Errorf("%d schema migration(s) pending; run \"apiinsight migrate up\"", len(pending))
+		}
+		applied, err := store.MigrateUp(0)
+		for _, m := range applied {
+			log.Printf("applied migration %d_%s", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Hash any API keys still stored in plaintext by older versions.
+	if err := MigrateAPIKeyHashes(store.DB()); err != nil {
+		return err
+	}
 
-	return db, nil
+	return store.PreparePartitions(time.Now())
 }
 
 // EnsureBootstrapAdmin makes sure there is at least one admin user
@@ -79,16 +126,16 @@ func EnsureBootstrapAPIKey(db *gorm.DB, cfg *config.Config) error {
 		return err
 	}
 
-	// Check if API key already exists (use Find so "not found" doesn't log as error).
-	var existingKey APIKey
-	if err := db.Where("key = ?", cfg.InternalAPIKey).Limit(1).Find(&existingKey).Error; err == nil && existingKey.ID != 0 {
+	// Check if API key already exists. Keys are stored hashed, so match on
+	// the hash of the configured plaintext value.
+	if existingKey, err := FindAPIKeyByToken(db, cfg.InternalAPIKey); err == nil {
 		// Key exists - ensure it belongs to admin.
 		if existingKey.UserID != admin.ID {
 			existingKey.UserID = admin.ID
 			existingKey.Name = "api-insight"
 			existingKey.Environment = "internal"
 			existingKey.Active = true
-			return db.Save(&existingKey).Error
+			return db.Save(existingKey).Error
 		}
 		// Already belongs to admin, nothing to do.
 		return nil
@@ -99,10 +146,11 @@ func EnsureBootstrapAPIKey(db *gorm.DB, cfg *config.Config) error {
 		UserID:        admin.ID,
 		Name:          "api-insight",
 		Environment:   "internal",
-		Key:           cfg.InternalAPIKey,
 		Active:        true,
 		RetentionDays: cfg.RetentionDays,
+		Scopes:        DefaultAPIKeyScopes,
 	}
+	apiKey.SetToken(cfg.InternalAPIKey)
 
 	return db.Create(apiKey).Error
 }
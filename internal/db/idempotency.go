@@ -0,0 +1,77 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// abandonedBatchAfter is how long a claimed batch key may stay unfinished
+// before another request may claim it, e.g. after a crash mid-request.
+const abandonedBatchAfter = time.Minute
+
+// IngestBatchKey remembers the response to an ingest request sent with an
+// Idempotency-Key header, so a retry of that request gets the original
+// answer instead of storing its events again.
+type IngestBatchKey struct {
+	APIKeyID       uint   `gorm:"primaryKey;autoIncrement:false"`
+	IdempotencyKey string `gorm:"primaryKey;size:255"`
+
+	CreatedAt time.Time
+	ExpiresAt time.Time `gorm:"index;not null"`
+
+	// RequestHash is the SHA-256 of the request body; reusing a key for a
+	// different body is an error.
+	RequestHash string `gorm:"size:64;not null"`
+
+	// Status is 0 while the first request is still being processed.
+	Status      int    `gorm:"not null;default:0"`
+	ContentType string `gorm:"size:128"`
+	Body        []byte
+}
+
+// ClaimBatchKey reserves key for a new request. When the key is already in
+// use, claimed is false and existing is the stored entry (Status 0 if that
+// request is still in flight).
+func ClaimBatchKey(db *gorm.DB, apiKeyID uint, key, requestHash string, ttl time.Duration) (existing *IngestBatchKey, claimed bool, err error) {
+	now := time.Now()
+	if err := db.Where("api_key_id = ? AND idempotency_key = ? AND (expires_at <= ? OR (status = 0 AND created_at <= ?))",
+		apiKeyID, key, now, now.Add(-abandonedBatchAfter)).Delete(&IngestBatchKey{}).Error; err != nil {
+		return nil, false, err
+	}
+
+	row := &IngestBatchKey{
+		APIKeyID:       apiKeyID,
+		IdempotencyKey: key,
+		CreatedAt:      now,
+		ExpiresAt:      now.Add(ttl),
+		RequestHash:    requestHash,
+	}
+	res := db.Clauses(clause.OnConflict{DoNothing: true}).Create(row)
+	if res.Error != nil {
+		return nil, false, res.Error
+	}
+	if res.RowsAffected == 1 {
+		return nil, true, nil
+	}
+
+	var found IngestBatchKey
+	if err := db.Where("api_key_id = ? AND idempotency_key = ?", apiKeyID, key).First(&found).Error; err != nil {
+		return nil, false, err
+	}
+	return &found, false, nil
+}
+
+// CompleteBatchKey stores the response for a claimed key.
+func CompleteBatchKey(db *gorm.DB, apiKeyID uint, key string, status int, contentType string, body []byte) error {
+	return db.Model(&IngestBatchKey{}).
+		Where("api_key_id = ? AND idempotency_key = ?", apiKeyID, key).
+		Updates(map[string]any{"status": status, "content_type": contentType, "body": body}).Error
+}
+
+// ReleaseBatchKey forgets a claimed key so the request can be retried,
+// used when it failed in a way the client should retry.
+func ReleaseBatchKey(db *gorm.DB, apiKeyID uint, key string) error {
+	return db.Where("api_key_id = ? AND idempotency_key = ?", apiKeyID, key).Delete(&IngestBatchKey{}).Error
+}
@@ -0,0 +1,324 @@
+package db
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// migrationFiles holds the schema migrations of each dialect, as
+// migrations/<dialect>/<version>_<name>.up.sql and a matching .down.sql.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+var migrationFile = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// Migration is one versioned schema change.
+type Migration struct {
+	Version int64
+	Name    string
+
+	up, down string
+}
+
+// MigrationStatus is a migration known to this build or recorded in the
+// database. AppliedAt is nil for pending migrations; Unknown is set for
+// applied versions this build has no files for.
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	AppliedAt *time.Time
+	Unknown   bool
+}
+
+// schemaMigration is a row of schema_migrations.
+type schemaMigration struct {
+	Version   int64
+	Name      string
+	AppliedAt time.Time
+}
+
+// ErrSchemaTooNew is returned when the database has migrations applied
+// that this build does not know, i.e. it was migrated by a newer version.
+var ErrSchemaTooNew = errors.New("database schema is newer than this build")
+
+// migrations reads the migrations of the named dialect, oldest first.
+func migrations(dialect string) ([]Migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int64]*Migration{}
+	for _, e := range entries {
+		m := migrationFile.FindStringSubmatch(e.Name())
+		if m == nil {
+			return nil, fmt.Errorf("migrations: unexpected file %s", e.Name())
+		}
+		version, _ := strconv.ParseInt(m[1], 10, 64)
+		body, err := fs.ReadFile(migrationFiles, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		mig := byVersion[version]
+		if mig == nil {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("migrations: version %d has two names", version)
+		}
+		if m[3] == "up" {
+			mig.up = string(body)
+		} else {
+			mig.down = string(body)
+		}
+	}
+
+	list := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.up == "" || mig.down == "" {
+			return nil, fmt.Errorf("migrations: version %d needs an up and a down file", mig.Version)
+		}
+		list = append(list, *mig)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	return list, nil
+}
+
+// legacyModels are the models AutoMigrate created before versioned
+// migrations.
+var legacyModels = []any{&Event{}, &User{}, &APIKey{}, &MetricBucket{}, &RouteTemplate{}, &Session{}, &APIKeyUsage{}, &IngestBatchKey{}, &SamplingRule{}, &RedactionRule{}}
+
+// appliedMigrations returns the rows of schema_migrations, creating the
+// table if needed. While no migration is recorded, a database created by
+// AutoMigrate is adopted first; see adoptLegacySchema.
+func (s *sqlStore) appliedMigrations(known []Migration) ([]schemaMigration, error) {
+	if err := s.db.Exec(s.dialect.migrationsTable()).Error; err != nil {
+		return nil, err
+	}
+	var applied []schemaMigration
+	if err := s.db.Table("schema_migrations").Order("version").Find(&applied).Error; err != nil {
+		return nil, err
+	}
+	if len(applied) > 0 || len(known) == 0 {
+		return applied, nil
+	}
+	if err := s.adoptLegacySchema(known[0]); err != nil {
+		return nil, err
+	}
+	err := s.db.Table("schema_migrations").Order("version").Find(&applied).Error
+	return applied, err
+}
+
+// adoptLegacySchema brings a database created by AutoMigrate before
+// versioned migrations up to date with a last AutoMigrate and records it
+// as being at baseline, the first migration, which creates that same
+// schema. The check and both steps run in one transaction holding the
+// migration lock, so concurrent starts adopt the database once.
+func (s *sqlStore) adoptLegacySchema(baseline Migration) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(s.dialect.migrationLock()).Error; err != nil {
+			return err
+		}
+		var n int64
+		if err := tx.Table("schema_migrations").Count(&n).Error; err != nil {
+			return err
+		}
+		if n > 0 || !tx.Migrator().HasTable(&User{}) {
+			return nil
+		}
+		if err := tx.AutoMigrate(legacyModels...); err != nil {
+			return fmt.Errorf("update existing schema: %w", err)
+		}
+		return tx.Exec(insertMigration(baseline)).Error
+	})
+}
+
+// MigrationStatus lists the known migrations and any unknown applied ones,
+// by version.
+func (s *sqlStore) MigrationStatus() ([]MigrationStatus, error) {
+	known, err := migrations(s.dialect.name())
+	if err != nil {
+		return nil, err
+	}
+	applied, err := s.appliedMigrations(known)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int64]schemaMigration{}
+	for _, a := range applied {
+		byVersion[a.Version] = a
+	}
+
+	var list []MigrationStatus
+	for _, m := range known {
+		st := MigrationStatus{Version: m.Version, Name: m.Name}
+		if a, ok := byVersion[m.Version]; ok {
+			st.AppliedAt = &a.AppliedAt
+			delete(byVersion, m.Version)
+		}
+		list = append(list, st)
+	}
+	for _, a := range byVersion {
+		a := a
+		list = append(list, MigrationStatus{Version: a.Version, Name: a.Name, AppliedAt: &a.AppliedAt, Unknown: true})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	return list, nil
+}
+
+// MigrateUp applies the pending migrations up to version to (every one
+// when to is 0) and returns them. It refuses to run with ErrSchemaTooNew.
+func (s *sqlStore) MigrateUp(to int64) ([]Migration, error) {
+	known, err := migrations(s.dialect.name())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.pendingMigrations(known); err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, m := range known {
+		if to > 0 && m.Version > to {
+			break
+		}
+		ran := false
+		err := s.migrationTx(m.Version, true, func(tx *sql.Tx) error {
+			ran = true
+			if _, err := tx.Exec(m.up); err != nil {
+				return err
+			}
+			_, err := tx.Exec(insertMigration(m))
+			return err
+		})
+		if err != nil {
+			return done, fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+		}
+		if ran {
+			done = append(done, m)
+		}
+	}
+	return done, nil
+}
+
+// MigrateDown reverts the last steps applied migrations and returns them.
+func (s *sqlStore) MigrateDown(steps int) ([]Migration, error) {
+	known, err := migrations(s.dialect.name())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.pendingMigrations(known); err != nil {
+		return nil, err
+	}
+	applied, err := s.appliedMigrations(known)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int64]Migration{}
+	for _, m := range known {
+		byVersion[m.Version] = m
+	}
+
+	var done []Migration
+	for i := len(applied) - 1; i >= 0 && len(done) < steps; i-- {
+		m, ok := byVersion[applied[i].Version]
+		if !ok {
+			return done, fmt.Errorf("migration %d_%s: no files in this build", applied[i].Version, applied[i].Name)
+		}
+		err := s.migrationTx(m.Version, false, func(tx *sql.Tx) error {
+			if _, err := tx.Exec(m.down); err != nil {
+				return err
+			}
+			_, err := tx.Exec("DELETE FROM schema_migrations WHERE version = " + strconv.FormatInt(m.Version, 10))
+			return err
+		})
+		if err != nil {
+			return done, fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// PendingMigrations returns the known migrations not yet applied, or
+// ErrSchemaTooNew.
+func (s *sqlStore) PendingMigrations() ([]Migration, error) {
+	known, err := migrations(s.dialect.name())
+	if err != nil {
+		return nil, err
+	}
+	return s.pendingMigrations(known)
+}
+
+func (s *sqlStore) pendingMigrations(known []Migration) ([]Migration, error) {
+	applied, err := s.appliedMigrations(known)
+	if err != nil {
+		return nil, err
+	}
+	var latest int64
+	if len(known) > 0 {
+		latest = known[len(known)-1].Version
+	}
+	done := map[int64]bool{}
+	for _, a := range applied {
+		if a.Version > latest {
+			return nil, fmt.Errorf("%w: version %d (%s) is applied, this build knows up to %d", ErrSchemaTooNew, a.Version, a.Name, latest)
+		}
+		done[a.Version] = true
+	}
+	var pending []Migration
+	for _, m := range known {
+		if !done[m.Version] {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// migrationTx runs fn in a transaction holding the migration lock, unless
+// another process has applied (up) or reverted (!up) version meanwhile.
+// Migration statements run without bind parameters, so that a file may
+// hold several statements.
+func (s *sqlStore) migrationTx(version int64, up bool, fn func(tx *sql.Tx) error) error {
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	tx, err := sqlDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(s.dialect.migrationLock()); err != nil {
+		return err
+	}
+	var n int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM schema_migrations WHERE version = " + strconv.FormatInt(version, 10)).Scan(&n); err != nil {
+		return err
+	}
+	if (n > 0) == up {
+		return nil
+	}
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertMigration records m as applied.
+func insertMigration(m Migration) string {
+	return "INSERT INTO schema_migrations (version, name) VALUES (" + strconv.FormatInt(m.Version, 10) + ", '" + m.Name + "')"
+}
@@ -0,0 +1,233 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func TestMigrations(t *testing.T) {
+	var versions [2][]string
+	for i, dialect := range []string{"postgres", "sqlite"} {
+		list, err := migrations(dialect)
+		if err != nil {
+			t.Fatalf("%s: %v", dialect, err)
+		}
+		if len(list) == 0 || list[0].Version != 1 {
+			t.Fatalf("%s: migrations do not start at version 1", dialect)
+		}
+		for j, m := range list {
+			if j > 0 && m.Version != list[j-1].Version+1 {
+				t.Errorf("%s: version %d follows %d", dialect, m.Version, list[j-1].Version)
+			}
+			if strings.TrimSpace(m.up) == "" || strings.TrimSpace(m.down) == "" {
+				t.Errorf("%s: migration %d has an empty file", dialect, m.Version)
+			}
+			versions[i] = append(versions[i], fmt.Sprintf("%d_%s", m.Version, m.Name))
+		}
+	}
+	if !reflect.DeepEqual(versions[0], versions[1]) {
+		t.Errorf("dialects have different migrations: postgres %v, sqlite %v", versions[0], versions[1])
+	}
+	if _, err := migrations("mysql"); err == nil {
+		t.Error("migrations of an unknown dialect succeeded")
+	}
+}
+
+func TestMigrationFile(t *testing.T) {
+	tests := []struct {
+		name  string
+		match []string
+	}{
+		{"0001_initial_schema.up.sql", []string{"0001", "initial_schema", "up"}},
+		{"12_add_x2.down.sql", []string{"12", "add_x2", "down"}},
+		{"0001_initial.sql", nil},
+		{"0001_Initial.up.sql", nil},
+		{"initial.up.sql", nil},
+		{"0001_initial.up.sql.bak", nil},
+	}
+	for _, tt := range tests {
+		m := migrationFile.FindStringSubmatch(tt.name)
+		var got []string
+		if m != nil {
+			got = m[1:]
+		}
+		if !reflect.DeepEqual(got, tt.match) {
+			t.Errorf("match %q = %q, want %q", tt.name, got, tt.match)
+		}
+	}
+}
+
+// sqliteSchema describes the tables of db, except bookkeeping tables, as
+// sorted "table.column type ..." and "table index ..." lines.
+func sqliteSchema(t *testing.T, db *gorm.DB) []string {
+	t.Helper()
+	var tables []string
+	if err := db.Raw(`SELECT name FROM sqlite_master WHERE type = 'table'
+		AND name NOT IN ('schema_migrations', 'sqlite_sequence')`).Scan(&tables).Error; err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, table := range tables {
+		var cols []struct {
+			Name      string
+			Type      string
+			NotNull   bool
+			DfltValue *string
+			PK        int
+		}
+		if err := db.Raw("SELECT name, type, \"notnull\" AS not_null, dflt_value, pk FROM pragma_table_info(?)", table).Scan(&cols).Error; err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range cols {
+			dflt := "-"
+			if c.DfltValue != nil {
+				dflt = strings.Trim(*c.DfltValue, `"'`)
+			}
+			lines = append(lines, fmt.Sprintf("%s.%s %s notnull=%v default=%s pk=%d",
+				table, c.Name, strings.ToLower(c.Type), c.NotNull, dflt, c.PK))
+		}
+
+		var indexes []struct {
+			Name   string
+			Unique bool
+			Origin string
+		}
+		if err := db.Raw("SELECT name, \"unique\", origin FROM pragma_index_list(?)", table).Scan(&indexes).Error; err != nil {
+			t.Fatal(err)
+		}
+		for _, idx := range indexes {
+			if idx.Origin == "pk" {
+				continue
+			}
+			var cols []string
+			if err := db.Raw("SELECT name FROM pragma_index_info(?) ORDER BY seqno", idx.Name).Scan(&cols).Error; err != nil {
+				t.Fatal(err)
+			}
+			lines = append(lines, fmt.Sprintf("%s index %s unique=%v (%s)", table, idx.Name, idx.Unique, strings.Join(cols, ", ")))
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// TestSQLiteMigrationsMatchModels checks that the migrations create the
+// schema AutoMigrate derives from the models, so that a model change
+// without a migration is noticed.
+func TestSQLiteMigrationsMatchModels(t *testing.T) {
+	migrated := newTestStore(t)
+
+	auto, err := OpenSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auto.Close()
+	if err := auto.DB().AutoMigrate(append(legacyModels, &EventIDKey{})...); err != nil {
+		t.Fatal(err)
+	}
+
+	got, want := sqliteSchema(t, migrated.DB()), sqliteSchema(t, auto.DB())
+	gotSet := map[string]bool{}
+	for _, l := range got {
+		gotSet[l] = true
+	}
+	for _, l := range want {
+		if !gotSet[l] {
+			t.Errorf("migrations lack: %s", l)
+		}
+		delete(gotSet, l)
+	}
+	for _, l := range got {
+		if gotSet[l] {
+			t.Errorf("migrations add: %s", l)
+		}
+	}
+}
+
+func TestMigrateDownAndUp(t *testing.T) {
+	s := newTestStore(t)
+	known, err := migrations("sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done, err := s.MigrateDown(len(known))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != len(known) || done[0].Version != known[len(known)-1].Version {
+		t.Fatalf("MigrateDown reverted %v", done)
+	}
+	if s.DB().Migrator().HasTable(&Event{}) {
+		t.Error("events table still exists after reverting every migration")
+	}
+
+	if done, err = s.MigrateUp(1); err != nil || len(done) != 1 {
+		t.Fatalf("MigrateUp(1) = %v, %v", done, err)
+	}
+	pending, err := s.PendingMigrations()
+	if err != nil || len(pending) != len(known)-1 {
+		t.Fatalf("PendingMigrations = %v, %v; want %d", pending, err, len(known)-1)
+	}
+	if done, err = s.MigrateUp(0); err != nil || len(done) != len(known)-1 {
+		t.Fatalf("MigrateUp(0) = %v, %v", done, err)
+	}
+	if done, err = s.MigrateUp(0); err != nil || len(done) != 0 {
+		t.Errorf("second MigrateUp(0) = %v, %v; want nothing", done, err)
+	}
+}
+
+func TestMigrateSchemaTooNew(t *testing.T) {
+	s := newTestStore(t)
+	if err := s.DB().Exec(insertMigration(Migration{Version: 9999, Name: "future"})).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.MigrateUp(0); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("MigrateUp = %v, want ErrSchemaTooNew", err)
+	}
+	status, err := s.MigrationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := status[len(status)-1]; last.Version != 9999 || !last.Unknown {
+		t.Errorf("last status = %+v, want unknown version 9999", last)
+	}
+}
+
+// TestAdoptLegacySchema migrates a database created by AutoMigrate before
+// versioned migrations.
+func TestAdoptLegacySchema(t *testing.T) {
+	s, err := OpenSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.DB().AutoMigrate(&Event{}, &User{}); err != nil {
+		t.Fatal(err)
+	}
+	id := "1"
+	if err := s.DB().Create(&Event{Project: "p", EventID: &id, SampleRate: 1}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	done, err := s.MigrateUp(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) == 0 || done[0].Version == 1 {
+		t.Errorf("MigrateUp applied %v, want the baseline recorded without running it", done)
+	}
+	if !s.DB().Migrator().HasTable(&SamplingRule{}) {
+		t.Error("adoption did not create the tables missing from the legacy schema")
+	}
+	var ids int64
+	s.DB().Model(&EventIDKey{}).Count(&ids)
+	if ids != 1 {
+		t.Errorf("event_ids has %d rows, want the legacy event's ID", ids)
+	}
+}
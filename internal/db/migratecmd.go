@@ -0,0 +1,118 @@
+package db
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"apiinsight/internal/config"
+)
+
+const migrateUsage = `Usage: apiinsight migrate up|down|status|partition-events [flags]
+
+Manages the database schema of APP_DATABASE_URL.
+
+  up                apply pending migrations (-to VERSION stops at that version)
+  down              revert applied migrations (-steps N, default 1)
+  status            list migrations and when each was applied
+  partition-events  partition the PostgreSQL events table by
+                    APP_EVENTS_PARTITION, locking it while every event is copied
+`
+
+// RunMigrate runs the migrate subcommand with the arguments after
+// "migrate".
+func RunMigrate(cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, migrateUsage)
+		return errors.New("missing command")
+	}
+	fset := flag.NewFlagSet("migrate "+args[0], flag.ContinueOnError)
+	fset.Usage = func() {
+		fmt.Fprint(fset.Output(), migrateUsage)
+		fset.PrintDefaults()
+	}
+	to := fset.Int64("to", 0, "up: last version to apply (0 for all)")
+	steps := fset.Int("steps", 1, "down: number of migrations to revert")
+	if err := fset.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fset.NArg() > 0 {
+		fset.Usage()
+		return fmt.Errorf("unexpected argument %q", fset.Arg(0))
+	}
+
+	store, err := Open(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	switch args[0] {
+	case "up":
+		applied, err := store.MigrateUp(*to)
+		for _, m := range applied {
+			fmt.Printf("applied %d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("schema is up to date")
+		}
+		return err
+	case "down":
+		if *steps < 1 {
+			return errors.New("-steps must be at least 1")
+		}
+		reverted, err := store.MigrateDown(*steps)
+		for _, m := range reverted {
+			fmt.Printf("reverted %d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(reverted) == 0 {
+			fmt.Println("no migrations applied")
+		}
+		return err
+	case "status":
+		list, err := store.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, m := range list {
+			applied := "pending"
+			if m.AppliedAt != nil {
+				applied = m.AppliedAt.UTC().Format(time.RFC3339)
+			}
+			if m.Unknown {
+				applied += " (unknown to this build)"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", m.Version, m.Name, applied)
+		}
+		return w.Flush()
+	case "partition-events":
+		ps, ok := store.(*PostgresStore)
+		if !ok {
+			return errors.New("partitioning needs PostgreSQL")
+		}
+		pending, err := store.PendingMigrations()
+		if err != nil {
+			return err
+		}
+		if len(pending) > 0 {
+			return errors.New(`schema migrations are pending; run "apiinsight migrate up" first`)
+		}
+		converted, err := ps.PartitionEvents(time.Now())
+		if err != nil {
+			return err
+		}
+		if converted {
+			fmt.Printf("partitioned the events table by %s\n", cfg.EventsPartition)
+		} else {
+			fmt.Println("the events table is already partitioned")
+		}
+		return ps.PreparePartitions(time.Now())
+	}
+	fset.Usage()
+	return fmt.Errorf("unknown command %q", args[0])
+}
@@ -0,0 +1,175 @@
+-- The schema created by AutoMigrate before versioned migrations. The events
+-- table is partitioned afterwards when APP_EVENTS_PARTITION is set.
+
+CREATE TABLE events (
+    id bigserial,
+    created_at timestamptz NOT NULL,
+    expires_at timestamptz,
+    user_id text,
+    project text,
+    event_id varchar(128),
+    route text,
+    raw_path text,
+    method text,
+    status bigint,
+    duration_ms bigint,
+    remote_ip text,
+    request_bytes bigint NOT NULL DEFAULT 0,
+    response_bytes bigint NOT NULL DEFAULT 0,
+    trace_id varchar(32),
+    span_id varchar(16),
+    parent_span_id varchar(16),
+    country varchar(2),
+    region varchar(16),
+    asn bigint NOT NULL DEFAULT 0,
+    asn_org varchar(255),
+    user_agent varchar(512),
+    browser varchar(64),
+    browser_version varchar(32),
+    os varchar(32),
+    os_version varchar(32),
+    device varchar(16),
+    app varchar(64),
+    app_version varchar(64),
+    is_bot boolean NOT NULL DEFAULT false,
+    sample_rate decimal NOT NULL DEFAULT 1,
+    attributes jsonb,
+    PRIMARY KEY (id)
+);
+CREATE INDEX idx_events_expires_at ON events (expires_at);
+CREATE INDEX idx_events_user_id ON events (user_id);
+CREATE INDEX idx_events_project ON events (project);
+CREATE UNIQUE INDEX idx_events_project_event_id ON events (project, event_id);
+CREATE INDEX idx_events_route ON events (route);
+CREATE INDEX idx_events_method ON events (method);
+CREATE INDEX idx_events_trace_id ON events (trace_id);
+CREATE INDEX idx_events_span_id ON events (span_id);
+CREATE INDEX idx_events_parent_span_id ON events (parent_span_id);
+CREATE INDEX idx_events_country ON events (country);
+CREATE INDEX idx_events_browser ON events (browser);
+CREATE INDEX idx_events_os ON events (os);
+CREATE INDEX idx_events_device ON events (device);
+CREATE INDEX idx_events_is_bot ON events (is_bot);
+
+CREATE TABLE users (
+    id bigserial,
+    created_at timestamptz,
+    updated_at timestamptz,
+    username varchar(64) NOT NULL,
+    password_hash varchar(255) NOT NULL,
+    is_admin boolean DEFAULT false,
+    time_format varchar(8) DEFAULT '12',
+    date_format varchar(16) DEFAULT 'dd-mm-yyyy',
+    PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX idx_users_username ON users (username);
+
+CREATE TABLE api_keys (
+    id bigserial,
+    created_at timestamptz,
+    updated_at timestamptz,
+    user_id bigint NOT NULL,
+    name varchar(128) NOT NULL,
+    environment varchar(32) NOT NULL,
+    key_prefix varchar(16),
+    key_hash varchar(64),
+    key varchar(255),
+    retention_days bigint NOT NULL DEFAULT 0,
+    active boolean DEFAULT true,
+    scopes varchar(128) NOT NULL DEFAULT 'ingest,metrics:read',
+    strict_validation boolean NOT NULL DEFAULT false,
+    rate_limit_events bigint NOT NULL DEFAULT 0,
+    rate_limit_bytes bigint NOT NULL DEFAULT 0,
+    daily_event_quota bigint NOT NULL DEFAULT 0,
+    monthly_event_quota bigint NOT NULL DEFAULT 0,
+    ip_policy varchar(16) NOT NULL DEFAULT '',
+    PRIMARY KEY (id),
+    CONSTRAINT fk_api_keys_user FOREIGN KEY (user_id) REFERENCES users (id)
+);
+CREATE INDEX idx_api_keys_user_id ON api_keys (user_id);
+CREATE INDEX idx_api_keys_key_prefix ON api_keys (key_prefix);
+CREATE UNIQUE INDEX idx_api_keys_legacy_key ON api_keys (key);
+
+CREATE TABLE metric_buckets (
+    id bigserial,
+    user_id text NOT NULL,
+    project text NOT NULL,
+    bucket_start timestamptz NOT NULL,
+    total_count bigint NOT NULL,
+    error_count bigint NOT NULL,
+    duration_p50_ms bigint NOT NULL,
+    duration_p95_ms bigint NOT NULL,
+    duration_p99_ms bigint NOT NULL,
+    request_bytes bigint NOT NULL DEFAULT 0,
+    response_bytes bigint NOT NULL DEFAULT 0,
+    PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX idx_metric_bucket_unique ON metric_buckets (user_id, project, bucket_start);
+
+CREATE TABLE route_templates (
+    id bigserial,
+    created_at timestamptz,
+    api_key_id bigint NOT NULL,
+    pattern varchar(512) NOT NULL,
+    PRIMARY KEY (id)
+);
+CREATE INDEX idx_route_templates_api_key_id ON route_templates (api_key_id);
+
+CREATE TABLE sessions (
+    id bigserial,
+    created_at timestamptz,
+    token_hash varchar(64) NOT NULL,
+    user_id bigint NOT NULL,
+    last_seen_at timestamptz NOT NULL,
+    expires_at timestamptz NOT NULL,
+    user_agent varchar(255),
+    remote_ip varchar(64),
+    csrf_token varchar(64),
+    PRIMARY KEY (id),
+    CONSTRAINT fk_sessions_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX idx_sessions_token_hash ON sessions (token_hash);
+CREATE INDEX idx_sessions_user_id ON sessions (user_id);
+CREATE INDEX idx_sessions_expires_at ON sessions (expires_at);
+
+CREATE TABLE api_key_usages (
+    api_key_id bigint,
+    day date,
+    events bigint NOT NULL DEFAULT 0,
+    bytes bigint NOT NULL DEFAULT 0,
+    PRIMARY KEY (api_key_id, day)
+);
+
+CREATE TABLE ingest_batch_keys (
+    api_key_id bigint,
+    idempotency_key varchar(255),
+    created_at timestamptz,
+    expires_at timestamptz NOT NULL,
+    request_hash varchar(64) NOT NULL,
+    status bigint NOT NULL DEFAULT 0,
+    content_type varchar(128),
+    body bytea,
+    PRIMARY KEY (api_key_id, idempotency_key)
+);
+CREATE INDEX idx_ingest_batch_keys_expires_at ON ingest_batch_keys (expires_at);
+
+CREATE TABLE sampling_rules (
+    id bigserial,
+    created_at timestamptz,
+    api_key_id bigint NOT NULL,
+    route varchar(512) NOT NULL DEFAULT '',
+    rate decimal NOT NULL,
+    PRIMARY KEY (id)
+);
+CREATE INDEX idx_sampling_rules_api_key_id ON sampling_rules (api_key_id);
+
+CREATE TABLE redaction_rules (
+    id bigserial,
+    created_at timestamptz,
+    api_key_id bigint NOT NULL,
+    kind varchar(16) NOT NULL,
+    pattern varchar(512) NOT NULL,
+    replacement varchar(512) NOT NULL DEFAULT '',
+    PRIMARY KEY (id)
+);
+CREATE INDEX idx_redaction_rules_api_key_id ON redaction_rules (api_key_id);
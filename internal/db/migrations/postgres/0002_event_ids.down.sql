@@ -0,0 +1,10 @@
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM pg_partitioned_table WHERE partrelid = 'events'::regclass) THEN
+        CREATE UNIQUE INDEX idx_events_project_event_id ON events (project, event_id, created_at);
+    ELSE
+        CREATE UNIQUE INDEX idx_events_project_event_id ON events (project, event_id);
+    END IF;
+END $$;
+
+DROP TABLE event_ids;
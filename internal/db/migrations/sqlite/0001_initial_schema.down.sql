@@ -0,0 +1,10 @@
+DROP TABLE redaction_rules;
+DROP TABLE sampling_rules;
+DROP TABLE ingest_batch_keys;
+DROP TABLE api_key_usages;
+DROP TABLE sessions;
+DROP TABLE route_templates;
+DROP TABLE metric_buckets;
+DROP TABLE api_keys;
+DROP TABLE users;
+DROP TABLE events;
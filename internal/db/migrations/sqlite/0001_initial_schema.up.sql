@@ -0,0 +1,166 @@
+-- The schema created by AutoMigrate before versioned migrations.
+
+CREATE TABLE events (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime NOT NULL,
+    expires_at datetime,
+    user_id text,
+    project text,
+    event_id text,
+    route text,
+    raw_path text,
+    method text,
+    status integer,
+    duration_ms integer,
+    remote_ip text,
+    request_bytes integer NOT NULL DEFAULT 0,
+    response_bytes integer NOT NULL DEFAULT 0,
+    trace_id text,
+    span_id text,
+    parent_span_id text,
+    country text,
+    region text,
+    asn integer NOT NULL DEFAULT 0,
+    asn_org text,
+    user_agent text,
+    browser text,
+    browser_version text,
+    os text,
+    os_version text,
+    device text,
+    app text,
+    app_version text,
+    is_bot numeric NOT NULL DEFAULT false,
+    sample_rate real NOT NULL DEFAULT 1,
+    attributes JSON
+);
+CREATE INDEX idx_events_expires_at ON events (expires_at);
+CREATE INDEX idx_events_user_id ON events (user_id);
+CREATE INDEX idx_events_project ON events (project);
+CREATE UNIQUE INDEX idx_events_project_event_id ON events (project, event_id);
+CREATE INDEX idx_events_route ON events (route);
+CREATE INDEX idx_events_method ON events (method);
+CREATE INDEX idx_events_trace_id ON events (trace_id);
+CREATE INDEX idx_events_span_id ON events (span_id);
+CREATE INDEX idx_events_parent_span_id ON events (parent_span_id);
+CREATE INDEX idx_events_country ON events (country);
+CREATE INDEX idx_events_browser ON events (browser);
+CREATE INDEX idx_events_os ON events (os);
+CREATE INDEX idx_events_device ON events (device);
+CREATE INDEX idx_events_is_bot ON events (is_bot);
+
+CREATE TABLE users (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    username text NOT NULL,
+    password_hash text NOT NULL,
+    is_admin numeric DEFAULT false,
+    time_format text DEFAULT '12',
+    date_format text DEFAULT 'dd-mm-yyyy'
+);
+CREATE UNIQUE INDEX idx_users_username ON users (username);
+
+CREATE TABLE api_keys (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    user_id integer NOT NULL,
+    name text NOT NULL,
+    environment text NOT NULL,
+    key_prefix text,
+    key_hash text,
+    key text,
+    retention_days integer NOT NULL DEFAULT 0,
+    active numeric DEFAULT true,
+    scopes text NOT NULL DEFAULT 'ingest,metrics:read',
+    strict_validation numeric NOT NULL DEFAULT false,
+    rate_limit_events integer NOT NULL DEFAULT 0,
+    rate_limit_bytes integer NOT NULL DEFAULT 0,
+    daily_event_quota integer NOT NULL DEFAULT 0,
+    monthly_event_quota integer NOT NULL DEFAULT 0,
+    ip_policy text NOT NULL DEFAULT '',
+    CONSTRAINT fk_api_keys_user FOREIGN KEY (user_id) REFERENCES users (id)
+);
+CREATE INDEX idx_api_keys_user_id ON api_keys (user_id);
+CREATE INDEX idx_api_keys_key_prefix ON api_keys (key_prefix);
+CREATE UNIQUE INDEX idx_api_keys_legacy_key ON api_keys (key);
+
+CREATE TABLE metric_buckets (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    user_id text NOT NULL,
+    project text NOT NULL,
+    bucket_start datetime NOT NULL,
+    total_count integer NOT NULL,
+    error_count integer NOT NULL,
+    duration_p50_ms integer NOT NULL,
+    duration_p95_ms integer NOT NULL,
+    duration_p99_ms integer NOT NULL,
+    request_bytes integer NOT NULL DEFAULT 0,
+    response_bytes integer NOT NULL DEFAULT 0
+);
+CREATE UNIQUE INDEX idx_metric_bucket_unique ON metric_buckets (user_id, project, bucket_start);
+
+CREATE TABLE route_templates (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    api_key_id integer NOT NULL,
+    pattern text NOT NULL
+);
+CREATE INDEX idx_route_templates_api_key_id ON route_templates (api_key_id);
+
+CREATE TABLE sessions (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    token_hash text NOT NULL,
+    user_id integer NOT NULL,
+    last_seen_at datetime NOT NULL,
+    expires_at datetime NOT NULL,
+    user_agent text,
+    remote_ip text,
+    csrf_token text,
+    CONSTRAINT fk_sessions_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX idx_sessions_token_hash ON sessions (token_hash);
+CREATE INDEX idx_sessions_user_id ON sessions (user_id);
+CREATE INDEX idx_sessions_expires_at ON sessions (expires_at);
+
+CREATE TABLE api_key_usages (
+    api_key_id integer,
+    day date,
+    events integer NOT NULL DEFAULT 0,
+    bytes integer NOT NULL DEFAULT 0,
+    PRIMARY KEY (api_key_id, day)
+);
+
+CREATE TABLE ingest_batch_keys (
+    api_key_id integer,
+    idempotency_key text,
+    created_at datetime,
+    expires_at datetime NOT NULL,
+    request_hash text NOT NULL,
+    status integer NOT NULL DEFAULT 0,
+    content_type text,
+    body blob,
+    PRIMARY KEY (api_key_id, idempotency_key)
+);
+CREATE INDEX idx_ingest_batch_keys_expires_at ON ingest_batch_keys (expires_at);
+
+CREATE TABLE sampling_rules (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    api_key_id integer NOT NULL,
+    route text NOT NULL DEFAULT '',
+    rate real NOT NULL
+);
+CREATE INDEX idx_sampling_rules_api_key_id ON sampling_rules (api_key_id);
+
+CREATE TABLE redaction_rules (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    api_key_id integer NOT NULL,
+    kind text NOT NULL,
+    pattern text NOT NULL,
+    replacement text NOT NULL DEFAULT ''
+);
+CREATE INDEX idx_redaction_rules_api_key_id ON redaction_rules (api_key_id);
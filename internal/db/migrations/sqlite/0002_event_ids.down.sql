@@ -0,0 +1,3 @@
+CREATE UNIQUE INDEX idx_events_project_event_id ON events (project, event_id);
+
+DROP TABLE event_ids;
@@ -0,0 +1,18 @@
+-- Event IDs move to their own table, as on PostgreSQL.
+
+CREATE TABLE event_ids (
+    project text,
+    event_id text,
+    expires_at datetime,
+    PRIMARY KEY (project, event_id)
+);
+CREATE INDEX idx_event_ids_expires_at ON event_ids (expires_at);
+
+-- An ID is kept until its last event expires; NULL never expires.
+INSERT INTO event_ids (project, event_id, expires_at)
+SELECT project, event_id, CASE WHEN COUNT(*) = COUNT(expires_at) THEN MAX(expires_at) END
+FROM events
+WHERE project IS NOT NULL AND event_id IS NOT NULL
+GROUP BY project, event_id;
+
+DROP INDEX IF EXISTS idx_events_project_event_id;
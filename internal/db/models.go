@@ -6,13 +6,14 @@ import (
 	"gorm.io/datatypes"
 )
 
-// Event represents a single API request event as stored in SQLite.
+// Event represents a single API request event as stored in the events table.
 // The schema is intentionally compact but flexible and can evolve as
 // the product grows.
 type Event struct {
 	ID uint `gorm:"primaryKey"`
 
-	CreatedAt time.Time
+	// CreatedAt is the partition key when the table is partitioned.
+	CreatedAt time.Time `gorm:"not null"`
 
 	// ExpiresAt is the timestamp after which this event is eligible
 	// for deletion by the retention worker. A nil value means the
@@ -23,19 +24,101 @@ type Event struct {
 	UserID string `gorm:"index"`
 
 	Project string `gorm:"index"`
+
+	// EventID is the optional client-supplied identifier. It is unique per
+	// project, so a retried delivery of the same event is not stored twice;
+	// see EventIDKey.
+	EventID *string `gorm:"size:128"`
+
+	// Route is the normalized route template (e.g. "/users/{id}") that
+	// metrics are grouped by. RawPath keeps the path exactly as received.
 	Route   string `gorm:"index"`
+	RawPath string
 	Method  string `gorm:"index"`
 	Status  int
 
 	DurationMs int64
 	RemoteIP   string
 
+	// RequestBytes and ResponseBytes are the message sizes reported by the
+	// client; zero when unknown.
+	RequestBytes  int64 `gorm:"not null;default:0"`
+	ResponseBytes int64 `gorm:"not null;default:0"`
+
+	// TraceID, SpanID and ParentSpanID link the event to the other requests
+	// of a distributed trace (lowercase hex; empty when not traced).
+	TraceID      string `gorm:"size:32;index"`
+	SpanID       string `gorm:"size:16;index"`
+	ParentSpanID string `gorm:"size:16;index"`
+
+	// Country (ISO 3166-1 alpha-2), Region (ISO 3166-2) and the autonomous
+	// system of the client, looked up from RemoteIP at ingest when GeoIP
+	// databases are configured. Lookups use the address before the IP
+	// policy is applied.
+	Country string `gorm:"size:2;index"`
+	Region  string `gorm:"size:16"`
+	ASN     uint   `gorm:"not null;default:0"`
+	ASNOrg  string `gorm:"size:255"`
+
+	// UserAgent is the client's User-Agent as received (after redaction).
+	// The other client fields are parsed from it at ingest; Browser holds
+	// the bot's name for bots.
+	UserAgent      string `gorm:"size:512"`
+	Browser        string `gorm:"size:64;index"`
+	BrowserVersion string `gorm:"size:32"`
+	OS             string `gorm:"column:os;size:32;index"`
+	OSVersion      string `gorm:"column:os_version;size:32"`
+	Device         string `gorm:"size:16;index"`
+	App            string `gorm:"size:64"`
+	AppVersion     string `gorm:"size:64"`
+	IsBot          bool   `gorm:"not null;default:false;index"`
+
+	// SampleRate is the fraction of requests this event was sampled from
+	// (client-side and server-side combined). Metrics count each event as
+	// 1/SampleRate requests; see WeightedCount.
+	SampleRate float64 `gorm:"not null;default:1"`
+
 	// Attributes holds arbitrary key/value pairs for this event, so
 	// callers can attach custom metrics (e.g. price, plan, region)
 	// without schema changes. This will back flexible charts later.
 	Attributes datatypes.JSONMap `gorm:"type:json"`
 }
 
+// EventIDKey records the EventID of a stored event for the event ID window,
+// or until the event expires if that is sooner, so that retried deliveries
+// of it are dropped. It is kept apart
+// from the events table, whose partitions cannot enforce uniqueness across
+// each other.
+type EventIDKey struct {
+	Project   string     `gorm:"primaryKey"`
+	EventID   string     `gorm:"primaryKey;size:128"`
+	ExpiresAt *time.Time `gorm:"index"`
+}
+
+func (EventIDKey) TableName() string { return "event_ids" }
+
+// WeightedCount is a SQL aggregate counting the requests that the selected
+// events represent, taking their sample rates into account.
+const WeightedCount = "CAST(ROUND(SUM(1.0 / sample_rate)) AS BIGINT)"
+
+// WeightedErrorCount is WeightedCount restricted to events with status >= 400.
+const WeightedErrorCount = "CAST(ROUND(COALESCE(SUM(CASE WHEN status >= 400 THEN 1.0 / sample_rate END), 0)) AS BIGINT)"
+
+// WeightedRequestBytes and WeightedResponseBytes sum the message sizes of
+// the requests the selected events represent.
+const (
+	WeightedRequestBytes  = "CAST(ROUND(COALESCE(SUM(request_bytes / sample_rate), 0)) AS BIGINT)"
+	WeightedResponseBytes = "CAST(ROUND(COALESCE(SUM(response_bytes / sample_rate), 0)) AS BIGINT)"
+)
+
+// Weight returns how many requests e stands for.
+func (e *Event) Weight() float64 {
+	if e.SampleRate <= 0 {
+		return 1
+	}
+	return 1 / e.SampleRate
+}
+
 // MetricBucket stores pre-aggregated hourly metrics per (user, project)
 // for fast error-rate and latency-percentile charts. Filled by the
 // aggregation worker.
@@ -51,4 +134,7 @@ type MetricBucket struct {
 	DurationP50Ms int64 `gorm:"not null"` // 50th percentile duration ms
 	DurationP95Ms int64 `gorm:"not null"` // 95th percentile duration ms
 	DurationP99Ms int64 `gorm:"not null"` // 99th percentile duration ms
+
+	RequestBytes  int64 `gorm:"not null;default:0"` // request bytes in this hour
+	ResponseBytes int64 `gorm:"not null;default:0"` // response bytes in this hour
 }
@@ -0,0 +1,370 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Partition intervals of the events table (APP_EVENTS_PARTITION).
+const (
+	PartitionDay  = "day"
+	PartitionWeek = "week"
+	PartitionNone = "none"
+)
+
+// ValidPartition reports whether interval is PartitionDay, PartitionWeek
+// or PartitionNone.
+func ValidPartition(interval string) bool {
+	switch interval {
+	case PartitionDay, PartitionWeek, PartitionNone:
+		return true
+	}
+	return false
+}
+
+// eventsDefaultPartition holds the events outside every range partition,
+// such as late events for a day whose partition was already dropped.
+const eventsDefaultPartition = "events_default"
+
+// partitionRange is a partition of the events table holding the events
+// created in [From, To).
+type partitionRange struct {
+	Name     string
+	From, To time.Time
+}
+
+// partitionStart returns the start of the day, or of the week (from
+// Monday), containing t, in UTC.
+func partitionStart(interval string, t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	if interval == PartitionWeek {
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	}
+	return day
+}
+
+// partitionEnd returns the end of the interval starting at start.
+func partitionEnd(interval string, start time.Time) time.Time {
+	if interval == PartitionWeek {
+		return start.AddDate(0, 0, 7)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// missingPartitions returns the partitions to create so that every
+// interval from the one containing from up to the one containing to is
+// covered. Ranges already covered by existing partitions, e.g. after the
+// interval was changed, are left out, so the result may hold partial
+// intervals.
+func missingPartitions(existing []partitionRange, interval string, from, to time.Time) []partitionRange {
+	var missing []partitionRange
+	for start := partitionStart(interval, from); !start.After(to); start = partitionEnd(interval, start) {
+		cur, end := start, partitionEnd(interval, start)
+		for _, p := range existing {
+			if !p.To.After(cur) || !p.From.Before(end) {
+				continue
+			}
+			if p.From.After(cur) {
+				missing = append(missing, newPartitionRange(cur, p.From))
+			}
+			cur = p.To
+		}
+		if cur.Before(end) {
+			missing = append(missing, newPartitionRange(cur, end))
+		}
+	}
+	return missing
+}
+
+func newPartitionRange(from, to time.Time) partitionRange {
+	return partitionRange{Name: "events_p" + from.Format("20060102"), From: from, To: to}
+}
+
+// pgTimestamp renders t as a timestamp literal. Partition bounds are part
+// of DDL statements, which take no bind parameters.
+func pgTimestamp(t time.Time) string {
+	return "'" + t.UTC().Format(time.RFC3339) + "'"
+}
+
+// partitionBound matches the range bounds of a partition as rendered by
+// pg_get_expr with the UTC time zone.
+var partitionBound = regexp.MustCompile(`^FOR VALUES FROM \('([^']+)'\) TO \('([^']+)'\)$`)
+
+// PreparePartitions creates the events table partitions from the current
+// interval to s.ahead intervals ahead. Events between partitions land in
+// the default partition and are moved into a partition when it is
+// created. An empty events table is partitioned first; one holding events
+// must be converted with PartitionEvents ("apiinsight migrate
+// partition-events"), as that copies every event.
+func (s *PostgresStore) PreparePartitions(now time.Time) error {
+	partitioned, err := eventsPartitioned(s.db)
+	if err != nil {
+		return err
+	}
+	if s.partition == PartitionNone {
+		if partitioned {
+			return errors.New("the events table is partitioned; set APP_EVENTS_PARTITION to day or week")
+		}
+		return nil
+	}
+	if !partitioned {
+		var hasEvents bool
+		if err := s.db.Raw("SELECT EXISTS (SELECT 1 FROM events)").Scan(&hasEvents).Error; err != nil {
+			return err
+		}
+		if hasEvents {
+			return errors.New("the events table is not partitioned; run \"apiinsight migrate partition-events\" or set APP_EVENTS_PARTITION=none")
+		}
+		if _, err := s.PartitionEvents(now); err != nil {
+			return err
+		}
+	}
+
+	existing, err := s.partitions()
+	if err != nil {
+		return err
+	}
+	to := partitionStart(s.partition, now)
+	for i := 0; i < s.ahead; i++ {
+		to = partitionEnd(s.partition, to)
+	}
+	for _, p := range missingPartitions(existing, s.partition, now, to) {
+		if err := s.createPartition(p); err != nil {
+			return fmt.Errorf("create partition %s: %w", p.Name, err)
+		}
+	}
+	return nil
+}
+
+func eventsPartitioned(db *gorm.DB) (bool, error) {
+	var partitioned bool
+	err := db.Raw("SELECT EXISTS (SELECT 1 FROM pg_partitioned_table WHERE partrelid = to_regclass('events'))").Scan(&partitioned).Error
+	return partitioned, err
+}
+
+// PartitionEvents replaces a plain events table with a copy partitioned by
+// s.partition, with partitions covering its existing events, and reports
+// whether it did; false means the table was already partitioned. The table
+// is locked while the events are copied. It holds the migration lock, so
+// concurrent conversions and migrations wait for each other.
+func (s *PostgresStore) PartitionEvents(now time.Time) (bool, error) {
+	if s.partition != PartitionDay && s.partition != PartitionWeek {
+		return false, errors.New("set APP_EVENTS_PARTITION to day or week")
+	}
+	converted := false
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(s.dialect.migrationLock()).Error; err != nil {
+			return err
+		}
+		partitioned, err := eventsPartitioned(tx)
+		if err != nil || partitioned {
+			return err
+		}
+		log.Printf("partitioning the events table by %s", s.partition)
+		if err := tx.Exec("LOCK TABLE events IN ACCESS EXCLUSIVE MODE").Error; err != nil {
+			return err
+		}
+		var oldest *time.Time
+		if err := tx.Raw("SELECT MIN(created_at) FROM events").Scan(&oldest).Error; err != nil {
+			return err
+		}
+		var sequence *string
+		if err := tx.Raw("SELECT pg_get_serial_sequence('events', 'id')").Scan(&sequence).Error; err != nil {
+			return err
+		}
+		// Indexes are recreated from their definitions, which name the
+		// table as "events" and so apply to the new table once the old one
+		// is dropped. The primary key must include the partition key and
+		// is replaced below.
+		var indexes []string
+		if err := tx.Raw("SELECT pg_get_indexdef(i.indexrelid) FROM pg_index i " +
+			"WHERE i.indrelid = 'events'::regclass AND NOT i.indisunique").Scan(&indexes).Error; err != nil {
+			return err
+		}
+
+		stmts := []string{
+			"ALTER TABLE events RENAME TO events_unpartitioned",
+			"CREATE TABLE events (LIKE events_unpartitioned INCLUDING DEFAULTS) PARTITION BY RANGE (created_at)",
+			"CREATE TABLE " + eventsDefaultPartition + " PARTITION OF events DEFAULT",
+		}
+		from := now
+		if oldest != nil && oldest.Before(now) {
+			from = *oldest
+		}
+		for _, p := range missingPartitions(nil, s.partition, from, now) {
+			stmts = append(stmts, "CREATE TABLE "+p.Name+" PARTITION OF events FOR VALUES FROM ("+pgTimestamp(p.From)+") TO ("+pgTimestamp(p.To)+")")
+		}
+		stmts = append(stmts, "INSERT INTO events SELECT * FROM events_unpartitioned")
+		if sequence != nil {
+			// Keep the ID sequence when the old table is dropped.
+			stmts = append(stmts, "ALTER SEQUENCE "+*sequence+" OWNED BY events.id")
+		}
+		stmts = append(stmts,
+			"DROP TABLE events_unpartitioned",
+			// Unique constraints of a partitioned table must include the
+			// partition key.
+			"ALTER TABLE events ADD PRIMARY KEY (id, created_at)",
+		)
+		stmts = append(stmts, indexes...)
+		for _, stmt := range stmts {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+		converted = true
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("partition events table: %w", err)
+	}
+	return converted, nil
+}
+
+// partitions returns the range partitions of the events table, oldest
+// first.
+func (s *PostgresStore) partitions() ([]partitionRange, error) {
+	var rows []struct {
+		Name  string
+		Bound string
+	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// pg_get_expr renders the bounds in the session time zone.
+		if err := tx.Exec("SET LOCAL TimeZone = 'UTC'").Error; err != nil {
+			return err
+		}
+		return tx.Raw("SELECT c.relname AS name, pg_get_expr(c.relpartbound, c.oid) AS bound " +
+			"FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid " +
+			"WHERE i.inhparent = to_regclass('events')").Scan(&rows).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var parts []partitionRange
+	for _, r := range rows {
+		m := partitionBound.FindStringSubmatch(r.Bound)
+		if m == nil {
+			continue // the default partition
+		}
+		from, err := time.Parse("2006-01-02 15:04:05-07", m[1])
+		if err != nil {
+			return nil, fmt.Errorf("partition %s: %w", r.Name, err)
+		}
+		to, err := time.Parse("2006-01-02 15:04:05-07", m[2])
+		if err != nil {
+			return nil, fmt.Errorf("partition %s: %w", r.Name, err)
+		}
+		parts = append(parts, partitionRange{Name: r.Name, From: from.UTC(), To: to.UTC()})
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].From.Before(parts[j].From) })
+	return parts, nil
+}
+
+// createPartition attaches partition p, first moving its events out of
+// the default partition: PostgreSQL refuses a new partition whose rows
+// are in the default partition.
+func (s *PostgresStore) createPartition(p partitionRange) error {
+	from, to := pgTimestamp(p.From), pgTimestamp(p.To)
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		for _, stmt := range []string{
+			"LOCK TABLE " + eventsDefaultPartition + " IN ACCESS EXCLUSIVE MODE",
+			"CREATE TABLE " + p.Name + " (LIKE events INCLUDING DEFAULTS)",
+			"WITH moved AS (DELETE FROM " + eventsDefaultPartition + " WHERE created_at >= " + from + " AND created_at < " + to + " RETURNING *) " +
+				"INSERT INTO " + p.Name + " SELECT * FROM moved",
+			"ALTER TABLE events ATTACH PARTITION " + p.Name + " FOR VALUES FROM (" + from + ") TO (" + to + ")",
+		} {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Retain drops the partitions whose events have all expired before
+// running the row deletes of the other backends, which then only remove
+// events from partitions with mixed retention.
+func (s *PostgresStore) Retain(now time.Time) error {
+	if s.partition != PartitionNone {
+		if err := s.dropExpiredPartitions(now); err != nil {
+			return err
+		}
+	}
+	return s.sqlStore.Retain(now)
+}
+
+// dropExpiredPartitions drops the partitions that end before now and hold
+// no event that is unexpired or never expires.
+func (s *PostgresStore) dropExpiredPartitions(now time.Time) error {
+	parts, err := s.partitions()
+	if err != nil {
+		return err
+	}
+	for _, p := range parts {
+		if p.To.After(now) {
+			break
+		}
+		// Check without locks first; most partitions that fail, fail on
+		// every pass.
+		live, err := partitionLive(s.db, p, now)
+		if err != nil {
+			return err
+		}
+		if live {
+			continue
+		}
+		dropped := false
+		err = s.db.Transaction(func(tx *gorm.DB) error {
+			// Lock the parent first, as queries do, and check again now
+			// that no event can be added.
+			if err := tx.Exec("LOCK TABLE ONLY events IN ACCESS EXCLUSIVE MODE").Error; err != nil {
+				return err
+			}
+			if err := tx.Exec("LOCK TABLE " + p.Name + " IN ACCESS EXCLUSIVE MODE").Error; err != nil {
+				return err
+			}
+			live, err := partitionLive(tx, p, now)
+			if err != nil || live {
+				return err
+			}
+			dropped = true
+			return tx.Exec("DROP TABLE " + p.Name).Error
+		})
+		if err != nil {
+			return fmt.Errorf("drop partition %s: %w", p.Name, err)
+		}
+		if dropped {
+			log.Printf("retention: dropped events partition %s", p.Name)
+		}
+	}
+	return nil
+}
+
+// partitionLive reports whether p holds an event that has not expired by
+// now or never expires.
+func partitionLive(db *gorm.DB, p partitionRange, now time.Time) (bool, error) {
+	var live bool
+	err := db.Raw("SELECT EXISTS (SELECT 1 FROM "+p.Name+" WHERE expires_at IS NULL OR expires_at > ?)", now).Scan(&live).Error
+	return live, err
+}
+
+// StartPartitionWorker creates upcoming event partitions once an hour, so
+// that a partition exists well before its first event arrives.
+func StartPartitionWorker(store Store) {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for t := range ticker.C {
+			if err := store.PreparePartitions(t); err != nil {
+				log.Printf("partition error: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,114 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func date(day int) time.Time {
+	return time.Date(2026, 3, day, 0, 0, 0, 0, time.UTC)
+}
+
+func TestPartitionStart(t *testing.T) {
+	tests := []struct {
+		interval string
+		t        time.Time
+		want     time.Time
+	}{
+		{PartitionDay, date(4).Add(23 * time.Hour), date(4)},
+		{PartitionDay, time.Date(2026, 3, 4, 23, 30, 0, 0, time.FixedZone("UTC-2", -2*3600)), date(5)},
+		// 2026-03-02 is a Monday.
+		{PartitionWeek, date(2), date(2)},
+		{PartitionWeek, date(4).Add(12 * time.Hour), date(2)},
+		{PartitionWeek, date(8).Add(23 * time.Hour), date(2)},
+		{PartitionWeek, date(9), date(9)},
+		{PartitionWeek, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 12, 29, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		if got := partitionStart(tt.interval, tt.t); !got.Equal(tt.want) {
+			t.Errorf("partitionStart(%s, %s) = %s, want %s", tt.interval, tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestPartitionEnd(t *testing.T) {
+	if got := partitionEnd(PartitionDay, date(31)); !got.Equal(time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("day end = %s", got)
+	}
+	if got := partitionEnd(PartitionWeek, date(30)); !got.Equal(time.Date(2026, 4, 6, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("week end = %s", got)
+	}
+}
+
+func TestMissingPartitions(t *testing.T) {
+	r := func(from, to int) partitionRange { return newPartitionRange(date(from), date(to)) }
+	tests := []struct {
+		name     string
+		existing []partitionRange
+		interval string
+		from, to time.Time
+		want     []partitionRange
+	}{
+		{
+			name:     "none exist",
+			interval: PartitionDay,
+			from:     date(4).Add(15 * time.Hour),
+			to:       date(6).Add(time.Hour),
+			want:     []partitionRange{r(4, 5), r(5, 6), r(6, 7)},
+		},
+		{
+			name:     "gap between existing",
+			existing: []partitionRange{r(4, 5), r(6, 7)},
+			interval: PartitionDay,
+			from:     date(4),
+			to:       date(7),
+			want:     []partitionRange{r(5, 6), r(7, 8)},
+		},
+		{
+			name:     "all exist",
+			existing: []partitionRange{r(4, 5), r(5, 6)},
+			interval: PartitionDay,
+			from:     date(4),
+			to:       date(5),
+			want:     nil,
+		},
+		{
+			name:     "weeks",
+			interval: PartitionWeek,
+			from:     date(4),
+			to:       date(10),
+			want:     []partitionRange{r(2, 9), r(9, 16)},
+		},
+		{
+			name:     "switched from days to weeks",
+			existing: []partitionRange{r(3, 4), r(4, 5)},
+			interval: PartitionWeek,
+			from:     date(4),
+			to:       date(4),
+			want:     []partitionRange{r(2, 3), r(5, 9)},
+		},
+		{
+			name:     "switched from weeks to days",
+			existing: []partitionRange{r(2, 9)},
+			interval: PartitionDay,
+			from:     date(7),
+			to:       date(9),
+			want:     []partitionRange{r(9, 10)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := missingPartitions(tt.existing, tt.interval, tt.from, tt.to)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("missingPartitions = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewPartitionRangeName(t *testing.T) {
+	if got := newPartitionRange(date(2), date(9)).Name; got != "events_p20260302" {
+		t.Errorf("Name = %q, want events_p20260302", got)
+	}
+}
@@ -0,0 +1,74 @@
+package db
+
+import (
+	"strconv"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// PostgresStore is the PostgreSQL backend. Its events table can be
+// partitioned by time; see PreparePartitions.
+type PostgresStore struct {
+	sqlStore
+
+	// partition is the partition interval (PartitionDay, PartitionWeek or
+	// PartitionNone) and ahead the number of future partitions to keep.
+	partition string
+	ahead     int
+}
+
+// OpenPostgres connects to the PostgreSQL database at dsn, partitioning
+// events by the given interval.
+func OpenPostgres(dsn, partition string, ahead int) (*PostgresStore, error) {
+	// PrepareStmt: true prevents the GORM postgres migrator from forcing simple protocol
+	// for "SELECT * FROM table LIMIT 1", which would otherwise trigger "insufficient arguments".
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{PrepareStmt: true})
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresStore{sqlStore: sqlStore{db: db, dialect: postgresDialect{}, eventIDWindow: DefaultEventIDWindow}, partition: partition, ahead: ahead}, nil
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) attrText(key string) (string, []any) {
+	return "attributes::jsonb ->> ?", []any{key}
+}
+
+func (postgresDialect) attrExists(key string) (string, []any) {
+	return "jsonb_exists(attributes::jsonb, ?)", []any{key}
+}
+
+func (postgresDialect) attrKeys() string {
+	return "jsonb_each(events.attributes::jsonb) je"
+}
+
+func (postgresDialect) bucket(halfHour bool) (string, string) {
+	if halfHour {
+		return `to_char(to_timestamp(floor(extract(epoch from created_at) / 1800) * 1800), 'YYYY-MM-DD"T"HH24:MI:SS') || 'Z'`,
+			"floor(extract(epoch from created_at) / 1800)"
+	}
+	return `to_char(date_trunc('hour', created_at), 'YYYY-MM-DD"T"HH24:MI:SS') || 'Z'`,
+		"date_trunc('hour', created_at)"
+}
+
+func (postgresDialect) hour() string {
+	return "date_trunc('hour', created_at AT TIME ZONE 'UTC')"
+}
+
+func (postgresDialect) name() string { return "postgres" }
+
+// migrationsTable holds the migration lock while creating the table:
+// concurrent CREATE TABLE IF NOT EXISTS statements can fail.
+func (postgresDialect) migrationsTable() string {
+	return "DO $$ BEGIN PERFORM pg_advisory_xact_lock(" + strconv.Itoa(migrationLockKey) + "); " +
+		"CREATE TABLE IF NOT EXISTS schema_migrations (version bigint PRIMARY KEY, name varchar(255) NOT NULL, applied_at timestamptz NOT NULL DEFAULT now()); END $$"
+}
+
+// migrationLockKey identifies the advisory lock held by migrations.
+const migrationLockKey = 0x61706969 // "apii"
+
+func (postgresDialect) migrationLock() string {
+	return "SELECT pg_advisory_xact_lock(" + strconv.Itoa(migrationLockKey) + ")"
+}
@@ -0,0 +1,43 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Kinds of RedactionRule.
+const (
+	// RedactDetector enables a built-in detector (Pattern is its name).
+	RedactDetector = "detector"
+	// RedactDenyKey removes the value of attributes named Pattern.
+	RedactDenyKey = "deny_key"
+	// RedactRoute replaces matches of the regular expression Pattern in
+	// routes with Replacement.
+	RedactRoute = "route"
+	// RedactUserAgent replaces matches of the regular expression Pattern
+	// in user agents with Replacement.
+	RedactUserAgent = "user_agent"
+)
+
+// RedactionRule adds to the global redaction settings for the events
+// ingested with an API key.
+type RedactionRule struct {
+	ID uint `gorm:"primaryKey"`
+
+	CreatedAt time.Time
+
+	// APIKeyID links this rule to the project key it applies to.
+	APIKeyID uint `gorm:"index;not null"`
+
+	Kind        string `gorm:"size:16;not null"`
+	Pattern     string `gorm:"size:512;not null"`
+	Replacement string `gorm:"size:512;not null;default:''"`
+}
+
+// RedactionRulesForKey returns the redaction rules configured for an API key.
+func RedactionRulesForKey(db *gorm.DB, apiKeyID uint) ([]RedactionRule, error) {
+	var rules []RedactionRule
+	err := db.Where("api_key_id = ?", apiKeyID).Order("id").Find(&rules).Error
+	return rules, err
+}
@@ -3,25 +3,41 @@ package db
 import (
 	"log"
 	"time"
-
-	"gorm.io/gorm"
 )
 
-// runRetentionOnce performs a single pass of retention cleanup,
-// deleting any events whose ExpiresAt is in the past.
-func runRetentionOnce(db *gorm.DB) error {
-	now := time.Now()
+// usageRetention is how long per-day API key usage rows are kept; monthly
+// quotas only need the current month.
+const usageRetention = 400 * 24 * time.Hour
+
+// Retain performs a single pass of retention cleanup, deleting any
+// events whose ExpiresAt is in the past along with login sessions that
+// have reached their absolute expiry, expired idempotency keys and old
+// API key usage counters.
+func (s *sqlStore) Retain(now time.Time) error {
+	db := s.db
 	if err := db.Where("expires_at IS NOT NULL AND expires_at <= ?", now).Delete(&Event{}).Error; err != nil {
 		return err
 	}
+	if err := db.Where("expires_at IS NOT NULL AND expires_at <= ?", now).Delete(&EventIDKey{}).Error; err != nil {
+		return err
+	}
+	if err := db.Where("expires_at <= ?", now).Delete(&Session{}).Error; err != nil {
+		return err
+	}
+	if err := db.Where("expires_at <= ?", now).Delete(&IngestBatchKey{}).Error; err != nil {
+		return err
+	}
+	if err := db.Where("day < ?", now.Add(-usageRetention)).Delete(&APIKeyUsage{}).Error; err != nil {
+		return err
+	}
 	return nil
 }
 
 // StartRetentionWorker launches a background goroutine that runs the
 // retention cleanup once at startup and then once per day.
-func StartRetentionWorker(db *gorm.DB) {
+func StartRetentionWorker(store Store) {
 	go func() {
-		if err := runRetentionOnce(db); err != nil {
+		if err := store.Retain(time.Now()); err != nil {
 			log.Printf("retention cleanup error (startup): %v", err)
 		}
 
@@ -29,7 +45,7 @@ func StartRetentionWorker(db *gorm.DB) {
 		defer ticker.Stop()
 
 		for range ticker.C {
-			if err := runRetentionOnce(db); err != nil {
+			if err := store.Retain(time.Now()); err != nil {
 				log.Printf("retention cleanup error: %v", err)
 			}
 		}
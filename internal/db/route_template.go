@@ -0,0 +1,34 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RouteTemplate is a user-defined route pattern (e.g. "/orders/{order_id}")
+// used to normalize request paths ingested with a given API key. Templates
+// are matched in creation order before automatic segment detection.
+type RouteTemplate struct {
+	ID uint `gorm:"primaryKey"`
+
+	CreatedAt time.Time
+
+	// APIKeyID links this template to the project key it applies to.
+	APIKeyID uint `gorm:"index;not null"`
+
+	// Pattern is the route template, with "{name}" placeholders for
+	// dynamic segments.
+	Pattern string `gorm:"size:512;not null"`
+}
+
+// RouteTemplatePatterns returns the patterns configured for an API key in
+// the order they should be matched.
+func RouteTemplatePatterns(db *gorm.DB, apiKeyID uint) ([]string, error) {
+	var patterns []string
+	err := db.Model(&RouteTemplate{}).
+		Where("api_key_id = ?", apiKeyID).
+		Order("id").
+		Pluck("pattern", &patterns).Error
+	return patterns, err
+}
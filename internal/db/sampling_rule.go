@@ -0,0 +1,31 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SamplingRule keeps only a fraction of the events ingested with an API
+// key. Route selects the events it applies to: an exact route template, a
+// prefix ending in "*", or empty for every route.
+type SamplingRule struct {
+	ID uint `gorm:"primaryKey"`
+
+	CreatedAt time.Time
+
+	// APIKeyID links this rule to the project key it applies to.
+	APIKeyID uint `gorm:"index;not null"`
+
+	Route string `gorm:"size:512;not null;default:''"`
+
+	// Rate is the fraction of matching events that is stored, in (0, 1].
+	Rate float64 `gorm:"not null"`
+}
+
+// SamplingRulesForKey returns the sampling rules configured for an API key.
+func SamplingRulesForKey(db *gorm.DB, apiKeyID uint) ([]SamplingRule, error) {
+	var rules []SamplingRule
+	err := db.Where("api_key_id = ?", apiKeyID).Order("id").Find(&rules).Error
+	return rules, err
+}
@@ -0,0 +1,138 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Session is a server-side login session. The browser only holds an
+// opaque random token; the table stores its SHA-256 hash so a database
+// leak does not expose usable session cookies.
+type Session struct {
+	ID uint `gorm:"primaryKey"`
+
+	CreatedAt time.Time
+
+	// TokenHash is the hex-encoded SHA-256 of the session cookie value.
+	TokenHash string `gorm:"uniqueIndex;size:64;not null"`
+
+	UserID uint `gorm:"index;not null"`
+
+	// LastSeenAt is refreshed as the session is used and drives the idle
+	// timeout. ExpiresAt is the absolute lifetime limit.
+	LastSeenAt time.Time `gorm:"not null"`
+	ExpiresAt  time.Time `gorm:"index;not null"`
+
+	UserAgent string `gorm:"size:255"`
+	RemoteIP  string `gorm:"size:64"`
+
+	// CSRFToken is the per-session anti-forgery token that every
+	// state-changing dashboard form must echo back.
+	CSRFToken string `gorm:"size:64"`
+
+	User User `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"`
+}
+
+// HashSessionToken returns the value stored in Session.TokenHash for a
+// cookie token.
+func HashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateSession starts a new session for userID and returns the opaque
+// token to be sent to the browser.
+func CreateSession(db *gorm.DB, userID uint, userAgent, remoteIP string, ttl time.Duration) (string, *Session, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	csrfToken, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+	now := time.Now()
+	s := &Session{
+		TokenHash:  HashSessionToken(token),
+		UserID:     userID,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(ttl),
+		UserAgent:  userAgent,
+		RemoteIP:   remoteIP,
+		CSRFToken:  csrfToken,
+	}
+	if err := db.Create(s).Error; err != nil {
+		return "", nil, err
+	}
+	return token, s, nil
+}
+
+// LookupSession loads the session (with its user) for a cookie token.
+// Expired or idle sessions are deleted and reported as not found.
+func LookupSession(db *gorm.DB, token string, idleTimeout time.Duration) (*Session, error) {
+	var s Session
+	if err := db.Where("token_hash = ?", HashSessionToken(token)).Preload("User").First(&s).Error; err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if now.After(s.ExpiresAt) || (idleTimeout > 0 && now.Sub(s.LastSeenAt) > idleTimeout) {
+		db.Delete(&s)
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &s, nil
+}
+
+// TouchSession refreshes LastSeenAt. To avoid a write on every request the
+// update is skipped when the session was seen within the last minute.
+func TouchSession(db *gorm.DB, s *Session) error {
+	now := time.Now()
+	if now.Sub(s.LastSeenAt) < time.Minute {
+		return nil
+	}
+	s.LastSeenAt = now
+	return db.Model(&Session{}).Where("id = ?", s.ID).Update("last_seen_at", now).Error
+}
+
+// EnsureCSRFToken assigns a CSRF token to a session that does not have one
+// yet (sessions created before CSRF protection was introduced).
+func EnsureCSRFToken(db *gorm.DB, s *Session) error {
+	if s.CSRFToken != "" {
+		return nil
+	}
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	if err := db.Model(&Session{}).Where("id = ?", s.ID).Update("csrf_token", token).Error; err != nil {
+		return err
+	}
+	s.CSRFToken = token
+	return nil
+}
+
+// DeleteUserSessions revokes every session belonging to userID except
+// keepID (pass 0 to revoke all).
+func DeleteUserSessions(db *gorm.DB, userID, keepID uint) error {
+	q := db.Where("user_id = ?", userID)
+	if keepID != 0 {
+		q = q.Where("id <> ?", keepID)
+	}
+	return q.Delete(&Session{}).Error
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,167 @@
+package db
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	sqlitedriver "github.com/glebarez/go-sqlite"
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+// sqliteDriverName is the pure-Go SQLite driver wrapped by utcDriver.
+const sqliteDriverName = "apiinsight-sqlite"
+
+func init() {
+	sql.Register(sqliteDriverName, utcDriver{&sqlitedriver.Driver{}})
+}
+
+// SQLiteStore is the embedded SQLite backend, for small deployments and
+// tests. It needs no cgo.
+type SQLiteStore struct {
+	sqlStore
+}
+
+// OpenSQLite opens (creating if needed) the SQLite database at path, which
+// may carry driver parameters after a "?". ":memory:" opens a private
+// in-memory database.
+func OpenSQLite(path string) (*SQLiteStore, error) {
+	file, query, _ := strings.Cut(path, "?")
+	if file == "" {
+		return nil, fmt.Errorf("sqlite: database path is required")
+	}
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: %w", err)
+	}
+	// WAL lets the dashboard read while the ingest workers write, and the
+	// busy timeout makes concurrent writers wait instead of failing.
+	if !params.Has("_pragma") {
+		params.Add("_pragma", "journal_mode(WAL)")
+		params.Add("_pragma", "busy_timeout(5000)")
+		params.Add("_pragma", "foreign_keys(1)")
+	}
+	params.Set("_time_format", "sqlite")
+
+	db, err := gorm.Open(sqlite.Dialector{DriverName: sqliteDriverName, DSN: file + "?" + params.Encode()}, &gorm.Config{
+		NowFunc: func() time.Time { return time.Now().UTC() },
+	})
+	if err != nil {
+		return nil, err
+	}
+	if file == ":memory:" {
+		// Every connection would get its own empty database.
+		sqlDB, err := db.DB()
+		if err != nil {
+			return nil, err
+		}
+		sqlDB.SetMaxOpenConns(1)
+	}
+	return &SQLiteStore{sqlStore{db: db, dialect: sqliteDialect{}, eventIDWindow: DefaultEventIDWindow}}, nil
+}
+
+type sqliteDialect struct{}
+
+// attrText renders JSON booleans as "true" and "false" like PostgreSQL's
+// ->> operator, rather than SQLite's 1 and 0.
+func (sqliteDialect) attrText(key string) (string, []any) {
+	path := jsonPath(key)
+	return "CASE json_type(attributes, ?) WHEN 'true' THEN 'true' WHEN 'false' THEN 'false' " +
+		"ELSE CAST(json_extract(attributes, ?) AS TEXT) END", []any{path, path}
+}
+
+func (sqliteDialect) attrExists(key string) (string, []any) {
+	return "json_type(attributes, ?) IS NOT NULL", []any{jsonPath(key)}
+}
+
+func (sqliteDialect) attrKeys() string {
+	return "json_each(events.attributes) je"
+}
+
+func (sqliteDialect) bucket(halfHour bool) (string, string) {
+	if halfHour {
+		e := "strftime('%Y-%m-%dT%H:%M:%SZ', (CAST(strftime('%s', created_at) AS INTEGER) / 1800) * 1800, 'unixepoch')"
+		return e, e
+	}
+	e := "strftime('%Y-%m-%dT%H:00:00Z', created_at)"
+	return e, e
+}
+
+func (sqliteDialect) hour() string {
+	return "strftime('%Y-%m-%d %H:00:00', created_at)"
+}
+
+func (sqliteDialect) name() string { return "sqlite" }
+
+func (sqliteDialect) migrationsTable() string {
+	return "CREATE TABLE IF NOT EXISTS schema_migrations (version integer PRIMARY KEY, name text NOT NULL, applied_at datetime NOT NULL DEFAULT CURRENT_TIMESTAMP)"
+}
+
+// migrationLock is not a lock of its own: SQLite allows a single writer,
+// and this write that changes nothing makes the transaction take the
+// database's write lock up front. As the first statement it waits for the
+// busy timeout, whereas a transaction that reads first fails when it later
+// writes after another connection did.
+func (sqliteDialect) migrationLock() string {
+	return "UPDATE schema_migrations SET version = version WHERE 0"
+}
+
+// jsonPath is the SQLite JSON path of the top-level key.
+func jsonPath(key string) string {
+	return `$."` + strings.ReplaceAll(key, `"`, `\"`) + `"`
+}
+
+// utcDriver binds times in UTC. SQLite stores them as text and compares
+// them as strings, which only orders correctly when every value has the
+// same offset.
+type utcDriver struct {
+	driver.Driver
+}
+
+// sqliteConn is the set of optional interfaces the SQLite driver's
+// connections implement, kept visible through utcConn.
+type sqliteConn interface {
+	driver.Conn
+	driver.ConnBeginTx
+	driver.ConnPrepareContext
+	driver.ExecerContext
+	driver.QueryerContext
+	driver.Pinger
+}
+
+func (d utcDriver) Open(name string) (driver.Conn, error) {
+	c, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	sc, ok := c.(sqliteConn)
+	if !ok {
+		c.Close()
+		return nil, fmt.Errorf("sqlite: unexpected connection type %T", c)
+	}
+	return utcConn{sc}, nil
+}
+
+type utcConn struct {
+	sqliteConn
+}
+
+// CheckNamedValue implements driver.NamedValueChecker; other values fall
+// through to the default conversion.
+func (utcConn) CheckNamedValue(nv *driver.NamedValue) error {
+	switch v := nv.Value.(type) {
+	case time.Time:
+		nv.Value = v.UTC()
+		return nil
+	case *time.Time:
+		if v != nil {
+			nv.Value = v.UTC()
+			return nil
+		}
+	}
+	return driver.ErrSkip
+}
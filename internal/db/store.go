@@ -0,0 +1,430 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Store is a storage backend. Users, keys, sessions and settings are plain
+// GORM models and use DB directly; events are read and written through the
+// methods, whose SQL differs between databases.
+type Store interface {
+	// DB returns the GORM handle for queries that are the same on every
+	// database.
+	DB() *gorm.DB
+	// Close closes the underlying connections.
+	Close() error
+
+	// InsertEvents stores events in multi-row inserts of at most batchSize
+	// rows and returns the stored ones. Events whose EventID was stored for
+	// their project within the event ID window are skipped; the IDs are
+	// tracked in event_ids, apart from the events, so this holds on
+	// partitioned tables too.
+	InsertEvents(events []Event, batchSize int) ([]Event, error)
+
+	// Events returns a query on the events matching f.
+	Events(f EventFilter) *gorm.DB
+	// TrafficSeries returns the weighted request count per hour, or per
+	// half hour when halfHour is set, oldest first.
+	TrafficSeries(f EventFilter, halfHour bool) ([]TrafficPoint, error)
+	// HourlyTotals computes MetricBucket-like totals per UTC hour from the
+	// raw events, for filters the hourly aggregates cannot answer. Only
+	// BucketStart, the counts and the byte sums are set.
+	HourlyTotals(f EventFilter) ([]MetricBucket, error)
+	// TopRoutes returns the routes with the most requests, each with its
+	// requests per status, and the number of distinct routes.
+	TopRoutes(f EventFilter, limit, offset int) ([]RouteCount, int64, error)
+
+	// AttributeKeys returns the distinct attribute keys of the events.
+	AttributeKeys(f EventFilter) ([]string, error)
+	// AttributeValues returns the distinct values of attribute key.
+	AttributeValues(f EventFilter, key string) ([]string, error)
+	// AttributeValueCounts returns the weighted request count per value of
+	// attribute key, most frequent first.
+	AttributeValueCounts(f EventFilter, key string) ([]ValueCount, error)
+
+	// Aggregate computes the MetricBucket rows of the hour starting at
+	// bucketStart (UTC, truncated to the hour).
+	Aggregate(bucketStart time.Time) error
+	// Retain deletes expired events, sessions and idempotency keys and
+	// old API key usage rows.
+	Retain(now time.Time) error
+	// PreparePartitions creates the events table partitions needed around
+	// now. It does nothing on backends without partitioning.
+	PreparePartitions(now time.Time) error
+
+	// MigrationStatus lists the schema migrations and when each was
+	// applied.
+	MigrationStatus() ([]MigrationStatus, error)
+	// PendingMigrations returns the migrations not applied yet.
+	PendingMigrations() ([]Migration, error)
+	// MigrateUp applies the pending migrations up to version to, or all
+	// of them when to is 0.
+	MigrateUp(to int64) ([]Migration, error)
+	// MigrateDown reverts the last steps applied migrations.
+	MigrateDown(steps int) ([]Migration, error)
+}
+
+// EventFilter selects the events a query covers. Zero fields do not filter.
+type EventFilter struct {
+	UserID  string
+	Project string
+	Since   time.Time
+	// Status is "success" (below 400) or "error" (400 and above).
+	Status string
+	Route  string
+	// AttrKey and AttrValue match events whose attribute AttrKey has the
+	// text value AttrValue; both must be set.
+	AttrKey   string
+	AttrValue string
+	// Bots is "exclude" to drop events from bots and crawlers or "only"
+	// to keep just those.
+	Bots string
+}
+
+// TrafficPoint is one bucket of TrafficSeries; Bucket is its start as an
+// ISO 8601 UTC timestamp.
+type TrafficPoint struct {
+	Bucket string
+	Count  int64
+}
+
+// RouteCount is one route of TopRoutes.
+type RouteCount struct {
+	Route    string
+	Count    int64
+	Statuses []StatusCount `gorm:"-"`
+}
+
+// StatusCount is the weighted request count of one status code.
+type StatusCount struct {
+	Status int
+	Count  int64
+}
+
+// ValueCount is the weighted request count of one attribute value.
+type ValueCount struct {
+	Value string
+	Count int64
+}
+
+// dialect holds the SQL that differs between databases. Expressions refer
+// to the columns of the events table.
+type dialect interface {
+	// attrText is the text of attribute key, with the arguments for its
+	// placeholders.
+	attrText(key string) (string, []any)
+	// attrExists is a condition on events having attribute key.
+	attrExists(key string) (string, []any)
+	// attrKeys is a join yielding one row per attribute of each event,
+	// with the key in je.key.
+	attrKeys() string
+	// bucket formats created_at truncated to the hour (or half hour) as an
+	// ISO 8601 UTC string, and returns the expression to group by.
+	bucket(halfHour bool) (sel, group string)
+	// hour is the start of the UTC hour of created_at.
+	hour() string
+
+	// name is the directory of the dialect's migrations.
+	name() string
+	// migrationsTable creates schema_migrations if it does not exist.
+	migrationsTable() string
+	// migrationLock is run first in every migration transaction to keep
+	// concurrent migrations apart until the transaction ends.
+	migrationLock() string
+}
+
+// DefaultEventIDWindow is how long stores opened directly, rather than by
+// Open, remember event IDs.
+const DefaultEventIDWindow = 24 * time.Hour
+
+// sqlStore implements Store on GORM; the embedding types supply the
+// dialect.
+type sqlStore struct {
+	db      *gorm.DB
+	dialect dialect
+
+	// eventIDWindow is how long event IDs are kept in event_ids, or less
+	// when their event expires first.
+	eventIDWindow time.Duration
+}
+
+func (s *sqlStore) DB() *gorm.DB { return s.db }
+
+func (s *sqlStore) Close() error {
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+func (s *sqlStore) PreparePartitions(now time.Time) error { return nil }
+
+func (s *sqlStore) InsertEvents(events []Event, batchSize int) ([]Event, error) {
+	var stored []Event
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		fresh, err := claimEventIDs(tx, events, batchSize, time.Now().Add(s.eventIDWindow))
+		if err != nil || len(fresh) == 0 {
+			return err
+		}
+		if err := tx.CreateInBatches(fresh, batchSize).Error; err != nil {
+			return err
+		}
+		stored = fresh
+		return nil
+	})
+	return stored, err
+}
+
+// claimEventIDs records the EventIDs of events in event_ids until
+// expiresAt, or until their event expires if that is earlier, and returns
+// copies of the events to store: those without an EventID and the first
+// with each EventID that was not recorded yet. A writer inserting the same
+// EventID concurrently is waited for by the database.
+func claimEventIDs(tx *gorm.DB, events []Event, batchSize int, expiresAt time.Time) ([]Event, error) {
+	type eventKey struct{ project, eventID string }
+	var keys []EventIDKey
+	seen := map[eventKey]bool{}
+	for _, e := range events {
+		if e.EventID == nil {
+			continue
+		}
+		k := eventKey{e.Project, *e.EventID}
+		if !seen[k] {
+			seen[k] = true
+			exp := expiresAt
+			if e.ExpiresAt != nil && e.ExpiresAt.Before(exp) {
+				exp = *e.ExpiresAt
+			}
+			keys = append(keys, EventIDKey{Project: e.Project, EventID: *e.EventID, ExpiresAt: &exp})
+		}
+	}
+
+	claimed := map[eventKey]bool{}
+	for len(keys) > 0 {
+		chunk := keys[:min(len(keys), batchSize)]
+		keys = keys[len(chunk):]
+
+		values := make([]string, len(chunk))
+		args := make([]any, 0, 3*len(chunk))
+		for i, k := range chunk {
+			values[i] = "(?, ?, ?)"
+			args = append(args, k.Project, k.EventID, k.ExpiresAt)
+		}
+		rows, err := tx.Raw("INSERT INTO event_ids (project, event_id, expires_at) VALUES "+strings.Join(values, ", ")+
+			" ON CONFLICT (project, event_id) DO NOTHING RETURNING project, event_id", args...).Rows()
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var k eventKey
+			if err := rows.Scan(&k.project, &k.eventID); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			claimed[k] = true
+		}
+		if err := rows.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	fresh := make([]Event, 0, len(events))
+	for _, e := range events {
+		if e.EventID != nil {
+			k := eventKey{e.Project, *e.EventID}
+			if !claimed[k] {
+				continue
+			}
+			delete(claimed, k)
+		}
+		fresh = append(fresh, e)
+	}
+	return fresh, nil
+}
+
+func (s *sqlStore) Events(f EventFilter) *gorm.DB {
+	q := s.db.Model(&Event{})
+	if f.UserID != "" {
+		q = q.Where("user_id = ?", f.UserID)
+	}
+	if !f.Since.IsZero() {
+		q = q.Where("created_at >= ?", f.Since)
+	}
+	if f.Project != "" {
+		q = q.Where("project = ?", f.Project)
+	}
+	switch f.Bots {
+	case "exclude":
+		q = q.Where("is_bot = ?", false)
+	case "only":
+		q = q.Where("is_bot = ?", true)
+	}
+	if f.Route != "" {
+		q = q.Where("route = ?", f.Route)
+	}
+	switch f.Status {
+	case "success":
+		q = q.Where("status < ?", 400)
+	case "error":
+		q = q.Where("status >= ?", 400)
+	}
+	if f.AttrKey != "" && f.AttrValue != "" {
+		expr, args := s.dialect.attrText(f.AttrKey)
+		q = q.Where(expr+" = ?", append(args, f.AttrValue)...)
+	}
+	return q
+}
+
+func (s *sqlStore) TrafficSeries(f EventFilter, halfHour bool) ([]TrafficPoint, error) {
+	sel, group := s.dialect.bucket(halfHour)
+	var rows []TrafficPoint
+	err := s.Events(f).
+		Select(sel + " AS bucket, " + WeightedCount + " AS count").
+		Group(group).
+		Order("bucket").
+		Scan(&rows).Error
+	return rows, err
+}
+
+func (s *sqlStore) HourlyTotals(f EventFilter) ([]MetricBucket, error) {
+	hour := s.dialect.hour()
+	var rows []struct {
+		BucketStart   scanTime
+		TotalCount    int64
+		ErrorCount    int64
+		RequestBytes  int64
+		ResponseBytes int64
+	}
+	if err := s.Events(f).
+		Select(hour + " AS bucket_start, " + WeightedCount + " AS total_count, " + WeightedErrorCount + " AS error_count, " +
+			WeightedRequestBytes + " AS request_bytes, " + WeightedResponseBytes + " AS response_bytes").
+		Group(hour).
+		Order("bucket_start").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	buckets := make([]MetricBucket, 0, len(rows))
+	for _, r := range rows {
+		buckets = append(buckets, MetricBucket{
+			BucketStart:   time.Time(r.BucketStart),
+			TotalCount:    r.TotalCount,
+			ErrorCount:    r.ErrorCount,
+			RequestBytes:  r.RequestBytes,
+			ResponseBytes: r.ResponseBytes,
+		})
+	}
+	return buckets, nil
+}
+
+// scanTime scans a computed timestamp, which SQLite returns as text in
+// the "2006-01-02 15:04:05" form rather than as a time.
+type scanTime time.Time
+
+func (t *scanTime) Scan(v any) error {
+	switch v := v.(type) {
+	case time.Time:
+		*t = scanTime(v.UTC())
+		return nil
+	case string:
+		return t.parse(v)
+	case []byte:
+		return t.parse(string(v))
+	}
+	return fmt.Errorf("db: cannot scan %T into a time", v)
+}
+
+func (t *scanTime) parse(s string) error {
+	v, err := time.ParseInLocation(time.DateTime, s, time.UTC)
+	if err != nil {
+		return err
+	}
+	*t = scanTime(v)
+	return nil
+}
+
+func (s *sqlStore) TopRoutes(f EventFilter, limit, offset int) ([]RouteCount, int64, error) {
+	var total int64
+	if err := s.Events(f).Select("COUNT(DISTINCT route)").Scan(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var rows []RouteCount
+	if err := s.Events(f).
+		Select("route AS route, " + WeightedCount + " AS count").
+		Group("route").
+		Order("count DESC").
+		Limit(limit).
+		Offset(offset).
+		Scan(&rows).Error; err != nil {
+		return nil, 0, err
+	}
+
+	names := make([]string, 0, len(rows))
+	for _, r := range rows {
+		if r.Route != "" {
+			names = append(names, r.Route)
+		}
+	}
+	if len(names) == 0 {
+		return rows, total, nil
+	}
+	type routeStatus struct {
+		Route  string
+		Status int
+		Count  int64
+	}
+	var statuses []routeStatus
+	if err := s.Events(f).
+		Where("route IN ?", names).
+		Select("route AS route, status AS status, " + WeightedCount + " AS count").
+		Group("route, status").
+		Scan(&statuses).Error; err != nil {
+		return nil, 0, err
+	}
+	byRoute := make(map[string][]StatusCount, len(names))
+	for _, rs := range statuses {
+		byRoute[rs.Route] = append(byRoute[rs.Route], StatusCount{Status: rs.Status, Count: rs.Count})
+	}
+	for i := range rows {
+		rows[i].Statuses = byRoute[rows[i].Route]
+	}
+	return rows, total, nil
+}
+
+func (s *sqlStore) AttributeKeys(f EventFilter) ([]string, error) {
+	var keys []string
+	err := s.Events(f).
+		Joins("CROSS JOIN " + s.dialect.attrKeys()).
+		Distinct("je.key").
+		Scan(&keys).Error
+	return keys, err
+}
+
+func (s *sqlStore) AttributeValues(f EventFilter, key string) ([]string, error) {
+	expr, args := s.dialect.attrText(key)
+	cond, condArgs := s.dialect.attrExists(key)
+	var values []string
+	err := s.Events(f).
+		Where(cond, condArgs...).
+		Select("DISTINCT "+expr+" AS value", args...).
+		Scan(&values).Error
+	return values, err
+}
+
+func (s *sqlStore) AttributeValueCounts(f EventFilter, key string) ([]ValueCount, error) {
+	expr, args := s.dialect.attrText(key)
+	cond, condArgs := s.dialect.attrExists(key)
+	var rows []ValueCount
+	err := s.Events(f).
+		Where(cond, condArgs...).
+		Select(expr+" AS value, "+WeightedCount+" AS count", args...).
+		Group("value").
+		Order("count DESC").
+		Scan(&rows).Error
+	return rows, err
+}
@@ -0,0 +1,164 @@
+package db
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestStore returns a migrated in-memory SQLite store.
+func newTestStore(t *testing.T) *SQLiteStore {
+	t.Helper()
+	s, err := OpenSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if _, err := s.MigrateUp(0); err != nil {
+		t.Fatalf("MigrateUp: %v", err)
+	}
+	return s
+}
+
+func TestInsertEventsDedupe(t *testing.T) {
+	ev := func(project, id, path string) Event {
+		e := Event{CreatedAt: time.Now().UTC(), Project: project, RawPath: path, SampleRate: 1}
+		if id != "" {
+			e.EventID = &id
+		}
+		return e
+	}
+	paths := func(events []Event) []string {
+		var out []string
+		for _, e := range events {
+			out = append(out, e.RawPath)
+		}
+		return out
+	}
+
+	tests := []struct {
+		name    string
+		batches [][]Event
+		stored  [][]string
+		ids     int64
+	}{
+		{
+			name:    "without event IDs",
+			batches: [][]Event{{ev("p", "", "/a"), ev("p", "", "/b")}, {ev("p", "", "/c")}},
+			stored:  [][]string{{"/a", "/b"}, {"/c"}},
+		},
+		{
+			name:    "duplicate within a batch",
+			batches: [][]Event{{ev("p", "1", "/a"), ev("p", "2", "/b"), ev("p", "1", "/c"), ev("p", "", "/d")}},
+			stored:  [][]string{{"/a", "/b", "/d"}},
+			ids:     2,
+		},
+		{
+			name:    "retried batch",
+			batches: [][]Event{{ev("p", "1", "/a"), ev("p", "2", "/b"), ev("p", "3", "/c")}, {ev("p", "3", "/c"), ev("p", "4", "/d"), ev("p", "1", "/a")}},
+			stored:  [][]string{{"/a", "/b", "/c"}, {"/d"}},
+			ids:     4,
+		},
+		{
+			name:    "same ID in another project",
+			batches: [][]Event{{ev("p", "1", "/a")}, {ev("q", "1", "/b")}},
+			stored:  [][]string{{"/a"}, {"/b"}},
+			ids:     2,
+		},
+		{
+			name:    "all duplicates",
+			batches: [][]Event{{ev("p", "1", "/a")}, {ev("p", "1", "/a")}},
+			stored:  [][]string{{"/a"}, nil},
+			ids:     1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore(t)
+			var total int
+			for i, batch := range tt.batches {
+				stored, err := s.InsertEvents(batch, 2)
+				if err != nil {
+					t.Fatalf("batch %d: %v", i, err)
+				}
+				got := paths(stored)
+				if len(got) != len(tt.stored[i]) {
+					t.Fatalf("batch %d stored %v, want %v", i, got, tt.stored[i])
+				}
+				for j := range got {
+					if got[j] != tt.stored[i][j] {
+						t.Fatalf("batch %d stored %v, want %v", i, got, tt.stored[i])
+					}
+				}
+				total += len(stored)
+			}
+
+			var events, ids int64
+			s.DB().Model(&Event{}).Count(&events)
+			s.DB().Model(&EventIDKey{}).Count(&ids)
+			if events != int64(total) || ids != tt.ids {
+				t.Errorf("rows: %d events, %d event IDs, want %d, %d", events, ids, total, tt.ids)
+			}
+		})
+	}
+}
+
+func TestRetainEventIDs(t *testing.T) {
+	s := newTestStore(t)
+	now := time.Now().UTC()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	id1, id2 := "1", "2"
+	if _, err := s.InsertEvents([]Event{
+		{CreatedAt: now, Project: "p", EventID: &id1, ExpiresAt: &past, SampleRate: 1},
+		{CreatedAt: now, Project: "p", EventID: &id2, ExpiresAt: &future, SampleRate: 1},
+	}, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Retain(now); err != nil {
+		t.Fatal(err)
+	}
+	var keys []EventIDKey
+	if err := s.DB().Find(&keys).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].EventID != "2" {
+		t.Errorf("event IDs after Retain = %+v, want only 2", keys)
+	}
+
+	// An expired ID may be stored again.
+	stored, err := s.InsertEvents([]Event{{CreatedAt: now, Project: "p", EventID: &id1, SampleRate: 1}}, 10)
+	if err != nil || len(stored) != 1 {
+		t.Errorf("reinsert of an expired ID = %d events, %v; want 1", len(stored), err)
+	}
+}
+
+func TestEventIDExpiry(t *testing.T) {
+	s := newTestStore(t)
+	s.eventIDWindow = 48 * time.Hour
+	now := time.Now().UTC()
+	soon, later := now.Add(time.Hour), now.Add(30*24*time.Hour)
+	tests := []struct {
+		name      string
+		expiresAt *time.Time
+		want      time.Time
+	}{
+		{"no retention", nil, now.Add(48 * time.Hour)},
+		{"retention longer than the window", &later, now.Add(48 * time.Hour)},
+		{"retention shorter than the window", &soon, soon},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := strconv.Itoa(i)
+			if _, err := s.InsertEvents([]Event{{CreatedAt: now, Project: "p", EventID: &id, ExpiresAt: tt.expiresAt, SampleRate: 1}}, 10); err != nil {
+				t.Fatal(err)
+			}
+			var key EventIDKey
+			if err := s.DB().Where("event_id = ?", id).First(&key).Error; err != nil {
+				t.Fatal(err)
+			}
+			if key.ExpiresAt == nil || key.ExpiresAt.Sub(tt.want).Abs() > time.Minute {
+				t.Errorf("ExpiresAt = %v, want %s", key.ExpiresAt, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"apiinsight/internal/ratelimit"
+)
+
+// APIKeyUsage counts the events (and request bytes) accepted for an API key
+// on one UTC day. Daily and monthly quotas are enforced against it.
+type APIKeyUsage struct {
+	APIKeyID uint      `gorm:"primaryKey;autoIncrement:false"`
+	Day      time.Time `gorm:"primaryKey;type:date"`
+	Events   int64     `gorm:"not null;default:0"`
+	Bytes    int64     `gorm:"not null;default:0"`
+}
+
+// Limits returns the rate limits and quotas configured on the key.
+func (k *APIKey) Limits() ratelimit.Limits {
+	return ratelimit.Limits{
+		EventsPerSecond: k.RateLimitEvents,
+		BytesPerSecond:  k.RateLimitBytes,
+		DailyEvents:     k.DailyEventQuota,
+		MonthlyEvents:   k.MonthlyEventQuota,
+	}
+}
+
+// UsageStore implements ratelimit.Store on the api_key_usages table.
+type UsageStore struct {
+	DB *gorm.DB
+}
+
+// Usage implements ratelimit.Store.
+func (s UsageStore) Usage(keyID uint, day time.Time) (int64, int64, error) {
+	monthStart := day.AddDate(0, 0, 1-day.Day())
+	var rows []APIKeyUsage
+	if err := s.DB.Where("api_key_id = ? AND day >= ? AND day <= ?", keyID, monthStart, day).
+		Find(&rows).Error; err != nil {
+		return 0, 0, err
+	}
+	var dayEvents, monthEvents int64
+	for _, r := range rows {
+		monthEvents += r.Events
+		if sameDate(r.Day, day) {
+			dayEvents += r.Events
+		}
+	}
+	return dayEvents, monthEvents, nil
+}
+
+// Add implements ratelimit.Store by upserting one row per key and day.
+func (s UsageStore) Add(deltas []ratelimit.Delta) error {
+	rows := make([]APIKeyUsage, 0, len(deltas))
+	for _, d := range deltas {
+		rows = append(rows, APIKeyUsage{APIKeyID: d.KeyID, Day: d.Day, Events: d.Events, Bytes: d.Bytes})
+	}
+	return s.DB.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "api_key_id"}, {Name: "day"}},
+		DoUpdates: clause.Set{
+			{Column: clause.Column{Name: "events"}, Value: gorm.Expr("api_key_usages.events + excluded.events")},
+			{Column: clause.Column{Name: "bytes"}, Value: gorm.Expr("api_key_usages.bytes + excluded.bytes")},
+		},
+	}).Create(&rows).Error
+}
+
+// UsageSummary is a key's usage in the current UTC day and month.
+type UsageSummary struct {
+	DayEvents   int64
+	DayBytes    int64
+	MonthEvents int64
+	MonthBytes  int64
+}
+
+// APIKeyUsageSummaries returns the usage of each key in keyIDs for the day
+// and month containing now.
+func APIKeyUsageSummaries(db *gorm.DB, keyIDs []uint, now time.Time) (map[uint]UsageSummary, error) {
+	out := make(map[uint]UsageSummary, len(keyIDs))
+	if len(keyIDs) == 0 {
+		return out, nil
+	}
+	y, m, d := now.UTC().Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	monthStart := time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+
+	var rows []APIKeyUsage
+	if err := db.Where("api_key_id IN ? AND day >= ?", keyIDs, monthStart).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		s := out[r.APIKeyID]
+		s.MonthEvents += r.Events
+		s.MonthBytes += r.Bytes
+		if sameDate(r.Day, day) {
+			s.DayEvents += r.Events
+			s.DayBytes += r.Bytes
+		}
+		out[r.APIKeyID] = s
+	}
+	return out, nil
+}
+
+// sameDate compares calendar dates; date columns may be scanned in the
+// connection's time zone rather than UTC.
+func sameDate(a, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return ay == by && am == bm && ad == bd
+}
@@ -0,0 +1,186 @@
+// Package geoip looks up the country, region and autonomous system of
+// client IPs in local MaxMind databases (GeoLite2/GeoIP2 Country, City and
+// ASN). Database files are reopened when they change on disk, so they can
+// be updated (e.g. by geoipupdate) without a restart.
+package geoip
+
+import (
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Info is what is known about an address. Fields are empty when no
+// database has the information.
+type Info struct {
+	// Country is the ISO 3166-1 alpha-2 country code, e.g. "DE".
+	Country string
+	// Region is the ISO 3166-2 code of the first subdivision, e.g. "DE-BE".
+	Region string
+	// ASN and ASNOrg identify the autonomous system announcing the address.
+	ASN    uint
+	ASNOrg string
+}
+
+// record decodes the fields used from any of the supported database types.
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+	ASN    uint   `maxminddb:"autonomous_system_number"`
+	ASNOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+type database struct {
+	path    string
+	reader  *maxminddb.Reader
+	modTime time.Time
+	size    int64
+}
+
+// Resolver looks addresses up in a set of database files. It is safe for
+// concurrent use; a nil Resolver finds nothing.
+type Resolver struct {
+	mu  sync.RWMutex
+	dbs []*database
+
+	stop chan struct{}
+}
+
+// Open opens the database files at paths.
+func Open(paths []string) (*Resolver, error) {
+	r := &Resolver{stop: make(chan struct{})}
+	for _, path := range paths {
+		db, err := openDatabase(path)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.dbs = append(r.dbs, db)
+	}
+	return r, nil
+}
+
+func openDatabase(path string) (*database, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &database{path: path, reader: reader, modTime: fi.ModTime(), size: fi.Size()}, nil
+}
+
+// Lookup returns what the databases know about ip. Invalid addresses and
+// lookup errors yield an empty Info.
+func (r *Resolver) Lookup(ip string) Info {
+	var info Info
+	if r == nil {
+		return info
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return info
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, db := range r.dbs {
+		var rec record
+		if err := db.reader.Lookup(addr, &rec); err != nil {
+			continue
+		}
+		if info.Country == "" {
+			info.Country = rec.Country.ISOCode
+		}
+		if info.Region == "" && len(rec.Subdivisions) > 0 && rec.Subdivisions[0].ISOCode != "" && rec.Country.ISOCode != "" {
+			info.Region = rec.Country.ISOCode + "-" + rec.Subdivisions[0].ISOCode
+		}
+		if info.ASN == 0 {
+			info.ASN, info.ASNOrg = rec.ASN, rec.ASNOrg
+		}
+	}
+	return info
+}
+
+// Watch checks the database files every interval and reopens those whose
+// modification time or size changed. A file that fails to open keeps the
+// previous version in use.
+func (r *Resolver) Watch(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				r.reload()
+			}
+		}
+	}()
+}
+
+func (r *Resolver) reload() {
+	r.mu.RLock()
+	var changed []*database
+	for _, db := range r.dbs {
+		fi, err := os.Stat(db.path)
+		if err == nil && (!fi.ModTime().Equal(db.modTime) || fi.Size() != db.size) {
+			changed = append(changed, db)
+		}
+	}
+	r.mu.RUnlock()
+
+	for _, old := range changed {
+		db, err := openDatabase(old.path)
+		if err != nil {
+			log.Printf("geoip: reload %s: %v", old.path, err)
+			continue
+		}
+		r.mu.Lock()
+		replaced := false
+		for i := range r.dbs {
+			if r.dbs[i] == old {
+				r.dbs[i], replaced = db, true
+			}
+		}
+		r.mu.Unlock()
+		if !replaced {
+			// Closed meanwhile.
+			db.reader.Close()
+			continue
+		}
+		old.reader.Close()
+		log.Printf("geoip: reloaded %s (%s, built %s)", old.path, db.reader.Metadata.DatabaseType,
+			time.Unix(int64(db.reader.Metadata.BuildEpoch), 0).UTC().Format(time.DateOnly))
+	}
+}
+
+// Close stops watching and closes the databases.
+func (r *Resolver) Close() error {
+	if r == nil {
+		return nil
+	}
+	select {
+	case <-r.stop:
+	default:
+		close(r.stop)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, db := range r.dbs {
+		db.reader.Close()
+	}
+	r.dbs = nil
+	return nil
+}
@@ -10,8 +10,13 @@ const (
 	UserKey      = "user"
 	APIKeyKey    = "apiKey"
 	UserTokenKey = "userToken"
+	SessionKey   = "session"
+	ProjectKey   = "projectScope"
 )
 
+// SessionCookie is the name of the cookie holding the opaque session token.
+const SessionCookie = "session_id"
+
 func SetUserToken(ctx *fasthttp.RequestCtx, token string) {
 	ctx.SetUserValue(UserTokenKey, token)
 }
@@ -49,3 +54,31 @@ func APIKeyFromCtx(ctx *fasthttp.RequestCtx) (*dbpkg.APIKey, bool) {
 	ak, ok := v.(*dbpkg.APIKey)
 	return ak, ok
 }
+
+func SetSession(ctx *fasthttp.RequestCtx, s *dbpkg.Session) {
+	ctx.SetUserValue(SessionKey, s)
+}
+
+func SessionFromCtx(ctx *fasthttp.RequestCtx) (*dbpkg.Session, bool) {
+	v := ctx.UserValue(SessionKey)
+	if v == nil {
+		return nil, false
+	}
+	s, ok := v.(*dbpkg.Session)
+	return s, ok
+}
+
+// SetProjectScope restricts metrics queries in this request to a single
+// project, used when authenticating with a project-scoped API key.
+func SetProjectScope(ctx *fasthttp.RequestCtx, project string) {
+	ctx.SetUserValue(ProjectKey, project)
+}
+
+func ProjectScopeFromCtx(ctx *fasthttp.RequestCtx) (string, bool) {
+	v := ctx.UserValue(ProjectKey)
+	if v == nil {
+		return "", false
+	}
+	s, ok := v.(string)
+	return s, ok
+}
@@ -3,11 +3,14 @@ package handlers
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"math"
 	"strconv"
+	"strings"
 
 	"github.com/valyala/fasthttp"
 	"gorm.io/gorm"
 
+	"apiinsight/internal/clientip"
 	"apiinsight/internal/config"
 	dbpkg "apiinsight/internal/db"
 )
@@ -48,6 +51,22 @@ func CreateAPIKey(db *gorm.DB, cfg *config.Config) fasthttp.RequestHandler {
 			}
 		}
 
+		var scopes []string
+		for _, v := range ctx.PostArgs().PeekMulti("scopes") {
+			scope := string(v)
+			if !dbpkg.ValidScope(scope) {
+				ctx.SetStatusCode(fasthttp.StatusBadRequest)
+				ctx.SetBodyString("invalid scope: " + scope)
+				return
+			}
+			scopes = append(scopes, scope)
+		}
+		if len(scopes) == 0 {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetBodyString("at least one scope is required")
+			return
+		}
+
 		user, ok := MustUser(ctx)
 		if !ok {
 			return
@@ -63,10 +82,13 @@ func CreateAPIKey(db *gorm.DB, cfg *config.Config) fasthttp.RequestHandler {
 			UserID:        user.ID,
 			Name:          name,
 			Environment:   environment,
-			Key:           key,
 			Active:        true,
 			RetentionDays: retentionDays,
+			Scopes:        strings.Join(scopes, ","),
+
+			StrictValidation: string(ctx.PostArgs().Peek("strict_validation")) == "on",
 		}
+		apiKey.SetToken(key)
 
 		if err := db.Create(apiKey).Error; err != nil {
 			ctx.SetStatusCode(fasthttp.StatusBadRequest)
@@ -74,7 +96,9 @@ func CreateAPIKey(db *gorm.DB, cfg *config.Config) fasthttp.RequestHandler {
 			return
 		}
 
-		ctx.Redirect("/settings", fasthttp.StatusSeeOther)
+		// Only the hash is stored, so this response is the one chance to
+		// see the plaintext key.
+		renderSettings(ctx, db, cfg, user, &NewAPIKeyView{Name: name, Token: key})
 	}
 }
 
@@ -104,7 +128,7 @@ func DeleteAPIKey(db *gorm.DB, cfg *config.Config) fasthttp.RequestHandler {
 			return
 		}
 
-		if cfg.InternalAPIKey != "" && apiKey.Key == cfg.InternalAPIKey {
+		if cfg.InternalAPIKey != "" && apiKey.Matches(cfg.InternalAPIKey) {
 			ctx.SetStatusCode(fasthttp.StatusForbidden)
 			ctx.SetBodyString("cannot delete internal API key")
 			return
@@ -155,3 +179,137 @@ func SetActiveAPIKey(db *gorm.DB, cfg *config.Config) fasthttp.RequestHandler {
 		ctx.Redirect("/settings", fasthttp.StatusSeeOther)
 	}
 }
+
+// SetStrictAPIKey switches a key between accepting the valid events of a
+// batch and rejecting the whole batch when any event is invalid.
+func SetStrictAPIKey(db *gorm.DB) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		id := string(ctx.PostArgs().Peek("id"))
+		strictStr := string(ctx.PostArgs().Peek("strict"))
+		if id == "" || (strictStr != "true" && strictStr != "false") {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetBodyString("id and strict (true|false) required")
+			return
+		}
+
+		user, ok := MustUser(ctx)
+		if !ok {
+			return
+		}
+		var apiKey dbpkg.APIKey
+		if err := db.First(&apiKey, id).Error; err != nil {
+			ctx.SetStatusCode(fasthttp.StatusNotFound)
+			ctx.SetBodyString("API key not found")
+			return
+		}
+		if apiKey.UserID != user.ID && !user.IsAdmin {
+			ctx.SetStatusCode(fasthttp.StatusForbidden)
+			ctx.SetBodyString("forbidden")
+			return
+		}
+
+		if err := db.Model(&apiKey).Update("strict_validation", strictStr == "true").Error; err != nil {
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString("failed to update API key")
+			return
+		}
+		ctx.Redirect("/settings", fasthttp.StatusSeeOther)
+	}
+}
+
+// SetAPIKeyIPPolicy sets how client IPs of a key's events are stored. An
+// empty policy falls back to the global default.
+func SetAPIKeyIPPolicy(db *gorm.DB) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		id := string(ctx.PostArgs().Peek("id"))
+		policy := string(ctx.PostArgs().Peek("ip_policy"))
+		if id == "" || (policy != "" && !clientip.ValidPolicy(policy)) {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetBodyString("id and ip_policy (empty, " + strings.Join(clientip.Policies, ", ") + ") required")
+			return
+		}
+
+		user, ok := MustUser(ctx)
+		if !ok {
+			return
+		}
+		var apiKey dbpkg.APIKey
+		if err := db.First(&apiKey, id).Error; err != nil {
+			ctx.SetStatusCode(fasthttp.StatusNotFound)
+			ctx.SetBodyString("API key not found")
+			return
+		}
+		if apiKey.UserID != user.ID && !user.IsAdmin {
+			ctx.SetStatusCode(fasthttp.StatusForbidden)
+			ctx.SetBodyString("forbidden")
+			return
+		}
+
+		if err := db.Model(&apiKey).Update("ip_policy", policy).Error; err != nil {
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString("failed to update API key")
+			return
+		}
+		ctx.Redirect("/settings", fasthttp.StatusSeeOther)
+	}
+}
+
+// SetAPIKeyLimits updates a key's ingest rate limits and quotas. Empty or
+// zero fields remove the corresponding limit.
+func SetAPIKeyLimits(db *gorm.DB) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		id := string(ctx.PostArgs().Peek("id"))
+		if id == "" {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetBodyString("id required")
+			return
+		}
+		var limits [4]int64
+		for i, field := range []string{"rate_limit_events", "rate_limit_bytes", "daily_event_quota", "monthly_event_quota"} {
+			v := strings.TrimSpace(string(ctx.PostArgs().Peek(field)))
+			if v == "" {
+				continue
+			}
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				ctx.SetStatusCode(fasthttp.StatusBadRequest)
+				ctx.SetBodyString("invalid " + field)
+				return
+			}
+			limits[i] = n
+		}
+		if limits[0] > math.MaxInt32 {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetBodyString("invalid rate_limit_events")
+			return
+		}
+
+		user, ok := MustUser(ctx)
+		if !ok {
+			return
+		}
+		var apiKey dbpkg.APIKey
+		if err := db.First(&apiKey, id).Error; err != nil {
+			ctx.SetStatusCode(fasthttp.StatusNotFound)
+			ctx.SetBodyString("API key not found")
+			return
+		}
+		if apiKey.UserID != user.ID && !user.IsAdmin {
+			ctx.SetStatusCode(fasthttp.StatusForbidden)
+			ctx.SetBodyString("forbidden")
+			return
+		}
+
+		if err := db.Model(&apiKey).Updates(map[string]any{
+			"rate_limit_events":   limits[0],
+			"rate_limit_bytes":    limits[1],
+			"daily_event_quota":   limits[2],
+			"monthly_event_quota": limits[3],
+		}).Error; err != nil {
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString("failed to update API key")
+			return
+		}
+		ctx.Redirect("/settings", fasthttp.StatusSeeOther)
+	}
+}
@@ -2,6 +2,11 @@ package handlers
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"strings"
 
 	"github.com/valyala/fasthttp"
 	"golang.org/x/crypto/bcrypt"
@@ -9,37 +14,129 @@ import (
 
 	"apiinsight/internal/config"
 	dbpkg "apiinsight/internal/db"
+	httpctx "apiinsight/internal/http/ctx"
+	appmw "apiinsight/internal/http/middleware"
 	ui "apiinsight/web"
 )
 
-func LoginForm(_ *config.Config) fasthttp.RequestHandler {
+func LoginForm(cfg *config.Config) fasthttp.RequestHandler {
 	return func(ctx *fasthttp.RequestCtx) {
-		t := ui.Templates().Lookup("login.html")
-		if t == nil {
-			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
-			ctx.SetBodyString("login template not found")
-			return
-		}
-		var buf bytes.Buffer
-		if err := t.Execute(&buf, nil); err != nil {
-			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
-			ctx.SetBodyString("render error")
-			return
-		}
-		ctx.SetContentType("text/html; charset=utf-8")
-		ctx.SetBody(buf.Bytes())
+		renderLogin(ctx, cfg, fasthttp.StatusOK, "")
+	}
+}
+
+// loginCSRFCookie holds the pre-session CSRF token of the login form. The
+// form echoes it in its csrf_token field, which a cross-site page cannot
+// read, so it cannot sign the browser in to another account.
+const loginCSRFCookie = "login_csrf"
+
+// renderLogin renders the login page with errMsg, if any, and a fresh
+// login CSRF token.
+func renderLogin(ctx *fasthttp.RequestCtx, cfg *config.Config, status int, errMsg string) {
+	t := ui.Templates().Lookup("login.html")
+	if t == nil {
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString("login template not found")
+		return
 	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString("failed to prepare CSRF token")
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, map[string]any{"Error": errMsg, "CSRFToken": token}); err != nil {
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString("render error")
+		return
+	}
+
+	var c fasthttp.Cookie
+	c.SetKey(loginCSRFCookie)
+	c.SetValue(token)
+	c.SetPath("/login")
+	c.SetHTTPOnly(true)
+	c.SetSecure(cookieSecure(ctx, cfg))
+	c.SetSameSite(fasthttp.CookieSameSiteStrictMode)
+	ctx.Response.Header.SetCookie(&c)
+
+	ctx.SetStatusCode(status)
+	ctx.SetContentType("text/html; charset=utf-8")
+	ctx.SetBody(buf.Bytes())
+}
+
+// cookieSecure reports whether the session cookie should carry the Secure
+// attribute for this request, according to cfg.CookieSecure.
+func cookieSecure(ctx *fasthttp.RequestCtx, cfg *config.Config) bool {
+	switch strings.ToLower(cfg.CookieSecure) {
+	case "true", "1", "yes":
+		return true
+	case "false", "0", "no":
+		return false
+	}
+	if ctx.IsTLS() {
+		return true
+	}
+	return strings.EqualFold(string(ctx.Request.Header.Peek("X-Forwarded-Proto")), "https")
+}
+
+func setSessionCookie(ctx *fasthttp.RequestCtx, cfg *config.Config, token string) {
+	var c fasthttp.Cookie
+	c.SetKey(httpctx.SessionCookie)
+	c.SetValue(token)
+	c.SetPath("/")
+	c.SetHTTPOnly(true)
+	c.SetSecure(cookieSecure(ctx, cfg))
+	c.SetSameSite(fasthttp.CookieSameSiteLaxMode)
+	c.SetMaxAge(int(cfg.SessionTTL.Seconds()))
+	ctx.Response.Header.SetCookie(&c)
 }
 
-func LoginSubmit(db *gorm.DB) fasthttp.RequestHandler {
+func clearSessionCookie(ctx *fasthttp.RequestCtx, cfg *config.Config) {
+	var c fasthttp.Cookie
+	c.SetKey(httpctx.SessionCookie)
+	c.SetValue("")
+	c.SetPath("/")
+	c.SetHTTPOnly(true)
+	c.SetSecure(cookieSecure(ctx, cfg))
+	c.SetSameSite(fasthttp.CookieSameSiteLaxMode)
+	c.SetMaxAge(-1)
+	ctx.Response.Header.SetCookie(&c)
+}
+
+func clearLoginCSRFCookie(ctx *fasthttp.RequestCtx, cfg *config.Config) {
+	var c fasthttp.Cookie
+	c.SetKey(loginCSRFCookie)
+	c.SetValue("")
+	c.SetPath("/login")
+	c.SetHTTPOnly(true)
+	c.SetSecure(cookieSecure(ctx, cfg))
+	c.SetSameSite(fasthttp.CookieSameSiteStrictMode)
+	c.SetMaxAge(-1)
+	ctx.Response.Header.SetCookie(&c)
+}
+
+// LoginSubmit signs the user in. The form must carry the token of the
+// login CSRF cookie set by the login page.
+func LoginSubmit(db *gorm.DB, cfg *config.Config) fasthttp.RequestHandler {
 	return func(ctx *fasthttp.RequestCtx) {
+		csrfCookie := ctx.Request.Header.Cookie(loginCSRFCookie)
+		csrfToken := ctx.PostArgs().Peek(appmw.CSRFFormField)
+		if len(csrfCookie) == 0 || subtle.ConstantTimeCompare(csrfCookie, csrfToken) != 1 {
+			renderLogin(ctx, cfg, fasthttp.StatusForbidden, "The login form expired. Please sign in again.")
+			return
+		}
+
 		username := string(ctx.PostArgs().Peek("username"))
 		password := string(ctx.PostArgs().Peek("password"))
 
 		var user dbpkg.User
 		if err := db.Where("username = ?", username).First(&user).Error; err != nil {
 			if err == gorm.ErrRecordNotFound {
-				renderLoginError(ctx, "Invalid username or password.")
+				renderLogin(ctx, cfg, fasthttp.StatusUnauthorized, "Invalid username or password.")
 				return
 			}
 			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
@@ -48,43 +145,33 @@ func LoginSubmit(db *gorm.DB) fasthttp.RequestHandler {
 		}
 
 		if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
-			renderLoginError(ctx, "Invalid username or password.")
+			renderLogin(ctx, cfg, fasthttp.StatusUnauthorized, "Invalid username or password.")
 			return
 		}
 
-		var c fasthttp.Cookie
-		c.SetKey("session_user")
-		c.SetValue(username)
-		c.SetPath("/")
-		c.SetHTTPOnly(true)
-		ctx.Response.Header.SetCookie(&c)
+		token, _, err := dbpkg.CreateSession(db, user.ID, string(ctx.UserAgent()), ctx.RemoteIP().String(), cfg.SessionTTL)
+		if err != nil {
+			log.Printf("failed to create session: %v", err)
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString("failed to create session")
+			return
+		}
+		setSessionCookie(ctx, cfg, token)
+		clearLoginCSRFCookie(ctx, cfg)
 
 		ctx.Redirect("/", fasthttp.StatusSeeOther)
 	}
 }
 
-func renderLoginError(ctx *fasthttp.RequestCtx, errMsg string) {
-	t := ui.Templates().Lookup("login.html")
-	if t != nil {
-		var buf bytes.Buffer
-		_ = t.Execute(&buf, map[string]any{"Error": errMsg})
-		ctx.SetStatusCode(fasthttp.StatusUnauthorized)
-		ctx.SetContentType("text/html; charset=utf-8")
-		ctx.SetBody(buf.Bytes())
-	} else {
-		ctx.SetStatusCode(fasthttp.StatusUnauthorized)
-		ctx.SetBodyString(errMsg)
-	}
-}
-
-func Logout() fasthttp.RequestHandler {
+// Logout revokes the server-side session (if any) and clears the cookie.
+func Logout(db *gorm.DB, cfg *config.Config) fasthttp.RequestHandler {
 	return func(ctx *fasthttp.RequestCtx) {
-		var c fasthttp.Cookie
-		c.SetKey("session_user")
-		c.SetValue("")
-		c.SetPath("/")
-		c.SetMaxAge(-1)
-		ctx.Response.Header.SetCookie(&c)
+		if token := ctx.Request.Header.Cookie(httpctx.SessionCookie); len(token) > 0 {
+			if err := db.Where("token_hash = ?", dbpkg.HashSessionToken(string(token))).Delete(&dbpkg.Session{}).Error; err != nil {
+				log.Printf("failed to revoke session on logout: %v", err)
+			}
+		}
+		clearSessionCookie(ctx, cfg)
 		ctx.Redirect("/login", fasthttp.StatusSeeOther)
 	}
 }
@@ -135,6 +222,15 @@ func ChangePasswordSelf(db *gorm.DB, cfg *config.Config) fasthttp.RequestHandler
 			return
 		}
 
+		// Sign out every other browser that was using the old password.
+		var keepID uint
+		if session, ok := httpctx.SessionFromCtx(ctx); ok && session != nil {
+			keepID = session.ID
+		}
+		if err := dbpkg.DeleteUserSessions(db, user.ID, keepID); err != nil {
+			log.Printf("failed to revoke sessions after password change: %v", err)
+		}
+
 		ctx.Redirect("/settings", fasthttp.StatusSeeOther)
 	}
 }
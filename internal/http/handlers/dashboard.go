@@ -2,6 +2,9 @@ package handlers
 
 import (
 	"bytes"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/valyala/fasthttp"
 	"gorm.io/gorm"
@@ -25,10 +28,92 @@ type LayoutData struct {
 	Username         string
 	AdminUser        string
 	Users            []dbpkg.User
+	Sessions         []SessionView
 	APIKeys          []dbpkg.APIKey
-	InternalAPIKey   string
+	RouteTemplates   []RouteTemplateView
+	SamplingRules    []SamplingRuleView
+	RedactionRules   []RedactionRuleView
+	GlobalRedaction  GlobalRedactionView
+	DefaultIPPolicy  string
+	KeyUsage         []KeyUsageView
+	InternalAPIKeyID uint
+	NewAPIKey        *NewAPIKeyView
 	TimeFormat       string
 	DateFormat       string
+	CSRFToken        string
+}
+
+// RouteTemplateView is a route template row with its project name resolved
+// for display on the settings page.
+type RouteTemplateView struct {
+	ID          uint
+	Pattern     string
+	Project     string
+	Environment string
+}
+
+// SamplingRuleView is a sampling rule row with its project name resolved
+// for display on the settings page.
+type SamplingRuleView struct {
+	ID          uint
+	Project     string
+	Environment string
+	Route       string
+	Percent     string
+}
+
+// RedactionRuleView is a redaction rule row with its project name resolved
+// for display on the settings page.
+type RedactionRuleView struct {
+	ID          uint
+	Project     string
+	Environment string
+	Kind        string
+	Pattern     string
+	Replacement string
+}
+
+// GlobalRedactionView lists the redaction settings from the environment,
+// which apply to every project.
+type GlobalRedactionView struct {
+	Detectors string
+	DenyKeys  string
+	Routes    []string
+}
+
+// KeyUsageView is a project's ingest limits and its usage in the current
+// UTC day and month, as shown on the settings page.
+type KeyUsageView struct {
+	ID          uint
+	Project     string
+	Environment string
+
+	RateLimitEvents   int
+	RateLimitBytes    int64
+	DailyEventQuota   int64
+	MonthlyEventQuota int64
+
+	DayEvents   int64
+	DayBytes    string
+	MonthEvents int64
+	MonthBytes  string
+	// DayPercent and MonthPercent are the share of the quota used, or -1
+	// without a quota.
+	DayPercent   int
+	MonthPercent int
+}
+
+// SessionView is an active login session as listed on the users page.
+type SessionView struct {
+	ID         uint
+	UserID     uint
+	Username   string
+	CreatedAt  string
+	LastSeenAt string
+	ExpiresAt  string
+	RemoteIP   string
+	UserAgent  string
+	Current    bool
 }
 
 type ProjectNav struct {
@@ -54,6 +139,11 @@ func getLayoutData(ctx *fasthttp.RequestCtx, cfg *config.Config, activePage, bre
 		}
 	}
 
+	csrfToken := ""
+	if s, ok := httpctx.SessionFromCtx(ctx); ok && s != nil {
+		csrfToken = s.CSRFToken
+	}
+
 	return LayoutData{
 		Title:            breadcrumb,
 		Breadcrumb:       breadcrumb,
@@ -65,6 +155,7 @@ func getLayoutData(ctx *fasthttp.RequestCtx, cfg *config.Config, activePage, bre
 		AdminUser:        cfg.AdminUser,
 		TimeFormat:       timeFormat,
 		DateFormat:       dateFormat,
+		CSRFToken:        csrfToken,
 	}
 }
 
@@ -138,48 +229,177 @@ func SettingsPage(db *gorm.DB, cfg *config.Config) fasthttp.RequestHandler {
 		if !ok {
 			return
 		}
-		isSuperAdmin := user.Username == cfg.AdminUser
+		renderSettings(ctx, db, cfg, user, nil)
+	}
+}
 
-		var apiKeys []dbpkg.APIKey
-		if err := db.Where("user_id = ?", user.ID).Order("created_at DESC").Find(&apiKeys).Error; err != nil {
-			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
-			ctx.SetBodyString("failed to load API keys")
-			return
-		}
+// NewAPIKeyView carries the plaintext of a freshly created key so the
+// settings page can show it exactly once.
+type NewAPIKeyView struct {
+	Name  string
+	Token string
+}
 
-		if isSuperAdmin && cfg.InternalAPIKey != "" {
-			hasInternal := false
-			for _, k := range apiKeys {
-				if k.Key == cfg.InternalAPIKey {
-					hasInternal = true
-					break
-				}
+// renderSettings renders the settings page for user. newKey, when non-nil,
+// is displayed once at the top of the page and never stored.
+func renderSettings(ctx *fasthttp.RequestCtx, db *gorm.DB, cfg *config.Config, user *dbpkg.User, newKey *NewAPIKeyView) {
+	isSuperAdmin := user.Username == cfg.AdminUser
+
+	var apiKeys []dbpkg.APIKey
+	if err := db.Where("user_id = ?", user.ID).Order("created_at DESC").Find(&apiKeys).Error; err != nil {
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString("failed to load API keys")
+		return
+	}
+
+	var internalKeyID uint
+	if isSuperAdmin && cfg.InternalAPIKey != "" {
+		for _, k := range apiKeys {
+			if k.Matches(cfg.InternalAPIKey) {
+				internalKeyID = k.ID
+				break
 			}
-			if !hasInternal {
-				var keyRow dbpkg.APIKey
-				if err := db.Where("key = ?", cfg.InternalAPIKey).First(&keyRow).Error; err != nil {
-					keyRow = dbpkg.APIKey{
-						UserID:      user.ID,
-						Name:        "api-insight",
-						Environment: "internal",
-						Key:         cfg.InternalAPIKey,
-						Active:      true,
-					}
-					db.Create(&keyRow)
-				} else if keyRow.UserID != user.ID {
-					keyRow.UserID = user.ID
-					db.Save(&keyRow)
+		}
+		if internalKeyID == 0 {
+			keyRow, err := dbpkg.FindAPIKeyByToken(db, cfg.InternalAPIKey)
+			if err != nil {
+				keyRow = &dbpkg.APIKey{
+					UserID:      user.ID,
+					Name:        "api-insight",
+					Environment: "internal",
+					Active:      true,
+					Scopes:      dbpkg.DefaultAPIKeyScopes,
 				}
-				apiKeys = append([]dbpkg.APIKey{keyRow}, apiKeys...)
+				keyRow.SetToken(cfg.InternalAPIKey)
+				db.Create(keyRow)
+			} else if keyRow.UserID != user.ID {
+				keyRow.UserID = user.ID
+				db.Save(keyRow)
 			}
+			internalKeyID = keyRow.ID
+			apiKeys = append([]dbpkg.APIKey{*keyRow}, apiKeys...)
 		}
+	}
 
-		data := getLayoutData(ctx, cfg, "settings", "Settings", "settings")
-		data.APIKeys = apiKeys
-		data.InternalAPIKey = cfg.InternalAPIKey
-		populateProjectsForLayout(&data, db, cfg, ctx, "")
-		renderLayout(ctx, data)
+	keyIDs := make([]uint, 0, len(apiKeys))
+	keysByID := make(map[uint]dbpkg.APIKey, len(apiKeys))
+	for _, k := range apiKeys {
+		keyIDs = append(keyIDs, k.ID)
+		keysByID[k.ID] = k
 	}
+	var templates []dbpkg.RouteTemplate
+	if len(keyIDs) > 0 {
+		if err := db.Where("api_key_id IN ?", keyIDs).Order("api_key_id, id").Find(&templates).Error; err != nil {
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString("failed to load route templates")
+			return
+		}
+	}
+	templateViews := make([]RouteTemplateView, 0, len(templates))
+	for _, t := range templates {
+		k := keysByID[t.APIKeyID]
+		templateViews = append(templateViews, RouteTemplateView{
+			ID:          t.ID,
+			Pattern:     t.Pattern,
+			Project:     k.Name,
+			Environment: k.Environment,
+		})
+	}
+
+	var samplingRules []dbpkg.SamplingRule
+	if len(keyIDs) > 0 {
+		if err := db.Where("api_key_id IN ?", keyIDs).Order("api_key_id, id").Find(&samplingRules).Error; err != nil {
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString("failed to load sampling rules")
+			return
+		}
+	}
+	samplingViews := make([]SamplingRuleView, 0, len(samplingRules))
+	for _, r := range samplingRules {
+		k := keysByID[r.APIKeyID]
+		samplingViews = append(samplingViews, SamplingRuleView{
+			ID:          r.ID,
+			Project:     k.Name,
+			Environment: k.Environment,
+			Route:       r.Route,
+			Percent:     strconv.FormatFloat(r.Rate*100, 'f', -1, 64) + "%",
+		})
+	}
+
+	var redactionRules []dbpkg.RedactionRule
+	if len(keyIDs) > 0 {
+		if err := db.Where("api_key_id IN ?", keyIDs).Order("api_key_id, id").Find(&redactionRules).Error; err != nil {
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString("failed to load redaction rules")
+			return
+		}
+	}
+	redactionViews := make([]RedactionRuleView, 0, len(redactionRules))
+	for _, r := range redactionRules {
+		k := keysByID[r.APIKeyID]
+		redactionViews = append(redactionViews, RedactionRuleView{
+			ID:          r.ID,
+			Project:     k.Name,
+			Environment: k.Environment,
+			Kind:        r.Kind,
+			Pattern:     r.Pattern,
+			Replacement: r.Replacement,
+		})
+	}
+
+	usage, err := dbpkg.APIKeyUsageSummaries(db, keyIDs, time.Now())
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString("failed to load API key usage")
+		return
+	}
+	usageViews := make([]KeyUsageView, 0, len(apiKeys))
+	for _, k := range apiKeys {
+		u := usage[k.ID]
+		usageViews = append(usageViews, KeyUsageView{
+			ID:                k.ID,
+			Project:           k.Name,
+			Environment:       k.Environment,
+			RateLimitEvents:   k.RateLimitEvents,
+			RateLimitBytes:    k.RateLimitBytes,
+			DailyEventQuota:   k.DailyEventQuota,
+			MonthlyEventQuota: k.MonthlyEventQuota,
+			DayEvents:         u.DayEvents,
+			DayBytes:          FormatBytes(u.DayBytes),
+			MonthEvents:       u.MonthEvents,
+			MonthBytes:        FormatBytes(u.MonthBytes),
+			DayPercent:        quotaPercent(u.DayEvents, k.DailyEventQuota),
+			MonthPercent:      quotaPercent(u.MonthEvents, k.MonthlyEventQuota),
+		})
+	}
+
+	data := getLayoutData(ctx, cfg, "settings", "Settings", "settings")
+	data.APIKeys = apiKeys
+	data.RouteTemplates = templateViews
+	data.SamplingRules = samplingViews
+	data.RedactionRules = redactionViews
+	data.DefaultIPPolicy = cfg.IPPolicy
+	data.GlobalRedaction = GlobalRedactionView{
+		Detectors: strings.Join(cfg.RedactDetectors, ", "),
+		DenyKeys:  strings.Join(cfg.RedactDenyKeys, ", "),
+		Routes:    cfg.RedactRouteReplacements,
+	}
+	data.KeyUsage = usageViews
+	data.InternalAPIKeyID = internalKeyID
+	data.NewAPIKey = newKey
+	populateProjectsForLayout(&data, db, cfg, ctx, "")
+	if newKey != nil {
+		ctx.Response.Header.Set("Cache-Control", "no-store")
+	}
+	renderLayout(ctx, data)
+}
+
+// quotaPercent returns used as a percentage of quota, or -1 without one.
+func quotaPercent(used, quota int64) int {
+	if quota <= 0 {
+		return -1
+	}
+	return int(used * 100 / quota)
 }
 
 func UsersPage(db *gorm.DB, cfg *config.Config) fasthttp.RequestHandler {
@@ -202,8 +422,37 @@ func UsersPage(db *gorm.DB, cfg *config.Config) fasthttp.RequestHandler {
 			return
 		}
 
+		var sessions []dbpkg.Session
+		if err := db.Preload("User").Where("expires_at > ?", time.Now()).Order("last_seen_at DESC").Find(&sessions).Error; err != nil {
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString("failed to load sessions")
+			return
+		}
+
 		data := getLayoutData(ctx, cfg, "users", "Users", "users")
 		data.Users = users
+
+		var currentID uint
+		if s, ok := httpctx.SessionFromCtx(ctx); ok && s != nil {
+			currentID = s.ID
+		}
+		data.Sessions = make([]SessionView, 0, len(sessions))
+		for _, s := range sessions {
+			if cfg.SessionIdleTimeout > 0 && time.Since(s.LastSeenAt) > cfg.SessionIdleTimeout {
+				continue
+			}
+			data.Sessions = append(data.Sessions, SessionView{
+				ID:         s.ID,
+				UserID:     s.UserID,
+				Username:   s.User.Username,
+				CreatedAt:  FormatEventDateTime(s.CreatedAt, data.TimeFormat, data.DateFormat),
+				LastSeenAt: FormatEventDateTime(s.LastSeenAt, data.TimeFormat, data.DateFormat),
+				ExpiresAt:  FormatEventDateTime(s.ExpiresAt, data.TimeFormat, data.DateFormat),
+				RemoteIP:   s.RemoteIP,
+				UserAgent:  s.UserAgent,
+				Current:    s.ID == currentID,
+			})
+		}
 		populateProjectsForLayout(&data, db, cfg, ctx, "")
 		renderLayout(ctx, data)
 	}
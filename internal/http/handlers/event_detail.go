@@ -9,6 +9,7 @@ import (
 	"gorm.io/gorm"
 
 	dbpkg "apiinsight/internal/db"
+	httpctx "apiinsight/internal/http/ctx"
 )
 
 func EventDetail(db *gorm.DB) fasthttp.RequestHandler {
@@ -48,7 +49,8 @@ func EventDetail(db *gorm.DB) fasthttp.RequestHandler {
 			return
 		}
 
-		if e.UserID != strconv.Itoa(int(user.ID)) {
+		scopedProject, scoped := httpctx.ProjectScopeFromCtx(ctx)
+		if e.UserID != strconv.Itoa(int(user.ID)) || (scoped && e.Project != scopedProject) {
 			ctx.SetStatusCode(fasthttp.StatusForbidden)
 			ctx.SetBodyString("forbidden")
 			return
@@ -71,13 +73,35 @@ func EventDetail(db *gorm.DB) fasthttp.RequestHandler {
 			"expires_at":         e.ExpiresAt,
 			"method":             e.Method,
 			"route":              e.Route,
+			"raw_path":           e.RawPath,
 			"status":             e.Status,
 			"duration_ms":        e.DurationMs,
 			"project":            e.Project,
 			"user_id":            e.UserID,
 			"remote_ip":          e.RemoteIP,
+			"request_bytes":      e.RequestBytes,
+			"response_bytes":     e.ResponseBytes,
+			"country":            e.Country,
+			"region":             e.Region,
+			"asn":                e.ASN,
+			"asn_org":            e.ASNOrg,
+			"user_agent":         e.UserAgent,
+			"browser":            e.Browser,
+			"browser_version":    e.BrowserVersion,
+			"os":                 e.OS,
+			"os_version":         e.OSVersion,
+			"device":             e.Device,
+			"app":                e.App,
+			"app_version":        e.AppVersion,
+			"is_bot":             e.IsBot,
+			"trace_id":           e.TraceID,
+			"span_id":            e.SpanID,
+			"parent_span_id":     e.ParentSpanID,
 			"attributes":         e.Attributes,
 		}
+		if e.TraceID != "" {
+			resp["trace_url"] = "/v1/metrics/trace/" + e.TraceID
+		}
 
 		ctx.SetContentType("application/json")
 		body, _ := json.Marshal(resp)
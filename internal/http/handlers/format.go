@@ -1,6 +1,9 @@
 package handlers
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
 
 // timeLayout returns the Go time layout for the given preference.
 // timeFormat: "12" or "24". Default "12".
@@ -42,3 +45,17 @@ func FormatEventDateTime(t time.Time, timeFormat, dateFormat string) string {
 	}
 	return t.Format(dateLayout(dateFormat) + " " + timeLayout(timeFormat))
 }
+
+// FormatBytes formats n with a binary unit (e.g. "1.5 MiB").
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"encoding/json"
+
+	"github.com/valyala/fasthttp"
+
+	"apiinsight/internal/ingest"
+)
+
+// IngestHealth reports the in-memory queue depth and, when the disk spool
+// is enabled, its size and replay lag.
+func IngestHealth(pipeline *ingest.Pipeline) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		body, err := json.Marshal(pipeline.Health())
+		if err != nil {
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString("failed to encode health")
+			return
+		}
+		ctx.SetStatusCode(fasthttp.StatusOK)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(body)
+	}
+}
@@ -2,22 +2,37 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/valyala/fasthttp"
 	"gorm.io/datatypes"
-	"gorm.io/gorm"
 
+	"apiinsight/internal/clientip"
 	"apiinsight/internal/config"
 	dbpkg "apiinsight/internal/db"
+	"apiinsight/internal/geoip"
 	httpctx "apiinsight/internal/http/ctx"
+	"apiinsight/internal/ingest"
+	"apiinsight/internal/ratelimit"
+	"apiinsight/internal/redact"
+	"apiinsight/internal/routes"
+	"apiinsight/internal/sampling"
+	"apiinsight/internal/useragent"
 )
 
 var (
 	requestsTotal          *prometheus.CounterVec
 	requestDurationBuckets *prometheus.HistogramVec
+	requestSizeBuckets     *prometheus.HistogramVec
+	responseSizeBuckets    *prometheus.HistogramVec
+	internalEventsDropped  *prometheus.CounterVec
+	redactionsTotal        *prometheus.CounterVec
 )
 
 func InitPrometheusMetrics() {
@@ -33,112 +48,513 @@ func InitPrometheusMetrics() {
 		prometheus.HistogramOpts{
 			Namespace: "apiinsight",
 			Name:      "request_duration_seconds",
-			Help:      "Histogram of ingested API request durations in seconds.",
+			Help:      "Histogram of ingested API request durations in seconds, per stored event (not weighted by sample_rate).",
 			Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2, 5},
 		},
 		[]string{"project", "route", "method"},
 	)
-	prometheus.MustRegister(requestsTotal, requestDurationBuckets)
+	requestSizeBuckets = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "apiinsight",
+			Name:      "request_size_bytes",
+			Help:      "Histogram of ingested API request sizes in bytes, for stored events that report one (not weighted by sample_rate).",
+			Buckets:   prometheus.ExponentialBuckets(128, 4, 9),
+		},
+		[]string{"project", "route", "method"},
+	)
+	responseSizeBuckets = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "apiinsight",
+			Name:      "response_size_bytes",
+			Help:      "Histogram of ingested API response sizes in bytes, for stored events that report one (not weighted by sample_rate).",
+			Buckets:   prometheus.ExponentialBuckets(128, 4, 9),
+		},
+		[]string{"project", "route", "method"},
+	)
+	internalEventsDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "apiinsight",
+			Name:      "internal_events_dropped_total",
+			Help:      "Self-reported request events that were not ingested, by reason.",
+		},
+		[]string{"reason"},
+	)
+	redactionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "apiinsight",
+			Name:      "redactions_total",
+			Help:      "Values redacted from stored events, by project and kind of match.",
+		},
+		[]string{"project", "kind"},
+	)
+	prometheus.MustRegister(requestsTotal, requestDurationBuckets, requestSizeBuckets, responseSizeBuckets,
+		internalEventsDropped, redactionsTotal)
 }
 
-type IngestEvent struct {
-	Timestamp  *time.Time     `json:"timestamp,omitempty"`
-	Path       string         `json:"path"`
-	Method     string         `json:"method,omitempty"`
-	Status     int            `json:"status,omitempty"`
-	UserID     string         `json:"user_id,omitempty"`
-	DurationMs int64          `json:"duration_ms"`
-	RemoteIP   string         `json:"remote_ip,omitempty"`
-	Attributes map[string]any `json:"attributes,omitempty"`
+type ingestRequest struct {
+	Events []ingest.Event `json:"events"`
 }
 
-type ingestRequest struct {
-	Events []IngestEvent `json:"events"`
+// rejectedEvent explains why the event at Index of the request was not
+// accepted. For NDJSON bodies Line is the 1-based line it was sent on.
+type rejectedEvent struct {
+	Index  int    `json:"index"`
+	Line   int    `json:"line,omitempty"`
+	Reason string `json:"reason"`
 }
 
-func IngestHandler(db *gorm.DB, cfg *config.Config) fasthttp.RequestHandler {
-	return func(ctx *fasthttp.RequestCtx) {
-		var payload ingestRequest
-		if err := json.Unmarshal(ctx.PostBody(), &payload); err != nil {
-			ctx.SetStatusCode(fasthttp.StatusBadRequest)
-			ctx.SetBodyString("invalid JSON body")
-			return
+// ingestResponse is the body of every /v1/events response that got past
+// JSON decoding. Status is "accepted", "partial" or "rejected"; Count
+// mirrors Accepted for older clients.
+type ingestResponse struct {
+	Status   string          `json:"status"`
+	Accepted int             `json:"accepted"`
+	Count    int             `json:"count"`
+	Rejected []rejectedEvent `json:"rejected"`
+
+	// SampledOut counts accepted events not stored because of a
+	// server-side sampling rule.
+	SampledOut int `json:"sampled_out,omitempty"`
+}
+
+func writeIngestResponse(ctx *fasthttp.RequestCtx, code int, resp ingestResponse) {
+	resp.Count = resp.Accepted
+	if resp.Rejected == nil {
+		resp.Rejected = []rejectedEvent{}
+	}
+	body, _ := json.Marshal(resp)
+	ctx.SetStatusCode(code)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(body)
+}
+
+// ObserveEvents records stored events in the Prometheus collectors. It is
+// the pipeline's OnStored callback, so retried events that were dropped as
+// duplicates are not counted again.
+func ObserveEvents(events []dbpkg.Event) {
+	for i := range events {
+		observeEvent(&events[i])
+	}
+}
+
+// observeEvent records an event in the Prometheus collectors. The request
+// counter is weighted by the number of requests the event stands for; the
+// histograms have no weighted observe and count each event once.
+func observeEvent(e *dbpkg.Event) {
+	requestsTotal.WithLabelValues(e.Project, e.Route, e.Method, strconv.Itoa(e.Status)).Add(e.Weight())
+	requestDurationBuckets.WithLabelValues(e.Project, e.Route, e.Method).Observe(float64(e.DurationMs) / 1000.0)
+	if e.RequestBytes > 0 {
+		requestSizeBuckets.WithLabelValues(e.Project, e.Route, e.Method).Observe(float64(e.RequestBytes))
+	}
+	if e.ResponseBytes > 0 {
+		responseSizeBuckets.WithLabelValues(e.Project, e.Route, e.Method).Observe(float64(e.ResponseBytes))
+	}
+}
+
+// eventIngester turns decoded wire events into rows and enqueues them. It
+// is shared by every ingest endpoint so validation, route normalization,
+// redaction, enrichment and retention work the same regardless of the wire
+// format.
+type eventIngester struct {
+	pipeline   *ingest.Pipeline
+	cfg        *config.Config
+	templates  *routes.Cache
+	normalizer routes.Normalizer
+	validator  *ingest.Validator
+	limiter    *ratelimit.Limiter
+	sampling   *sampling.Cache
+	redaction  *redact.Cache
+	anonymizer *clientip.Anonymizer
+	geoip      *geoip.Resolver
+}
+
+func newEventIngester(pipeline *ingest.Pipeline, cfg *config.Config, templates *routes.Cache, limiter *ratelimit.Limiter, samplingRules *sampling.Cache, redaction *redact.Cache, geo *geoip.Resolver) *eventIngester {
+	return &eventIngester{
+		pipeline:   pipeline,
+		cfg:        cfg,
+		templates:  templates,
+		limiter:    limiter,
+		sampling:   samplingRules,
+		redaction:  redaction,
+		anonymizer: clientip.NewAnonymizer(cfg.IPHashKey),
+		geoip:      geo,
+		normalizer: routes.Normalizer{AutoDetect: cfg.RouteAutoDetect},
+		validator: ingest.NewValidator(ingest.Limits{
+			MaxAge:            cfg.IngestMaxEventAge,
+			MaxClockSkew:      cfg.IngestMaxClockSkew,
+			MaxAttributes:     cfg.IngestMaxAttributes,
+			MaxAttributeBytes: cfg.IngestMaxAttributeBytes,
+			MaxAttributeDepth: cfg.IngestMaxAttributeDepth,
+		}),
+	}
+}
+
+// ingestResult summarizes what accept did with a batch. Refused is set
+// when nothing was enqueued because no event was valid or because the key
+// is in strict mode and at least one event was invalid. Accepted counts
+// valid events including the SampledOut ones dropped by sampling rules.
+// Limit is the rate limit state of the key, if it was checked.
+type ingestResult struct {
+	Accepted   int
+	SampledOut int
+	Rejected   []rejectedEvent
+	Refused    bool
+	Limit      *ratelimit.Decision
+}
+
+// accept validates, normalizes and enqueues events for ak, which is nil
+// for events not tied to a key. invalid maps the index of each event that
+// already failed decoding to the reason to report for it. size is the
+// request body size counted against the key's bytes-per-second limit.
+// The returned error is a pipeline error or *ratelimit.ExceededError (see
+// writeEnqueueError), or a failure to load the key's route templates,
+// sampling or redaction rules or usage.
+func (in *eventIngester) accept(ak *dbpkg.APIKey, events []ingest.Event, invalid map[int]string, size int) (ingestResult, error) {
+	now := time.Now()
+	retentionDays := in.cfg.RetentionDays
+	ownerUserID := ""
+	project := ""
+	strict := false
+	ipPolicy := in.cfg.IPPolicy
+	var routeTemplates []routes.Template
+	var samplingRules []sampling.Rule
+	redactor := in.redaction.Global()
+	if ak != nil {
+		if ak.RetentionDays > 0 {
+			retentionDays = ak.RetentionDays
 		}
-		if len(payload.Events) == 0 {
-			ctx.SetStatusCode(fasthttp.StatusBadRequest)
-			ctx.SetBodyString("no events provided")
-			return
+		ownerUserID = strconv.Itoa(int(ak.UserID))
+		project = ak.Name
+		strict = ak.StrictValidation
+		if ak.IPPolicy != "" {
+			ipPolicy = ak.IPPolicy
+		}
+
+		t, err := in.templates.Templates(ak.ID)
+		if err != nil {
+			return ingestResult{}, fmt.Errorf("load route templates: %w", err)
 		}
+		routeTemplates = t
 
-		now := time.Now()
-		retentionDays := cfg.RetentionDays
-		ownerUserID := ""
-		project := ""
-		if ak, ok := httpctx.APIKeyFromCtx(ctx); ok && ak != nil {
-			if ak.RetentionDays > 0 {
-				retentionDays = ak.RetentionDays
+		if in.sampling != nil {
+			r, err := in.sampling.Rules(ak.ID)
+			if err != nil {
+				return ingestResult{}, fmt.Errorf("load sampling rules: %w", err)
 			}
-			ownerUserID = strconv.Itoa(int(ak.UserID))
-			project = ak.Name
+			samplingRules = r
 		}
 
-		records := make([]dbpkg.Event, 0, len(payload.Events))
+		r, err := in.redaction.Redactor(ak.ID)
+		if err != nil {
+			return ingestResult{}, fmt.Errorf("load redaction rules: %w", err)
+		}
+		redactor = r
+	}
 
-		for _, ev := range payload.Events {
-			if ev.Path == "" {
-				continue
-			}
+	records := make([]dbpkg.Event, 0, len(events))
+	var rejected []rejectedEvent
+	sampledOut := 0
+	var redacted redact.Counts
 
-			createdAt := now
-			if ev.Timestamp != nil {
-				createdAt = *ev.Timestamp
+	for i := range events {
+		ev := &events[i]
+		reason, ok := invalid[i]
+		if !ok {
+			reason = in.validator.Validate(ev, now)
+		}
+		if reason != "" {
+			rejected = append(rejected, rejectedEvent{Index: i, Reason: reason})
+			continue
+		}
+
+		createdAt := now
+		if ev.Timestamp != nil {
+			createdAt = *ev.Timestamp
+		}
+
+		// Sources that already know the route template (e.g. OTel's
+		// http.route) skip normalization.
+		route, params := ev.Route, map[string]string(nil)
+		if route == "" {
+			route, params = in.normalizer.Normalize(ev.Path, routeTemplates)
+		}
+		var counts redact.Counts
+		route = redactor.Route(route, &counts)
+
+		sampleRate := ev.SampleRate
+		if sampleRate == 0 {
+			sampleRate = 1
+		}
+		if rate := sampling.Rate(samplingRules, route); rate < 1 {
+			if !sampling.Keep(rate) {
+				sampledOut++
+				continue
 			}
+			// Bound the weight of events sampled by both sides.
+			sampleRate = max(sampleRate*rate, sampling.MinRate)
+		}
 
-			attrs := datatypes.JSONMap{}
-			for k, v := range ev.Attributes {
+		attrs := datatypes.JSONMap{}
+		for k, v := range ev.Attributes {
+			attrs[k] = v
+		}
+		for k, v := range routes.ParamAttributes(params) {
+			if _, exists := attrs[k]; !exists {
 				attrs[k] = v
 			}
+		}
+		redactor.Attributes(attrs, &counts)
+		redacted.Add(counts)
 
-			var expiresAt *time.Time
-			if retentionDays > 0 {
-				t := createdAt.Add(time.Duration(retentionDays) * 24 * time.Hour)
-				expiresAt = &t
-			}
+		var expiresAt *time.Time
+		if retentionDays > 0 {
+			t := createdAt.Add(time.Duration(retentionDays) * 24 * time.Hour)
+			expiresAt = &t
+		}
 
-			rec := dbpkg.Event{
-				CreatedAt:  createdAt,
-				ExpiresAt:  expiresAt,
-				UserID:     ownerUserID,
-				Project:    project,
-				Route:      ev.Path,
-				Method:     ev.Method,
-				Status:     ev.Status,
-				DurationMs: ev.DurationMs,
-				RemoteIP:   ev.RemoteIP,
-				Attributes: attrs,
-			}
-			records = append(records, rec)
+		// Look the client up before the IP policy anonymizes the address.
+		geo := in.geoip.Lookup(clientip.Normalize(ev.RemoteIP))
+		ua := useragent.Parse(ev.UserAgent)
+		userAgent := ev.UserAgent
+		if len(userAgent) > ingest.MaxUserAgentLength {
+			userAgent = strings.ToValidUTF8(userAgent[:ingest.MaxUserAgentLength], "")
+		}
+
+		rec := dbpkg.Event{
+			CreatedAt:  createdAt,
+			ExpiresAt:  expiresAt,
+			UserID:     ownerUserID,
+			Project:    project,
+			Route:      route,
+			RawPath:    redactor.String(ev.Path, &redacted),
+			Method:     ev.Method,
+			Status:     ev.Status,
+			DurationMs: ev.DurationMs,
+			RemoteIP:   in.anonymizer.Apply(ipPolicy, ev.RemoteIP),
+
+			RequestBytes:  ev.RequestBytes,
+			ResponseBytes: ev.ResponseBytes,
+
+			TraceID:      ev.TraceID,
+			SpanID:       ev.SpanID,
+			ParentSpanID: ev.ParentSpanID,
+
+			Country: geo.Country,
+			Region:  geo.Region,
+			ASN:     geo.ASN,
+			ASNOrg:  geo.ASNOrg,
+
+			UserAgent:      redactor.UserAgent(userAgent, &redacted),
+			Browser:        ua.Browser,
+			BrowserVersion: ua.BrowserVersion,
+			OS:             ua.OS,
+			OSVersion:      ua.OSVersion,
+			Device:         ua.Device,
+			App:            ua.App,
+			AppVersion:     ua.AppVersion,
+			IsBot:          ua.Bot,
+
+			SampleRate: sampleRate,
+			Attributes: attrs,
+		}
+		if ev.EventID != "" {
+			id := ev.EventID
+			rec.EventID = &id
+		}
+		records = append(records, rec)
+	}
+
+	if len(records)+sampledOut == 0 || (strict && len(rejected) > 0) {
+		return ingestResult{Rejected: rejected, Refused: true}, nil
+	}
+	if len(records) == 0 {
+		return ingestResult{Accepted: sampledOut, SampledOut: sampledOut, Rejected: rejected}, nil
+	}
 
-			labels := []string{project, ev.Path, ev.Method, strconv.Itoa(ev.Status)}
-			requestsTotal.WithLabelValues(labels...).Inc()
-			requestDurationBuckets.WithLabelValues(project, ev.Path, ev.Method).
-				Observe(float64(ev.DurationMs) / 1000.0)
+	var limit *ratelimit.Decision
+	if in.limiter != nil && ak != nil {
+		d, err := in.limiter.Allow(ak.ID, ak.Limits(), len(records), size, now)
+		if err != nil {
+			return ingestResult{}, fmt.Errorf("load usage: %w", err)
+		}
+		if !d.Allowed {
+			return ingestResult{}, &ratelimit.ExceededError{Decision: d}
 		}
+		limit = &d
+	}
+
+	if err := in.pipeline.Enqueue(records); err != nil {
+		if limit != nil {
+			in.limiter.Release(ak.ID, limit.Limits, len(records), size, now)
+		}
+		return ingestResult{}, err
+	}
+	if limit != nil {
+		in.limiter.Record(ak.ID, len(records), size, now)
+	}
+	redacted.Each(func(k redact.Kind, n int) {
+		redactionsTotal.WithLabelValues(project, k.String()).Add(float64(n))
+	})
+	return ingestResult{Accepted: len(records) + sampledOut, SampledOut: sampledOut, Rejected: rejected, Limit: limit}, nil
+}
+
+// requestAPIKey returns the key BearerAuth stored on ctx, or nil.
+func requestAPIKey(ctx *fasthttp.RequestCtx) *dbpkg.APIKey {
+	ak, _ := httpctx.APIKeyFromCtx(ctx)
+	return ak
+}
+
+// readIngestBody returns the decompressed request body, or writes an
+// error response and returns false.
+func (in *eventIngester) readIngestBody(ctx *fasthttp.RequestCtx) ([]byte, bool) {
+	body, err := ingest.ReadBody(ctx.PostBody(), string(ctx.Request.Header.ContentEncoding()), in.cfg.IngestMaxBodyBytes)
+	if err != nil {
+		writeBodyError(ctx, err)
+		return nil, false
+	}
+	return body, true
+}
+
+// writeBodyError answers a request whose body could not be decompressed.
+func writeBodyError(ctx *fasthttp.RequestCtx, err error) {
+	switch {
+	case errors.Is(err, ingest.ErrBodyTooLarge):
+		ctx.SetStatusCode(fasthttp.StatusRequestEntityTooLarge)
+		ctx.SetBodyString("request body exceeds the decompressed size limit")
+	case errors.Is(err, ingest.ErrUnsupportedEncoding):
+		ctx.SetStatusCode(fasthttp.StatusUnsupportedMediaType)
+		ctx.SetBodyString("content encoding must be gzip, zstd or identity")
+	default:
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(err.Error())
+	}
+}
+
+// isNDJSON reports whether the request declares a newline-delimited body.
+func isNDJSON(ctx *fasthttp.RequestCtx) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.SplitN(string(ctx.Request.Header.ContentType()), ";", 2)[0]))
+	return mediaType == "application/x-ndjson" || mediaType == "application/ndjson"
+}
+
+// setRateLimitHeaders reports the key's limits and what is left of them.
+func setRateLimitHeaders(ctx *fasthttp.RequestCtx, d *ratelimit.Decision) {
+	if d == nil {
+		return
+	}
+	h := &ctx.Response.Header
+	if d.Limits.EventsPerSecond > 0 {
+		h.Set("X-RateLimit-Limit", strconv.Itoa(d.Limits.EventsPerSecond))
+		h.Set("X-RateLimit-Remaining", strconv.FormatInt(d.Remaining, 10))
+		h.Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(d.Reset)))
+	}
+	if d.Limits.DailyEvents > 0 {
+		h.Set("X-RateLimit-Daily-Limit", strconv.FormatInt(d.Limits.DailyEvents, 10))
+		h.Set("X-RateLimit-Daily-Remaining", strconv.FormatInt(d.DailyRemaining, 10))
+	}
+	if d.Limits.MonthlyEvents > 0 {
+		h.Set("X-RateLimit-Monthly-Limit", strconv.FormatInt(d.Limits.MonthlyEvents, 10))
+		h.Set("X-RateLimit-Monthly-Remaining", strconv.FormatInt(d.MonthlyRemaining, 10))
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
 
-		if len(records) == 0 {
+// writeEnqueueError answers a failed accept: 429 with Retry-After when the
+// queue is full or the key is over its limits, 503 during shutdown and 500
+// otherwise.
+func writeEnqueueError(ctx *fasthttp.RequestCtx, err error) {
+	var exceeded *ratelimit.ExceededError
+	switch {
+	case errors.As(err, &exceeded):
+		d := exceeded.Decision
+		setRateLimitHeaders(ctx, &d)
+		ctx.Response.Header.Set("Retry-After", strconv.Itoa(max(ceilSeconds(d.RetryAfter), 1)))
+		ctx.SetStatusCode(fasthttp.StatusTooManyRequests)
+		ctx.SetBodyString("rate limit exceeded: " + d.Reason)
+	case errors.Is(err, ingest.ErrQueueFull):
+		ctx.Response.Header.Set("Retry-After", "1")
+		ctx.SetStatusCode(fasthttp.StatusTooManyRequests)
+		ctx.SetBodyString("ingest queue is full, retry later")
+	case errors.Is(err, ingest.ErrClosed):
+		ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+		ctx.SetBodyString("ingest is shutting down")
+	default:
+		log.Printf("ingest: failed to accept events: %v", err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString("failed to store events")
+	}
+}
+
+// IngestHandler validates and normalizes a batch of events and hands it to
+// the asynchronous ingest pipeline. The body is either a JSON document with
+// an events array or, with Content-Type application/x-ndjson, one event per
+// line; both may be gzip or zstd compressed. A 202 response means the valid
+// events are queued and lists the index (and NDJSON line) and reason of
+// every rejected one; keys in strict mode get 400 and nothing is accepted
+// if any event is invalid. When the queue is full or the key exceeds its
+// rate limits or quotas the client gets 429 with Retry-After.
+func IngestHandler(pipeline *ingest.Pipeline, cfg *config.Config, templates *routes.Cache, limiter *ratelimit.Limiter, samplingRules *sampling.Cache, redaction *redact.Cache, geo *geoip.Resolver) fasthttp.RequestHandler {
+	ingester := newEventIngester(pipeline, cfg, templates, limiter, samplingRules, redaction, geo)
+	return func(ctx *fasthttp.RequestCtx) {
+		var (
+			events  []ingest.Event
+			invalid map[int]string
+			lines   []int
+		)
+		if isNDJSON(ctx) {
+			r, err := ingest.NewBodyReader(ctx.PostBody(), string(ctx.Request.Header.ContentEncoding()), cfg.IngestMaxBodyBytes)
+			if err != nil {
+				writeBodyError(ctx, err)
+				return
+			}
+			batch, err := ingest.DecodeNDJSON(r)
+			r.Close()
+			if err != nil {
+				writeBodyError(ctx, err)
+				return
+			}
+			events, invalid, lines = batch.Events, batch.Invalid, batch.Lines
+		} else {
+			body, ok := ingester.readIngestBody(ctx)
+			if !ok {
+				return
+			}
+			var payload ingestRequest
+			if err := json.Unmarshal(body, &payload); err != nil {
+				ctx.SetStatusCode(fasthttp.StatusBadRequest)
+				ctx.SetBodyString("invalid JSON body")
+				return
+			}
+			events = payload.Events
+		}
+		if len(events) == 0 {
 			ctx.SetStatusCode(fasthttp.StatusBadRequest)
-			ctx.SetBodyString("no valid events after validation")
+			ctx.SetBodyString("no events provided")
 			return
 		}
 
-		if err := db.Create(&records).Error; err != nil {
-			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
-			ctx.SetBodyString("failed to persist events")
+		res, err := ingester.accept(requestAPIKey(ctx), events, invalid, len(ctx.PostBody()))
+		if err != nil {
+			writeEnqueueError(ctx, err)
+			return
+		}
+		setRateLimitHeaders(ctx, res.Limit)
+		if lines != nil {
+			for i := range res.Rejected {
+				res.Rejected[i].Line = lines[res.Rejected[i].Index]
+			}
+		}
+		if res.Refused {
+			writeIngestResponse(ctx, fasthttp.StatusBadRequest, ingestResponse{Status: "rejected", Rejected: res.Rejected})
 			return
 		}
 
-		ctx.SetStatusCode(fasthttp.StatusAccepted)
-		ctx.SetContentType("application/json")
-		ctx.SetBodyString(`{"status":"accepted","count":` + strconv.Itoa(len(records)) + `}`)
+		status := "accepted"
+		if len(res.Rejected) > 0 {
+			status = "partial"
+		}
+		writeIngestResponse(ctx, fasthttp.StatusAccepted, ingestResponse{Status: status, Accepted: res.Accepted, Rejected: res.Rejected, SampledOut: res.SampledOut})
 	}
 }
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/valyala/fasthttp"
+
+	"apiinsight/internal/config"
+	dbpkg "apiinsight/internal/db"
+	"apiinsight/internal/ingest"
+	"apiinsight/internal/redact"
+)
+
+var testMetricsOnce sync.Once
+
+// ingestEvents posts events to IngestHandler with the default redaction
+// detectors enabled and returns the stored rows.
+func ingestEvents(t *testing.T, events []ingest.Event) []dbpkg.Event {
+	t.Helper()
+	testMetricsOnce.Do(InitPrometheusMetrics)
+
+	store, err := dbpkg.OpenSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if _, err := store.MigrateUp(0); err != nil {
+		t.Fatal(err)
+	}
+	pipeline := ingest.NewPipeline(store, ingest.Options{FlushInterval: 10 * time.Millisecond})
+	redaction := redact.NewCache(redact.Rules{Detectors: redact.Detectors}, nil, time.Minute)
+	handler := IngestHandler(pipeline, config.Load(), nil, nil, nil, redaction, nil)
+
+	body, err := json.Marshal(ingestRequest{Events: events})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+	ctx.Request.Header.SetContentType("application/json")
+	ctx.Request.SetBody(body)
+	handler(&ctx)
+	if code := ctx.Response.StatusCode(); code != fasthttp.StatusAccepted {
+		t.Fatalf("status %d: %s", code, ctx.Response.Body())
+	}
+	if err := pipeline.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored []dbpkg.Event
+	if err := store.DB().Order("id").Find(&stored).Error; err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+// redactionCount returns the sum of apiinsight_redactions_total.
+func redactionCount(t *testing.T) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n float64
+	for _, f := range families {
+		if f.GetName() == "apiinsight_redactions_total" {
+			for _, m := range f.GetMetric() {
+				n += m.GetCounter().GetValue()
+			}
+		}
+	}
+	return n
+}
+
+func TestIngestKeepsUserAgent(t *testing.T) {
+	agents := []string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+		"ExampleBot/2.1 (+https://example.com/bot; ops@example.com)",
+	}
+	before := redactionCount(t)
+
+	var events []ingest.Event
+	for _, ua := range agents {
+		events = append(events, ingest.Event{Path: "/users", UserAgent: ua})
+	}
+	stored := ingestEvents(t, events)
+	if len(stored) != len(agents) {
+		t.Fatalf("stored %d events, want %d", len(stored), len(agents))
+	}
+	for i, ua := range agents {
+		if stored[i].UserAgent != ua {
+			t.Errorf("UserAgent = %q, want %q unchanged", stored[i].UserAgent, ua)
+		}
+	}
+	if stored[0].Browser != "Chrome" {
+		t.Errorf("Browser = %q, want Chrome", stored[0].Browser)
+	}
+	if n := redactionCount(t) - before; n != 0 {
+		t.Errorf("redactions_total grew by %g, want 0", n)
+	}
+}
@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"apiinsight/internal/config"
+	dbpkg "apiinsight/internal/db"
+	"apiinsight/internal/geoip"
+	"apiinsight/internal/ingest"
+	"apiinsight/internal/ratelimit"
+	"apiinsight/internal/redact"
+	"apiinsight/internal/routes"
+	"apiinsight/internal/sampling"
+)
+
+// internalKeyTTL is how long the internal API key's settings (retention,
+// strict mode, active flag) are cached before being reloaded.
+const internalKeyTTL = time.Minute
+
+// InternalSink feeds this instance's own requests into the ingest pipeline
+// without an HTTP round trip. Events are validated, normalized and counted
+// exactly like those posted to /v1/events with the internal API key.
+// Report never blocks; events are handed to the pipeline in batches by a
+// background goroutine and dropped (and counted) when the sink falls behind.
+type InternalSink struct {
+	db       *gorm.DB
+	token    string
+	ingester *eventIngester
+
+	events    chan ingest.Event
+	batchSize int
+	interval  time.Duration
+	done      chan struct{}
+	closeOnce sync.Once
+
+	key       *dbpkg.APIKey
+	keyLoaded time.Time
+}
+
+// NewInternalSink starts a sink reporting with cfg.InternalAPIKey. It
+// returns nil when internal reporting is disabled.
+func NewInternalSink(db *gorm.DB, pipeline *ingest.Pipeline, cfg *config.Config, templates *routes.Cache, limiter *ratelimit.Limiter, samplingRules *sampling.Cache, redaction *redact.Cache, geo *geoip.Resolver) *InternalSink {
+	if cfg.InternalAPIKey == "" {
+		return nil
+	}
+	s := &InternalSink{
+		db:        db,
+		token:     cfg.InternalAPIKey,
+		ingester:  newEventIngester(pipeline, cfg, templates, limiter, samplingRules, redaction, geo),
+		events:    make(chan ingest.Event, cfg.IngestBatchSize*4),
+		batchSize: cfg.IngestBatchSize,
+		interval:  cfg.IngestFlushInterval,
+		done:      make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Report queues ev. It is a no-op on a nil sink.
+func (s *InternalSink) Report(ev ingest.Event) {
+	if s == nil {
+		return
+	}
+	select {
+	case s.events <- ev:
+	default:
+		internalEventsDropped.WithLabelValues("queue_full").Inc()
+	}
+}
+
+// Close hands the queued events to the pipeline and stops the sink. The
+// caller must not call Report afterwards; the pipeline should be closed
+// after the sink so these events are drained too.
+func (s *InternalSink) Close(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	s.closeOnce.Do(func() { close(s.events) })
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *InternalSink) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	batch := make([]ingest.Event, 0, s.batchSize)
+	for {
+		select {
+		case ev, ok := <-s.events:
+			if !ok {
+				s.flush(batch)
+				return
+			}
+			batch = append(batch, ev)
+			if len(batch) >= s.batchSize {
+				s.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			s.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (s *InternalSink) flush(batch []ingest.Event) {
+	if len(batch) == 0 {
+		return
+	}
+	ak, err := s.apiKey()
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			// Deactivated or deleted in Settings: reporting is paused.
+			internalEventsDropped.WithLabelValues("inactive_key").Add(float64(len(batch)))
+			return
+		}
+		log.Printf("internal reporting: load API key: %v", err)
+		internalEventsDropped.WithLabelValues("error").Add(float64(len(batch)))
+		return
+	}
+
+	res, err := s.ingester.accept(ak, batch, nil, 0)
+	var exceeded *ratelimit.ExceededError
+	if errors.As(err, &exceeded) {
+		internalEventsDropped.WithLabelValues("rate_limited").Add(float64(len(batch)))
+		return
+	}
+	if err != nil {
+		log.Printf("internal reporting: %d events dropped: %v", len(batch), err)
+		internalEventsDropped.WithLabelValues("error").Add(float64(len(batch)))
+		return
+	}
+	if res.Refused {
+		internalEventsDropped.WithLabelValues("rejected").Add(float64(len(batch)))
+	} else if len(res.Rejected) > 0 {
+		internalEventsDropped.WithLabelValues("rejected").Add(float64(len(res.Rejected)))
+	}
+}
+
+// apiKey returns the internal key, reloading it every internalKeyTTL. Only
+// the run goroutine calls it.
+func (s *InternalSink) apiKey() (*dbpkg.APIKey, error) {
+	if s.key != nil && time.Since(s.keyLoaded) < internalKeyTTL {
+		return s.key, nil
+	}
+	ak, err := dbpkg.FindActiveAPIKey(s.db, s.token)
+	if err == nil && !ak.HasScope(dbpkg.ScopeIngest) {
+		err = gorm.ErrRecordNotFound
+	}
+	if err != nil {
+		s.key = nil
+		return nil, err
+	}
+	s.key, s.keyLoaded = ak, time.Now()
+	return ak, nil
+}
@@ -11,6 +11,7 @@ import (
 	"gorm.io/gorm"
 
 	dbpkg "apiinsight/internal/db"
+	httpctx "apiinsight/internal/http/ctx"
 )
 
 var safeAttrKey = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
@@ -39,6 +40,15 @@ func parseRange(ctx *fasthttp.RequestCtx) (cutoff time.Time, bucket30Min bool) {
 	return cutoff, false
 }
 
+// projectFilter returns the project metrics should be restricted to. A
+// project-scoped API key always wins over the "project" query parameter.
+func projectFilter(ctx *fasthttp.RequestCtx) string {
+	if p, ok := httpctx.ProjectScopeFromCtx(ctx); ok {
+		return p
+	}
+	return string(ctx.QueryArgs().Peek("project"))
+}
+
 // RequestLogger returns fasthttp middleware that logs method, path, status, duration.
 func RequestLogger(next fasthttp.RequestHandler) fasthttp.RequestHandler {
 	return func(ctx *fasthttp.RequestCtx) {
@@ -75,79 +85,56 @@ type topRoute struct {
 	Statuses []statusCount `json:"statuses,omitempty" gorm:"-"`
 }
 
-func applyMetricsFilters(q *gorm.DB, status, attrKey, attrValue string) *gorm.DB {
-	switch status {
-	case "success":
-		q = q.Where("status < ?", 400)
-	case "error":
-		q = q.Where("status >= ?", 400)
+// eventFilter returns the filter for the query parameters shared by the
+// metrics endpoints (project, status, route, attr_key/attr_value and bots),
+// covering events since the given cutoff. bots is "exclude" to drop events
+// from bots and crawlers or "only" to keep just those. Attribute keys
+// outside safeAttrKey are ignored.
+func eventFilter(ctx *fasthttp.RequestCtx, user *dbpkg.User, since time.Time) dbpkg.EventFilter {
+	f := dbpkg.EventFilter{
+		UserID:  strconv.Itoa(int(user.ID)),
+		Project: projectFilter(ctx),
+		Since:   since,
+		Status:  string(ctx.QueryArgs().Peek("status")),
+		Route:   string(ctx.QueryArgs().Peek("route")),
+		Bots:    string(ctx.QueryArgs().Peek("bots")),
 	}
-	if attrKey != "" && attrValue != "" && safeAttrKey.MatchString(attrKey) {
-		q = q.Where("attributes::jsonb ->> ? = ?", attrKey, attrValue)
+	if attrKey := string(ctx.QueryArgs().Peek("attr_key")); safeAttrKey.MatchString(attrKey) {
+		f.AttrKey = attrKey
+		f.AttrValue = string(ctx.QueryArgs().Peek("attr_value"))
 	}
-	return q
+	return f
 }
 
-func TrafficSeries(db *gorm.DB) fasthttp.RequestHandler {
+func TrafficSeries(store dbpkg.Store) fasthttp.RequestHandler {
 	return func(ctx *fasthttp.RequestCtx) {
 		user, ok := MustUser(ctx)
 		if !ok {
 			return
 		}
-		project := string(ctx.QueryArgs().Peek("project"))
+		// Bucket by 30 min for short ranges, else 1 hour.
 		cutoff, bucket30Min := parseRange(ctx)
-		status := string(ctx.QueryArgs().Peek("status"))
-		attrKey := string(ctx.QueryArgs().Peek("attr_key"))
-		attrValue := string(ctx.QueryArgs().Peek("attr_value"))
-
-		// Use Raw so GROUP BY is never parameterized. Bucket by 30 min for short ranges, else 1 hour.
-		var bucketExpr string
-		if bucket30Min {
-			bucketExpr = `to_char(to_timestamp(floor(extract(epoch from created_at) / 1800) * 1800), 'YYYY-MM-DD"T"HH24:MI:SS') || 'Z'`
-		} else {
-			bucketExpr = `to_char(date_trunc('hour', created_at), 'YYYY-MM-DD"T"HH24:MI:SS') || 'Z'`
-		}
-		sql := `SELECT ` + bucketExpr + ` AS bucket, count(*) AS count FROM events WHERE user_id = ? AND created_at >= ?`
-		args := []any{strconv.Itoa(int(user.ID)), cutoff}
-		if project != "" {
-			sql += ` AND project = ?`
-			args = append(args, project)
-		}
-		if status == "success" {
-			sql += ` AND status < 400`
-		} else if status == "error" {
-			sql += ` AND status >= 400`
-		}
-		if attrKey != "" && attrValue != "" && safeAttrKey.MatchString(attrKey) {
-			sql += ` AND attributes::jsonb ->> ? = ?`
-			args = append(args, attrKey, attrValue)
-		}
-		if bucket30Min {
-			sql += ` GROUP BY floor(extract(epoch from created_at) / 1800) ORDER BY 1`
-		} else {
-			sql += ` GROUP BY date_trunc('hour', created_at) ORDER BY 1`
-		}
 
-		var rows []trafficPoint
-		if err := db.Raw(sql, args...).Scan(&rows).Error; err != nil {
+		points, err := store.TrafficSeries(eventFilter(ctx, user, cutoff), bucket30Min)
+		if err != nil {
 			errResponse(ctx, fasthttp.StatusInternalServerError, "failed to query metrics")
 			return
 		}
+		rows := make([]trafficPoint, 0, len(points))
+		for _, p := range points {
+			rows = append(rows, trafficPoint{Bucket: p.Bucket, Count: p.Count})
+		}
 		jsonResponse(ctx, map[string]any{"series": rows})
 	}
 }
 
-func TopRoutes(db *gorm.DB) fasthttp.RequestHandler {
+func TopRoutes(store dbpkg.Store) fasthttp.RequestHandler {
 	return func(ctx *fasthttp.RequestCtx) {
 		user, ok := MustUser(ctx)
 		if !ok {
 			return
 		}
-		project := string(ctx.QueryArgs().Peek("project"))
 		cutoff, _ := parseRange(ctx)
-		status := string(ctx.QueryArgs().Peek("status"))
-		attrKey := string(ctx.QueryArgs().Peek("attr_key"))
-		attrValue := string(ctx.QueryArgs().Peek("attr_value"))
 
 		limit := 10
 		if s := string(ctx.QueryArgs().Peek("limit")); s != "" {
@@ -165,69 +152,19 @@ func TopRoutes(db *gorm.DB) fasthttp.RequestHandler {
 			}
 		}
 
-		q := db.Model(&dbpkg.Event{}).
-			Where("user_id = ?", strconv.Itoa(int(user.ID))).
-			Where("created_at >= ?", cutoff)
-		if project != "" {
-			q = q.Where("project = ?", project)
-		}
-		q = applyMetricsFilters(q, status, attrKey, attrValue)
-
-		var totalCount int64
-		if err := q.Select("COUNT(DISTINCT route)").Scan(&totalCount).Error; err != nil {
-			errResponse(ctx, fasthttp.StatusInternalServerError, "failed to count routes")
-			return
-		}
-
-		var rows []topRoute
-		if err := q.
-			Select("route as route, count(*) as count").
-			Group("route").
-			Order("count(*) DESC").
-			Limit(limit).
-			Offset(offset).
-			Scan(&rows).Error; err != nil {
+		routes, totalCount, err := store.TopRoutes(eventFilter(ctx, user, cutoff), limit, offset)
+		if err != nil {
 			errResponse(ctx, fasthttp.StatusInternalServerError, "failed to query top routes")
 			return
 		}
 
-		if len(rows) > 0 {
-			routeNames := make([]string, 0, len(rows))
-			for _, row := range rows {
-				if row.Route != "" {
-					routeNames = append(routeNames, row.Route)
-				}
-			}
-			if len(routeNames) > 0 {
-				type scRow struct {
-					Route  string
-					Status int
-					Count  int64
-				}
-				var scRows []scRow
-				qs := db.Model(&dbpkg.Event{}).
-					Where("user_id = ?", strconv.Itoa(int(user.ID))).
-					Where("created_at >= ?", cutoff)
-				if project != "" {
-					qs = qs.Where("project = ?", project)
-				}
-				qs = applyMetricsFilters(qs, status, attrKey, attrValue)
-				if err := qs.
-					Where("route IN ?", routeNames).
-					Select("route as route, status as status, count(*) as count").
-					Group("route, status").
-					Scan(&scRows).Error; err != nil {
-					errResponse(ctx, fasthttp.StatusInternalServerError, "failed to query route status breakdown")
-					return
-				}
-				byRoute := make(map[string][]statusCount, len(routeNames))
-				for _, sc := range scRows {
-					byRoute[sc.Route] = append(byRoute[sc.Route], statusCount{Status: sc.Status, Count: sc.Count})
-				}
-				for i := range rows {
-					rows[i].Statuses = byRoute[rows[i].Route]
-				}
+		rows := make([]topRoute, 0, len(routes))
+		for _, r := range routes {
+			row := topRoute{Route: r.Route, Count: r.Count}
+			for _, sc := range r.Statuses {
+				row.Statuses = append(row.Statuses, statusCount{Status: sc.Status, Count: sc.Count})
 			}
+			rows = append(rows, row)
 		}
 
 		hasMore := offset+limit < int(totalCount)
@@ -241,21 +178,18 @@ type recentEvent struct {
 	CreatedAt  string `json:"created_at"`  // ISO 8601 UTC for client-side local formatting
 	Method     string `json:"method"`
 	Route      string `json:"route"`
+	RawPath    string `json:"raw_path"`
 	Status     int    `json:"status"`
 	DurationMs int64  `json:"duration_ms"`
 	Project    string `json:"project"`
 }
 
-func RecentEvents(db *gorm.DB) fasthttp.RequestHandler {
+func RecentEvents(store dbpkg.Store) fasthttp.RequestHandler {
 	return func(ctx *fasthttp.RequestCtx) {
 		user, ok := MustUser(ctx)
 		if !ok {
 			return
 		}
-		project := string(ctx.QueryArgs().Peek("project"))
-		status := string(ctx.QueryArgs().Peek("status"))
-		attrKey := string(ctx.QueryArgs().Peek("attr_key"))
-		attrValue := string(ctx.QueryArgs().Peek("attr_value"))
 
 		limit := 10
 		if s := string(ctx.QueryArgs().Peek("limit")); s != "" {
@@ -273,11 +207,7 @@ func RecentEvents(db *gorm.DB) fasthttp.RequestHandler {
 			}
 		}
 
-		q := db.Model(&dbpkg.Event{}).Where("user_id = ?", strconv.Itoa(int(user.ID)))
-		if project != "" {
-			q = q.Where("project = ?", project)
-		}
-		q = applyMetricsFilters(q, status, attrKey, attrValue)
+		q := store.Events(eventFilter(ctx, user, time.Time{}))
 
 		var totalCount int64
 		if err := q.Count(&totalCount).Error; err != nil {
@@ -303,6 +233,7 @@ func RecentEvents(db *gorm.DB) fasthttp.RequestHandler {
 				CreatedAt:  e.CreatedAt.UTC().Format(time.RFC3339),
 				Method:     e.Method,
 				Route:      e.Route,
+				RawPath:    e.RawPath,
 				Status:     e.Status,
 				DurationMs: e.DurationMs,
 				Project:    e.Project,
@@ -314,25 +245,37 @@ func RecentEvents(db *gorm.DB) fasthttp.RequestHandler {
 	}
 }
 
-func ErrorRateSeries(db *gorm.DB) fasthttp.RequestHandler {
+func ErrorRateSeries(store dbpkg.Store) fasthttp.RequestHandler {
 	return func(ctx *fasthttp.RequestCtx) {
 		user, ok := MustUser(ctx)
 		if !ok {
 			return
 		}
-		project := string(ctx.QueryArgs().Peek("project"))
+		project := projectFilter(ctx)
 		cutoff, _ := parseRange(ctx)
 		cutoff = cutoff.UTC()
 
-		q := db.Model(&dbpkg.MetricBucket{}).Where("user_id = ?", strconv.Itoa(int(user.ID))).Where("bucket_start >= ?", cutoff)
-		if project != "" {
-			q = q.Where("project = ?", project)
-		}
+		bots := string(ctx.QueryArgs().Peek("bots"))
 
 		var buckets []dbpkg.MetricBucket
-		if err := q.Order("bucket_start").Find(&buckets).Error; err != nil {
-			errResponse(ctx, fasthttp.StatusInternalServerError, "failed to query error rate")
-			return
+		if bots != "" {
+			// The hourly aggregates cover every client, so filtering bots
+			// needs the raw events.
+			var err error
+			buckets, err = store.HourlyTotals(dbpkg.EventFilter{UserID: strconv.Itoa(int(user.ID)), Project: project, Since: cutoff, Bots: bots})
+			if err != nil {
+				errResponse(ctx, fasthttp.StatusInternalServerError, "failed to query error rate")
+				return
+			}
+		} else {
+			q := store.DB().Model(&dbpkg.MetricBucket{}).Where("user_id = ?", strconv.Itoa(int(user.ID))).Where("bucket_start >= ?", cutoff)
+			if project != "" {
+				q = q.Where("project = ?", project)
+			}
+			if err := q.Order("bucket_start").Find(&buckets).Error; err != nil {
+				errResponse(ctx, fasthttp.StatusInternalServerError, "failed to query error rate")
+				return
+			}
 		}
 
 		series := make([]map[string]any, 0, len(buckets))
@@ -362,7 +305,7 @@ func LatencyPercentilesSeries(db *gorm.DB) fasthttp.RequestHandler {
 		if !ok {
 			return
 		}
-		project := string(ctx.QueryArgs().Peek("project"))
+		project := projectFilter(ctx)
 		cutoff, _ := parseRange(ctx)
 		cutoff = cutoff.UTC()
 
@@ -395,28 +338,18 @@ func LatencyPercentilesSeries(db *gorm.DB) fasthttp.RequestHandler {
 
 // AvgDuration returns the average request duration (in milliseconds) over the selected range.
 // The range is controlled by the same hours/days parameters as other metrics endpoints.
-func AvgDuration(db *gorm.DB) fasthttp.RequestHandler {
+func AvgDuration(store dbpkg.Store) fasthttp.RequestHandler {
 	return func(ctx *fasthttp.RequestCtx) {
 		user, ok := MustUser(ctx)
 		if !ok {
 			return
 		}
-		project := string(ctx.QueryArgs().Peek("project"))
-		status := string(ctx.QueryArgs().Peek("status"))
-		attrKey := string(ctx.QueryArgs().Peek("attr_key"))
-		attrValue := string(ctx.QueryArgs().Peek("attr_value"))
 		cutoff, _ := parseRange(ctx)
 
-		q := db.Model(&dbpkg.Event{}).
-			Where("user_id = ?", strconv.Itoa(int(user.ID))).
-			Where("created_at >= ?", cutoff)
-		if project != "" {
-			q = q.Where("project = ?", project)
-		}
-		q = applyMetricsFilters(q, status, attrKey, attrValue)
+		q := store.Events(eventFilter(ctx, user, cutoff))
 
 		var avgDurationMs float64
-		if err := q.Select("COALESCE(AVG(duration_ms), 0)").Scan(&avgDurationMs).Error; err != nil {
+		if err := q.Select("COALESCE(SUM(duration_ms / sample_rate) / NULLIF(SUM(1.0 / sample_rate), 0), 0)").Scan(&avgDurationMs).Error; err != nil {
 			errResponse(ctx, fasthttp.StatusInternalServerError, "failed to query avg duration")
 			return
 		}
@@ -424,38 +357,32 @@ func AvgDuration(db *gorm.DB) fasthttp.RequestHandler {
 	}
 }
 
-func AttributeKeys(db *gorm.DB) fasthttp.RequestHandler {
+func AttributeKeys(store dbpkg.Store) fasthttp.RequestHandler {
 	return func(ctx *fasthttp.RequestCtx) {
 		user, ok := MustUser(ctx)
 		if !ok {
 			return
 		}
+		project := projectFilter(ctx)
 		cutoff, _ := parseRange(ctx)
 
-		type keyRow struct {
-			Key string `json:"key"`
-		}
-		var rows []keyRow
-		err := db.Raw(
-			"SELECT DISTINCT je.key AS key FROM events, jsonb_each(events.attributes::jsonb) je WHERE events.user_id = ? AND events.created_at >= ?",
-			strconv.Itoa(int(user.ID)), cutoff,
-		).Scan(&rows).Error
+		rows, err := store.AttributeKeys(dbpkg.EventFilter{UserID: strconv.Itoa(int(user.ID)), Project: project, Since: cutoff})
 		if err != nil {
 			errResponse(ctx, fasthttp.StatusInternalServerError, "failed to query attribute keys")
 			return
 		}
 
 		keys := make([]string, 0, len(rows))
-		for _, row := range rows {
-			if row.Key != "" {
-				keys = append(keys, row.Key)
+		for _, key := range rows {
+			if key != "" {
+				keys = append(keys, key)
 			}
 		}
 		jsonResponse(ctx, map[string]any{"keys": keys})
 	}
 }
 
-func AttributeValues(db *gorm.DB) fasthttp.RequestHandler {
+func AttributeValues(store dbpkg.Store) fasthttp.RequestHandler {
 	return func(ctx *fasthttp.RequestCtx) {
 		user, ok := MustUser(ctx)
 		if !ok {
@@ -467,37 +394,19 @@ func AttributeValues(db *gorm.DB) fasthttp.RequestHandler {
 			return
 		}
 
-		project := string(ctx.QueryArgs().Peek("project"))
+		project := projectFilter(ctx)
 		cutoff, _ := parseRange(ctx)
 
-		type valRow struct {
-			Value string `json:"value"`
-		}
-		var rows []valRow
-		if project != "" {
-			err := db.Raw(
-				"SELECT DISTINCT events.attributes::jsonb ->> ? AS value FROM events WHERE events.user_id = ? AND events.project = ? AND events.created_at >= ? AND jsonb_exists(events.attributes::jsonb, ?)",
-				attrKey, strconv.Itoa(int(user.ID)), project, cutoff, attrKey,
-			).Scan(&rows).Error
-			if err != nil {
-				errResponse(ctx, fasthttp.StatusInternalServerError, "failed to query attribute values")
-				return
-			}
-		} else {
-			err := db.Raw(
-				"SELECT DISTINCT events.attributes::jsonb ->> ? AS value FROM events WHERE events.user_id = ? AND events.created_at >= ? AND jsonb_exists(events.attributes::jsonb, ?)",
-				attrKey, strconv.Itoa(int(user.ID)), cutoff, attrKey,
-			).Scan(&rows).Error
-			if err != nil {
-				errResponse(ctx, fasthttp.StatusInternalServerError, "failed to query attribute values")
-				return
-			}
+		rows, err := store.AttributeValues(dbpkg.EventFilter{UserID: strconv.Itoa(int(user.ID)), Project: project, Since: cutoff}, attrKey)
+		if err != nil {
+			errResponse(ctx, fasthttp.StatusInternalServerError, "failed to query attribute values")
+			return
 		}
 
 		values := make([]string, 0, len(rows))
-		for _, row := range rows {
-			if row.Value != "" {
-				values = append(values, row.Value)
+		for _, value := range rows {
+			if value != "" {
+				values = append(values, value)
 			}
 		}
 		jsonResponse(ctx, map[string]any{"values": values})
@@ -509,7 +418,7 @@ type attributeValueCount struct {
 	Count int64  `json:"count"`
 }
 
-func AttributeValueCounts(db *gorm.DB) fasthttp.RequestHandler {
+func AttributeValueCounts(store dbpkg.Store) fasthttp.RequestHandler {
 	return func(ctx *fasthttp.RequestCtx) {
 		user, ok := MustUser(ctx)
 		if !ok {
@@ -521,33 +430,13 @@ func AttributeValueCounts(db *gorm.DB) fasthttp.RequestHandler {
 			return
 		}
 
-		project := string(ctx.QueryArgs().Peek("project"))
+		project := projectFilter(ctx)
 		cutoff, _ := parseRange(ctx)
-		userID := strconv.Itoa(int(user.ID))
 
-		type countRow struct {
-			Value string `json:"value"`
-			Count int64  `json:"count"`
-		}
-		var rows []countRow
-		if project != "" {
-			err := db.Raw(
-				"SELECT events.attributes::jsonb ->> ? AS value, COUNT(*) AS count FROM events WHERE events.user_id = ? AND events.project = ? AND events.created_at >= ? AND jsonb_exists(events.attributes::jsonb, ?) GROUP BY 1 ORDER BY count DESC",
-				attrKey, userID, project, cutoff, attrKey,
-			).Scan(&rows).Error
-			if err != nil {
-				errResponse(ctx, fasthttp.StatusInternalServerError, "failed to query attribute value counts")
-				return
-			}
-		} else {
-			err := db.Raw(
-				"SELECT events.attributes::jsonb ->> ? AS value, COUNT(*) AS count FROM events WHERE events.user_id = ? AND events.created_at >= ? AND jsonb_exists(events.attributes::jsonb, ?) GROUP BY 1 ORDER BY count DESC",
-				attrKey, userID, cutoff, attrKey,
-			).Scan(&rows).Error
-			if err != nil {
-				errResponse(ctx, fasthttp.StatusInternalServerError, "failed to query attribute value counts")
-				return
-			}
+		rows, err := store.AttributeValueCounts(dbpkg.EventFilter{UserID: strconv.Itoa(int(user.ID)), Project: project, Since: cutoff}, attrKey)
+		if err != nil {
+			errResponse(ctx, fasthttp.StatusInternalServerError, "failed to query attribute value counts")
+			return
 		}
 
 		counts := make([]attributeValueCount, 0, len(rows))
@@ -557,3 +446,181 @@ func AttributeValueCounts(db *gorm.DB) fasthttp.RequestHandler {
 		jsonResponse(ctx, map[string]any{"counts": counts})
 	}
 }
+
+type countryCount struct {
+	Country string `json:"country"`
+	Count   int64  `json:"count"`
+	Errors  int64  `json:"errors"`
+}
+
+// CountryCounts returns request and error counts per client country, as
+// looked up from GeoIP databases at ingest. Events without a known country
+// are counted under an empty country.
+func CountryCounts(store dbpkg.Store) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		user, ok := MustUser(ctx)
+		if !ok {
+			return
+		}
+		cutoff, _ := parseRange(ctx)
+
+		q := store.Events(eventFilter(ctx, user, cutoff))
+
+		counts := []countryCount{}
+		if err := q.
+			Select("country AS country, " + dbpkg.WeightedCount + " AS count, " + dbpkg.WeightedErrorCount + " AS errors").
+			Group("country").
+			Order("count DESC").
+			Scan(&counts).Error; err != nil {
+			errResponse(ctx, fasthttp.StatusInternalServerError, "failed to query country counts")
+			return
+		}
+		jsonResponse(ctx, map[string]any{"counts": counts})
+	}
+}
+
+type clientCount struct {
+	Value  string `json:"value"`
+	Count  int64  `json:"count"`
+	Errors int64  `json:"errors"`
+}
+
+// clientGroups maps the by parameter of ClientCounts to event columns.
+var clientGroups = map[string]string{
+	"browser":     "browser",
+	"os":          "os",
+	"device":      "device",
+	"app":         "app",
+	"app_version": "app_version",
+}
+
+// ClientCounts returns request and error counts grouped by a field parsed
+// from the user agent: by=browser (the default), os, device, app or
+// app_version. by=bot splits traffic into "bot" and "human".
+func ClientCounts(store dbpkg.Store) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		user, ok := MustUser(ctx)
+		if !ok {
+			return
+		}
+		by := string(ctx.QueryArgs().Peek("by"))
+		if by == "" {
+			by = "browser"
+		}
+		column, ok := clientGroups[by]
+		if by == "bot" {
+			column, ok = "CASE WHEN is_bot THEN 'bot' ELSE 'human' END", true
+		}
+		if !ok {
+			errResponse(ctx, fasthttp.StatusBadRequest, "by must be browser, os, device, app, app_version or bot")
+			return
+		}
+		cutoff, _ := parseRange(ctx)
+
+		q := store.Events(eventFilter(ctx, user, cutoff))
+
+		counts := []clientCount{}
+		if err := q.
+			Select(column + " AS value, " + dbpkg.WeightedCount + " AS count, " + dbpkg.WeightedErrorCount + " AS errors").
+			Group(column).
+			Order("count DESC").
+			Scan(&counts).Error; err != nil {
+			errResponse(ctx, fasthttp.StatusInternalServerError, "failed to query client counts")
+			return
+		}
+		jsonResponse(ctx, map[string]any{"counts": counts})
+	}
+}
+
+// BandwidthSeries returns request and response bytes per hour. Without a
+// bots filter it reads the hourly aggregates; with one, the raw events.
+func BandwidthSeries(store dbpkg.Store) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		user, ok := MustUser(ctx)
+		if !ok {
+			return
+		}
+		project := projectFilter(ctx)
+		cutoff, _ := parseRange(ctx)
+		cutoff = cutoff.UTC()
+
+		bots := string(ctx.QueryArgs().Peek("bots"))
+
+		var buckets []dbpkg.MetricBucket
+		var err error
+		if bots != "" {
+			buckets, err = store.HourlyTotals(dbpkg.EventFilter{UserID: strconv.Itoa(int(user.ID)), Project: project, Since: cutoff, Bots: bots})
+		} else {
+			q := store.DB().Model(&dbpkg.MetricBucket{}).Where("user_id = ?", strconv.Itoa(int(user.ID))).Where("bucket_start >= ?", cutoff)
+			if project != "" {
+				q = q.Where("project = ?", project)
+			}
+			err = q.Select("bucket_start, SUM(request_bytes) AS request_bytes, SUM(response_bytes) AS response_bytes").
+				Group("bucket_start").
+				Order("bucket_start").
+				Scan(&buckets).Error
+		}
+		if err != nil {
+			errResponse(ctx, fasthttp.StatusInternalServerError, "failed to query bandwidth")
+			return
+		}
+
+		series := make([]map[string]any, 0, len(buckets))
+		for _, b := range buckets {
+			utc := time.Date(b.BucketStart.Year(), b.BucketStart.Month(), b.BucketStart.Day(),
+				b.BucketStart.Hour(), b.BucketStart.Minute(), b.BucketStart.Second(), 0, time.UTC)
+			bucketISO := utc.Format("2006-01-02T15:04:05") + "Z"
+			series = append(series, map[string]any{
+				"bucket":         bucketISO,
+				"request_bytes":  b.RequestBytes,
+				"response_bytes": b.ResponseBytes,
+			})
+		}
+		jsonResponse(ctx, map[string]any{"series": series})
+	}
+}
+
+type heavyRoute struct {
+	Route         string `json:"route"`
+	Count         int64  `json:"count"`
+	RequestBytes  int64  `json:"request_bytes"`
+	ResponseBytes int64  `json:"response_bytes"`
+	TotalBytes    int64  `json:"total_bytes"`
+}
+
+// HeaviestRoutes ranks routes by the bytes they transferred (request plus
+// response) over the selected range, heaviest first.
+func HeaviestRoutes(store dbpkg.Store) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		user, ok := MustUser(ctx)
+		if !ok {
+			return
+		}
+		cutoff, _ := parseRange(ctx)
+
+		limit := 10
+		if s := string(ctx.QueryArgs().Peek("limit")); s != "" {
+			if n, err := strconv.Atoi(s); err == nil && n > 0 {
+				if n > 100 {
+					n = 100
+				}
+				limit = n
+			}
+		}
+
+		q := store.Events(eventFilter(ctx, user, cutoff))
+
+		rows := []heavyRoute{}
+		if err := q.
+			Select("route AS route, " + dbpkg.WeightedCount + " AS count, " + dbpkg.WeightedRequestBytes + " AS request_bytes, " + dbpkg.WeightedResponseBytes + " AS response_bytes, " +
+				"(" + dbpkg.WeightedRequestBytes + " + " + dbpkg.WeightedResponseBytes + ") AS total_bytes").
+			Group("route").
+			Order("total_bytes DESC").
+			Limit(limit).
+			Scan(&rows).Error; err != nil {
+			errResponse(ctx, fasthttp.StatusInternalServerError, "failed to query heaviest routes")
+			return
+		}
+		jsonResponse(ctx, map[string]any{"routes": rows})
+	}
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+
+	"apiinsight/internal/config"
+	"apiinsight/internal/geoip"
+	"apiinsight/internal/ingest"
+	"apiinsight/internal/otlp"
+	"apiinsight/internal/ratelimit"
+	"apiinsight/internal/redact"
+	"apiinsight/internal/routes"
+	"apiinsight/internal/sampling"
+)
+
+// OTLPTracesHandler implements the OTLP/HTTP traces endpoint so an
+// OpenTelemetry collector or SDK exporter can send spans directly. Server
+// spans become events; other spans are acknowledged and ignored. Invalid
+// spans are reported through the partial_success field of the response.
+func OTLPTracesHandler(pipeline *ingest.Pipeline, cfg *config.Config, templates *routes.Cache, limiter *ratelimit.Limiter, samplingRules *sampling.Cache, redaction *redact.Cache, geo *geoip.Resolver) fasthttp.RequestHandler {
+	ingester := newEventIngester(pipeline, cfg, templates, limiter, samplingRules, redaction, geo)
+	return func(ctx *fasthttp.RequestCtx) {
+		contentType := string(ctx.Request.Header.ContentType())
+		body, ok := ingester.readIngestBody(ctx)
+		if !ok {
+			return
+		}
+
+		res, err := otlp.Decode(contentType, body)
+		if err != nil {
+			if errors.Is(err, otlp.ErrUnsupportedContentType) {
+				ctx.SetStatusCode(fasthttp.StatusUnsupportedMediaType)
+				ctx.SetBodyString("content type must be application/x-protobuf or application/json")
+				return
+			}
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetBodyString("invalid OTLP traces request: " + err.Error())
+			return
+		}
+
+		encode := otlp.EncodeProtobufResponse
+		respType := "application/x-protobuf"
+		if strings.HasPrefix(strings.ToLower(contentType), "application/json") {
+			encode = otlp.EncodeJSONResponse
+			respType = "application/json"
+		}
+
+		var result ingestResult
+		if len(res.Events) > 0 {
+			result, err = ingester.accept(requestAPIKey(ctx), res.Events, nil, len(ctx.PostBody()))
+			if err != nil {
+				writeEnqueueError(ctx, err)
+				return
+			}
+			setRateLimitHeaders(ctx, result.Limit)
+		}
+
+		rejected := int64(len(result.Rejected))
+		message := ""
+		if result.Refused {
+			rejected = int64(len(res.Events))
+		}
+		if len(result.Rejected) > 0 {
+			message = fmt.Sprintf("%d of %d server spans rejected, first: %s",
+				len(result.Rejected), len(res.Events), result.Rejected[0].Reason)
+		}
+
+		ctx.SetContentType(respType)
+		if result.Refused {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		} else {
+			ctx.SetStatusCode(fasthttp.StatusOK)
+		}
+		ctx.SetBody(encode(rejected, message))
+	}
+}
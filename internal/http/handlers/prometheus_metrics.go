@@ -21,8 +21,8 @@ func ProjectMetricsHandler(db *gorm.DB) fasthttp.RequestHandler {
 			return
 		}
 
-		var key dbpkg.APIKey
-		if err := db.Where("key = ? AND active = ?", apiKeyValue, true).Preload("User").First(&key).Error; err != nil {
+		key, err := dbpkg.FindActiveAPIKey(db, apiKeyValue)
+		if err != nil {
 			if err == gorm.ErrRecordNotFound {
 				ctx.SetStatusCode(fasthttp.StatusUnauthorized)
 				ctx.SetBodyString("invalid API key")
@@ -33,6 +33,12 @@ func ProjectMetricsHandler(db *gorm.DB) fasthttp.RequestHandler {
 			return
 		}
 
+		if !key.HasScope(dbpkg.ScopeMetricsRead) {
+			ctx.SetStatusCode(fasthttp.StatusForbidden)
+			ctx.SetBodyString("API key lacks required scope: " + dbpkg.ScopeMetricsRead)
+			return
+		}
+
 		projectName := key.Name
 
 		metricFamilies, err := prometheus.DefaultGatherer.Gather()
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"strings"
+
+	"github.com/valyala/fasthttp"
+	"gorm.io/gorm"
+
+	dbpkg "apiinsight/internal/db"
+	"apiinsight/internal/redact"
+)
+
+// CreateRedactionRule adds a redaction rule for a project: a built-in
+// detector to enable, an attribute key to deny, or a route or user agent
+// regex with its replacement.
+func CreateRedactionRule(db *gorm.DB, rules *redact.Cache) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		apiKeyID := string(ctx.PostArgs().Peek("api_key_id"))
+		kind := string(ctx.PostArgs().Peek("kind"))
+		pattern := strings.TrimSpace(string(ctx.PostArgs().Peek("pattern")))
+		replacement := strings.TrimSpace(string(ctx.PostArgs().Peek("replacement")))
+		if apiKeyID == "" || pattern == "" {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetBodyString("api_key_id and pattern required")
+			return
+		}
+		switch kind {
+		case dbpkg.RedactDetector:
+			if !redact.ValidDetector(pattern) {
+				ctx.SetStatusCode(fasthttp.StatusBadRequest)
+				ctx.SetBodyString("unknown detector; use one of " + strings.Join(redact.Detectors, ", "))
+				return
+			}
+			replacement = ""
+		case dbpkg.RedactDenyKey:
+			replacement = ""
+		case dbpkg.RedactRoute, dbpkg.RedactUserAgent:
+			if _, err := redact.NewReplacement(pattern, replacement); err != nil {
+				ctx.SetStatusCode(fasthttp.StatusBadRequest)
+				ctx.SetBodyString(err.Error())
+				return
+			}
+		default:
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetBodyString("kind must be detector, deny_key, route or user_agent")
+			return
+		}
+
+		user, ok := MustUser(ctx)
+		if !ok {
+			return
+		}
+		var apiKey dbpkg.APIKey
+		if err := db.First(&apiKey, apiKeyID).Error; err != nil {
+			ctx.SetStatusCode(fasthttp.StatusNotFound)
+			ctx.SetBodyString("API key not found")
+			return
+		}
+		if apiKey.UserID != user.ID && !user.IsAdmin {
+			ctx.SetStatusCode(fasthttp.StatusForbidden)
+			ctx.SetBodyString("forbidden")
+			return
+		}
+
+		row := &dbpkg.RedactionRule{APIKeyID: apiKey.ID, Kind: kind, Pattern: pattern, Replacement: replacement}
+		if err := db.Create(row).Error; err != nil {
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString("failed to create redaction rule")
+			return
+		}
+		rules.Invalidate(apiKey.ID)
+
+		ctx.Redirect("/settings", fasthttp.StatusSeeOther)
+	}
+}
+
+func DeleteRedactionRule(db *gorm.DB, rules *redact.Cache) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		id := string(ctx.QueryArgs().Peek("id"))
+		if id == "" {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetBodyString("id required")
+			return
+		}
+
+		user, ok := MustUser(ctx)
+		if !ok {
+			return
+		}
+		var row dbpkg.RedactionRule
+		if err := db.First(&row, id).Error; err != nil {
+			ctx.SetStatusCode(fasthttp.StatusNotFound)
+			ctx.SetBodyString("redaction rule not found")
+			return
+		}
+		var apiKey dbpkg.APIKey
+		if err := db.First(&apiKey, row.APIKeyID).Error; err == nil && apiKey.UserID != user.ID && !user.IsAdmin {
+			ctx.SetStatusCode(fasthttp.StatusForbidden)
+			ctx.SetBodyString("forbidden")
+			return
+		}
+
+		if err := db.Delete(&row).Error; err != nil {
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString("failed to delete redaction rule")
+			return
+		}
+		rules.Invalidate(row.APIKeyID)
+
+		ctx.Redirect("/settings", fasthttp.StatusSeeOther)
+	}
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"github.com/valyala/fasthttp"
+	"gorm.io/gorm"
+
+	dbpkg "apiinsight/internal/db"
+	"apiinsight/internal/routes"
+)
+
+func CreateRouteTemplate(db *gorm.DB, templates *routes.Cache) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		apiKeyID := string(ctx.PostArgs().Peek("api_key_id"))
+		pattern := string(ctx.PostArgs().Peek("pattern"))
+		if apiKeyID == "" || pattern == "" {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetBodyString("api_key_id and pattern required")
+			return
+		}
+		t, ok := routes.ParseTemplate(pattern)
+		if !ok {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetBodyString("invalid route template (expected e.g. /orders/{order_id}/items/{item})")
+			return
+		}
+
+		user, ok := MustUser(ctx)
+		if !ok {
+			return
+		}
+		var apiKey dbpkg.APIKey
+		if err := db.First(&apiKey, apiKeyID).Error; err != nil {
+			ctx.SetStatusCode(fasthttp.StatusNotFound)
+			ctx.SetBodyString("API key not found")
+			return
+		}
+		if apiKey.UserID != user.ID && !user.IsAdmin {
+			ctx.SetStatusCode(fasthttp.StatusForbidden)
+			ctx.SetBodyString("forbidden")
+			return
+		}
+
+		row := &dbpkg.RouteTemplate{APIKeyID: apiKey.ID, Pattern: t.Pattern}
+		if err := db.Create(row).Error; err != nil {
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString("failed to create route template")
+			return
+		}
+		templates.Invalidate(apiKey.ID)
+
+		ctx.Redirect("/settings", fasthttp.StatusSeeOther)
+	}
+}
+
+func DeleteRouteTemplate(db *gorm.DB, templates *routes.Cache) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		id := string(ctx.QueryArgs().Peek("id"))
+		if id == "" {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetBodyString("id required")
+			return
+		}
+
+		user, ok := MustUser(ctx)
+		if !ok {
+			return
+		}
+		var row dbpkg.RouteTemplate
+		if err := db.First(&row, id).Error; err != nil {
+			ctx.SetStatusCode(fasthttp.StatusNotFound)
+			ctx.SetBodyString("route template not found")
+			return
+		}
+		var apiKey dbpkg.APIKey
+		if err := db.First(&apiKey, row.APIKeyID).Error; err == nil && apiKey.UserID != user.ID && !user.IsAdmin {
+			ctx.SetStatusCode(fasthttp.StatusForbidden)
+			ctx.SetBodyString("forbidden")
+			return
+		}
+
+		if err := db.Delete(&row).Error; err != nil {
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString("failed to delete route template")
+			return
+		}
+		templates.Invalidate(row.APIKeyID)
+
+		ctx.Redirect("/settings", fasthttp.StatusSeeOther)
+	}
+}
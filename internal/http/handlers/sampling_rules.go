@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+	"gorm.io/gorm"
+
+	dbpkg "apiinsight/internal/db"
+	"apiinsight/internal/sampling"
+)
+
+// CreateSamplingRule adds a server-side sampling rule for a project. An
+// empty route applies the rule to every route of the project.
+func CreateSamplingRule(db *gorm.DB, rules *sampling.Cache) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		apiKeyID := string(ctx.PostArgs().Peek("api_key_id"))
+		route := strings.TrimSpace(string(ctx.PostArgs().Peek("route")))
+		rate, err := strconv.ParseFloat(strings.TrimSpace(string(ctx.PostArgs().Peek("rate"))), 64)
+		if apiKeyID == "" || err != nil || !sampling.ValidRate(rate) {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetBodyString(fmt.Sprintf("api_key_id and a rate between %g and 1 required", sampling.MinRate))
+			return
+		}
+		if route != "" && route != "*" && !strings.HasPrefix(route, "/") {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetBodyString("route must start with / (or be empty for all routes)")
+			return
+		}
+
+		user, ok := MustUser(ctx)
+		if !ok {
+			return
+		}
+		var apiKey dbpkg.APIKey
+		if err := db.First(&apiKey, apiKeyID).Error; err != nil {
+			ctx.SetStatusCode(fasthttp.StatusNotFound)
+			ctx.SetBodyString("API key not found")
+			return
+		}
+		if apiKey.UserID != user.ID && !user.IsAdmin {
+			ctx.SetStatusCode(fasthttp.StatusForbidden)
+			ctx.SetBodyString("forbidden")
+			return
+		}
+
+		row := &dbpkg.SamplingRule{APIKeyID: apiKey.ID, Route: route, Rate: rate}
+		if err := db.Create(row).Error; err != nil {
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString("failed to create sampling rule")
+			return
+		}
+		rules.Invalidate(apiKey.ID)
+
+		ctx.Redirect("/settings", fasthttp.StatusSeeOther)
+	}
+}
+
+func DeleteSamplingRule(db *gorm.DB, rules *sampling.Cache) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		id := string(ctx.QueryArgs().Peek("id"))
+		if id == "" {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetBodyString("id required")
+			return
+		}
+
+		user, ok := MustUser(ctx)
+		if !ok {
+			return
+		}
+		var row dbpkg.SamplingRule
+		if err := db.First(&row, id).Error; err != nil {
+			ctx.SetStatusCode(fasthttp.StatusNotFound)
+			ctx.SetBodyString("sampling rule not found")
+			return
+		}
+		var apiKey dbpkg.APIKey
+		if err := db.First(&apiKey, row.APIKeyID).Error; err == nil && apiKey.UserID != user.ID && !user.IsAdmin {
+			ctx.SetStatusCode(fasthttp.StatusForbidden)
+			ctx.SetBodyString("forbidden")
+			return
+		}
+
+		if err := db.Delete(&row).Error; err != nil {
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString("failed to delete sampling rule")
+			return
+		}
+		rules.Invalidate(row.APIKeyID)
+
+		ctx.Redirect("/settings", fasthttp.StatusSeeOther)
+	}
+}
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"gorm.io/gorm"
+
+	dbpkg "apiinsight/internal/db"
+	httpctx "apiinsight/internal/http/ctx"
+	"apiinsight/internal/ingest"
+)
+
+// maxTraceEvents bounds the events loaded for one trace.
+const maxTraceEvents = 1000
+
+// traceSpan is one event of a trace in the waterfall returned by
+// TraceView. OffsetMs is its start relative to the start of the trace.
+type traceSpan struct {
+	ID           uint         `json:"id"`
+	Project      string       `json:"project"`
+	Method       string       `json:"method"`
+	Route        string       `json:"route"`
+	RawPath      string       `json:"raw_path"`
+	Status       int          `json:"status"`
+	CreatedAt    string       `json:"created_at"`
+	OffsetMs     int64        `json:"offset_ms"`
+	DurationMs   int64        `json:"duration_ms"`
+	SpanID       string       `json:"span_id,omitempty"`
+	ParentSpanID string       `json:"parent_span_id,omitempty"`
+	Depth        int          `json:"depth"`
+	Children     []*traceSpan `json:"children"`
+}
+
+// TraceView returns every event of the user's projects that shares the
+// trace ID in the path, as a tree of spans linked by parent span IDs.
+// Events whose parent was not reported are returned as additional roots.
+// Keys scoped to one project only see that project's events.
+func TraceView(db *gorm.DB) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		user, ok := MustUser(ctx)
+		if !ok {
+			return
+		}
+		traceID, _ := ctx.UserValue("trace_id").(string)
+		traceID = strings.ToLower(traceID)
+		if !ingest.ValidTraceID(traceID) {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetBodyString("invalid trace id")
+			return
+		}
+
+		q := db.Where("user_id = ? AND trace_id = ?", strconv.Itoa(int(user.ID)), traceID)
+		if project, scoped := httpctx.ProjectScopeFromCtx(ctx); scoped {
+			q = q.Where("project = ?", project)
+		}
+		var events []dbpkg.Event
+		if err := q.Order("created_at, id").Limit(maxTraceEvents + 1).Find(&events).Error; err != nil {
+			errResponse(ctx, fasthttp.StatusInternalServerError, "failed to load trace")
+			return
+		}
+		truncated := len(events) > maxTraceEvents
+		if truncated {
+			events = events[:maxTraceEvents]
+		}
+		if len(events) == 0 {
+			errResponse(ctx, fasthttp.StatusNotFound, "trace not found")
+			return
+		}
+
+		roots, start, end := buildTraceTree(events)
+		jsonResponse(ctx, map[string]any{
+			"trace_id":    traceID,
+			"start":       start.UTC().Format(time.RFC3339Nano),
+			"duration_ms": end.Sub(start).Milliseconds(),
+			"count":       len(events),
+			"truncated":   truncated,
+			"spans":       roots,
+		})
+	}
+}
+
+// buildTraceTree links events (ordered by start) into trees by span ID and
+// returns the roots together with the start and end of the whole trace.
+// Every event appears exactly once, even with duplicate or cyclic IDs.
+func buildTraceTree(events []dbpkg.Event) (roots []*traceSpan, start, end time.Time) {
+	start = events[0].CreatedAt
+	spans := make([]*traceSpan, len(events))
+	bySpanID := make(map[string]int, len(events))
+	for i, e := range events {
+		if e.CreatedAt.Before(start) {
+			start = e.CreatedAt
+		}
+		if fin := e.CreatedAt.Add(time.Duration(e.DurationMs) * time.Millisecond); fin.After(end) {
+			end = fin
+		}
+		spans[i] = &traceSpan{
+			ID:           e.ID,
+			Project:      e.Project,
+			Method:       e.Method,
+			Route:        e.Route,
+			RawPath:      e.RawPath,
+			Status:       e.Status,
+			CreatedAt:    e.CreatedAt.UTC().Format(time.RFC3339Nano),
+			DurationMs:   e.DurationMs,
+			SpanID:       e.SpanID,
+			ParentSpanID: e.ParentSpanID,
+			Children:     []*traceSpan{},
+		}
+		if _, dup := bySpanID[e.SpanID]; e.SpanID != "" && !dup {
+			bySpanID[e.SpanID] = i
+		}
+	}
+
+	children := make(map[int][]int, len(events))
+	var rootIdx []int
+	for i, e := range events {
+		p, ok := bySpanID[e.ParentSpanID]
+		if e.ParentSpanID == "" || !ok || p == i {
+			rootIdx = append(rootIdx, i)
+			continue
+		}
+		children[p] = append(children[p], i)
+	}
+
+	placed := make([]bool, len(events))
+	var attach func(i, depth int) *traceSpan
+	attach = func(i, depth int) *traceSpan {
+		placed[i] = true
+		s := spans[i]
+		s.Depth = depth
+		s.OffsetMs = events[i].CreatedAt.Sub(start).Milliseconds()
+		for _, c := range children[i] {
+			if !placed[c] {
+				s.Children = append(s.Children, attach(c, depth+1))
+			}
+		}
+		return s
+	}
+	for _, i := range rootIdx {
+		roots = append(roots, attach(i, 0))
+	}
+	// Events only reachable through a cycle of parent IDs.
+	for i := range events {
+		if !placed[i] {
+			roots = append(roots, attach(i, 0))
+		}
+	}
+	sort.SliceStable(roots, func(a, b int) bool { return roots[a].OffsetMs < roots[b].OffsetMs })
+	return roots, start, end
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"log"
 	"strconv"
 
 	"github.com/valyala/fasthttp"
@@ -101,6 +102,9 @@ func ResetPassword(db *gorm.DB, cfg *config.Config) fasthttp.RequestHandler {
 			ctx.SetBodyString("failed to update password")
 			return
 		}
+		if err := dbpkg.DeleteUserSessions(db, user.ID, 0); err != nil {
+			log.Printf("failed to revoke sessions after password reset: %v", err)
+		}
 
 		ctx.Redirect("/users", fasthttp.StatusSeeOther)
 	}
@@ -140,6 +144,12 @@ func DeleteUser(db *gorm.DB, cfg *config.Config) fasthttp.RequestHandler {
 			return
 		}
 
+		if err := dbpkg.DeleteUserSessions(db, user.ID, 0); err != nil {
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString("failed to revoke user sessions")
+			return
+		}
+
 		if err := db.Delete(&user).Error; err != nil {
 			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
 			ctx.SetBodyString("failed to delete user")
@@ -149,3 +159,65 @@ func DeleteUser(db *gorm.DB, cfg *config.Config) fasthttp.RequestHandler {
 		ctx.Redirect("/users", fasthttp.StatusSeeOther)
 	}
 }
+
+// RevokeSession deletes a single session by ID, signing that browser out.
+func RevokeSession(db *gorm.DB, cfg *config.Config) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		current, ok := MustUser(ctx)
+		if !ok {
+			return
+		}
+		if !current.IsAdmin && current.Username != cfg.AdminUser {
+			ctx.SetStatusCode(fasthttp.StatusForbidden)
+			ctx.SetBodyString("forbidden")
+			return
+		}
+
+		idStr, _ := ctx.UserValue("id").(string)
+		id, err := strconv.ParseUint(idStr, 10, 32)
+		if err != nil {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetBodyString("invalid session ID")
+			return
+		}
+
+		if err := db.Delete(&dbpkg.Session{}, id).Error; err != nil {
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString("failed to revoke session")
+			return
+		}
+
+		ctx.Redirect("/users", fasthttp.StatusSeeOther)
+	}
+}
+
+// RevokeUserSessions deletes every active session of a user.
+func RevokeUserSessions(db *gorm.DB, cfg *config.Config) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		current, ok := MustUser(ctx)
+		if !ok {
+			return
+		}
+		if !current.IsAdmin && current.Username != cfg.AdminUser {
+			ctx.SetStatusCode(fasthttp.StatusForbidden)
+			ctx.SetBodyString("forbidden")
+			return
+		}
+
+		idStr, _ := ctx.UserValue("id").(string)
+		id, err := strconv.ParseUint(idStr, 10, 32)
+		if err != nil {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetBodyString("invalid user ID")
+			return
+		}
+
+		if err := dbpkg.DeleteUserSessions(db, uint(id), 0); err != nil {
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString("failed to revoke sessions")
+			return
+		}
+
+		ctx.Redirect("/users", fasthttp.StatusSeeOther)
+	}
+}
@@ -1,6 +1,8 @@
 package middleware
 
 import (
+	"log"
+
 	"github.com/valyala/fasthttp"
 	"gorm.io/gorm"
 
@@ -9,27 +11,37 @@ import (
 	httpctx "apiinsight/internal/http/ctx"
 )
 
-// AdminAuth returns middleware that loads the session user and sets it on the context.
+// AdminAuth returns middleware that resolves the server-side session from the
+// session cookie, enforces its expiry and idle timeout, and sets the session
+// user on the context.
 func AdminAuth(db *gorm.DB, cfg *config.Config) func(fasthttp.RequestHandler) fasthttp.RequestHandler {
 	return func(next fasthttp.RequestHandler) fasthttp.RequestHandler {
 		return func(ctx *fasthttp.RequestCtx) {
-			cookie := ctx.Request.Header.Cookie("session_user")
+			cookie := ctx.Request.Header.Cookie(httpctx.SessionCookie)
 			if len(cookie) == 0 {
 				ctx.Redirect("/login", fasthttp.StatusSeeOther)
 				return
 			}
-			username := string(cookie)
 
-			var user dbpkg.User
-			if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+			session, err := dbpkg.LookupSession(db, string(cookie), cfg.SessionIdleTimeout)
+			if err != nil {
+				if err != gorm.ErrRecordNotFound {
+					log.Printf("session lookup error: %v", err)
+				}
+				ctx.Response.Header.DelClientCookie(httpctx.SessionCookie)
 				ctx.Redirect("/login", fasthttp.StatusSeeOther)
 				return
 			}
+			if err := dbpkg.TouchSession(db, session); err != nil {
+				log.Printf("session touch error: %v", err)
+			}
 
+			user := session.User
 			if user.Username == cfg.AdminUser {
 				user.IsAdmin = true
 			}
 
+			httpctx.SetSession(ctx, session)
 			httpctx.SetUser(ctx, &user)
 			next(ctx)
 		}
@@ -11,47 +11,63 @@ import (
 	httpctx "apiinsight/internal/http/ctx"
 )
 
-// BearerAuth validates Bearer tokens against API keys in the database.
-func BearerAuth(db *gorm.DB) func(fasthttp.RequestHandler) fasthttp.RequestHandler {
+// BearerAuth validates Bearer tokens against API keys in the database and
+// requires the key to hold scope.
+func BearerAuth(db *gorm.DB, scope string) func(fasthttp.RequestHandler) fasthttp.RequestHandler {
 	return func(next fasthttp.RequestHandler) fasthttp.RequestHandler {
 		return func(ctx *fasthttp.RequestCtx) {
-			auth := ctx.Request.Header.Peek("Authorization")
-			if len(auth) == 0 {
-				ctx.SetStatusCode(fasthttp.StatusUnauthorized)
-				ctx.SetBodyString("missing Authorization header")
+			apiKey, ok := authenticateBearer(ctx, db)
+			if !ok {
 				return
 			}
-
-			const prefix = "Bearer "
-			if !bytes.HasPrefix(auth, []byte(prefix)) {
-				ctx.SetStatusCode(fasthttp.StatusUnauthorized)
-				ctx.SetBodyString("invalid Authorization header")
+			if !apiKey.HasScope(scope) {
+				ctx.SetStatusCode(fasthttp.StatusForbidden)
+				ctx.SetBodyString("API key lacks required scope: " + scope)
 				return
 			}
+			next(ctx)
+		}
+	}
+}
 
-			token := strings.TrimSpace(string(auth[len(prefix):]))
-			if token == "" {
-				ctx.SetStatusCode(fasthttp.StatusUnauthorized)
-				ctx.SetBodyString("empty bearer token")
-				return
-			}
+// authenticateBearer resolves the request's Bearer token, stores the key
+// and its owner on the context, and writes an error response on failure.
+func authenticateBearer(ctx *fasthttp.RequestCtx, db *gorm.DB) (*dbpkg.APIKey, bool) {
+	auth := ctx.Request.Header.Peek("Authorization")
+	if len(auth) == 0 {
+		ctx.SetStatusCode(fasthttp.StatusUnauthorized)
+		ctx.SetBodyString("missing Authorization header")
+		return nil, false
+	}
 
-			var apiKey dbpkg.APIKey
-			if err := db.Where("key = ? AND active = ?", token, true).Preload("User").First(&apiKey).Error; err != nil {
-				if err == gorm.ErrRecordNotFound {
-					ctx.SetStatusCode(fasthttp.StatusUnauthorized)
-					ctx.SetBodyString("invalid API key")
-					return
-				}
-				ctx.SetStatusCode(fasthttp.StatusInternalServerError)
-				ctx.SetBodyString("database error")
-				return
-			}
+	const prefix = "Bearer "
+	if !bytes.HasPrefix(auth, []byte(prefix)) {
+		ctx.SetStatusCode(fasthttp.StatusUnauthorized)
+		ctx.SetBodyString("invalid Authorization header")
+		return nil, false
+	}
 
-			httpctx.SetUserToken(ctx, token)
-			httpctx.SetAPIKey(ctx, &apiKey)
-			httpctx.SetUser(ctx, &apiKey.User)
-			next(ctx)
+	token := strings.TrimSpace(string(auth[len(prefix):]))
+	if token == "" {
+		ctx.SetStatusCode(fasthttp.StatusUnauthorized)
+		ctx.SetBodyString("empty bearer token")
+		return nil, false
+	}
+
+	apiKey, err := dbpkg.FindActiveAPIKey(db, token)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			ctx.SetStatusCode(fasthttp.StatusUnauthorized)
+			ctx.SetBodyString("invalid API key")
+			return nil, false
 		}
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString("database error")
+		return nil, false
 	}
+
+	httpctx.SetUserToken(ctx, token)
+	httpctx.SetAPIKey(ctx, apiKey)
+	httpctx.SetUser(ctx, &apiKey.User)
+	return apiKey, true
 }
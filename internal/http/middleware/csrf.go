@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"log"
+
+	"github.com/valyala/fasthttp"
+	"gorm.io/gorm"
+
+	dbpkg "apiinsight/internal/db"
+	httpctx "apiinsight/internal/http/ctx"
+)
+
+// CSRFFormField and CSRFHeader are where state-changing requests must carry
+// the session's CSRF token.
+const (
+	CSRFFormField = "csrf_token"
+	CSRFHeader    = "X-CSRF-Token"
+)
+
+// CSRF returns middleware that validates the per-session CSRF token on every
+// unsafe method (anything other than GET, HEAD, OPTIONS and TRACE). It must
+// run after AdminAuth so the session is available on the context.
+func CSRF(db *gorm.DB) func(fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+		return func(ctx *fasthttp.RequestCtx) {
+			session, ok := httpctx.SessionFromCtx(ctx)
+			if !ok || session == nil {
+				ctx.SetStatusCode(fasthttp.StatusForbidden)
+				ctx.SetBodyString("forbidden: no session")
+				return
+			}
+			if err := dbpkg.EnsureCSRFToken(db, session); err != nil {
+				log.Printf("failed to assign CSRF token: %v", err)
+				ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+				ctx.SetBodyString("failed to prepare CSRF token")
+				return
+			}
+
+			if isSafeMethod(ctx) {
+				next(ctx)
+				return
+			}
+
+			token := ctx.Request.Header.Peek(CSRFHeader)
+			if len(token) == 0 {
+				token = ctx.PostArgs().Peek(CSRFFormField)
+			}
+			if len(token) == 0 {
+				if form, err := ctx.MultipartForm(); err == nil {
+					if v := form.Value[CSRFFormField]; len(v) > 0 {
+						token = []byte(v[0])
+					}
+				}
+			}
+			if len(token) == 0 || subtle.ConstantTimeCompare(token, []byte(session.CSRFToken)) != 1 {
+				ctx.SetStatusCode(fasthttp.StatusForbidden)
+				ctx.SetBodyString("forbidden: invalid or missing CSRF token, reload the page and try again")
+				return
+			}
+			next(ctx)
+		}
+	}
+}
+
+func isSafeMethod(ctx *fasthttp.RequestCtx) bool {
+	return ctx.IsGet() || ctx.IsHead() || ctx.IsOptions() || ctx.IsTrace()
+}
@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+
+	"github.com/valyala/fasthttp"
+	"gorm.io/gorm"
+
+	"apiinsight/internal/config"
+	dbpkg "apiinsight/internal/db"
+	httpctx "apiinsight/internal/http/ctx"
+)
+
+// maxIdempotencyKeyLength bounds the Idempotency-Key header.
+const maxIdempotencyKeyLength = 255
+
+// Idempotency makes ingest requests carrying an Idempotency-Key header
+// safe to retry: the first response with a final status is stored for
+// cfg.IngestIdempotencyWindow and replayed, with Idempotent-Replayed: true,
+// for later requests with the same key and body. Responses the client is
+// expected to retry (429, 5xx) are not stored. It must run after
+// BearerAuth, as keys are scoped to the API key.
+func Idempotency(db *gorm.DB, cfg *config.Config) func(fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+		return func(ctx *fasthttp.RequestCtx) {
+			key := string(ctx.Request.Header.Peek("Idempotency-Key"))
+			ak, ok := httpctx.APIKeyFromCtx(ctx)
+			if key == "" || !ok || ak == nil {
+				next(ctx)
+				return
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				ctx.SetStatusCode(fasthttp.StatusBadRequest)
+				ctx.SetBodyString("Idempotency-Key is too long")
+				return
+			}
+
+			sum := sha256.Sum256(ctx.PostBody())
+			hash := hex.EncodeToString(sum[:])
+			existing, claimed, err := dbpkg.ClaimBatchKey(db, ak.ID, key, hash, cfg.IngestIdempotencyWindow)
+			if err != nil {
+				log.Printf("idempotency: claim key: %v", err)
+				ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+				ctx.SetBodyString("database error")
+				return
+			}
+			if !claimed {
+				switch {
+				case existing.RequestHash != hash:
+					ctx.SetStatusCode(fasthttp.StatusUnprocessableEntity)
+					ctx.SetBodyString("Idempotency-Key was already used for a different request body")
+				case existing.Status == 0:
+					ctx.SetStatusCode(fasthttp.StatusConflict)
+					ctx.SetBodyString("a request with this Idempotency-Key is still being processed")
+				default:
+					ctx.Response.Header.Set("Idempotent-Replayed", "true")
+					ctx.SetStatusCode(existing.Status)
+					if existing.ContentType != "" {
+						ctx.SetContentType(existing.ContentType)
+					}
+					ctx.SetBody(existing.Body)
+				}
+				return
+			}
+
+			next(ctx)
+
+			status := ctx.Response.StatusCode()
+			if status == fasthttp.StatusTooManyRequests || status >= 500 {
+				err = dbpkg.ReleaseBatchKey(db, ak.ID, key)
+			} else {
+				err = dbpkg.CompleteBatchKey(db, ak.ID, key, status,
+					string(ctx.Response.Header.ContentType()), ctx.Response.Body())
+			}
+			if err != nil {
+				log.Printf("idempotency: store response: %v", err)
+			}
+		}
+	}
+}
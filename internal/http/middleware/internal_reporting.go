@@ -1,19 +1,30 @@
 package middleware
 
 import (
-	"bytes"
-	"encoding/json"
-	"net/http"
+	"net/netip"
+	"strings"
 	"time"
 
+	"github.com/fasthttp/router"
 	"github.com/valyala/fasthttp"
 
+	"apiinsight/internal/clientip"
 	"apiinsight/internal/config"
+	"apiinsight/internal/ingest"
 )
 
-// InternalReporting reports metrics about this API Insight instance to itself.
-// If APP_INTERNAL_API_KEY is not set, this middleware does nothing.
-func InternalReporting(cfg *config.Config, ingestURL string) func(fasthttp.RequestHandler) fasthttp.RequestHandler {
+// EventSink receives the events recorded by InternalReporting. Report must
+// not block.
+type EventSink interface {
+	Report(ev ingest.Event)
+}
+
+// InternalReporting reports metrics about this API Insight instance to
+// itself through sink. Paths matching cfg.InternalReportingExclude are not
+// reported. Requests arriving through one of trustedProxies are attributed
+// to the client named in their Forwarded or X-Forwarded-For header. If
+// APP_INTERNAL_API_KEY is not set, this middleware does nothing.
+func InternalReporting(cfg *config.Config, sink EventSink, trustedProxies []netip.Prefix) func(fasthttp.RequestHandler) fasthttp.RequestHandler {
 	if cfg.InternalAPIKey == "" {
 		return func(next fasthttp.RequestHandler) fasthttp.RequestHandler {
 			return next
@@ -27,36 +38,54 @@ func InternalReporting(cfg *config.Config, ingestURL string) func(fasthttp.Reque
 			duration := time.Since(start)
 
 			path := string(ctx.Path())
-			if path == "/v1/events" || path == "/v1/metrics" || path == "/metrics" || path == "/healthz" || path == "/login" {
+			if pathExcluded(path, cfg.InternalReportingExclude) {
 				return
 			}
 
-			status := ctx.Response.StatusCode()
-			method := string(ctx.Method())
-			remoteAddr := ctx.RemoteAddr().String()
-
-			go func() {
-				event := map[string]interface{}{
-					"timestamp":   time.Now(),
-					"path":        path,
-					"method":      method,
-					"status":      status,
-					"duration_ms": duration.Milliseconds(),
-					"remote_ip":   remoteAddr,
-					"attributes": map[string]interface{}{
-						"env": "internal",
-					},
-				}
-				payload := map[string]interface{}{
-					"events": []interface{}{event},
-				}
-				body, _ := json.Marshal(payload)
-				req, _ := http.NewRequest("POST", ingestURL, bytes.NewReader(body))
-				req.Header.Set("Content-Type", "application/json")
-				req.Header.Set("Authorization", "Bearer "+cfg.InternalAPIKey)
-				client := &http.Client{Timeout: 2 * time.Second}
-				_, _ = client.Do(req)
-			}()
+			// The router records the matched pattern (e.g.
+			// /admin/users/{id}/delete) when SaveMatchedRoutePath is set.
+			route, _ := ctx.UserValue(router.MatchedRoutePathParam).(string)
+
+			remote, _ := netip.AddrFromSlice(ctx.RemoteIP())
+			client := clientip.FromRequest(remote,
+				string(ctx.Request.Header.Peek("Forwarded")),
+				string(ctx.Request.Header.Peek("X-Forwarded-For")),
+				trustedProxies)
+
+			attrs := map[string]any{"env": "internal"}
+			if tp := ctx.Request.Header.Peek("traceparent"); len(tp) > 0 {
+				attrs[ingest.TraceparentAttribute] = string(tp)
+			}
+
+			sink.Report(ingest.Event{
+				Timestamp:  &start,
+				Path:       path,
+				Route:      route,
+				Method:     string(ctx.Method()),
+				Status:     ctx.Response.StatusCode(),
+				DurationMs: duration.Milliseconds(),
+				RemoteIP:   client.String(),
+				UserAgent:  string(ctx.UserAgent()),
+				Attributes: attrs,
+
+				RequestBytes:  int64(len(ctx.Request.Body())),
+				ResponseBytes: int64(len(ctx.Response.Body())),
+			})
+		}
+	}
+}
+
+// pathExcluded reports whether path equals one of patterns or starts with
+// a pattern ending in "*".
+func pathExcluded(path string, patterns []string) bool {
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(path, prefix) {
+				return true
+			}
+		} else if path == p {
+			return true
 		}
 	}
+	return false
 }
@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"github.com/valyala/fasthttp"
+	"gorm.io/gorm"
+
+	"apiinsight/internal/config"
+	dbpkg "apiinsight/internal/db"
+	httpctx "apiinsight/internal/http/ctx"
+)
+
+// MetricsAuth guards the JSON /v1/metrics/* endpoints. Requests carrying an
+// Authorization header are authenticated as an API key: keys with the
+// metrics:read scope see only their own project, keys with the admin scope
+// see every project of their owner. Requests without the header fall back to
+// the dashboard session (AdminAuth).
+func MetricsAuth(db *gorm.DB, cfg *config.Config) func(fasthttp.RequestHandler) fasthttp.RequestHandler {
+	session := AdminAuth(db, cfg)
+	return func(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+		withSession := session(next)
+		return func(ctx *fasthttp.RequestCtx) {
+			if len(ctx.Request.Header.Peek("Authorization")) == 0 {
+				withSession(ctx)
+				return
+			}
+
+			apiKey, ok := authenticateBearer(ctx, db)
+			if !ok {
+				return
+			}
+			switch {
+			case apiKey.HasScope(dbpkg.ScopeAdmin):
+			case apiKey.HasScope(dbpkg.ScopeMetricsRead):
+				httpctx.SetProjectScope(ctx, apiKey.Name)
+			default:
+				ctx.SetStatusCode(fasthttp.StatusForbidden)
+				ctx.SetBodyString("API key lacks required scope: " + dbpkg.ScopeMetricsRead)
+				return
+			}
+			next(ctx)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	// ErrBodyTooLarge is returned when a request body, after
+	// decompression, exceeds the configured limit.
+	ErrBodyTooLarge = errors.New("request body exceeds the size limit")
+
+	// ErrUnsupportedEncoding is returned for a Content-Encoding other than
+	// identity, gzip or zstd.
+	ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+)
+
+// NewBodyReader returns a reader over the decompressed request body. The
+// reader fails with ErrBodyTooLarge once more than max bytes have been
+// produced, so compressed bodies cannot expand without bound.
+func NewBodyReader(body []byte, contentEncoding string, max int64) (io.ReadCloser, error) {
+	var r io.ReadCloser
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "", "identity":
+		r = io.NopCloser(bytes.NewReader(body))
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %w", err)
+		}
+		r = zr
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(body), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("invalid zstd body: %w", err)
+		}
+		r = zr.IOReadCloser()
+	default:
+		return nil, ErrUnsupportedEncoding
+	}
+	return &limitedReader{r: r, remaining: max}, nil
+}
+
+// ReadBody reads the whole decompressed body (see NewBodyReader).
+func ReadBody(body []byte, contentEncoding string, max int64) ([]byte, error) {
+	r, err := NewBodyReader(body, contentEncoding, max)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+type limitedReader struct {
+	r         io.ReadCloser
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		// Only fail if there really is more data.
+		var one [1]byte
+		if n, _ := l.r.Read(one[:]); n > 0 {
+			return 0, ErrBodyTooLarge
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+func (l *limitedReader) Close() error {
+	return l.r.Close()
+}
+
+// NDJSONBatch is the result of decoding newline-delimited events.
+type NDJSONBatch struct {
+	// Events holds one entry per non-blank line. Entries whose line could
+	// not be decoded are zero and listed in Invalid.
+	Events []Event
+	// Lines holds the 1-based line number of each entry in Events.
+	Lines []int
+	// Invalid maps an index in Events to the reason its line was not
+	// valid JSON.
+	Invalid map[int]string
+}
+
+// DecodeNDJSON decodes one event per line from r. Blank lines are skipped;
+// lines that are not valid JSON are recorded in Invalid rather than
+// failing the batch. The returned error is only set when reading r fails,
+// e.g. with ErrBodyTooLarge.
+func DecodeNDJSON(r io.Reader) (NDJSONBatch, error) {
+	batch := NDJSONBatch{Invalid: map[int]string{}}
+	br := bufio.NewReader(r)
+	for lineNo := 1; ; lineNo++ {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return batch, err
+		}
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			var ev Event
+			if uerr := json.Unmarshal(trimmed, &ev); uerr != nil {
+				batch.Invalid[len(batch.Events)] = "invalid JSON: " + uerr.Error()
+				ev = Event{}
+			}
+			batch.Events = append(batch.Events, ev)
+			batch.Lines = append(batch.Lines, lineNo)
+		}
+		if err == io.EOF {
+			return batch, nil
+		}
+	}
+}
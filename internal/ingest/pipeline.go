@@ -0,0 +1,288 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	dbpkg "apiinsight/internal/db"
+	"apiinsight/internal/spool"
+)
+
+var (
+	// ErrQueueFull is returned by Enqueue when accepting the events would
+	// exceed the configured buffer. Callers should ask clients to retry.
+	ErrQueueFull = errors.New("ingest queue is full")
+
+	// ErrClosed is returned by Enqueue once shutdown has started.
+	ErrClosed = errors.New("ingest pipeline is shutting down")
+)
+
+// Options configures a Pipeline.
+type Options struct {
+	// BufferSize is the maximum number of events accepted but not yet
+	// written to the database.
+	BufferSize int
+	// Workers is the number of writer goroutines.
+	Workers int
+	// BatchSize is the maximum number of rows per insert statement.
+	BatchSize int
+	// FlushInterval bounds how long a partial batch is held.
+	FlushInterval time.Duration
+	// Spool, when set, makes ingest durable: Enqueue appends to the
+	// on-disk spool instead of the in-memory queue, and a replayer drains
+	// the spool into the database whenever it is reachable.
+	Spool *spool.Spool
+	// OnStored, when set, is called with the events of every write that
+	// were stored, leaving out duplicates of events stored before.
+	OnStored func(events []dbpkg.Event)
+}
+
+// writeAttempts is how many times a batch insert is tried before the
+// events are dropped and counted as lost.
+const writeAttempts = 5
+
+var (
+	metricsOnce    sync.Once
+	queuedEvents   prometheus.Gauge
+	writtenEvents  prometheus.Counter
+	droppedEvents  prometheus.Counter
+	rejectedEvents prometheus.Counter
+)
+
+func initMetrics() {
+	metricsOnce.Do(func() {
+		queuedEvents = prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "apiinsight",
+			Subsystem: "ingest",
+			Name:      "queued_events",
+			Help:      "Events accepted and waiting to be written to the database.",
+		})
+		writtenEvents = prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "apiinsight",
+			Subsystem: "ingest",
+			Name:      "written_events_total",
+			Help:      "Events written to the database by the ingest pipeline.",
+		})
+		droppedEvents = prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "apiinsight",
+			Subsystem: "ingest",
+			Name:      "dropped_events_total",
+			Help:      "Accepted events that could not be written after retries.",
+		})
+		rejectedEvents = prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "apiinsight",
+			Subsystem: "ingest",
+			Name:      "rejected_events_total",
+			Help:      "Events rejected with 429 because the ingest queue was full.",
+		})
+		prometheus.MustRegister(queuedEvents, writtenEvents, droppedEvents, rejectedEvents)
+	})
+}
+
+// Pipeline decouples ingest requests from database writes. Accepted events
+// are held in a bounded in-memory queue and written by a pool of workers
+// that coalesce events from many requests into multi-row inserts. With a
+// spool configured, events are made durable on disk first and a single
+// replayer writes them in order.
+type Pipeline struct {
+	store dbpkg.Store
+	opts  Options
+
+	// mu guards closed and the closing of queue against concurrent sends.
+	mu     sync.RWMutex
+	closed bool
+	queue  chan []dbpkg.Event
+
+	// closing is closed when shutdown starts; abort when the shutdown
+	// deadline passes and the replayer must give up waiting for the DB.
+	closing chan struct{}
+	abort   chan struct{}
+
+	pending atomic.Int64
+	wg      sync.WaitGroup
+}
+
+// NewPipeline starts the writer workers and returns a ready Pipeline.
+func NewPipeline(store dbpkg.Store, opts Options) *Pipeline {
+	initMetrics()
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = 10000
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 500
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = time.Second
+	}
+
+	p := &Pipeline{
+		store: store,
+		opts:  opts,
+		// Every queued slice holds at least one event and capacity is
+		// reserved before sending, so sends never block.
+		queue:   make(chan []dbpkg.Event, opts.BufferSize),
+		closing: make(chan struct{}),
+		abort:   make(chan struct{}),
+	}
+	if opts.Spool != nil {
+		initSpoolMetrics(opts.Spool)
+		p.wg.Add(1)
+		go p.replay()
+		return p
+	}
+	for i := 0; i < opts.Workers; i++ {
+		p.wg.Add(1)
+		go p.worker()
+	}
+	return p
+}
+
+// Enqueue accepts events for asynchronous writing. Either all events are
+// accepted or none are: ErrQueueFull means the caller should retry later.
+func (p *Pipeline) Enqueue(events []dbpkg.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	n := int64(len(events))
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return ErrClosed
+	}
+	if p.opts.Spool != nil {
+		return p.appendToSpool(events)
+	}
+	if p.pending.Add(n) > int64(p.opts.BufferSize) {
+		p.pending.Add(-n)
+		rejectedEvents.Add(float64(n))
+		return ErrQueueFull
+	}
+	queuedEvents.Add(float64(n))
+	p.queue <- events
+	return nil
+}
+
+// Pending returns the number of accepted events not yet written.
+func (p *Pipeline) Pending() int64 {
+	return p.pending.Load()
+}
+
+// Close stops accepting events and waits until every queued event has
+// been written or ctx is done. Spooled events that could not be written in
+// time stay on disk and are replayed on the next start.
+func (p *Pipeline) Close(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+		close(p.closing)
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		close(p.abort)
+		err = ctx.Err()
+	}
+	if p.opts.Spool != nil {
+		if cerr := p.opts.Spool.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (p *Pipeline) worker() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.opts.FlushInterval)
+	defer ticker.Stop()
+
+	buf := make([]dbpkg.Event, 0, p.opts.BatchSize)
+	for {
+		select {
+		case events, ok := <-p.queue:
+			if !ok {
+				p.flush(buf)
+				return
+			}
+			buf = append(buf, events...)
+			if len(buf) >= p.opts.BatchSize {
+				p.flush(buf)
+				buf = buf[:0]
+			}
+		case <-ticker.C:
+			if len(buf) > 0 {
+				p.flush(buf)
+				buf = buf[:0]
+			}
+		}
+	}
+}
+
+// flush writes events with retries, then releases their queue capacity.
+func (p *Pipeline) flush(events []dbpkg.Event) {
+	if len(events) == 0 {
+		return
+	}
+	n := len(events)
+	defer func() {
+		p.pending.Add(-int64(n))
+		queuedEvents.Sub(float64(n))
+	}()
+
+	stored, err := p.write(events)
+	if err != nil {
+		droppedEvents.Add(float64(n))
+		log.Printf("ingest: dropped %d events after %d attempts: %v", n, writeAttempts, err)
+		return
+	}
+	p.stored(stored)
+}
+
+// stored counts events the database stored and hands them to OnStored.
+func (p *Pipeline) stored(events []dbpkg.Event) {
+	writtenEvents.Add(float64(len(events)))
+	if p.opts.OnStored != nil && len(events) > 0 {
+		p.opts.OnStored(events)
+	}
+}
+
+// write inserts events using multi-row INSERT statements of at most
+// BatchSize rows, retrying with exponential backoff. Duplicate event IDs
+// are skipped rather than failing the batch; the stored events are
+// returned.
+func (p *Pipeline) write(events []dbpkg.Event) ([]dbpkg.Event, error) {
+	backoff := 200 * time.Millisecond
+	var err error
+	for attempt := 1; attempt <= writeAttempts; attempt++ {
+		var stored []dbpkg.Event
+		stored, err = p.store.InsertEvents(events, p.opts.BatchSize)
+		if err == nil {
+			return stored, nil
+		}
+		if attempt < writeAttempts {
+			log.Printf("ingest: write of %d events failed (attempt %d): %v", len(events), attempt, err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,217 @@
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	dbpkg "apiinsight/internal/db"
+	"apiinsight/internal/spool"
+)
+
+const (
+	// replayBatchRecords is how many spooled requests the replayer reads
+	// and writes per transaction.
+	replayBatchRecords = 64
+	// maxHealthBackoff caps the wait between database health checks while
+	// the database is unreachable.
+	maxHealthBackoff = 30 * time.Second
+)
+
+var spoolMetricsOnce sync.Once
+
+func initSpoolMetrics(sp *spool.Spool) {
+	spoolMetricsOnce.Do(func() {
+		prometheus.MustRegister(
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace: "apiinsight",
+				Subsystem: "spool",
+				Name:      "pending_bytes",
+				Help:      "Bytes of accepted events in the spool not yet written to the database.",
+			}, func() float64 { return float64(sp.Stats().PendingBytes) }),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace: "apiinsight",
+				Subsystem: "spool",
+				Name:      "segments",
+				Help:      "Segment files currently held by the spool.",
+			}, func() float64 { return float64(sp.Stats().Segments) }),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace: "apiinsight",
+				Subsystem: "spool",
+				Name:      "oldest_unflushed_age_seconds",
+				Help:      "Age of the oldest spooled event not yet written to the database.",
+			}, func() float64 {
+				oldest := sp.Stats().OldestUnflushed
+				if oldest.IsZero() {
+					return 0
+				}
+				return time.Since(oldest).Seconds()
+			}),
+		)
+	})
+}
+
+// appendToSpool makes events durable on disk. A full spool is reported as
+// ErrQueueFull so clients back off exactly as with the in-memory queue.
+func (p *Pipeline) appendToSpool(events []dbpkg.Event) error {
+	payload, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	if err := p.opts.Spool.Append(payload); err != nil {
+		if errors.Is(err, spool.ErrFull) {
+			rejectedEvents.Add(float64(len(events)))
+			return ErrQueueFull
+		}
+		return err
+	}
+	return nil
+}
+
+// replay drains the spool into the database in append order. A batch is
+// only committed (and so removed from the spool) after it was written, so
+// delivery is at-least-once: a crash between the insert and the commit
+// replays that batch on the next start.
+func (p *Pipeline) replay() {
+	defer p.wg.Done()
+	sp := p.opts.Spool
+
+	ticker := time.NewTicker(p.opts.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		recs, err := sp.Read(replayBatchRecords)
+		if err != nil {
+			log.Printf("ingest: spool read failed: %v", err)
+			if !p.sleep(time.Second) {
+				return
+			}
+			continue
+		}
+		if len(recs) == 0 {
+			select {
+			case <-p.closing:
+				return
+			case <-sp.Notify():
+			case <-ticker.C:
+			}
+			continue
+		}
+
+		var events []dbpkg.Event
+		for _, r := range recs {
+			if len(r.Payload) == 0 {
+				continue // skipped corrupt tail
+			}
+			var batch []dbpkg.Event
+			if err := json.Unmarshal(r.Payload, &batch); err != nil {
+				log.Printf("ingest: discarding undecodable spool record: %v", err)
+				continue
+			}
+			events = append(events, batch...)
+		}
+		if len(events) > 0 && !p.writeDurable(events) {
+			return
+		}
+		if err := sp.Commit(recs[len(recs)-1].Next); err != nil {
+			log.Printf("ingest: spool commit failed: %v", err)
+		}
+	}
+}
+
+// writeDurable writes events, waiting for the database to become healthy
+// for as long as it takes. Once the database answers again but the batch
+// still fails, rows are written one by one and rows the database refuses
+// are dropped so a single bad event cannot stall the spool. It returns
+// false only when shutdown gave up waiting.
+func (p *Pipeline) writeDurable(events []dbpkg.Event) bool {
+	backoff := time.Second
+	for {
+		stored, err := p.write(events)
+		if err == nil {
+			p.stored(stored)
+			return true
+		}
+		log.Printf("ingest: spooled write of %d events failed: %v", len(events), err)
+		if p.healthy() {
+			p.writeEach(events)
+			return true
+		}
+		for !p.healthy() {
+			if !p.sleep(backoff) {
+				return false
+			}
+			if backoff *= 2; backoff > maxHealthBackoff {
+				backoff = maxHealthBackoff
+			}
+		}
+	}
+}
+
+func (p *Pipeline) writeEach(events []dbpkg.Event) {
+	for i := range events {
+		stored, err := p.store.InsertEvents(events[i:i+1], 1)
+		if err != nil {
+			droppedEvents.Inc()
+			log.Printf("ingest: dropped spooled event: %v", err)
+			continue
+		}
+		p.stored(stored)
+	}
+}
+
+// healthy reports whether the database answers a ping.
+func (p *Pipeline) healthy() bool {
+	sqlDB, err := p.store.DB().DB()
+	if err != nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return sqlDB.PingContext(ctx) == nil
+}
+
+// sleep waits for d and reports false if shutdown was aborted meanwhile.
+func (p *Pipeline) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-p.abort:
+		return false
+	}
+}
+
+// Health describes the state of the ingest pipeline for /healthz/ingest.
+type Health struct {
+	QueuedEvents         int64      `json:"queued_events"`
+	Spool                bool       `json:"spool"`
+	SpoolPendingBytes    int64      `json:"spool_pending_bytes,omitempty"`
+	SpoolSegments        int        `json:"spool_segments,omitempty"`
+	SpoolOldestUnflushed *time.Time `json:"spool_oldest_unflushed,omitempty"`
+	SpoolLagSeconds      float64    `json:"spool_lag_seconds,omitempty"`
+}
+
+// Health returns the current queue and spool state.
+func (p *Pipeline) Health() Health {
+	h := Health{QueuedEvents: p.Pending()}
+	if p.opts.Spool == nil {
+		return h
+	}
+	st := p.opts.Spool.Stats()
+	h.Spool = true
+	h.SpoolPendingBytes = st.PendingBytes
+	h.SpoolSegments = st.Segments
+	if !st.OldestUnflushed.IsZero() {
+		oldest := st.OldestUnflushed
+		h.SpoolOldestUnflushed = &oldest
+		h.SpoolLagSeconds = time.Since(oldest).Seconds()
+	}
+	return h
+}
@@ -0,0 +1,89 @@
+package ingest
+
+import "strings"
+
+// Lengths of W3C trace context identifiers, in hex digits.
+const (
+	TraceIDLength = 32
+	SpanIDLength  = 16
+)
+
+// TraceparentAttribute is the attribute holding a W3C traceparent header,
+// as recorded by the SDK middlewares and internal reporting.
+const TraceparentAttribute = "traceparent"
+
+// ParseTraceparent parses a W3C traceparent header
+// ("00-<trace-id>-<parent-id>-<flags>"). The parent ID is the span of the
+// caller, i.e. the parent of the span handling the request. Invalid values
+// are reported with ok false, as the specification asks receivers to
+// ignore them.
+func ParseTraceparent(s string) (traceID, parentID string, ok bool) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(s)), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || !isHex(parts[0]) {
+		return "", "", false
+	}
+	// Version 00 has exactly four fields; later versions may append more.
+	if parts[0] == "00" && len(parts) != 4 {
+		return "", "", false
+	}
+	if len(parts[3]) != 2 || !isHex(parts[3]) {
+		return "", "", false
+	}
+	if !ValidTraceID(parts[1]) || !ValidSpanID(parts[2]) {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// ValidTraceID reports whether s is a lowercase, non-zero 32-digit hex
+// trace ID.
+func ValidTraceID(s string) bool {
+	return len(s) == TraceIDLength && isHex(s) && strings.Trim(s, "0") != ""
+}
+
+// ValidSpanID reports whether s is a lowercase, non-zero 16-digit hex
+// span ID.
+func ValidSpanID(s string) bool {
+	return len(s) == SpanIDLength && isHex(s) && strings.Trim(s, "0") != ""
+}
+
+// normalizeTrace lower-cases and checks the trace fields of ev, filling
+// them from a traceparent attribute when the event has no trace ID.
+func normalizeTrace(ev *Event) string {
+	ev.TraceID = strings.ToLower(ev.TraceID)
+	ev.SpanID = strings.ToLower(ev.SpanID)
+	ev.ParentSpanID = strings.ToLower(ev.ParentSpanID)
+
+	if ev.TraceID == "" {
+		if tp, ok := ev.Attributes[TraceparentAttribute].(string); ok {
+			if traceID, parentID, ok := ParseTraceparent(tp); ok {
+				ev.TraceID = traceID
+				if ev.ParentSpanID == "" {
+					ev.ParentSpanID = parentID
+				}
+			}
+		}
+	}
+
+	switch {
+	case ev.TraceID != "" && !ValidTraceID(ev.TraceID):
+		return "trace_id must be 32 hex digits and not all zero"
+	case ev.SpanID != "" && !ValidSpanID(ev.SpanID):
+		return "span_id must be 16 hex digits and not all zero"
+	case ev.ParentSpanID != "" && !ValidSpanID(ev.ParentSpanID):
+		return "parent_span_id must be 16 hex digits and not all zero"
+	case ev.TraceID == "" && (ev.SpanID != "" || ev.ParentSpanID != ""):
+		return "span_id and parent_span_id require a trace_id"
+	}
+	return ""
+}
+
+func isHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,236 @@
+package ingest
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"apiinsight/internal/sampling"
+)
+
+// Event is a single request event as sent by clients to /v1/events.
+type Event struct {
+	Timestamp  *time.Time     `json:"timestamp,omitempty"`
+	Path       string         `json:"path"`
+	Method     string         `json:"method,omitempty"`
+	Status     int            `json:"status,omitempty"`
+	UserID     string         `json:"user_id,omitempty"`
+	DurationMs int64          `json:"duration_ms"`
+	RemoteIP   string         `json:"remote_ip,omitempty"`
+	Attributes map[string]any `json:"attributes,omitempty"`
+
+	// Route is the route template when the source already knows it, e.g.
+	// from the router of an SDK middleware or OpenTelemetry's http.route.
+	// When empty, the route is derived from Path.
+	Route string `json:"route,omitempty"`
+
+	// EventID is an optional client-chosen identifier. An event whose ID
+	// was already stored for the same project is dropped, so retried
+	// deliveries do not create duplicates.
+	EventID string `json:"event_id,omitempty"`
+
+	// UserAgent is the client's User-Agent header. Browser, OS, device,
+	// app version and bot flag are derived from it at ingest.
+	UserAgent string `json:"user_agent,omitempty"`
+
+	// RequestBytes and ResponseBytes are the sizes of the request and
+	// response bodies (or whole messages, when that is what the source
+	// measures). Zero means unknown.
+	RequestBytes  int64 `json:"request_bytes,omitempty"`
+	ResponseBytes int64 `json:"response_bytes,omitempty"`
+
+	// TraceID, SpanID and ParentSpanID place the request in a distributed
+	// trace (W3C trace context, lowercase hex). When TraceID is empty they
+	// are taken from a "traceparent" attribute; see ParseTraceparent.
+	TraceID      string `json:"trace_id,omitempty"`
+	SpanID       string `json:"span_id,omitempty"`
+	ParentSpanID string `json:"parent_span_id,omitempty"`
+
+	// SampleRate is the fraction of requests the client reports, e.g. 0.1
+	// when only 1 in 10 is sent. Each stored event then counts as 1/SampleRate
+	// requests in metrics. Zero means 1 (unsampled).
+	SampleRate float64 `json:"sample_rate,omitempty"`
+}
+
+// MaxEventIDLength is the longest accepted event_id, in bytes.
+const MaxEventIDLength = 128
+
+// MaxUserAgentLength is the longest stored user_agent, in bytes; longer
+// values are truncated rather than rejected.
+const MaxUserAgentLength = 512
+
+// Limits bounds what a single event may contain.
+type Limits struct {
+	// MaxPathLength is the longest accepted path, in bytes.
+	MaxPathLength int
+	// MaxAge rejects events whose timestamp is further in the past.
+	MaxAge time.Duration
+	// MaxClockSkew rejects events whose timestamp is further in the future.
+	MaxClockSkew time.Duration
+	// MaxAttributes is the maximum number of top-level attribute keys.
+	MaxAttributes int
+	// MaxAttributeBytes is the maximum JSON-encoded size of all attributes.
+	MaxAttributeBytes int
+	// MaxAttributeDepth is the maximum nesting of attribute values; 1
+	// allows only scalars, 2 allows one level of objects or arrays.
+	MaxAttributeDepth int
+}
+
+// DefaultLimits are used for any zero field of a Limits value.
+var DefaultLimits = Limits{
+	MaxPathLength:     2048,
+	MaxAge:            7 * 24 * time.Hour,
+	MaxClockSkew:      5 * time.Minute,
+	MaxAttributes:     64,
+	MaxAttributeBytes: 16 << 10,
+	MaxAttributeDepth: 3,
+}
+
+// allowedMethods is the HTTP method whitelist. An empty method is allowed
+// for clients that do not report one.
+var allowedMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true,
+	"DELETE": true, "OPTIONS": true, "TRACE": true, "CONNECT": true,
+}
+
+// Validator checks events against Limits.
+type Validator struct {
+	limits Limits
+}
+
+// NewValidator returns a Validator, filling zero limits from DefaultLimits.
+func NewValidator(limits Limits) *Validator {
+	if limits.MaxPathLength <= 0 {
+		limits.MaxPathLength = DefaultLimits.MaxPathLength
+	}
+	if limits.MaxAge <= 0 {
+		limits.MaxAge = DefaultLimits.MaxAge
+	}
+	if limits.MaxClockSkew <= 0 {
+		limits.MaxClockSkew = DefaultLimits.MaxClockSkew
+	}
+	if limits.MaxAttributes <= 0 {
+		limits.MaxAttributes = DefaultLimits.MaxAttributes
+	}
+	if limits.MaxAttributeBytes <= 0 {
+		limits.MaxAttributeBytes = DefaultLimits.MaxAttributeBytes
+	}
+	if limits.MaxAttributeDepth <= 0 {
+		limits.MaxAttributeDepth = DefaultLimits.MaxAttributeDepth
+	}
+	return &Validator{limits: limits}
+}
+
+// Validate checks ev and returns a client-facing reason when it must be
+// rejected, or "" when it is valid. The method is upper-cased in place so
+// "get" and "GET" are stored alike, and trace IDs are lower-cased or filled
+// in from a traceparent attribute.
+func (v *Validator) Validate(ev *Event, now time.Time) string {
+	switch {
+	case ev.Path == "":
+		return "path is required"
+	case !strings.HasPrefix(ev.Path, "/"):
+		return "path must start with /"
+	case len(ev.Path) > v.limits.MaxPathLength:
+		return fmt.Sprintf("path exceeds %d bytes", v.limits.MaxPathLength)
+	case strings.IndexFunc(ev.Path, unicode.IsControl) >= 0:
+		return "path contains control characters"
+	}
+
+	if ev.Route != "" {
+		switch {
+		case !strings.HasPrefix(ev.Route, "/"):
+			return "route must start with /"
+		case len(ev.Route) > v.limits.MaxPathLength:
+			return fmt.Sprintf("route exceeds %d bytes", v.limits.MaxPathLength)
+		case strings.IndexFunc(ev.Route, unicode.IsControl) >= 0:
+			return "route contains control characters"
+		}
+	}
+
+	if len(ev.EventID) > MaxEventIDLength {
+		return fmt.Sprintf("event_id exceeds %d bytes", MaxEventIDLength)
+	}
+	if strings.IndexFunc(ev.EventID, unicode.IsControl) >= 0 {
+		return "event_id contains control characters"
+	}
+
+	if reason := normalizeTrace(ev); reason != "" {
+		return reason
+	}
+
+	if ev.RequestBytes < 0 || ev.ResponseBytes < 0 {
+		return "request_bytes and response_bytes must not be negative"
+	}
+
+	if ev.SampleRate != 0 && !sampling.ValidRate(ev.SampleRate) {
+		return fmt.Sprintf("sample_rate must be between %g and 1", sampling.MinRate)
+	}
+
+	ev.Method = strings.ToUpper(strings.TrimSpace(ev.Method))
+	if ev.Method != "" && !allowedMethods[ev.Method] {
+		return fmt.Sprintf("method %q is not allowed", ev.Method)
+	}
+
+	if ev.Status != 0 && (ev.Status < 100 || ev.Status > 599) {
+		return fmt.Sprintf("status %d is outside 100-599", ev.Status)
+	}
+	if ev.DurationMs < 0 {
+		return "duration_ms must not be negative"
+	}
+
+	if ev.Timestamp != nil {
+		if ev.Timestamp.Before(now.Add(-v.limits.MaxAge)) {
+			return fmt.Sprintf("timestamp is more than %s in the past", v.limits.MaxAge)
+		}
+		if ev.Timestamp.After(now.Add(v.limits.MaxClockSkew)) {
+			return fmt.Sprintf("timestamp is more than %s in the future", v.limits.MaxClockSkew)
+		}
+	}
+
+	if len(ev.Attributes) > v.limits.MaxAttributes {
+		return fmt.Sprintf("more than %d attributes", v.limits.MaxAttributes)
+	}
+	for k, val := range ev.Attributes {
+		if k == "" {
+			return "attribute keys must not be empty"
+		}
+		if depth(val) > v.limits.MaxAttributeDepth {
+			return fmt.Sprintf("attribute %q is nested deeper than %d levels", k, v.limits.MaxAttributeDepth)
+		}
+	}
+	if len(ev.Attributes) > 0 {
+		b, err := json.Marshal(ev.Attributes)
+		if err != nil {
+			return "attributes are not valid JSON"
+		}
+		if len(b) > v.limits.MaxAttributeBytes {
+			return fmt.Sprintf("attributes exceed %d bytes", v.limits.MaxAttributeBytes)
+		}
+	}
+	return ""
+}
+
+// depth returns the nesting depth of a decoded JSON value; scalars are 1.
+func depth(v any) int {
+	max := 0
+	switch t := v.(type) {
+	case map[string]any:
+		for _, e := range t {
+			if d := depth(e); d > max {
+				max = d
+			}
+		}
+	case []any:
+		for _, e := range t {
+			if d := depth(e); d > max {
+				max = d
+			}
+		}
+	default:
+		return 1
+	}
+	return max + 1
+}
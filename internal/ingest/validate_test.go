@@ -0,0 +1,125 @@
+package ingest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"apiinsight/internal/sampling"
+)
+
+func TestValidate(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *time.Time {
+		ts := now.Add(d)
+		return &ts
+	}
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	tests := []struct {
+		name   string
+		ev     Event
+		reason string
+	}{
+		{"minimal", Event{Path: "/"}, ""},
+		{"missing path", Event{}, "path is required"},
+		{"relative path", Event{Path: "users"}, "path must start with /"},
+		{"long path", Event{Path: "/" + strings.Repeat("a", 2048)}, "path exceeds 2048 bytes"},
+		{"control character in path", Event{Path: "/a\nb"}, "path contains control characters"},
+		{"relative route", Event{Path: "/u/1", Route: "u/:id"}, "route must start with /"},
+
+		{"event_id at limit", Event{Path: "/", EventID: strings.Repeat("e", MaxEventIDLength)}, ""},
+		{"long event_id", Event{Path: "/", EventID: strings.Repeat("e", MaxEventIDLength+1)}, "event_id exceeds 128 bytes"},
+		{"control character in event_id", Event{Path: "/", EventID: "a\x00"}, "event_id contains control characters"},
+
+		{"trace ids", Event{Path: "/", TraceID: traceID, SpanID: "00f067aa0ba902b7"}, ""},
+		{"zero trace_id", Event{Path: "/", TraceID: strings.Repeat("0", 32)}, "trace_id must be 32 hex digits and not all zero"},
+		{"span without trace", Event{Path: "/", SpanID: "00f067aa0ba902b7"}, "span_id and parent_span_id require a trace_id"},
+
+		{"negative response_bytes", Event{Path: "/", ResponseBytes: -1}, "request_bytes and response_bytes must not be negative"},
+
+		{"lowercase method", Event{Path: "/", Method: " get "}, ""},
+		{"unknown method", Event{Path: "/", Method: "brew"}, `method "BREW" is not allowed`},
+		{"status 599", Event{Path: "/", Status: 599}, ""},
+		{"status 600", Event{Path: "/", Status: 600}, "status 600 is outside 100-599"},
+		{"negative duration", Event{Path: "/", DurationMs: -1}, "duration_ms must not be negative"},
+
+		{"timestamp within skew", Event{Path: "/", Timestamp: at(4 * time.Minute)}, ""},
+		{"timestamp in the future", Event{Path: "/", Timestamp: at(6 * time.Minute)}, "timestamp is more than 5m0s in the future"},
+		{"timestamp too old", Event{Path: "/", Timestamp: at(-8 * 24 * time.Hour)}, "timestamp is more than 168h0m0s in the past"},
+
+		{"nested attributes", Event{Path: "/", Attributes: map[string]any{"a": map[string]any{"b": []any{1.0}}}}, ""},
+		{"attributes too deep", Event{Path: "/", Attributes: map[string]any{"a": map[string]any{"b": []any{[]any{1.0}}}}}, `attribute "a" is nested deeper than 3 levels`},
+		{"empty attribute key", Event{Path: "/", Attributes: map[string]any{"": 1.0}}, "attribute keys must not be empty"},
+		{"large attributes", Event{Path: "/", Attributes: map[string]any{"a": strings.Repeat("x", 16<<10)}}, "attributes exceed 16384 bytes"},
+	}
+	v := NewValidator(Limits{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev := tt.ev
+			if got := v.Validate(&ev, now); got != tt.reason {
+				t.Errorf("Validate = %q, want %q", got, tt.reason)
+			}
+		})
+	}
+}
+
+func TestValidateNormalizes(t *testing.T) {
+	v := NewValidator(Limits{})
+	ev := Event{
+		Path:   "/",
+		Method: "post",
+		Attributes: map[string]any{
+			TraceparentAttribute: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00F067AA0BA902B7-01",
+		},
+	}
+	if reason := v.Validate(&ev, time.Now()); reason != "" {
+		t.Fatalf("Validate = %q", reason)
+	}
+	if ev.Method != "POST" {
+		t.Errorf("Method = %q, want POST", ev.Method)
+	}
+	if ev.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || ev.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("trace = %q/%q, want IDs from the traceparent attribute", ev.TraceID, ev.ParentSpanID)
+	}
+}
+
+func TestValidatorLimits(t *testing.T) {
+	v := NewValidator(Limits{MaxPathLength: 4, MaxAttributes: 1, MaxAttributeDepth: 1})
+	tests := []struct {
+		ev     Event
+		reason string
+	}{
+		{Event{Path: "/abc"}, ""},
+		{Event{Path: "/abcd"}, "path exceeds 4 bytes"},
+		{Event{Path: "/", Attributes: map[string]any{"a": 1.0, "b": 2.0}}, "more than 1 attributes"},
+		{Event{Path: "/", Attributes: map[string]any{"a": []any{1.0}}}, `attribute "a" is nested deeper than 1 levels`},
+	}
+	for _, tt := range tests {
+		if got := v.Validate(&tt.ev, time.Now()); got != tt.reason {
+			t.Errorf("Validate(%+v) = %q, want %q", tt.ev, got, tt.reason)
+		}
+	}
+}
+
+func TestValidateSampleRate(t *testing.T) {
+	tests := []struct {
+		rate   float64
+		reason string
+	}{
+		{0, ""},
+		{1, ""},
+		{0.5, ""},
+		{sampling.MinRate, ""},
+		{sampling.MinRate / 10, "sample_rate must be between 0.0001 and 1"},
+		{-0.5, "sample_rate must be between 0.0001 and 1"},
+		{1.5, "sample_rate must be between 0.0001 and 1"},
+	}
+	v := NewValidator(Limits{})
+	for _, tt := range tests {
+		ev := Event{Path: "/", SampleRate: tt.rate}
+		if got := v.Validate(&ev, time.Now()); got != tt.reason {
+			t.Errorf("Validate(sample_rate %g) = %q, want %q", tt.rate, got, tt.reason)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package otlp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+// The types below mirror the OTLP/JSON encoding, which differs from the
+// generic protobuf JSON mapping: trace and span IDs are hex strings rather
+// than base64, and 64-bit integers may be sent as strings or numbers.
+
+type jsonRequest struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []jsonKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []struct {
+			Scope struct {
+				Name string `json:"name"`
+			} `json:"scope"`
+			Spans []jsonSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+type jsonSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId"`
+	Name              string         `json:"name"`
+	Kind              jsonSpanKind   `json:"kind"`
+	StartTimeUnixNano jsonUint64     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   jsonUint64     `json:"endTimeUnixNano"`
+	Attributes        []jsonKeyValue `json:"attributes"`
+	Status            struct {
+		Code jsonStatusCode `json:"code"`
+	} `json:"status"`
+}
+
+type jsonKeyValue struct {
+	Key   string    `json:"key"`
+	Value jsonValue `json:"value"`
+}
+
+type jsonValue struct {
+	StringValue *string    `json:"stringValue"`
+	BoolValue   *bool      `json:"boolValue"`
+	IntValue    *jsonInt64 `json:"intValue"`
+	DoubleValue *float64   `json:"doubleValue"`
+	BytesValue  *string    `json:"bytesValue"`
+	ArrayValue  *struct {
+		Values []jsonValue `json:"values"`
+	} `json:"arrayValue"`
+	KvlistValue *struct {
+		Values []jsonKeyValue `json:"values"`
+	} `json:"kvlistValue"`
+}
+
+func (v *jsonValue) value() any {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.IntValue != nil:
+		return int64(*v.IntValue)
+	case v.DoubleValue != nil:
+		return *v.DoubleValue
+	case v.BytesValue != nil:
+		return *v.BytesValue // already base64
+	case v.ArrayValue != nil:
+		out := make([]any, 0, len(v.ArrayValue.Values))
+		for i := range v.ArrayValue.Values {
+			out = append(out, v.ArrayValue.Values[i].value())
+		}
+		return out
+	case v.KvlistValue != nil:
+		return jsonAttributes(v.KvlistValue.Values)
+	}
+	return nil
+}
+
+func jsonAttributes(kvs []jsonKeyValue) map[string]any {
+	out := make(map[string]any, len(kvs))
+	for i := range kvs {
+		if v := kvs[i].Value.value(); v != nil {
+			out[kvs[i].Key] = v
+		}
+	}
+	return out
+}
+
+// unquote strips the quotes of a JSON string so numeric fields can be
+// parsed whether they were sent as "123" or 123.
+func unquote(b []byte) []byte {
+	if len(b) >= 2 && b[0] == '"' && b[len(b)-1] == '"' {
+		return b[1 : len(b)-1]
+	}
+	return b
+}
+
+type jsonUint64 uint64
+
+func (n *jsonUint64) UnmarshalJSON(b []byte) error {
+	if bytes.Equal(b, []byte("null")) {
+		return nil
+	}
+	v, err := strconv.ParseUint(string(unquote(b)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid uint64 %s", b)
+	}
+	*n = jsonUint64(v)
+	return nil
+}
+
+type jsonInt64 int64
+
+func (n *jsonInt64) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseInt(string(unquote(b)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid int64 %s", b)
+	}
+	*n = jsonInt64(v)
+	return nil
+}
+
+// jsonSpanKind accepts the enum as an integer or by name.
+type jsonSpanKind int32
+
+func (k *jsonSpanKind) UnmarshalJSON(b []byte) error {
+	if v, ok := tracepb.Span_SpanKind_value[string(unquote(b))]; ok {
+		*k = jsonSpanKind(v)
+		return nil
+	}
+	v, err := strconv.ParseInt(string(b), 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid span kind %s", b)
+	}
+	*k = jsonSpanKind(v)
+	return nil
+}
+
+// jsonStatusCode accepts the enum as an integer or by name.
+type jsonStatusCode int32
+
+func (c *jsonStatusCode) UnmarshalJSON(b []byte) error {
+	if v, ok := tracepb.Status_StatusCode_value[string(unquote(b))]; ok {
+		*c = jsonStatusCode(v)
+		return nil
+	}
+	v, err := strconv.ParseInt(string(b), 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid status code %s", b)
+	}
+	*c = jsonStatusCode(v)
+	return nil
+}
+
+// DecodeJSON decodes an OTLP/JSON ExportTraceServiceRequest.
+func DecodeJSON(body []byte) (Result, error) {
+	var req jsonRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return Result{}, err
+	}
+	var spans []span
+	for _, rs := range req.ResourceSpans {
+		resource := jsonAttributes(rs.Resource.Attributes)
+		for _, ss := range rs.ScopeSpans {
+			for i := range ss.Spans {
+				s := &ss.Spans[i]
+				spans = append(spans, span{
+					traceID:      s.TraceID,
+					spanID:       s.SpanID,
+					parentSpanID: s.ParentSpanID,
+					name:         s.Name,
+					kind:         int32(s.Kind),
+					start:        uint64(s.StartTimeUnixNano),
+					end:          uint64(s.EndTimeUnixNano),
+					statusCode:   int32(s.Status.Code),
+					attrs:        jsonAttributes(s.Attributes),
+					resource:     resource,
+					scope:        ss.Scope.Name,
+				})
+			}
+		}
+	}
+	return toResult(spans), nil
+}
+
+// EncodeJSONResponse returns an OTLP/JSON ExportTraceServiceResponse.
+func EncodeJSONResponse(rejected int64, message string) []byte {
+	if rejected == 0 && message == "" {
+		return []byte("{}")
+	}
+	body, _ := json.Marshal(map[string]any{
+		"partialSuccess": map[string]any{
+			"rejectedSpans": strconv.FormatInt(rejected, 10),
+			"errorMessage":  message,
+		},
+	})
+	return body
+}
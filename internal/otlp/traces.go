@@ -0,0 +1,269 @@
+// Package otlp converts OpenTelemetry trace exports (OTLP/HTTP, protobuf or
+// JSON encoding) into ingest events. Only server spans describe requests
+// handled by a service, so every other span kind is ignored.
+package otlp
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+
+	"apiinsight/internal/ingest"
+)
+
+// span is the subset of an OTLP span needed to build an event, independent
+// of the wire encoding it came from.
+type span struct {
+	traceID      string
+	spanID       string
+	parentSpanID string
+	name         string
+	kind         int32
+	start, end   uint64
+	statusCode   int32
+	attrs        map[string]any
+	resource     map[string]any
+	scope        string
+}
+
+const spanKindServer = int32(tracepb.Span_SPAN_KIND_SERVER)
+
+// Result is the outcome of decoding an export request.
+type Result struct {
+	// Events holds one event per server span, in request order.
+	Events []ingest.Event
+	// Spans is the total number of spans in the request, including the
+	// ignored non-server ones.
+	Spans int
+}
+
+// DecodeProtobuf decodes a binary ExportTraceServiceRequest.
+func DecodeProtobuf(body []byte) (Result, error) {
+	// ExportTraceServiceRequest and TracesData share the same wire format
+	// (field 1: repeated ResourceSpans), which spares a dependency on the
+	// gRPC collector packages.
+	var req tracepb.TracesData
+	if err := proto.Unmarshal(body, &req); err != nil {
+		return Result{}, err
+	}
+	var spans []span
+	for _, rs := range req.GetResourceSpans() {
+		resource := pbAttributes(rs.GetResource().GetAttributes())
+		for _, ss := range rs.GetScopeSpans() {
+			scope := ss.GetScope().GetName()
+			for _, s := range ss.GetSpans() {
+				spans = append(spans, span{
+					traceID:      hex.EncodeToString(s.GetTraceId()),
+					spanID:       hex.EncodeToString(s.GetSpanId()),
+					parentSpanID: hex.EncodeToString(s.GetParentSpanId()),
+					name:         s.GetName(),
+					kind:         int32(s.GetKind()),
+					start:        s.GetStartTimeUnixNano(),
+					end:          s.GetEndTimeUnixNano(),
+					statusCode:   int32(s.GetStatus().GetCode()),
+					attrs:        pbAttributes(s.GetAttributes()),
+					resource:     resource,
+					scope:        scope,
+				})
+			}
+		}
+	}
+	return toResult(spans), nil
+}
+
+func pbAttributes(kvs []*commonpb.KeyValue) map[string]any {
+	out := make(map[string]any, len(kvs))
+	for _, kv := range kvs {
+		if v := pbValue(kv.GetValue()); v != nil {
+			out[kv.GetKey()] = v
+		}
+	}
+	return out
+}
+
+func pbValue(v *commonpb.AnyValue) any {
+	switch t := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return t.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return t.BoolValue
+	case *commonpb.AnyValue_IntValue:
+		return t.IntValue
+	case *commonpb.AnyValue_DoubleValue:
+		return t.DoubleValue
+	case *commonpb.AnyValue_BytesValue:
+		return base64.StdEncoding.EncodeToString(t.BytesValue)
+	case *commonpb.AnyValue_ArrayValue:
+		out := make([]any, 0, len(t.ArrayValue.GetValues()))
+		for _, e := range t.ArrayValue.GetValues() {
+			out = append(out, pbValue(e))
+		}
+		return out
+	case *commonpb.AnyValue_KvlistValue:
+		return pbAttributes(t.KvlistValue.GetValues())
+	}
+	return nil
+}
+
+// toResult converts HTTP server spans to events.
+func toResult(spans []span) Result {
+	res := Result{Spans: len(spans)}
+	for i := range spans {
+		if spans[i].kind != spanKindServer {
+			continue
+		}
+		ev := spans[i].event()
+		if ev.Path == "" && ev.Method == "" {
+			continue // not an HTTP server span, e.g. gRPC
+		}
+		res.Events = append(res.Events, ev)
+	}
+	return res
+}
+
+// event maps a server span to an ingest event using the stable HTTP
+// semantic conventions, falling back to the older attribute names that
+// many instrumentations still emit.
+func (s *span) event() ingest.Event {
+	ev := ingest.Event{
+		Route:      stringAttr(s.attrs, "http.route"),
+		Method:     stringAttr(s.attrs, "http.request.method", "http.method"),
+		Status:     intAttr(s.attrs, "http.response.status_code", "http.status_code"),
+		RemoteIP:   stringAttr(s.attrs, "client.address", "http.client_ip", "net.sock.peer.addr", "net.peer.ip"),
+		UserAgent:  stringAttr(s.attrs, "user_agent.original", "http.user_agent"),
+		Attributes: make(map[string]any, len(s.resource)+len(s.attrs)+4),
+	}
+	if ev.Method == "_OTHER" {
+		ev.Method = ""
+	}
+	ev.RequestBytes = int64(intAttr(s.attrs, "http.request.body.size", "http.request_content_length"))
+	ev.ResponseBytes = int64(intAttr(s.attrs, "http.response.body.size", "http.response_content_length"))
+
+	ev.Path = stringAttr(s.attrs, "url.path")
+	if ev.Path == "" {
+		// http.target and url.full may carry a query string or a full URL.
+		if target := stringAttr(s.attrs, "http.target", "url.full", "http.url"); target != "" {
+			if u, err := url.Parse(target); err == nil {
+				ev.Path = u.Path
+			}
+		}
+	}
+	if ev.Path == "" {
+		ev.Path = ev.Route
+	}
+
+	if s.start > 0 {
+		ts := time.Unix(0, int64(s.start)).UTC()
+		ev.Timestamp = &ts
+	}
+	if s.end >= s.start {
+		ev.DurationMs = int64((s.end - s.start) / uint64(time.Millisecond))
+	}
+
+	// Resource attributes (service.name, deployment.environment, ...) come
+	// first so that span attributes win on conflicts.
+	for k, v := range s.resource {
+		ev.Attributes[k] = v
+	}
+	for k, v := range s.attrs {
+		ev.Attributes[k] = v
+	}
+	ev.Attributes["span.name"] = s.name
+	// Malformed IDs are left out rather than failing validation, so the
+	// span is still stored, just without its place in the trace.
+	if traceID := strings.ToLower(s.traceID); ingest.ValidTraceID(traceID) {
+		ev.TraceID = traceID
+		if spanID := strings.ToLower(s.spanID); ingest.ValidSpanID(spanID) {
+			ev.SpanID = spanID
+		}
+		if parentID := strings.ToLower(s.parentSpanID); ingest.ValidSpanID(parentID) {
+			ev.ParentSpanID = parentID
+		}
+	}
+	if s.spanID != "" {
+		// A span is identified by its trace and span IDs, so an exporter
+		// retrying a request does not store the span twice.
+		ev.EventID = s.traceID + s.spanID
+	}
+	if s.scope != "" {
+		ev.Attributes["otel.scope.name"] = s.scope
+	}
+	if s.statusCode != 0 {
+		ev.Attributes["otel.status_code"] = strings.TrimPrefix(tracepb.Status_StatusCode_name[s.statusCode], "STATUS_CODE_")
+	}
+	return ev
+}
+
+func stringAttr(attrs map[string]any, keys ...string) string {
+	for _, k := range keys {
+		switch v := attrs[k].(type) {
+		case string:
+			if v != "" {
+				return v
+			}
+		case int64:
+			return strconv.FormatInt(v, 10)
+		}
+	}
+	return ""
+}
+
+func intAttr(attrs map[string]any, keys ...string) int {
+	for _, k := range keys {
+		switch v := attrs[k].(type) {
+		case int64:
+			return int(v)
+		case float64:
+			return int(v)
+		case string:
+			if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+				return n
+			}
+		}
+	}
+	return 0
+}
+
+// EncodeProtobufResponse returns a binary ExportTraceServiceResponse. A
+// partial_success is included only when spans were rejected.
+func EncodeProtobufResponse(rejected int64, message string) []byte {
+	if rejected == 0 && message == "" {
+		return []byte{}
+	}
+	var ps []byte
+	ps = protowire.AppendTag(ps, 1, protowire.VarintType)
+	ps = protowire.AppendVarint(ps, uint64(rejected))
+	if message != "" {
+		ps = protowire.AppendTag(ps, 2, protowire.BytesType)
+		ps = protowire.AppendString(ps, message)
+	}
+	var out []byte
+	out = protowire.AppendTag(out, 1, protowire.BytesType)
+	out = protowire.AppendBytes(out, ps)
+	return out
+}
+
+// ErrUnsupportedContentType is returned for bodies that are neither
+// application/x-protobuf nor application/json.
+var ErrUnsupportedContentType = errors.New("unsupported content type")
+
+// Decode decodes body according to contentType.
+func Decode(contentType string, body []byte) (Result, error) {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+	switch mediaType {
+	case "application/x-protobuf", "application/protobuf":
+		return DecodeProtobuf(body)
+	case "application/json":
+		return DecodeJSON(body)
+	}
+	return Result{}, ErrUnsupportedContentType
+}
@@ -0,0 +1,313 @@
+// Package ratelimit enforces per-API-key ingest limits: token buckets for
+// events and bytes per second, and daily and monthly event quotas counted
+// in UTC calendar periods.
+package ratelimit
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limits are the limits configured for one key. Zero disables a limit.
+type Limits struct {
+	EventsPerSecond int
+	BytesPerSecond  int64
+	DailyEvents     int64
+	MonthlyEvents   int64
+}
+
+// Delta is usage to add to a key's counters for one UTC day.
+type Delta struct {
+	KeyID  uint
+	Day    time.Time
+	Events int64
+	Bytes  int64
+}
+
+// Store persists quota usage so it survives restarts.
+type Store interface {
+	// Usage returns the events already counted for key on day and in the
+	// calendar month containing day.
+	Usage(keyID uint, day time.Time) (dayEvents, monthEvents int64, err error)
+	// Add adds deltas to the stored counters.
+	Add(deltas []Delta) error
+}
+
+// Reasons a request is refused, as reported in Decision.Reason.
+const (
+	ReasonEventsPerSecond = "events_per_second"
+	ReasonBytesPerSecond  = "bytes_per_second"
+	ReasonDailyQuota      = "daily_quota"
+	ReasonMonthlyQuota    = "monthly_quota"
+)
+
+// Decision is the outcome of Allow together with the state reported in
+// X-RateLimit-* headers. Remaining counts are -1 for disabled limits.
+type Decision struct {
+	Allowed    bool
+	Reason     string
+	RetryAfter time.Duration
+
+	Limits Limits
+	// Remaining is the events bucket's content after this request and
+	// Reset the time until it is full again.
+	Remaining        int64
+	Reset            time.Duration
+	DailyRemaining   int64
+	MonthlyRemaining int64
+}
+
+// ExceededError is returned by callers that refuse a request because of a
+// Decision that was not allowed.
+type ExceededError struct {
+	Decision Decision
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("rate limit exceeded (%s), retry in %s", e.Decision.Reason, e.Decision.RetryAfter)
+}
+
+// bucket is a token bucket holding at most one second of its rate. A full
+// bucket admits a request larger than its capacity and goes into debt, so
+// batches bigger than the per-second limit are slowed down rather than
+// refused forever.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) refill(rate float64, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens, b.last = rate, now
+		return
+	}
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(rate, b.tokens+elapsed*rate)
+	}
+	b.last = now
+}
+
+// wait returns how long until n tokens can be taken, or 0 if they can now.
+func (b *bucket) wait(rate float64, n float64) time.Duration {
+	if b.tokens >= n || b.tokens >= rate {
+		return 0
+	}
+	need := math.Min(n, rate) - b.tokens
+	return time.Duration(need / rate * float64(time.Second))
+}
+
+type keyState struct {
+	mu     sync.Mutex
+	loaded bool
+	day    time.Time
+	events bucket
+	bytes  bucket
+
+	dayEvents   int64
+	monthEvents int64
+}
+
+// Limiter tracks usage for every key that sent events since startup.
+type Limiter struct {
+	store Store
+
+	mu      sync.Mutex
+	keys    map[uint]*keyState
+	pending map[pendingKey]*Delta
+}
+
+type pendingKey struct {
+	keyID uint
+	day   time.Time
+}
+
+// New returns a limiter persisting quota usage to store.
+func New(store Store) *Limiter {
+	return &Limiter{
+		store:   store,
+		keys:    map[uint]*keyState{},
+		pending: map[pendingKey]*Delta{},
+	}
+}
+
+func (l *Limiter) state(keyID uint) *keyState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	st, ok := l.keys[keyID]
+	if !ok {
+		st = &keyState{}
+		l.keys[keyID] = st
+	}
+	return st
+}
+
+// Allow decides whether a request carrying events events and bytes bytes
+// may be accepted for key. An allowed request takes its tokens from the
+// buckets and reserves its events in the quotas, so concurrent requests
+// cannot together exceed them. The caller then calls Record once the
+// events are accepted, or Release if they are not.
+func (l *Limiter) Allow(keyID uint, lim Limits, events int, bytes int, now time.Time) (Decision, error) {
+	st := l.state(keyID)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	day := truncateDay(now)
+	if !st.loaded {
+		dayEvents, monthEvents, err := l.store.Usage(keyID, day)
+		if err != nil {
+			return Decision{}, err
+		}
+		st.loaded, st.day, st.dayEvents, st.monthEvents = true, day, dayEvents, monthEvents
+	} else if !st.day.Equal(day) {
+		if st.day.Month() != day.Month() || st.day.Year() != day.Year() {
+			st.monthEvents = 0
+		}
+		st.day, st.dayEvents = day, 0
+	}
+
+	d := Decision{Allowed: true, Limits: lim, Remaining: -1, DailyRemaining: -1, MonthlyRemaining: -1}
+	n := int64(events)
+
+	if lim.MonthlyEvents > 0 {
+		d.MonthlyRemaining = max(lim.MonthlyEvents-st.monthEvents, 0)
+		if st.monthEvents+n > lim.MonthlyEvents {
+			d.refuse(ReasonMonthlyQuota, day.AddDate(0, 1, 1-day.Day()).Sub(now))
+		}
+	}
+	if lim.DailyEvents > 0 {
+		d.DailyRemaining = max(lim.DailyEvents-st.dayEvents, 0)
+		if d.Allowed && st.dayEvents+n > lim.DailyEvents {
+			d.refuse(ReasonDailyQuota, day.AddDate(0, 0, 1).Sub(now))
+		}
+	}
+
+	eventRate, byteRate := float64(lim.EventsPerSecond), float64(lim.BytesPerSecond)
+	if eventRate > 0 {
+		st.events.refill(eventRate, now)
+		if w := st.events.wait(eventRate, float64(events)); d.Allowed && w > 0 {
+			d.refuse(ReasonEventsPerSecond, w)
+		}
+	}
+	if byteRate > 0 {
+		st.bytes.refill(byteRate, now)
+		if w := st.bytes.wait(byteRate, float64(bytes)); d.Allowed && w > 0 {
+			d.refuse(ReasonBytesPerSecond, w)
+		}
+	}
+
+	if d.Allowed {
+		if eventRate > 0 {
+			st.events.tokens -= float64(events)
+		}
+		if byteRate > 0 {
+			st.bytes.tokens -= float64(bytes)
+		}
+		st.dayEvents += n
+		st.monthEvents += n
+		if d.DailyRemaining >= 0 {
+			d.DailyRemaining -= n
+		}
+		if d.MonthlyRemaining >= 0 {
+			d.MonthlyRemaining -= n
+		}
+	}
+	if eventRate > 0 {
+		d.Remaining = int64(math.Max(0, math.Floor(st.events.tokens)))
+		d.Reset = time.Duration((eventRate - st.events.tokens) / eventRate * float64(time.Second))
+	}
+	return d, nil
+}
+
+func (d *Decision) refuse(reason string, retryAfter time.Duration) {
+	d.Allowed, d.Reason, d.RetryAfter = false, reason, retryAfter
+}
+
+// Release gives back what Allow took for a request that was then not
+// accepted: its tokens and its quota reservation. now must be the time
+// passed to Allow.
+func (l *Limiter) Release(keyID uint, lim Limits, events int, bytes int, now time.Time) {
+	st := l.state(keyID)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.loaded && st.day.Equal(truncateDay(now)) {
+		st.dayEvents -= int64(events)
+		st.monthEvents -= int64(events)
+	}
+	if rate := float64(lim.EventsPerSecond); rate > 0 {
+		st.events.tokens = math.Min(rate, st.events.tokens+float64(events))
+	}
+	if rate := float64(lim.BytesPerSecond); rate > 0 {
+		st.bytes.tokens = math.Min(rate, st.bytes.tokens+float64(bytes))
+	}
+}
+
+// Record persists the usage of a request Allow admitted and the caller
+// accepted. It is written to the store by Flush.
+func (l *Limiter) Record(keyID uint, events int, bytes int, now time.Time) {
+	day := truncateDay(now)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	pk := pendingKey{keyID: keyID, day: day}
+	d, ok := l.pending[pk]
+	if !ok {
+		d = &Delta{KeyID: keyID, Day: day}
+		l.pending[pk] = d
+	}
+	d.Events += int64(events)
+	d.Bytes += int64(bytes)
+}
+
+// Flush writes the usage recorded since the last flush. On failure the
+// usage is kept and retried on the next call.
+func (l *Limiter) Flush() error {
+	l.mu.Lock()
+	if len(l.pending) == 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	deltas := make([]Delta, 0, len(l.pending))
+	for _, d := range l.pending {
+		deltas = append(deltas, *d)
+	}
+	l.pending = map[pendingKey]*Delta{}
+	l.mu.Unlock()
+
+	if err := l.store.Add(deltas); err != nil {
+		l.mu.Lock()
+		for _, d := range deltas {
+			pk := pendingKey{keyID: d.KeyID, day: d.Day}
+			if p, ok := l.pending[pk]; ok {
+				p.Events += d.Events
+				p.Bytes += d.Bytes
+			} else {
+				d := d
+				l.pending[pk] = &d
+			}
+		}
+		l.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Start flushes usage every interval in a background goroutine. Call
+// Flush once more on shutdown.
+func (l *Limiter) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := l.Flush(); err != nil {
+				log.Printf("rate limit usage flush: %v", err)
+			}
+		}
+	}()
+}
+
+func truncateDay(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,225 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type fakeStore struct {
+	dayEvents, monthEvents int64
+	added                  []Delta
+	err                    error
+}
+
+func (s *fakeStore) Usage(uint, time.Time) (int64, int64, error) {
+	return s.dayEvents, s.monthEvents, nil
+}
+
+func (s *fakeStore) Add(deltas []Delta) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.added = append(s.added, deltas...)
+	return nil
+}
+
+var t0 = time.Date(2026, 1, 31, 23, 59, 0, 0, time.UTC)
+
+// step is a call to Allow, or to Release if release is set.
+type step struct {
+	at      time.Duration // offset from t0
+	events  int
+	bytes   int
+	release bool
+
+	allowed bool
+	reason  string
+}
+
+func TestAllow(t *testing.T) {
+	tests := []struct {
+		name  string
+		lim   Limits
+		store fakeStore
+		steps []step
+	}{
+		{
+			name: "no limits",
+			steps: []step{
+				{events: 1 << 20, bytes: 1 << 30, allowed: true},
+			},
+		},
+		{
+			name: "events bucket refills over time",
+			lim:  Limits{EventsPerSecond: 10},
+			steps: []step{
+				{events: 6, allowed: true},
+				{events: 6, reason: ReasonEventsPerSecond},
+				{at: 100 * time.Millisecond, events: 5, allowed: true},
+				{at: 100 * time.Millisecond, events: 1, reason: ReasonEventsPerSecond},
+				{at: 2 * time.Second, events: 10, allowed: true},
+			},
+		},
+		{
+			name: "full bucket admits an oversized batch",
+			lim:  Limits{EventsPerSecond: 10},
+			steps: []step{
+				{events: 25, allowed: true},
+				{at: time.Second, events: 1, reason: ReasonEventsPerSecond},
+				{at: 3500 * time.Millisecond, events: 1, allowed: true},
+			},
+		},
+		{
+			name: "bytes bucket",
+			lim:  Limits{BytesPerSecond: 100},
+			steps: []step{
+				{events: 1, bytes: 80, allowed: true},
+				{events: 1, bytes: 80, reason: ReasonBytesPerSecond},
+			},
+		},
+		{
+			name:  "daily quota counts stored usage",
+			lim:   Limits{DailyEvents: 10},
+			store: fakeStore{dayEvents: 7},
+			steps: []step{
+				{events: 3, allowed: true},
+				{events: 1, reason: ReasonDailyQuota},
+			},
+		},
+		{
+			name: "daily quota resets at midnight UTC",
+			lim:  Limits{DailyEvents: 5},
+			steps: []step{
+				{events: 5, allowed: true},
+				{events: 1, reason: ReasonDailyQuota},
+				{at: time.Minute, events: 5, allowed: true},
+			},
+		},
+		{
+			name:  "monthly quota resets with the month",
+			lim:   Limits{MonthlyEvents: 5},
+			store: fakeStore{monthEvents: 5},
+			steps: []step{
+				{events: 1, reason: ReasonMonthlyQuota},
+				{at: time.Minute, events: 5, allowed: true},
+			},
+		},
+		{
+			name: "monthly quota wins over daily",
+			lim:  Limits{DailyEvents: 1, MonthlyEvents: 1, EventsPerSecond: 1},
+			steps: []step{
+				{events: 2, reason: ReasonMonthlyQuota},
+			},
+		},
+		{
+			name: "refused requests reserve nothing",
+			lim:  Limits{DailyEvents: 10},
+			steps: []step{
+				{events: 11, reason: ReasonDailyQuota},
+				{events: 10, allowed: true},
+			},
+		},
+		{
+			name: "release returns quota and tokens",
+			lim:  Limits{EventsPerSecond: 10, DailyEvents: 10},
+			steps: []step{
+				{events: 10, allowed: true},
+				{events: 1, reason: ReasonDailyQuota},
+				{events: 10, release: true},
+				{events: 10, allowed: true},
+			},
+		},
+		{
+			name: "release after midnight keeps the new day's quota",
+			lim:  Limits{DailyEvents: 10},
+			steps: []step{
+				{events: 10, allowed: true},
+				{at: time.Minute, events: 10, allowed: true},
+				{events: 10, release: true},
+				{at: time.Minute, events: 1, reason: ReasonDailyQuota},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New(&tt.store)
+			for i, s := range tt.steps {
+				now := t0.Add(s.at)
+				if s.release {
+					l.Release(1, tt.lim, s.events, s.bytes, now)
+					continue
+				}
+				d, err := l.Allow(1, tt.lim, s.events, s.bytes, now)
+				if err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+				if d.Allowed != s.allowed || d.Reason != s.reason {
+					t.Fatalf("step %d: Allow = (%v, %q), want (%v, %q)", i, d.Allowed, d.Reason, s.allowed, s.reason)
+				}
+				if !d.Allowed && d.RetryAfter <= 0 {
+					t.Errorf("step %d: RetryAfter = %s, want > 0", i, d.RetryAfter)
+				}
+			}
+		})
+	}
+}
+
+func TestDecisionRemaining(t *testing.T) {
+	l := New(&fakeStore{dayEvents: 2, monthEvents: 50})
+	lim := Limits{EventsPerSecond: 10, DailyEvents: 10, MonthlyEvents: 100}
+	d, err := l.Allow(1, lim, 3, 0, t0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Remaining != 7 || d.DailyRemaining != 5 || d.MonthlyRemaining != 47 {
+		t.Errorf("Remaining = %d/%d/%d, want 7/5/47", d.Remaining, d.DailyRemaining, d.MonthlyRemaining)
+	}
+	if d.Reset != 300*time.Millisecond {
+		t.Errorf("Reset = %s, want 300ms", d.Reset)
+	}
+
+	d, _ = l.Allow(2, Limits{}, 3, 0, t0)
+	if d.Remaining != -1 || d.DailyRemaining != -1 || d.MonthlyRemaining != -1 {
+		t.Errorf("Remaining without limits = %d/%d/%d, want -1/-1/-1", d.Remaining, d.DailyRemaining, d.MonthlyRemaining)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	store := &fakeStore{err: errors.New("down")}
+	l := New(store)
+	l.Record(1, 3, 300, t0)
+	l.Record(1, 2, 200, t0.Add(time.Second))
+	l.Record(1, 1, 100, t0.Add(time.Minute))
+	if err := l.Flush(); err == nil {
+		t.Fatal("Flush with a failing store succeeded")
+	}
+	l.Record(1, 1, 100, t0)
+
+	store.err = nil
+	if err := l.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	got := map[time.Time]Delta{}
+	for _, d := range store.added {
+		got[d.Day] = d
+	}
+	day := truncateDay(t0)
+	want := map[time.Time]Delta{
+		day:                  {KeyID: 1, Day: day, Events: 6, Bytes: 600},
+		day.AddDate(0, 0, 1): {KeyID: 1, Day: day.AddDate(0, 0, 1), Events: 1, Bytes: 100},
+	}
+	if len(got) != len(want) || len(store.added) != len(want) {
+		t.Fatalf("added = %+v, want %+v", store.added, want)
+	}
+	for k, w := range want {
+		if got[k] != w {
+			t.Errorf("delta for %s = %+v, want %+v", k.Format(time.DateOnly), got[k], w)
+		}
+	}
+
+	store.added = nil
+	if err := l.Flush(); err != nil || len(store.added) != 0 {
+		t.Errorf("second Flush = %v, added %+v, want nothing", err, store.added)
+	}
+}
@@ -0,0 +1,73 @@
+package redact
+
+import (
+	"sync"
+	"time"
+)
+
+// LoadFunc returns the rules configured for an API key.
+type LoadFunc func(apiKeyID uint) (Rules, error)
+
+// Cache keeps a Redactor per API key, combining the global rules with the
+// key's own, so the ingest path does not hit the database for every
+// request.
+type Cache struct {
+	global *Redactor
+	rules  Rules
+	load   LoadFunc
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	entries map[uint]cacheEntry
+}
+
+type cacheEntry struct {
+	redactor *Redactor
+	loadedAt time.Time
+}
+
+// NewCache returns a Cache applying global to every key and reloading each
+// key's rules through load at most once per ttl.
+func NewCache(global Rules, load LoadFunc, ttl time.Duration) *Cache {
+	return &Cache{global: New(global), rules: global, load: load, ttl: ttl, entries: make(map[uint]cacheEntry)}
+}
+
+// Global returns the Redactor for events not tied to an API key. A nil
+// Cache redacts nothing.
+func (c *Cache) Global() *Redactor {
+	if c == nil {
+		return nil
+	}
+	return c.global
+}
+
+// Redactor returns the Redactor for apiKeyID.
+func (c *Cache) Redactor(apiKeyID uint) (*Redactor, error) {
+	if c == nil {
+		return nil, nil
+	}
+	c.mu.Lock()
+	e, ok := c.entries[apiKeyID]
+	c.mu.Unlock()
+	if ok && time.Since(e.loadedAt) < c.ttl {
+		return e.redactor, nil
+	}
+
+	rules, err := c.load(apiKeyID)
+	if err != nil {
+		return nil, err
+	}
+	r := New(c.rules.Merge(rules))
+
+	c.mu.Lock()
+	c.entries[apiKeyID] = cacheEntry{redactor: r, loadedAt: time.Now()}
+	c.mu.Unlock()
+	return r, nil
+}
+
+// Invalidate drops the cached Redactor for apiKeyID.
+func (c *Cache) Invalidate(apiKeyID uint) {
+	c.mu.Lock()
+	delete(c.entries, apiKeyID)
+	c.mu.Unlock()
+}
@@ -0,0 +1,312 @@
+// Package redact scrubs personal data and secrets from events before they
+// are stored: built-in detectors replace emails, JWTs, card numbers and IP
+// addresses found in paths, routes and attribute values; deny-listed
+// attribute keys have their values removed; and regex replacements rewrite
+// routes and user agents.
+package redact
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+// Kind identifies what a redaction matched.
+type Kind int
+
+const (
+	Email Kind = iota
+	JWT
+	Card
+	IP
+	DenyKey
+	Route
+	UserAgent
+	numKinds
+)
+
+var kindNames = [numKinds]string{"email", "jwt", "card", "ip", "deny_key", "route", "user_agent"}
+
+func (k Kind) String() string { return kindNames[k] }
+
+// Detectors are the names of the built-in detectors, in the order they run.
+var Detectors = []string{"email", "jwt", "card", "ip"}
+
+// ValidDetector reports whether name is a built-in detector.
+func ValidDetector(name string) bool {
+	_, ok := detectors[name]
+	return ok
+}
+
+// Counts is the number of values redacted, by Kind.
+type Counts [numKinds]int
+
+// Add adds o to c.
+func (c *Counts) Add(o Counts) {
+	for k := range c {
+		c[k] += o[k]
+	}
+}
+
+// Each calls fn for every kind with a non-zero count.
+func (c *Counts) Each(fn func(k Kind, n int)) {
+	for k, n := range c {
+		if n > 0 {
+			fn(Kind(k), n)
+		}
+	}
+}
+
+// Placeholder is what a deny-listed attribute value is replaced with.
+// Detected values are replaced with their kind in brackets, e.g. "[email]".
+const Placeholder = "[redacted]"
+
+type detector struct {
+	kind  Kind
+	re    *regexp.Regexp
+	valid func(s string, start, end int) bool
+}
+
+var detectors = map[string]detector{
+	"email": {kind: Email, re: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`)},
+	"jwt":   {kind: JWT, re: regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`)},
+	"card":  {kind: Card, re: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), valid: validCard},
+	"ip":    {kind: IP, re: regexp.MustCompile(`(?:[0-9A-Fa-f]{0,4}:){2,6}(?:\d{1,3}\.){3}\d{1,3}|(?:\d{1,3}\.){3}\d{1,3}|[0-9A-Fa-f]{0,4}(?::[0-9A-Fa-f]{0,4}){2,7}`), valid: validIP},
+}
+
+// validCard checks the length and Luhn checksum of a candidate card number.
+func validCard(s string, start, end int) bool {
+	digits := make([]int, 0, end-start)
+	for _, r := range s[start:end] {
+		if r >= '0' && r <= '9' {
+			digits = append(digits, int(r-'0'))
+		}
+	}
+	if len(digits) < 13 || len(digits) > 19 {
+		return false
+	}
+	sum := 0
+	for i := range digits {
+		d := digits[len(digits)-1-i]
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// validIP accepts candidates that parse as an address and stand alone:
+// not part of a longer token such as "v1.2.3.4" or "1.2.3.4.5", and not the
+// version of a product token such as "Chrome/120.0.0.0".
+func validIP(s string, start, end int) bool {
+	if start > 0 && isAddrChar(s[start-1]) || isProductVersion(s, start) {
+		return false
+	}
+	// A colon after an IPv4 address starts a port.
+	if end < len(s) && isAddrChar(s[end]) && !(s[end] == ':' && !strings.Contains(s[start:end], ":")) {
+		return false
+	}
+	addr, err := netip.ParseAddr(s[start:end])
+	return err == nil && !(addr.Is6() && addr.IsUnspecified())
+}
+
+// isProductVersion reports whether s[start:] follows "name/" at the start
+// of a token, as versions do in User-Agent and Server headers. A path
+// segment such as "/hosts/10.0.0.1" starts with "/" and is not a product.
+func isProductVersion(s string, start int) bool {
+	if start == 0 || s[start-1] != '/' {
+		return false
+	}
+	i := start - 1
+	for i > 0 && isProductChar(s[i-1]) {
+		i--
+	}
+	if i == start-1 || !isLetter(s[i]) {
+		return false
+	}
+	return i == 0 || s[i-1] != '/'
+}
+
+func isAddrChar(c byte) bool {
+	return c >= '0' && c <= '9' || isLetter(c) || c == '.' || c == ':'
+}
+
+func isProductChar(c byte) bool {
+	return c >= '0' && c <= '9' || isLetter(c) || c == '.' || c == '_' || c == '-'
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// Replacement rewrites the parts of a route or user agent matching Pattern
+// with With, which may refer to submatches as $1 or ${name}.
+type Replacement struct {
+	Pattern *regexp.Regexp
+	With    string
+}
+
+// ParseReplacement parses "pattern=>replacement".
+func ParseReplacement(s string) (Replacement, error) {
+	pattern, with, ok := strings.Cut(s, "=>")
+	if !ok {
+		return Replacement{}, fmt.Errorf("route replacement %q: want pattern=>replacement", s)
+	}
+	return NewReplacement(pattern, with)
+}
+
+// NewReplacement compiles a replacement.
+func NewReplacement(pattern, with string) (Replacement, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return Replacement{}, fmt.Errorf("replacement %q: %w", pattern, err)
+	}
+	return Replacement{Pattern: re, With: with}, nil
+}
+
+// Rules configures a Redactor. Unknown detector names are ignored; check
+// them with ValidDetector when they are configured.
+type Rules struct {
+	Detectors  []string
+	DenyKeys   []string
+	Routes     []Replacement
+	UserAgents []Replacement
+}
+
+// Merge returns the union of r and o, with r's replacements first.
+func (r Rules) Merge(o Rules) Rules {
+	return Rules{
+		Detectors:  append(append([]string(nil), r.Detectors...), o.Detectors...),
+		DenyKeys:   append(append([]string(nil), r.DenyKeys...), o.DenyKeys...),
+		Routes:     append(append([]Replacement(nil), r.Routes...), o.Routes...),
+		UserAgents: append(append([]Replacement(nil), r.UserAgents...), o.UserAgents...),
+	}
+}
+
+// Redactor applies Rules. A nil Redactor changes nothing.
+type Redactor struct {
+	detectors  []detector
+	deny       map[string]bool
+	routes     []Replacement
+	userAgents []Replacement
+}
+
+// New returns a Redactor for rules.
+func New(rules Rules) *Redactor {
+	enabled := map[string]bool{}
+	for _, name := range rules.Detectors {
+		enabled[name] = true
+	}
+	r := &Redactor{deny: map[string]bool{}, routes: rules.Routes, userAgents: rules.UserAgents}
+	for _, name := range Detectors {
+		if enabled[name] {
+			r.detectors = append(r.detectors, detectors[name])
+		}
+	}
+	for _, k := range rules.DenyKeys {
+		r.deny[normalizeKey(k)] = true
+	}
+	return r
+}
+
+// normalizeKey makes deny-list matching ignore case, "-" and "_", so
+// "api_key" also matches "apiKey" and "API-Key".
+func normalizeKey(k string) string {
+	return strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(k))
+}
+
+// String replaces every detected value in s with its kind in brackets.
+func (r *Redactor) String(s string, c *Counts) string {
+	if r == nil {
+		return s
+	}
+	for _, d := range r.detectors {
+		s = d.replace(s, c)
+	}
+	return s
+}
+
+func (d detector) replace(s string, c *Counts) string {
+	matches := d.re.FindAllStringIndex(s, -1)
+	if matches == nil {
+		return s
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		if d.valid != nil && !d.valid(s, m[0], m[1]) {
+			continue
+		}
+		b.WriteString(s[last:m[0]])
+		b.WriteString("[" + d.kind.String() + "]")
+		last = m[1]
+		c[d.kind]++
+	}
+	if last == 0 {
+		return s
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// Route applies the route replacements to route, then the detectors.
+func (r *Redactor) Route(route string, c *Counts) string {
+	if r == nil {
+		return route
+	}
+	return r.String(replaceAll(route, r.routes, Route, c), c)
+}
+
+// UserAgent applies the user agent replacements to ua. The detectors do
+// not run on user agents, whose version numbers such as "120.0.0.0" would
+// be taken for addresses.
+func (r *Redactor) UserAgent(ua string, c *Counts) string {
+	if r == nil {
+		return ua
+	}
+	return replaceAll(ua, r.userAgents, UserAgent, c)
+}
+
+func replaceAll(s string, reps []Replacement, kind Kind, c *Counts) string {
+	for _, rep := range reps {
+		if rep.Pattern.MatchString(s) {
+			s = rep.Pattern.ReplaceAllString(s, rep.With)
+			c[kind]++
+		}
+	}
+	return s
+}
+
+// Attributes redacts attrs in place: values of deny-listed keys, at any
+// depth, become Placeholder and detected values in strings are replaced.
+func (r *Redactor) Attributes(attrs map[string]any, c *Counts) {
+	if r == nil {
+		return
+	}
+	for k, v := range attrs {
+		if r.deny[normalizeKey(k)] {
+			attrs[k] = Placeholder
+			c[DenyKey]++
+			continue
+		}
+		attrs[k] = r.value(v, c)
+	}
+}
+
+func (r *Redactor) value(v any, c *Counts) any {
+	switch v := v.(type) {
+	case string:
+		return r.String(v, c)
+	case map[string]any:
+		r.Attributes(v, c)
+	case []any:
+		for i := range v {
+			v[i] = r.value(v[i], c)
+		}
+	}
+	return v
+}
@@ -0,0 +1,64 @@
+package routes
+
+import (
+	"sync"
+	"time"
+)
+
+// LoadFunc returns the raw template patterns configured for an API key.
+type LoadFunc func(apiKeyID uint) ([]string, error)
+
+// Cache keeps parsed per-API-key templates in memory so the ingest path
+// does not hit the database for every request.
+type Cache struct {
+	load LoadFunc
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[uint]cacheEntry
+}
+
+type cacheEntry struct {
+	templates []Template
+	loadedAt  time.Time
+}
+
+// NewCache returns a Cache that reloads templates through load at most
+// once per ttl for each key.
+func NewCache(load LoadFunc, ttl time.Duration) *Cache {
+	return &Cache{load: load, ttl: ttl, entries: make(map[uint]cacheEntry)}
+}
+
+// Templates returns the parsed templates for apiKeyID. Invalid patterns are
+// skipped silently; they are rejected when saved from the settings page.
+func (c *Cache) Templates(apiKeyID uint) ([]Template, error) {
+	c.mu.Lock()
+	e, ok := c.entries[apiKeyID]
+	c.mu.Unlock()
+	if ok && time.Since(e.loadedAt) < c.ttl {
+		return e.templates, nil
+	}
+
+	patterns, err := c.load(apiKeyID)
+	if err != nil {
+		return nil, err
+	}
+	templates := make([]Template, 0, len(patterns))
+	for _, p := range patterns {
+		if t, ok := ParseTemplate(p); ok {
+			templates = append(templates, t)
+		}
+	}
+
+	c.mu.Lock()
+	c.entries[apiKeyID] = cacheEntry{templates: templates, loadedAt: time.Now()}
+	c.mu.Unlock()
+	return templates, nil
+}
+
+// Invalidate drops the cached templates for apiKeyID.
+func (c *Cache) Invalidate(apiKeyID uint) {
+	c.mu.Lock()
+	delete(c.entries, apiKeyID)
+	c.mu.Unlock()
+}
@@ -0,0 +1,173 @@
+package routes
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ParamAttributePrefix is prepended to every extracted route parameter name
+// when it is stored in an event's attributes (e.g. "param_order_id").
+const ParamAttributePrefix = "param_"
+
+var (
+	numericSegment = regexp.MustCompile(`^[0-9]+$`)
+	uuidSegment    = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hexSegment     = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+	slugSegment    = regexp.MustCompile(`^[a-zA-Z0-9]+(?:[-_][a-zA-Z0-9]+)+$`)
+	tokenSegment   = regexp.MustCompile(`^[a-zA-Z0-9_-]{20,}$`)
+	paramName      = regexp.MustCompile(`^\{([a-zA-Z0-9_]+)\}$`)
+	hasDigit       = regexp.MustCompile(`[0-9]`)
+)
+
+// Template is a user-defined route pattern such as
+// "/orders/{order_id}/items/{item}". Literal segments must match exactly;
+// "{name}" segments match any single non-empty path segment.
+type Template struct {
+	Pattern  string
+	segments []string
+}
+
+// ParseTemplate validates pattern and returns a Template ready for matching.
+// It returns false when the pattern is not a valid absolute route template.
+func ParseTemplate(pattern string) (Template, bool) {
+	pattern = strings.TrimSpace(pattern)
+	if pattern == "" || pattern[0] != '/' {
+		return Template{}, false
+	}
+	segments := splitPath(pattern)
+	for _, s := range segments {
+		if s == "" {
+			return Template{}, false
+		}
+		if strings.ContainsAny(s, "{}") && !paramName.MatchString(s) {
+			return Template{}, false
+		}
+	}
+	return Template{Pattern: pattern, segments: segments}, true
+}
+
+// match reports whether segments fit the template and returns the
+// extracted parameter values keyed by name.
+func (t Template) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(t.segments) {
+		return nil, false
+	}
+	var params map[string]string
+	for i, ts := range t.segments {
+		if m := paramName.FindStringSubmatch(ts); m != nil {
+			if segments[i] == "" {
+				return nil, false
+			}
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[m[1]] = segments[i]
+			continue
+		}
+		if ts != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// Normalizer collapses concrete request paths into route templates so that
+// /users/123 and /users/456 are both reported as /users/{id}.
+type Normalizer struct {
+	// AutoDetect enables replacement of numeric, UUID, hex and slug-like
+	// segments when no user-defined template matches.
+	AutoDetect bool
+}
+
+// Normalize returns the route template for path and any parameters that
+// were extracted from it. User-defined templates are tried in order before
+// automatic detection. The query string, if any, is ignored.
+func (n Normalizer) Normalize(path string, templates []Template) (string, map[string]string) {
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+	if path == "" {
+		return "/", nil
+	}
+	segments := splitPath(path)
+
+	for _, t := range templates {
+		if params, ok := t.match(segments); ok {
+			return t.Pattern, params
+		}
+	}
+
+	if !n.AutoDetect {
+		return path, nil
+	}
+
+	var params map[string]string
+	out := make([]string, len(segments))
+	for i, s := range segments {
+		name := detectSegment(s)
+		if name == "" {
+			out[i] = s
+			continue
+		}
+		if params == nil {
+			params = make(map[string]string)
+		}
+		name = uniqueName(params, name)
+		params[name] = s
+		out[i] = "{" + name + "}"
+	}
+	route := "/" + strings.Join(out, "/")
+	if !strings.HasPrefix(path, "/") {
+		route = strings.TrimPrefix(route, "/")
+	}
+	return route, params
+}
+
+// ParamAttributes converts extracted params into event attribute keys.
+func ParamAttributes(params map[string]string) map[string]any {
+	if len(params) == 0 {
+		return nil
+	}
+	attrs := make(map[string]any, len(params))
+	for k, v := range params {
+		attrs[ParamAttributePrefix+k] = v
+	}
+	return attrs
+}
+
+// detectSegment returns the placeholder name for a dynamic-looking segment,
+// or "" when the segment should be kept literally.
+func detectSegment(s string) string {
+	switch {
+	case s == "":
+		return ""
+	case numericSegment.MatchString(s):
+		return "id"
+	case uuidSegment.MatchString(s):
+		return "uuid"
+	case hexSegment.MatchString(s) && hasDigit.MatchString(s):
+		return "hash"
+	case tokenSegment.MatchString(s) && hasDigit.MatchString(s):
+		return "token"
+	case slugSegment.MatchString(s) && hasDigit.MatchString(s):
+		return "slug"
+	}
+	return ""
+}
+
+func uniqueName(params map[string]string, name string) string {
+	if _, taken := params[name]; !taken {
+		return name
+	}
+	for i := 2; ; i++ {
+		candidate := name + "_" + strconv.Itoa(i)
+		if _, taken := params[candidate]; !taken {
+			return candidate
+		}
+	}
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
@@ -0,0 +1,112 @@
+// Package sampling implements server-side sampling rules. A rule keeps a
+// fraction of the events of an API key, optionally only for some routes;
+// kept events carry the combined sample rate so metrics can weight each
+// stored event by the number of requests it stands for.
+package sampling
+
+import (
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rule keeps Rate (MinRate <= Rate <= 1) of the events whose route matches Route.
+// Route is an exact route template such as "/users/{id}", a prefix ending
+// in "*" such as "/internal/*", or empty to match every route.
+type Rule struct {
+	Route string
+	Rate  float64
+}
+
+// matches reports whether r applies to route, and how specific it is:
+// exact matches beat longer prefixes, which beat shorter ones and the
+// catch-all.
+func (r Rule) matches(route string) (bool, int) {
+	switch {
+	case r.Route == "" || r.Route == "*":
+		return true, 0
+	case strings.HasSuffix(r.Route, "*"):
+		prefix := strings.TrimSuffix(r.Route, "*")
+		return strings.HasPrefix(route, prefix), 1 + len(prefix)
+	default:
+		return r.Route == route, 1 << 30
+	}
+}
+
+// Rate returns the sample rate of the most specific rule matching route,
+// or 1 when none does.
+func Rate(rules []Rule, route string) float64 {
+	rate, best := 1.0, -1
+	for _, r := range rules {
+		if ok, score := r.matches(route); ok && score > best {
+			rate, best = r.Rate, score
+		}
+	}
+	return rate
+}
+
+// Keep decides at random whether an event sampled at rate is kept.
+func Keep(rate float64) bool {
+	return rate >= 1 || rand.Float64() < rate
+}
+
+// MinRate is the lowest sample rate, of a rule, an event or the two
+// combined. It bounds the weight of a single event to 1/MinRate requests.
+const MinRate = 1e-4
+
+// ValidRate reports whether rate is usable as a sample rate.
+func ValidRate(rate float64) bool {
+	return rate >= MinRate && rate <= 1
+}
+
+// LoadFunc returns the rules configured for an API key.
+type LoadFunc func(apiKeyID uint) ([]Rule, error)
+
+// Cache keeps per-API-key rules in memory so the ingest path does not hit
+// the database for every request.
+type Cache struct {
+	load LoadFunc
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[uint]cacheEntry
+}
+
+type cacheEntry struct {
+	rules    []Rule
+	loadedAt time.Time
+}
+
+// NewCache returns a Cache that reloads rules through load at most once
+// per ttl for each key.
+func NewCache(load LoadFunc, ttl time.Duration) *Cache {
+	return &Cache{load: load, ttl: ttl, entries: make(map[uint]cacheEntry)}
+}
+
+// Rules returns the rules for apiKeyID.
+func (c *Cache) Rules(apiKeyID uint) ([]Rule, error) {
+	c.mu.Lock()
+	e, ok := c.entries[apiKeyID]
+	c.mu.Unlock()
+	if ok && time.Since(e.loadedAt) < c.ttl {
+		return e.rules, nil
+	}
+
+	rules, err := c.load(apiKeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.entries[apiKeyID] = cacheEntry{rules: rules, loadedAt: time.Now()}
+	c.mu.Unlock()
+	return rules, nil
+}
+
+// Invalidate drops the cached rules for apiKeyID.
+func (c *Cache) Invalidate(apiKeyID uint) {
+	c.mu.Lock()
+	delete(c.entries, apiKeyID)
+	c.mu.Unlock()
+}
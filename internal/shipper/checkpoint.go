@@ -0,0 +1,67 @@
+package shipper
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// checkpoint records, per log path, the position after the last line that
+// was delivered (or deliberately skipped), so a restart resumes there.
+type checkpoint struct {
+	path  string
+	Files map[string]position `json:"files"`
+}
+
+func loadCheckpoint(path string) (*checkpoint, error) {
+	cp := &checkpoint{path: path, Files: map[string]position{}}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, cp); err != nil {
+		return nil, err
+	}
+	if cp.Files == nil {
+		cp.Files = map[string]position{}
+	}
+	return cp, nil
+}
+
+func (c *checkpoint) get(logPath string) *position {
+	p, ok := c.Files[logPath]
+	if !ok {
+		return nil
+	}
+	return &p
+}
+
+// save writes the checkpoint atomically (temp file, fsync, rename).
+func (c *checkpoint) save() error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), ".checkpoint-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
@@ -0,0 +1,368 @@
+// Package shipper implements the "apiinsight ship" subcommand, which tails
+// web server access logs and posts the requests they describe to an API
+// Insight /v1/events endpoint in batches.
+package shipper
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"apiinsight/internal/accesslog"
+	"apiinsight/internal/ingest"
+)
+
+// attrFlag collects repeated -attr key=value flags.
+type attrFlag map[string]string
+
+func (a attrFlag) String() string { return fmt.Sprint(map[string]string(a)) }
+
+func (a attrFlag) Set(v string) error {
+	k, val, ok := strings.Cut(v, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("expected key=value, got %q", v)
+	}
+	a[k] = val
+	return nil
+}
+
+// options are the parsed command-line flags.
+type options struct {
+	url           string
+	apiKey        string
+	format        *accesslog.Format
+	checkpoint    string
+	batchSize     int
+	flushInterval time.Duration
+	pollInterval  time.Duration
+	fromStart     bool
+	attrs         map[string]string
+	files         []string
+}
+
+// Run executes the ship subcommand with the arguments following "ship".
+func Run(args []string) error {
+	opts, err := parseFlags(args)
+	if err != nil {
+		return err
+	}
+
+	cp, err := loadCheckpoint(opts.checkpoint)
+	if err != nil {
+		return fmt.Errorf("load checkpoint: %w", err)
+	}
+
+	tailers := make([]*tailer, 0, len(opts.files))
+	for _, path := range opts.files {
+		t := newTailer(path)
+		if err := t.resume(cp.get(path), opts.fromStart); err != nil {
+			return fmt.Errorf("open %s: %w", path, err)
+		}
+		tailers = append(tailers, t)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	s := &shipper{
+		opts:    opts,
+		cp:      cp,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		pending: map[string]position{},
+	}
+	log.Printf("shipping %d file(s) to %s", len(tailers), opts.url)
+	return s.loop(ctx, tailers)
+}
+
+func parseFlags(args []string) (*options, error) {
+	fset := flag.NewFlagSet("ship", flag.ContinueOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "Usage: apiinsight ship [flags] LOGFILE...\n\n"+
+			"Tails access logs and sends each request to API Insight.\n\n")
+		fset.PrintDefaults()
+	}
+
+	attrs := attrFlag{}
+	url := fset.String("url", getenv("APIINSIGHT_URL", "http://localhost:8080"), "API Insight base URL (env APIINSIGHT_URL)")
+	apiKey := fset.String("api-key", os.Getenv("APIINSIGHT_API_KEY"), "API key with the ingest scope (env APIINSIGHT_API_KEY)")
+	named := fset.String("format", "combined", "predefined log format: common, combined or combined_timed")
+	nginxFormat := fset.String("nginx-format", "", "nginx log_format definition; overrides -format")
+	apacheFormat := fset.String("apache-format", "", "Apache LogFormat string; overrides -format")
+	checkpointPath := fset.String("checkpoint", "apiinsight-ship.checkpoint", "file recording how far each log has been shipped")
+	batchSize := fset.Int("batch-size", 500, "maximum events per request")
+	flushInterval := fset.Duration("flush-interval", 2*time.Second, "maximum time to hold a partial batch")
+	pollInterval := fset.Duration("poll-interval", 250*time.Millisecond, "how often to check files for new lines")
+	fromStart := fset.Bool("from-start", false, "ship existing lines of files without a checkpoint instead of only new ones")
+	fset.Var(attrs, "attr", "static attribute added to every event, as key=value (repeatable)")
+
+	if err := fset.Parse(args); err != nil {
+		return nil, err
+	}
+	if fset.NArg() == 0 {
+		fset.Usage()
+		return nil, errors.New("no log files given")
+	}
+	if *apiKey == "" {
+		return nil, errors.New("an API key is required (-api-key or APIINSIGHT_API_KEY)")
+	}
+	if *batchSize <= 0 || *flushInterval <= 0 || *pollInterval <= 0 {
+		return nil, errors.New("batch size and intervals must be positive")
+	}
+
+	var format *accesslog.Format
+	var err error
+	switch {
+	case *nginxFormat != "":
+		format, err = accesslog.ParseNginx(*nginxFormat)
+	case *apacheFormat != "":
+		format, err = accesslog.ParseApache(*apacheFormat)
+	default:
+		format, err = accesslog.Named(*named)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("log format: %w", err)
+	}
+
+	return &options{
+		url:           strings.TrimRight(*url, "/") + "/v1/events",
+		apiKey:        *apiKey,
+		format:        format,
+		checkpoint:    *checkpointPath,
+		batchSize:     *batchSize,
+		flushInterval: *flushInterval,
+		pollInterval:  *pollInterval,
+		fromStart:     *fromStart,
+		attrs:         attrs,
+		files:         fset.Args(),
+	}, nil
+}
+
+type shipper struct {
+	opts   *options
+	cp     *checkpoint
+	client *http.Client
+
+	batch []ingest.Event
+	// pending holds the positions consumed since the last delivery; they
+	// are written to the checkpoint once the batch is accepted.
+	pending map[string]position
+
+	unparsed int
+}
+
+func (s *shipper) loop(ctx context.Context, tailers []*tailer) error {
+	ticker := time.NewTicker(s.opts.pollInterval)
+	defer ticker.Stop()
+	lastFlush := time.Now()
+
+	for {
+		for _, t := range tailers {
+			lines, err := t.poll()
+			if err != nil {
+				log.Printf("ship: %s: %v", t.path, err)
+			}
+			for _, l := range lines {
+				s.add(l)
+				if len(s.batch) >= s.opts.batchSize {
+					if err := s.flush(ctx); err != nil {
+						return err
+					}
+					lastFlush = time.Now()
+				}
+			}
+		}
+		if len(s.pending) > 0 && time.Since(lastFlush) >= s.opts.flushInterval {
+			if err := s.flush(ctx); err != nil {
+				return err
+			}
+			lastFlush = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			// Deliver what was read before exiting; flush gives up on its
+			// own if the server stays unreachable.
+			flushCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := s.flush(flushCtx); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+				return err
+			}
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// add parses a line into the current batch. Lines that do not describe a
+// request are skipped but still advance the checkpoint.
+func (s *shipper) add(l line) {
+	s.pending[l.path] = l.pos
+	ev, ok := s.toEvent(l.text)
+	if ok {
+		// The line's position identifies it, so lines resent after a crash
+		// between delivery and checkpoint are stored once (except in files
+		// still shorter than the fingerprint, whose fingerprint changes).
+		ev.EventID = l.pos.eventID()
+	}
+	if !ok {
+		s.unparsed++
+		if s.unparsed <= 10 || s.unparsed%1000 == 0 {
+			log.Printf("ship: skipped %d unparseable line(s), latest in %s: %.200q", s.unparsed, l.path, l.text)
+		}
+		return
+	}
+	s.batch = append(s.batch, ev)
+}
+
+func (s *shipper) toEvent(text string) (ingest.Event, bool) {
+	if strings.TrimSpace(text) == "" {
+		return ingest.Event{}, false
+	}
+	e, err := s.opts.format.Parse(text)
+	if err != nil || !strings.HasPrefix(e.Path(), "/") {
+		return ingest.Event{}, false
+	}
+
+	ev := ingest.Event{
+		Path:       e.URI,
+		Method:     e.Method,
+		Status:     e.Status,
+		RemoteIP:   e.RemoteAddr,
+		UserAgent:  e.UserAgent,
+		DurationMs: e.RequestTime.Milliseconds(),
+		Attributes: map[string]any{"source": "access_log"},
+
+		RequestBytes:  e.RequestLength,
+		ResponseBytes: e.BytesSent,
+	}
+	if !e.Time.IsZero() {
+		t := e.Time
+		ev.Timestamp = &t
+	}
+	if e.Referer != "" {
+		ev.Attributes["referer"] = e.Referer
+	}
+	if e.Host != "" {
+		ev.Attributes["host"] = e.Host
+	}
+	for k, v := range e.Extra {
+		ev.Attributes[k] = v
+	}
+	for k, v := range s.opts.attrs {
+		ev.Attributes[k] = v
+	}
+	return ev, true
+}
+
+// flush delivers the current batch, retrying until it is accepted, and
+// then advances the checkpoint.
+func (s *shipper) flush(ctx context.Context) error {
+	if len(s.batch) > 0 {
+		if err := s.send(ctx, s.batch); err != nil {
+			return err
+		}
+	}
+	for path, pos := range s.pending {
+		s.cp.Files[path] = pos
+	}
+	if len(s.pending) > 0 {
+		if err := s.cp.save(); err != nil {
+			return fmt.Errorf("save checkpoint: %w", err)
+		}
+	}
+	s.batch = s.batch[:0]
+	s.pending = map[string]position{}
+	return nil
+}
+
+// errFatal marks responses that retrying cannot fix, such as a revoked key.
+var errFatal = errors.New("server refused events")
+
+func (s *shipper) send(ctx context.Context, events []ingest.Event) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(map[string]any{"events": events}); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	body := buf.Bytes()
+
+	backoff := time.Second
+	for {
+		wait, err := s.post(ctx, body)
+		if err == nil || errors.Is(err, errFatal) {
+			return err
+		}
+		if wait <= 0 {
+			wait = backoff
+			if backoff *= 2; backoff > 30*time.Second {
+				backoff = 30 * time.Second
+			}
+		}
+		log.Printf("ship: delivering %d events failed, retrying in %s: %v", len(events), wait, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// post sends one request. It returns a Retry-After hint for retryable
+// failures.
+func (s *shipper) post(ctx context.Context, body []byte) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.opts.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Authorization", "Bearer "+s.opts.apiKey)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	switch {
+	case resp.StatusCode == http.StatusAccepted:
+		return 0, nil
+	case resp.StatusCode == http.StatusBadRequest:
+		// Every event was rejected by validation; retrying would not
+		// help, so the lines are skipped.
+		log.Printf("ship: batch rejected: %s", bytes.TrimSpace(msg))
+		return 0, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		wait := time.Duration(0)
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			wait = time.Duration(secs) * time.Second
+		}
+		return wait, fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	default:
+		return 0, fmt.Errorf("%w: status %d: %s", errFatal, resp.StatusCode, bytes.TrimSpace(msg))
+	}
+}
+
+func getenv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,256 @@
+package shipper
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// fingerprintSize is how many leading bytes of a file identify it across
+// restarts. Rotation replaces the file, so its first line changes.
+const fingerprintSize = 1024
+
+// maxLineSize bounds a single buffered line so a file without newlines
+// cannot exhaust memory; longer lines are discarded.
+const maxLineSize = 1 << 20
+
+// position identifies where a line ends within a particular file.
+type position struct {
+	Fingerprint    string `json:"fingerprint"`
+	FingerprintLen int    `json:"fingerprint_len"`
+	Offset         int64  `json:"offset"`
+}
+
+// eventID derives a stable event_id for the line ending at p.
+func (p position) eventID() string {
+	return fmt.Sprintf("%.16s:%d", p.Fingerprint, p.Offset)
+}
+
+// line is a complete log line and the position just after it.
+type line struct {
+	path string
+	text string
+	pos  position
+}
+
+// tailer follows one log file path across rotations. Both rename-based
+// rotation (logrotate's default) and copytruncate are handled: a renamed
+// file is drained to EOF before the new file is opened, and a file that
+// shrank is reread from the start.
+type tailer struct {
+	path string
+
+	f       *os.File
+	info    os.FileInfo
+	offset  int64 // bytes consumed from f, including partial
+	partial []byte
+	skip    bool // discarding the rest of an over-long line
+
+	fp    string
+	fpLen int
+}
+
+func newTailer(path string) *tailer {
+	return &tailer{path: path}
+}
+
+// resume positions the tailer according to a checkpoint. If the file at
+// path is no longer the checkpointed one, the previous generation (path.1)
+// is drained first when it matches, so lines written just before a
+// rotation are not lost. Without a checkpoint the tailer starts at the end
+// of the file unless fromStart is set.
+func (t *tailer) resume(cp *position, fromStart bool) error {
+	if err := t.open(t.path); err != nil {
+		return err
+	}
+	if t.f == nil {
+		return nil // opened on a later poll
+	}
+	if cp == nil {
+		if !fromStart {
+			t.offset = t.info.Size()
+		}
+		return t.seek()
+	}
+	if t.matches(cp) {
+		t.offset = cp.Offset
+		return t.seek()
+	}
+
+	rotated := t.path + ".1"
+	prev := &tailer{path: rotated}
+	if err := prev.open(rotated); err == nil && prev.f != nil && prev.matches(cp) {
+		// Swap: read the rest of path.1 first, then continue with path
+		// from the start once it is exhausted (see poll).
+		t.close()
+		prev.offset = cp.Offset
+		if err := prev.seek(); err != nil {
+			prev.close()
+			return err
+		}
+		t.f, t.info, t.offset, t.fp, t.fpLen = prev.f, prev.info, prev.offset, prev.fp, prev.fpLen
+		return nil
+	} else if prev.f != nil {
+		prev.close()
+	}
+	return t.seek()
+}
+
+func (t *tailer) open(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	t.f, t.info, t.offset, t.partial, t.skip = f, info, 0, nil, false
+	t.fp, t.fpLen = "", 0
+	t.updateFingerprint()
+	return nil
+}
+
+func (t *tailer) seek() error {
+	if t.f == nil {
+		return nil
+	}
+	_, err := t.f.Seek(t.offset, io.SeekStart)
+	return err
+}
+
+func (t *tailer) close() {
+	if t.f != nil {
+		t.f.Close()
+		t.f = nil
+	}
+}
+
+// updateFingerprint hashes the first fingerprintSize bytes of the file, or
+// as many as exist so far.
+func (t *tailer) updateFingerprint() {
+	if t.fpLen >= fingerprintSize {
+		return
+	}
+	buf := make([]byte, fingerprintSize)
+	n, _ := t.f.ReadAt(buf, 0)
+	if n == t.fpLen && t.fp != "" {
+		return
+	}
+	sum := sha256.Sum256(buf[:n])
+	t.fp, t.fpLen = hex.EncodeToString(sum[:]), n
+}
+
+// matches reports whether the open file is the one cp was taken from.
+func (t *tailer) matches(cp *position) bool {
+	if cp.FingerprintLen > fingerprintSize || t.info.Size() < cp.Offset {
+		return false
+	}
+	buf := make([]byte, cp.FingerprintLen)
+	n, _ := t.f.ReadAt(buf, 0)
+	if n != cp.FingerprintLen {
+		return false
+	}
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:]) == cp.Fingerprint
+}
+
+// poll returns the complete lines appended since the last call.
+func (t *tailer) poll() ([]line, error) {
+	if t.f == nil {
+		if err := t.open(t.path); err != nil || t.f == nil {
+			return nil, err
+		}
+	}
+
+	lines, err := t.read()
+	if err != nil {
+		return lines, err
+	}
+
+	cur, err := os.Stat(t.path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return lines, nil // rotated away, new file not created yet
+	case err != nil:
+		return lines, err
+	case !os.SameFile(cur, t.info):
+		// Rotated: anything written to the old file after our last read
+		// still belongs to it.
+		more, err := t.read()
+		lines = append(lines, more...)
+		if err != nil {
+			return lines, err
+		}
+		t.close()
+		if err := t.open(t.path); err != nil {
+			return lines, err
+		}
+		more, err = t.read()
+		return append(lines, more...), err
+	case cur.Size() < t.offset:
+		// Truncated in place (copytruncate).
+		t.offset, t.partial, t.skip = 0, nil, false
+		t.fp, t.fpLen = "", 0
+		if err := t.seek(); err != nil {
+			return lines, err
+		}
+		t.updateFingerprint()
+	}
+	return lines, nil
+}
+
+func (t *tailer) read() ([]line, error) {
+	var lines []line
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := t.f.Read(buf)
+		if n > 0 {
+			start := t.offset
+			t.offset += int64(n)
+			if t.fpLen < fingerprintSize {
+				t.updateFingerprint()
+			}
+			data := buf[:n]
+			for len(data) > 0 {
+				i := bytes.IndexByte(data, '\n')
+				if i < 0 {
+					if !t.skip {
+						t.partial = append(t.partial, data...)
+						if len(t.partial) > maxLineSize {
+							t.partial, t.skip = nil, true
+						}
+					}
+					break
+				}
+				end := start + int64(i) + 1
+				if !t.skip {
+					text := string(append(t.partial, data[:i]...))
+					lines = append(lines, line{
+						path: t.path,
+						text: text,
+						pos:  position{Fingerprint: t.fp, FingerprintLen: t.fpLen, Offset: end},
+					})
+				}
+				t.partial, t.skip = nil, false
+				start = end
+				data = data[i+1:]
+			}
+		}
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return lines, err
+		}
+	}
+}
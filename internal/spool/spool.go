@@ -0,0 +1,461 @@
+// Package spool implements an on-disk, append-only write-ahead log used to
+// make accepted ingest batches durable before they reach the database.
+//
+// The spool is a directory of numbered segment files plus a cursor file.
+// Each record is framed as
+//
+//	[4-byte length][4-byte CRC-32C][8-byte append time (unix nanos)][payload]
+//
+// with the checksum covering the timestamp and payload. Readers consume
+// records in order and Commit their position; fully consumed segments are
+// deleted. A torn record at the end of a segment (e.g. after a crash during
+// append) is detected by its length or checksum and ignored.
+package spool
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	headerSize    = 16
+	segmentPrefix = "segment-"
+	segmentSuffix = ".log"
+	cursorFile    = "cursor"
+
+	// maxRecordSize guards against reading absurd lengths from a
+	// corrupted header.
+	maxRecordSize = 256 << 20
+)
+
+// ErrFull is returned by Append when the spool has reached its size limit.
+var ErrFull = errors.New("spool is full")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Options configures a Spool.
+type Options struct {
+	// MaxBytes caps the total size of unconsumed data. Zero means no limit.
+	MaxBytes int64
+	// SegmentBytes is the size at which the active segment is rotated.
+	SegmentBytes int64
+	// Fsync forces an fsync after every append. Without it a machine
+	// crash (not just a process crash) can lose recent records.
+	Fsync bool
+}
+
+// Position identifies a record boundary in the spool.
+type Position struct {
+	Segment uint64
+	Offset  int64
+}
+
+// Record is a single spooled payload and the position just after it.
+type Record struct {
+	Payload    []byte
+	AppendedAt time.Time
+	Next       Position
+}
+
+// Stats describes the unconsumed part of the spool.
+type Stats struct {
+	PendingBytes    int64
+	Segments        int
+	OldestUnflushed time.Time // zero when the spool is empty
+}
+
+// Spool is safe for concurrent appenders and a single reader.
+type Spool struct {
+	dir  string
+	opts Options
+
+	mu       sync.Mutex
+	segments []uint64 // ascending; last is the active segment
+	sizes    map[uint64]int64
+	active   *os.File
+	cursor   Position
+	oldest   time.Time
+	notify   chan struct{}
+}
+
+// Open opens (creating if needed) the spool in dir. A fresh active segment
+// is started so that a torn tail left by a crash is never appended to.
+func Open(dir string, opts Options) (*Spool, error) {
+	if opts.SegmentBytes <= 0 {
+		opts.SegmentBytes = 64 << 20
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	s := &Spool{
+		dir:    dir,
+		opts:   opts,
+		sizes:  make(map[uint64]int64),
+		notify: make(chan struct{}, 1),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, seq)
+		s.sizes[seq] = info.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+
+	if err := s.loadCursor(); err != nil {
+		return nil, err
+	}
+
+	next := uint64(1)
+	if n := len(s.segments); n > 0 {
+		next = s.segments[n-1] + 1
+	}
+	if err := s.openSegment(next); err != nil {
+		return nil, err
+	}
+	if len(s.segments) == 1 || s.cursor.Segment == 0 {
+		s.cursor = Position{Segment: s.segments[0]}
+	}
+	s.oldest = s.peekTime(s.cursor)
+	return s, nil
+}
+
+// Append durably adds payload to the spool.
+func (s *Spool) Append(payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active == nil {
+		return errors.New("spool is closed")
+	}
+	frameSize := int64(headerSize + len(payload))
+	if s.opts.MaxBytes > 0 && s.pendingBytesLocked()+frameSize > s.opts.MaxBytes {
+		return ErrFull
+	}
+
+	activeSeq := s.segments[len(s.segments)-1]
+	if s.sizes[activeSeq] > 0 && s.sizes[activeSeq]+frameSize > s.opts.SegmentBytes {
+		if err := s.openSegment(activeSeq + 1); err != nil {
+			return err
+		}
+		activeSeq++
+	}
+
+	now := time.Now()
+	frame := make([]byte, frameSize)
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint64(frame[8:16], uint64(now.UnixNano()))
+	copy(frame[headerSize:], payload)
+	binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(frame[8:], crcTable))
+
+	if n, err := s.active.Write(frame); err != nil {
+		// Never append after a partial frame: start a new segment so the
+		// torn one is skipped by readers without hiding later records.
+		s.sizes[activeSeq] += int64(n)
+		if rerr := s.openSegment(activeSeq + 1); rerr != nil {
+			log.Printf("spool: rotate after failed write: %v", rerr)
+		}
+		return err
+	}
+	if s.opts.Fsync {
+		if err := s.active.Sync(); err != nil {
+			return err
+		}
+	}
+	s.sizes[activeSeq] += frameSize
+	if s.oldest.IsZero() {
+		s.oldest = now
+	}
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Notify returns a channel that receives a value after appends, so a
+// reader can sleep until there is new data.
+func (s *Spool) Notify() <-chan struct{} {
+	return s.notify
+}
+
+// Read returns up to max records starting at the committed cursor. It does
+// not advance the cursor; call Commit with the last record's Next position
+// once the records have been processed.
+func (s *Spool) Read(max int) ([]Record, error) {
+	s.mu.Lock()
+	pos := s.cursor
+	segments := append([]uint64(nil), s.segments...)
+	sizes := make(map[uint64]int64, len(s.sizes))
+	for k, v := range s.sizes {
+		sizes[k] = v
+	}
+	s.mu.Unlock()
+
+	var out []Record
+	for _, seq := range segments {
+		if seq < pos.Segment {
+			continue
+		}
+		offset := int64(0)
+		if seq == pos.Segment {
+			offset = pos.Offset
+		}
+		limit := sizes[seq]
+		if offset >= limit {
+			continue
+		}
+		recs, err := s.readSegment(seq, offset, limit, max-len(out))
+		if err != nil {
+			return out, err
+		}
+		out = append(out, recs...)
+		if len(out) >= max {
+			break
+		}
+		if len(recs) == 0 || recs[len(recs)-1].Next.Offset < limit {
+			// A torn or corrupt record ends this segment early; skip
+			// to the next one by positioning at its end.
+			if seq != segments[len(segments)-1] {
+				log.Printf("spool: skipping corrupt tail of segment %d at offset %d", seq, lastOffset(recs, offset))
+				out = append(out, Record{Next: Position{Segment: seq, Offset: limit}})
+			}
+		}
+	}
+	return out, nil
+}
+
+func lastOffset(recs []Record, def int64) int64 {
+	if len(recs) == 0 {
+		return def
+	}
+	return recs[len(recs)-1].Next.Offset
+}
+
+func (s *Spool) readSegment(seq uint64, offset, limit int64, max int) ([]Record, error) {
+	f, err := os.Open(s.segmentPath(seq))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(io.LimitReader(f, limit-offset))
+
+	var out []Record
+	header := make([]byte, headerSize)
+	for len(out) < max {
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+		n := binary.BigEndian.Uint32(header[0:4])
+		if n > maxRecordSize || offset+headerSize+int64(n) > limit {
+			break
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			break
+		}
+		crc := crc32.Update(crc32.Checksum(header[8:16], crcTable), crcTable, payload)
+		if crc != binary.BigEndian.Uint32(header[4:8]) {
+			break
+		}
+		offset += headerSize + int64(n)
+		out = append(out, Record{
+			Payload:    payload,
+			AppendedAt: time.Unix(0, int64(binary.BigEndian.Uint64(header[8:16]))),
+			Next:       Position{Segment: seq, Offset: offset},
+		})
+	}
+	return out, nil
+}
+
+// Commit records that everything before pos has been processed. Segments
+// that are entirely behind the cursor (other than the active one) are
+// removed.
+func (s *Spool) Commit(pos Position) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Move past a fully consumed, rotated segment.
+	for i, seq := range s.segments {
+		if seq == pos.Segment && pos.Offset >= s.sizes[seq] && i < len(s.segments)-1 {
+			pos = Position{Segment: s.segments[i+1]}
+		}
+	}
+	s.cursor = pos
+	if err := s.writeCursor(); err != nil {
+		return err
+	}
+
+	kept := s.segments[:0]
+	for _, seq := range s.segments {
+		if seq < pos.Segment {
+			if err := os.Remove(s.segmentPath(seq)); err != nil && !os.IsNotExist(err) {
+				log.Printf("spool: failed to remove segment %d: %v", seq, err)
+			}
+			delete(s.sizes, seq)
+			continue
+		}
+		kept = append(kept, seq)
+	}
+	s.segments = kept
+	s.oldest = s.peekTime(pos)
+	return nil
+}
+
+// Stats reports the unconsumed size and age of the spool.
+func (s *Spool) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := s.pendingBytesLocked()
+	st := Stats{PendingBytes: pending, Segments: len(s.segments)}
+	if pending > 0 {
+		st.OldestUnflushed = s.oldest
+	}
+	return st
+}
+
+// Close closes the active segment. Unconsumed records stay on disk and are
+// returned by Read after the next Open.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active == nil {
+		return nil
+	}
+	err := s.active.Close()
+	s.active = nil
+	return err
+}
+
+func (s *Spool) pendingBytesLocked() int64 {
+	var total int64
+	for _, seq := range s.segments {
+		if seq < s.cursor.Segment {
+			continue
+		}
+		total += s.sizes[seq]
+		if seq == s.cursor.Segment {
+			total -= s.cursor.Offset
+		}
+	}
+	return total
+}
+
+func (s *Spool) openSegment(seq uint64) error {
+	f, err := os.OpenFile(s.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if s.active != nil {
+		if err := s.active.Close(); err != nil {
+			log.Printf("spool: failed to close segment: %v", err)
+		}
+	}
+	s.active = f
+	s.segments = append(s.segments, seq)
+	s.sizes[seq] = 0
+	return nil
+}
+
+// peekTime returns the append time of the record at pos, or zero if there
+// is none. The caller must hold s.mu.
+func (s *Spool) peekTime(pos Position) time.Time {
+	for _, seq := range s.segments {
+		if seq < pos.Segment {
+			continue
+		}
+		offset := int64(0)
+		if seq == pos.Segment {
+			offset = pos.Offset
+		}
+		if offset >= s.sizes[seq] {
+			continue
+		}
+		recs, err := s.readSegment(seq, offset, s.sizes[seq], 1)
+		if err == nil && len(recs) == 1 {
+			return recs[0].AppendedAt
+		}
+	}
+	return time.Time{}
+}
+
+func (s *Spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s%020d%s", segmentPrefix, seq, segmentSuffix))
+}
+
+func (s *Spool) loadCursor() error {
+	b, err := os.ReadFile(filepath.Join(s.dir, cursorFile))
+	if os.IsNotExist(err) {
+		if len(s.segments) > 0 {
+			s.cursor = Position{Segment: s.segments[0]}
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var pos Position
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(b)), "%d %d", &pos.Segment, &pos.Offset); err != nil {
+		return fmt.Errorf("spool: invalid cursor file: %w", err)
+	}
+	s.cursor = pos
+	if len(s.segments) > 0 && s.cursor.Segment < s.segments[0] {
+		s.cursor = Position{Segment: s.segments[0]}
+	}
+	return nil
+}
+
+// writeCursor persists the cursor atomically via a temp file and rename.
+// The caller must hold s.mu.
+func (s *Spool) writeCursor() error {
+	path := filepath.Join(s.dir, cursorFile)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%d %d\n", s.cursor.Segment, s.cursor.Offset); err != nil {
+		f.Close()
+		return err
+	}
+	if s.opts.Fsync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
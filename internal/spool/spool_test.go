@@ -0,0 +1,213 @@
+package spool
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openSpool(t *testing.T, dir string, opts Options) *Spool {
+	t.Helper()
+	s, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func appendAll(t *testing.T, s *Spool, payloads ...string) {
+	t.Helper()
+	for _, p := range payloads {
+		if err := s.Append([]byte(p)); err != nil {
+			t.Fatalf("Append(%q): %v", p, err)
+		}
+	}
+}
+
+// payloads returns the payloads of recs, leaving out the empty records
+// Read returns for skipped corrupt tails.
+func payloads(recs []Record) []string {
+	var out []string
+	for _, r := range recs {
+		if len(r.Payload) > 0 {
+			out = append(out, string(r.Payload))
+		}
+	}
+	return out
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestReadCommitAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	s := openSpool(t, dir, Options{})
+	appendAll(t, s, "a", "bb", "ccc")
+
+	recs, err := s.Read(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := payloads(recs); !equal(got, []string{"a", "bb"}) {
+		t.Fatalf("Read(2) = %q", got)
+	}
+	// Reading again without a commit returns the same records.
+	again, _ := s.Read(2)
+	if got := payloads(again); !equal(got, []string{"a", "bb"}) {
+		t.Fatalf("second Read(2) = %q", got)
+	}
+	if err := s.Commit(recs[1].Next); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.Stats().PendingBytes, int64(headerSize+3); got != want {
+		t.Errorf("PendingBytes = %d, want %d", got, want)
+	}
+	s.Close()
+
+	s = openSpool(t, dir, Options{})
+	recs, err = s.Read(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := payloads(recs); !equal(got, []string{"ccc"}) {
+		t.Fatalf("Read after reopen = %q, want [ccc]", got)
+	}
+	if err := s.Commit(recs[len(recs)-1].Next); err != nil {
+		t.Fatal(err)
+	}
+	st := s.Stats()
+	if st.PendingBytes != 0 || !st.OldestUnflushed.IsZero() {
+		t.Errorf("Stats after full commit = %+v, want empty", st)
+	}
+}
+
+func TestCommitRemovesConsumedSegments(t *testing.T) {
+	dir := t.TempDir()
+	// Every record gets a segment of its own.
+	s := openSpool(t, dir, Options{SegmentBytes: headerSize + 1})
+	appendAll(t, s, "a", "b", "c", "d")
+	if got := s.Stats().Segments; got != 4 {
+		t.Fatalf("Segments = %d, want 4", got)
+	}
+
+	recs, err := s.Read(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Commit(recs[len(recs)-1].Next); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Stats().Segments; got != 1 {
+		t.Errorf("Segments after commit = %d, want 1", got)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, segmentPrefix+"*"))
+	if len(files) != 1 {
+		t.Errorf("segment files = %v, want 1", files)
+	}
+	recs, _ = s.Read(10)
+	if got := payloads(recs); !equal(got, []string{"d"}) {
+		t.Errorf("Read = %q, want [d]", got)
+	}
+}
+
+func TestFull(t *testing.T) {
+	s := openSpool(t, t.TempDir(), Options{MaxBytes: 2 * (headerSize + 4)})
+	appendAll(t, s, "1234", "5678")
+	if err := s.Append([]byte("x")); !errors.Is(err, ErrFull) {
+		t.Fatalf("Append over MaxBytes = %v, want ErrFull", err)
+	}
+	recs, _ := s.Read(1)
+	if err := s.Commit(recs[0].Next); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append([]byte("x")); err != nil {
+		t.Errorf("Append after commit = %v", err)
+	}
+}
+
+func TestCorruptTail(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(frame []byte) []byte
+	}{
+		{"truncated header", func(f []byte) []byte { return f[:headerSize-3] }},
+		{"truncated payload", func(f []byte) []byte { return f[:len(f)-2] }},
+		{"bad checksum", func(f []byte) []byte { f[4] ^= 0xff; return f }},
+		{"flipped payload", func(f []byte) []byte { f[len(f)-1] ^= 0x01; return f }},
+		{"flipped timestamp", func(f []byte) []byte { f[12] ^= 0x01; return f }},
+		{"huge length", func(f []byte) []byte { f[0] = 0xff; return f }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := openSpool(t, dir, Options{})
+			appendAll(t, s, "first", "second", "last")
+			s.Close()
+
+			// Replace the last frame of the segment by its corrupted form.
+			path := s.segmentPath(s.segments[0])
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lastStart := len(b) - (headerSize + len("last"))
+			frame := append([]byte(nil), b[lastStart:]...)
+			if err := os.WriteFile(path, append(b[:lastStart], tt.corrupt(frame)...), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			s = openSpool(t, dir, Options{})
+			appendAll(t, s, "after")
+			recs, err := s.Read(10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := payloads(recs); !equal(got, []string{"first", "second", "after"}) {
+				t.Fatalf("Read = %q, want [first second after]", got)
+			}
+			if err := s.Commit(recs[len(recs)-1].Next); err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Stats().PendingBytes; got != 0 {
+				t.Errorf("PendingBytes after commit = %d, want 0", got)
+			}
+		})
+	}
+}
+
+func TestCursorFile(t *testing.T) {
+	dir := t.TempDir()
+	s := openSpool(t, dir, Options{})
+	appendAll(t, s, "a", "b")
+	recs, _ := s.Read(1)
+	if err := s.Commit(recs[0].Next); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	b, err := os.ReadFile(filepath.Join(dir, cursorFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "1 17\n"; got != want {
+		t.Errorf("cursor file = %q, want %q", got, want)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, cursorFile), []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dir, Options{}); err == nil {
+		t.Error("Open with an invalid cursor file succeeded")
+	}
+}
@@ -0,0 +1,209 @@
+// Package useragent classifies HTTP clients from their User-Agent header:
+// browser, operating system, device type, the name and version of native
+// apps and HTTP libraries, and whether the client is a known bot or
+// crawler. It favours a few well-known patterns over completeness.
+package useragent
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Device types.
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceBot     = "bot"
+	DeviceOther   = "other"
+)
+
+// Info is what Parse found. Browser and OS versions keep at most
+// major.minor; AppVersion is kept as sent.
+type Info struct {
+	Browser        string
+	BrowserVersion string
+	OS             string
+	OSVersion      string
+	Device         string
+	// App and AppVersion name the leading product of user agents that do
+	// not pretend to be a browser, e.g. "MyApp/3.2.1 (iPhone; iOS 17.0)"
+	// or "okhttp/4.12.0".
+	App        string
+	AppVersion string
+	// Bot is set for crawlers, monitors and other automated clients; the
+	// bot's name is reported as Browser.
+	Bot bool
+}
+
+var (
+	productRe = regexp.MustCompile(`([A-Za-z][A-Za-z0-9_.-]*)/([0-9][A-Za-z0-9_.]*)`)
+
+	// botNameRe matches names ending in a bot keyword, such as Googlebot or
+	// AdsBot-Google; see botName for when they count.
+	botNameRe = regexp.MustCompile(`(?i)\b[a-z0-9]+(?:bot|crawler|spider)(?:-[a-z0-9]+)*\b`)
+	// botWordRe matches the keywords as words of their own, as in
+	// "Yahoo! Slurp" or "Sogou web spider/4.0".
+	botWordRe = regexp.MustCompile(`(?i)\b(?:bot|crawler|spider|slurp)\b`)
+
+	windowsRe = regexp.MustCompile(`Windows NT ([0-9.]+)`)
+	iosRe     = regexp.MustCompile(`(?:iPhone OS|CPU OS|iOS) ([0-9_.]+)`)
+	macRe     = regexp.MustCompile(`Mac OS X ([0-9_.]+)`)
+	androidRe = regexp.MustCompile(`Android ([0-9.]+)`)
+)
+
+// botNames are automated clients whose user agent lacks a bot keyword.
+var botNames = []string{
+	"facebookexternalhit", "HeadlessChrome", "Lighthouse", "Pingdom", "UptimeRobot",
+	"StatusCake", "Site24x7", "PhantomJS", "Prerender", "WhatsApp", "Google-InspectionTool",
+}
+
+// windowsVersions maps Windows NT versions to marketing names.
+var windowsVersions = map[string]string{
+	"10.0": "10", "6.3": "8.1", "6.2": "8", "6.1": "7", "6.0": "Vista", "5.1": "XP",
+}
+
+// browsers are matched in order: Chromium-based browsers also carry
+// Chrome/ and Safari/ tokens.
+var browsers = []struct{ token, name string }{
+	{"Edg", "Edge"},
+	{"EdgA", "Edge"},
+	{"EdgiOS", "Edge"},
+	{"OPR", "Opera"},
+	{"SamsungBrowser", "Samsung Internet"},
+	{"YaBrowser", "Yandex Browser"},
+	{"Vivaldi", "Vivaldi"},
+	{"FxiOS", "Firefox"},
+	{"Firefox", "Firefox"},
+	{"CriOS", "Chrome"},
+	{"Chrome", "Chrome"},
+}
+
+// Parse classifies ua. An empty ua yields an empty Info.
+func Parse(ua string) Info {
+	ua = strings.TrimSpace(ua)
+	if ua == "" {
+		return Info{}
+	}
+	var info Info
+	products := productRe.FindAllStringSubmatch(ua, -1)
+	version := func(token string) (string, bool) {
+		for _, p := range products {
+			if p[1] == token {
+				return shortVersion(p[2]), true
+			}
+		}
+		return "", false
+	}
+
+	info.OS, info.OSVersion = parseOS(ua)
+
+	if name := botName(ua); name != "" {
+		info.Bot, info.Device = true, DeviceBot
+		info.Browser = name
+		if v, ok := version(name); ok {
+			info.BrowserVersion = v
+		}
+		return info
+	}
+
+	if len(products) > 0 && products[0][1] != "Mozilla" && products[0][1] != "Opera" && strings.HasPrefix(ua, products[0][0]) {
+		info.App, info.AppVersion = products[0][1], products[0][2]
+	} else {
+		for _, b := range browsers {
+			if v, ok := version(b.token); ok {
+				info.Browser, info.BrowserVersion = b.name, v
+				break
+			}
+		}
+		if info.Browser == "" {
+			if _, ok := version("Safari"); ok {
+				info.Browser = "Safari"
+				info.BrowserVersion, _ = version("Version")
+			} else if strings.Contains(ua, "Trident/") || strings.Contains(ua, "MSIE ") {
+				info.Browser = "Internet Explorer"
+			}
+		}
+	}
+
+	info.Device = device(ua, info.OS)
+	return info
+}
+
+// botName returns the name of the bot ua belongs to, or "". A name ending
+// in a bot keyword counts when it is a product ("Googlebot/2.1"), has a
+// suffix ("AdsBot-Google") or follows "compatible;", so that device and
+// app names such as "Cubot X30" are not taken for bots.
+func botName(ua string) string {
+	for _, name := range botNames {
+		if strings.Contains(ua, name) {
+			return name
+		}
+	}
+	for _, m := range botNameRe.FindAllStringIndex(ua, -1) {
+		name := ua[m[0]:m[1]]
+		if m[1] < len(ua) && ua[m[1]] == '/' || strings.Contains(name, "-") ||
+			strings.HasSuffix(strings.TrimRight(ua[:m[0]], " "), "compatible;") {
+			return name
+		}
+	}
+	return botWordRe.FindString(ua)
+}
+
+func parseOS(ua string) (string, string) {
+	switch {
+	case strings.Contains(ua, "Windows Phone"):
+		return "Windows Phone", ""
+	case strings.Contains(ua, "Windows"):
+		if m := windowsRe.FindStringSubmatch(ua); m != nil {
+			if name, ok := windowsVersions[m[1]]; ok {
+				return "Windows", name
+			}
+			return "Windows", m[1]
+		}
+		return "Windows", ""
+	case strings.Contains(ua, "iPhone") || strings.Contains(ua, "iPad") || strings.Contains(ua, "iPod") || iosRe.MatchString(ua) && !strings.Contains(ua, "Mac OS X"):
+		if m := iosRe.FindStringSubmatch(ua); m != nil {
+			return "iOS", shortVersion(m[1])
+		}
+		return "iOS", ""
+	case strings.Contains(ua, "Android"):
+		if m := androidRe.FindStringSubmatch(ua); m != nil {
+			return "Android", shortVersion(m[1])
+		}
+		return "Android", ""
+	case strings.Contains(ua, "CrOS"):
+		return "ChromeOS", ""
+	case strings.Contains(ua, "Mac OS X") || strings.Contains(ua, "Macintosh"):
+		if m := macRe.FindStringSubmatch(ua); m != nil {
+			return "macOS", shortVersion(m[1])
+		}
+		return "macOS", ""
+	case strings.Contains(ua, "Linux"):
+		return "Linux", ""
+	}
+	return "", ""
+}
+
+func device(ua, os string) string {
+	switch {
+	case strings.Contains(ua, "iPad") || strings.Contains(ua, "Tablet"):
+		return DeviceTablet
+	case os == "Android" && !strings.Contains(ua, "Mobile"):
+		return DeviceTablet
+	case os == "iOS" || os == "Android" || os == "Windows Phone" || strings.Contains(ua, "Mobile"):
+		return DeviceMobile
+	case os == "Windows" || os == "macOS" || os == "Linux" || os == "ChromeOS":
+		return DeviceDesktop
+	}
+	return DeviceOther
+}
+
+// shortVersion keeps major.minor of v, accepting "_" as the separator.
+func shortVersion(v string) string {
+	parts := strings.FieldsFunc(v, func(r rune) bool { return r == '.' || r == '_' })
+	if len(parts) > 2 {
+		parts = parts[:2]
+	}
+	return strings.Join(parts, ".")
+}
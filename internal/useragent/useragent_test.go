@@ -0,0 +1,114 @@
+package useragent
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		ua   string
+		want Info
+	}{
+		{"empty", "", Info{}},
+
+		{
+			"chrome on windows",
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+			Info{Browser: "Chrome", BrowserVersion: "120.0", OS: "Windows", OSVersion: "10", Device: DeviceDesktop},
+		},
+		{
+			"edge on windows",
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.2210.91",
+			Info{Browser: "Edge", BrowserVersion: "120.0", OS: "Windows", OSVersion: "10", Device: DeviceDesktop},
+		},
+		{
+			"firefox on linux",
+			"Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0",
+			Info{Browser: "Firefox", BrowserVersion: "121.0", OS: "Linux", Device: DeviceDesktop},
+		},
+		{
+			"safari on macos",
+			"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Safari/605.1.15",
+			Info{Browser: "Safari", BrowserVersion: "17.2", OS: "macOS", OSVersion: "10.15", Device: DeviceDesktop},
+		},
+		{
+			"safari on iphone",
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 17_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Mobile/15E148 Safari/604.1",
+			Info{Browser: "Safari", BrowserVersion: "17.2", OS: "iOS", OSVersion: "17.2", Device: DeviceMobile},
+		},
+		{
+			"chrome on android phone",
+			"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.6099.144 Mobile Safari/537.36",
+			Info{Browser: "Chrome", BrowserVersion: "120.0", OS: "Android", OSVersion: "14", Device: DeviceMobile},
+		},
+		{
+			"android tablet",
+			"Mozilla/5.0 (Linux; Android 13; SM-X200) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+			Info{Browser: "Chrome", BrowserVersion: "120.0", OS: "Android", OSVersion: "13", Device: DeviceTablet},
+		},
+		{
+			"native app",
+			"MyApp/3.2.1 (iPhone; iOS 17.0)",
+			Info{App: "MyApp", AppVersion: "3.2.1", OS: "iOS", OSVersion: "17.0", Device: DeviceMobile},
+		},
+		{"http library", "okhttp/4.12.0", Info{App: "okhttp", AppVersion: "4.12.0", Device: DeviceOther}},
+
+		{
+			"googlebot",
+			"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			Info{Browser: "Googlebot", BrowserVersion: "2.1", Device: DeviceBot, Bot: true},
+		},
+		{
+			"bingbot",
+			"Mozilla/5.0 AppleWebKit/537.36 (KHTML, like Gecko; compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm) Chrome/116.0.1938.76 Safari/537.36",
+			Info{Browser: "bingbot", BrowserVersion: "2.0", Device: DeviceBot, Bot: true},
+		},
+		{
+			"petalbot without version",
+			"Mozilla/5.0 (compatible; PetalBot;+https://webmaster.petalsearch.com/site/petalbot)",
+			Info{Browser: "PetalBot", Device: DeviceBot, Bot: true},
+		},
+		{"adsbot", "AdsBot-Google (+http://www.google.com/adsbot.html)", Info{Browser: "AdsBot-Google", Device: DeviceBot, Bot: true}},
+		{"baiduspider", "Mozilla/5.0 (compatible; Baiduspider/2.0; +http://www.baidu.com/search/spider.html)", Info{Browser: "Baiduspider", BrowserVersion: "2.0", Device: DeviceBot, Bot: true}},
+		{"slurp", "Mozilla/5.0 (compatible; Yahoo! Slurp; http://help.yahoo.com/help/us/ysearch/slurp)", Info{Browser: "Slurp", Device: DeviceBot, Bot: true}},
+		{"uptime monitor", "Mozilla/5.0+(compatible; UptimeRobot/2.0; http://www.uptimerobot.com/)", Info{Browser: "UptimeRobot", BrowserVersion: "2.0", Device: DeviceBot, Bot: true}},
+		{
+			"headless chrome",
+			"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) HeadlessChrome/120.0.0.0 Safari/537.36",
+			Info{Browser: "HeadlessChrome", BrowserVersion: "120.0", OS: "Linux", Device: DeviceBot, Bot: true},
+		},
+
+		{
+			"cubot phone",
+			"Mozilla/5.0 (Linux; Android 10; Cubot X30) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36",
+			Info{Browser: "Chrome", BrowserVersion: "120.0", OS: "Android", OSVersion: "10", Device: DeviceMobile},
+		},
+		{
+			"cubot build name",
+			"Mozilla/5.0 (Linux; Android 9; CUBOT_P30 Build/PPR1.180610.011) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/119.0.0.0 Mobile Safari/537.36",
+			Info{Browser: "Chrome", BrowserVersion: "119.0", OS: "Android", OSVersion: "9", Device: DeviceMobile},
+		},
+		{"abbott app", "AbbottLibreLink/2.10.1 (iPhone; iOS 17.1)", Info{App: "AbbottLibreLink", AppVersion: "2.10.1", OS: "iOS", OSVersion: "17.1", Device: DeviceMobile}},
+		{
+			"roboform extension",
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 RoboForm/9.5.6",
+			Info{Browser: "Chrome", BrowserVersion: "120.0", OS: "Windows", OSVersion: "10", Device: DeviceDesktop},
+		},
+		{"bottle app", "Bottle/0.12.25", Info{App: "Bottle", AppVersion: "0.12.25", Device: DeviceOther}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Parse(tt.ua); got != tt.want {
+				t.Errorf("Parse(%q)\n got %+v\nwant %+v", tt.ua, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShortVersion(t *testing.T) {
+	tests := map[string]string{"120.0.6099.144": "120.0", "17_2_1": "17.2", "14": "14", "": ""}
+	for in, want := range tests {
+		if got := shortVersion(in); got != want {
+			t.Errorf("shortVersion(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -1,30 +1,68 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/fasthttp/router"
 	"github.com/joho/godotenv"
 	"github.com/valyala/fasthttp"
 
+	"apiinsight/internal/clientip"
 	"apiinsight/internal/config"
 	"apiinsight/internal/db"
+	"apiinsight/internal/geoip"
 	"apiinsight/internal/http/handlers"
 	appmw "apiinsight/internal/http/middleware"
+	"apiinsight/internal/ingest"
+	"apiinsight/internal/ratelimit"
+	"apiinsight/internal/redact"
+	"apiinsight/internal/routes"
+	"apiinsight/internal/sampling"
+	"apiinsight/internal/shipper"
+	"apiinsight/internal/spool"
 	ui "apiinsight/web"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "ship":
+			if err := shipper.Run(os.Args[2:]); err != nil {
+				log.Fatalf("ship: %v", err)
+			}
+			return
+		case "migrate":
+			_ = godotenv.Load()
+			if err := db.RunMigrate(config.Load(), os.Args[2:]); err != nil {
+				log.Fatalf("migrate: %v", err)
+			}
+			return
+		}
+	}
+
 	_ = godotenv.Load()
 	cfg := config.Load()
 
-	sqlDB, err := db.Connect(cfg)
+	if !db.ValidPartition(cfg.EventsPartition) {
+		log.Fatalf("APP_EVENTS_PARTITION: unknown interval %q", cfg.EventsPartition)
+	}
+	store, err := db.Connect(cfg)
 	if err != nil {
 		log.Fatalf("failed to connect database: %v", err)
 	}
+	defer store.Close()
+	sqlDB := store.DB()
 
-	db.StartRetentionWorker(sqlDB)
-	db.StartAggregationWorker(sqlDB)
+	db.StartRetentionWorker(store)
+	db.StartAggregationWorker(store)
+	db.StartPartitionWorker(store)
 
 	if err := db.EnsureBootstrapAdmin(sqlDB, cfg); err != nil {
 		log.Fatalf("failed to ensure bootstrap admin: %v", err)
@@ -40,65 +78,235 @@ func main() {
 
 	handlers.InitPrometheusMetrics()
 
-	r := router.New()
+	routeTemplates := routes.NewCache(func(apiKeyID uint) ([]string, error) {
+		return db.RouteTemplatePatterns(sqlDB, apiKeyID)
+	}, time.Minute)
+
+	samplingRules := sampling.NewCache(func(apiKeyID uint) ([]sampling.Rule, error) {
+		rows, err := db.SamplingRulesForKey(sqlDB, apiKeyID)
+		if err != nil {
+			return nil, err
+		}
+		rules := make([]sampling.Rule, 0, len(rows))
+		for _, r := range rows {
+			rules = append(rules, sampling.Rule{Route: r.Route, Rate: r.Rate})
+		}
+		return rules, nil
+	}, time.Minute)
+
+	if !clientip.ValidPolicy(cfg.IPPolicy) {
+		log.Fatalf("APP_IP_POLICY: unknown policy %q", cfg.IPPolicy)
+	}
+	if cfg.IPHashKey == "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			log.Fatalf("failed to generate IP hash key: %v", err)
+		}
+		cfg.IPHashKey = hex.EncodeToString(key)
+		log.Printf("APP_IP_HASH_KEY is not set; hashed client IPs will change on restart")
+	}
+	trustedProxies, err := clientip.ParsePrefixes(cfg.TrustedProxies)
+	if err != nil {
+		log.Fatalf("APP_TRUSTED_PROXIES: %v", err)
+	}
+
+	var geo *geoip.Resolver
+	if len(cfg.GeoIPDatabases) > 0 {
+		geo, err = geoip.Open(cfg.GeoIPDatabases)
+		if err != nil {
+			log.Fatalf("failed to open GeoIP databases: %v", err)
+		}
+		geo.Watch(cfg.GeoIPReloadInterval)
+		defer geo.Close()
+	}
 
-	internalURL := "http://localhost" + cfg.ListenAddr + "/v1/events"
-	if cfg.ListenAddr != "" && cfg.ListenAddr[0] != ':' {
-		internalURL = "http://" + cfg.ListenAddr + "/v1/events"
+	globalRedaction := redact.Rules{Detectors: cfg.RedactDetectors, DenyKeys: cfg.RedactDenyKeys}
+	for _, name := range cfg.RedactDetectors {
+		if !redact.ValidDetector(name) {
+			log.Fatalf("APP_REDACT_DETECTORS: unknown detector %q", name)
+		}
 	}
+	for _, v := range cfg.RedactRouteReplacements {
+		rep, err := redact.ParseReplacement(v)
+		if err != nil {
+			log.Fatalf("APP_REDACT_ROUTE_REPLACEMENTS: %v", err)
+		}
+		globalRedaction.Routes = append(globalRedaction.Routes, rep)
+	}
+	redaction := redact.NewCache(globalRedaction, func(apiKeyID uint) (redact.Rules, error) {
+		rows, err := db.RedactionRulesForKey(sqlDB, apiKeyID)
+		if err != nil {
+			return redact.Rules{}, err
+		}
+		var rules redact.Rules
+		for _, r := range rows {
+			switch r.Kind {
+			case db.RedactDetector:
+				rules.Detectors = append(rules.Detectors, r.Pattern)
+			case db.RedactDenyKey:
+				rules.DenyKeys = append(rules.DenyKeys, r.Pattern)
+			case db.RedactRoute:
+				// Patterns are checked when saved from the settings page.
+				if rep, err := redact.NewReplacement(r.Pattern, r.Replacement); err == nil {
+					rules.Routes = append(rules.Routes, rep)
+				}
+			case db.RedactUserAgent:
+				if rep, err := redact.NewReplacement(r.Pattern, r.Replacement); err == nil {
+					rules.UserAgents = append(rules.UserAgents, rep)
+				}
+			}
+		}
+		return rules, nil
+	}, time.Minute)
+
+	ingestOpts := ingest.Options{
+		BufferSize:    cfg.IngestBufferSize,
+		Workers:       cfg.IngestWorkers,
+		BatchSize:     cfg.IngestBatchSize,
+		FlushInterval: cfg.IngestFlushInterval,
+		OnStored:      handlers.ObserveEvents,
+	}
+	if cfg.SpoolDir != "" {
+		sp, err := spool.Open(cfg.SpoolDir, spool.Options{
+			MaxBytes:     cfg.SpoolMaxBytes,
+			SegmentBytes: cfg.SpoolSegmentBytes,
+			Fsync:        cfg.SpoolFsync,
+		})
+		if err != nil {
+			log.Fatalf("failed to open ingest spool: %v", err)
+		}
+		if st := sp.Stats(); st.PendingBytes > 0 {
+			log.Printf("ingest spool: replaying %d bytes left from a previous run", st.PendingBytes)
+		}
+		ingestOpts.Spool = sp
+	}
+	pipeline := ingest.NewPipeline(store, ingestOpts)
+
+	limiter := ratelimit.New(db.UsageStore{DB: sqlDB})
+	limiter.Start(5 * time.Second)
+
+	r := router.New()
+	// Lets internal reporting group its events by route pattern.
+	r.SaveMatchedRoutePath = true
+
+	// Internal reporting writes straight into the pipeline; nil when
+	// APP_INTERNAL_API_KEY is unset.
+	internalSink := handlers.NewInternalSink(sqlDB, pipeline, cfg, routeTemplates, limiter, samplingRules, redaction, geo)
 
 	// Global middleware chain: request logger, then internal reporting, then router
-	handler := handlers.RequestLogger(appmw.InternalReporting(cfg, internalURL)(r.Handler))
+	handler := handlers.RequestLogger(appmw.InternalReporting(cfg, internalSink, trustedProxies)(r.Handler))
 
 	r.GET("/healthz", func(ctx *fasthttp.RequestCtx) {
 		ctx.SetStatusCode(fasthttp.StatusOK)
 		ctx.SetBodyString("ok")
 	})
+	r.GET("/healthz/ingest", handlers.IngestHealth(pipeline))
 
 	r.ServeFS("/static/{filepath:*}", ui.StaticFS())
 
 	r.GET("/login", handlers.LoginForm(cfg))
-	r.POST("/login", handlers.LoginSubmit(sqlDB))
-	r.POST("/logout", handlers.Logout())
+	r.POST("/login", handlers.LoginSubmit(sqlDB, cfg))
+
+	// admin wraps dashboard routes with session authentication and CSRF
+	// validation for state-changing methods.
+	admin := func(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+		return appmw.AdminAuth(sqlDB, cfg)(appmw.CSRF(sqlDB)(h))
+	}
+
+	// metricsAuth accepts either a dashboard session or an API key with the
+	// metrics:read or admin scope.
+	metricsAuth := appmw.MetricsAuth(sqlDB, cfg)
+
+	r.POST("/logout", admin(handlers.Logout(sqlDB, cfg)))
+
+	r.GET("/", admin(handlers.Dashboard(sqlDB, cfg)))
+	r.GET("/metrics", admin(handlers.MetricsPage(sqlDB, cfg)))
+	r.GET("/docs", admin(handlers.DocsPage(sqlDB, cfg)))
+	r.GET("/settings", admin(handlers.SettingsPage(sqlDB, cfg)))
+	r.GET("/users", admin(handlers.UsersPage(sqlDB, cfg)))
 
-	r.GET("/", appmw.AdminAuth(sqlDB, cfg)(handlers.Dashboard(sqlDB, cfg)))
-	r.GET("/metrics", appmw.AdminAuth(sqlDB, cfg)(handlers.MetricsPage(sqlDB, cfg)))
-	r.GET("/docs", appmw.AdminAuth(sqlDB, cfg)(handlers.DocsPage(sqlDB, cfg)))
-	r.GET("/settings", appmw.AdminAuth(sqlDB, cfg)(handlers.SettingsPage(sqlDB, cfg)))
-	r.GET("/users", appmw.AdminAuth(sqlDB, cfg)(handlers.UsersPage(sqlDB, cfg)))
+	r.POST("/admin/users/create", admin(handlers.CreateUser(sqlDB)))
+	r.POST("/admin/users/{id}/reset-password", admin(handlers.ResetPassword(sqlDB, cfg)))
+	r.POST("/admin/users/{id}/delete", admin(handlers.DeleteUser(sqlDB, cfg)))
+	r.POST("/admin/users/{id}/sessions/revoke", admin(handlers.RevokeUserSessions(sqlDB, cfg)))
+	r.POST("/admin/sessions/{id}/revoke", admin(handlers.RevokeSession(sqlDB, cfg)))
 
-	r.POST("/admin/users/create", appmw.AdminAuth(sqlDB, cfg)(handlers.CreateUser(sqlDB)))
-	r.POST("/admin/users/{id}/reset-password", appmw.AdminAuth(sqlDB, cfg)(handlers.ResetPassword(sqlDB, cfg)))
-	r.POST("/admin/users/{id}/delete", appmw.AdminAuth(sqlDB, cfg)(handlers.DeleteUser(sqlDB, cfg)))
+	r.POST("/settings/password", admin(handlers.ChangePasswordSelf(sqlDB, cfg)))
+	r.POST("/settings/display", admin(handlers.UpdateDisplaySettings(sqlDB, cfg)))
 
-	r.POST("/settings/password", appmw.AdminAuth(sqlDB, cfg)(handlers.ChangePasswordSelf(sqlDB, cfg)))
-	r.POST("/settings/display", appmw.AdminAuth(sqlDB, cfg)(handlers.UpdateDisplaySettings(sqlDB, cfg)))
+	r.POST("/admin/apikeys/create", admin(handlers.CreateAPIKey(sqlDB, cfg)))
+	r.POST("/admin/apikeys/delete", admin(handlers.DeleteAPIKey(sqlDB, cfg)))
+	r.POST("/admin/apikeys/set-active", admin(handlers.SetActiveAPIKey(sqlDB, cfg)))
+	r.POST("/admin/apikeys/set-strict", admin(handlers.SetStrictAPIKey(sqlDB)))
+	r.POST("/admin/apikeys/set-limits", admin(handlers.SetAPIKeyLimits(sqlDB)))
+	r.POST("/admin/apikeys/set-ip-policy", admin(handlers.SetAPIKeyIPPolicy(sqlDB)))
 
-	r.POST("/admin/apikeys/create", appmw.AdminAuth(sqlDB, cfg)(handlers.CreateAPIKey(sqlDB, cfg)))
-	r.POST("/admin/apikeys/delete", appmw.AdminAuth(sqlDB, cfg)(handlers.DeleteAPIKey(sqlDB, cfg)))
-	r.POST("/admin/apikeys/set-active", appmw.AdminAuth(sqlDB, cfg)(handlers.SetActiveAPIKey(sqlDB, cfg)))
+	r.POST("/admin/routes/create", admin(handlers.CreateRouteTemplate(sqlDB, routeTemplates)))
+	r.POST("/admin/routes/delete", admin(handlers.DeleteRouteTemplate(sqlDB, routeTemplates)))
 
-	r.GET("/admin/healthz", appmw.AdminAuth(sqlDB, cfg)(func(ctx *fasthttp.RequestCtx) {
+	r.POST("/admin/sampling/create", admin(handlers.CreateSamplingRule(sqlDB, samplingRules)))
+	r.POST("/admin/sampling/delete", admin(handlers.DeleteSamplingRule(sqlDB, samplingRules)))
+
+	r.POST("/admin/redaction/create", admin(handlers.CreateRedactionRule(sqlDB, redaction)))
+	r.POST("/admin/redaction/delete", admin(handlers.DeleteRedactionRule(sqlDB, redaction)))
+
+	r.GET("/admin/healthz", admin(func(ctx *fasthttp.RequestCtx) {
 		ctx.SetStatusCode(fasthttp.StatusOK)
 		ctx.SetBodyString("admin ok")
 	}))
 
 	r.GET("/v1/metrics", handlers.ProjectMetricsHandler(sqlDB))
-	r.POST("/v1/events", appmw.BearerAuth(sqlDB)(handlers.IngestHandler(sqlDB, cfg)))
-
-	r.GET("/v1/metrics/traffic", appmw.AdminAuth(sqlDB, cfg)(handlers.TrafficSeries(sqlDB)))
-	r.GET("/v1/metrics/error-rate", appmw.AdminAuth(sqlDB, cfg)(handlers.ErrorRateSeries(sqlDB)))
-	r.GET("/v1/metrics/latency-percentiles", appmw.AdminAuth(sqlDB, cfg)(handlers.LatencyPercentilesSeries(sqlDB)))
-	r.GET("/v1/metrics/avg-duration", appmw.AdminAuth(sqlDB, cfg)(handlers.AvgDuration(sqlDB)))
-	r.GET("/v1/metrics/attribute-keys", appmw.AdminAuth(sqlDB, cfg)(handlers.AttributeKeys(sqlDB)))
-	r.GET("/v1/metrics/attribute-values", appmw.AdminAuth(sqlDB, cfg)(handlers.AttributeValues(sqlDB)))
-	r.GET("/v1/metrics/attribute-value-counts", appmw.AdminAuth(sqlDB, cfg)(handlers.AttributeValueCounts(sqlDB)))
-	r.GET("/v1/metrics/top-routes", appmw.AdminAuth(sqlDB, cfg)(handlers.TopRoutes(sqlDB)))
-	r.GET("/v1/metrics/recent", appmw.AdminAuth(sqlDB, cfg)(handlers.RecentEvents(sqlDB)))
-	r.GET("/v1/metrics/event/{id}", appmw.AdminAuth(sqlDB, cfg)(handlers.EventDetail(sqlDB)))
-
-	log.Printf("apiinsight listening on %s", cfg.ListenAddr)
-	if err := fasthttp.ListenAndServe(cfg.ListenAddr, handler); err != nil {
-		log.Fatalf("server error: %v", err)
+	r.POST("/v1/events", appmw.BearerAuth(sqlDB, db.ScopeIngest)(appmw.Idempotency(sqlDB, cfg)(handlers.IngestHandler(pipeline, cfg, routeTemplates, limiter, samplingRules, redaction, geo))))
+	r.POST("/v1/otlp/traces", appmw.BearerAuth(sqlDB, db.ScopeIngest)(handlers.OTLPTracesHandler(pipeline, cfg, routeTemplates, limiter, samplingRules, redaction, geo)))
+
+	r.GET("/v1/metrics/traffic", metricsAuth(handlers.TrafficSeries(store)))
+	r.GET("/v1/metrics/error-rate", metricsAuth(handlers.ErrorRateSeries(store)))
+	r.GET("/v1/metrics/latency-percentiles", metricsAuth(handlers.LatencyPercentilesSeries(sqlDB)))
+	r.GET("/v1/metrics/avg-duration", metricsAuth(handlers.AvgDuration(store)))
+	r.GET("/v1/metrics/attribute-keys", metricsAuth(handlers.AttributeKeys(store)))
+	r.GET("/v1/metrics/attribute-values", metricsAuth(handlers.AttributeValues(store)))
+	r.GET("/v1/metrics/attribute-value-counts", metricsAuth(handlers.AttributeValueCounts(store)))
+	r.GET("/v1/metrics/countries", metricsAuth(handlers.CountryCounts(store)))
+	r.GET("/v1/metrics/clients", metricsAuth(handlers.ClientCounts(store)))
+	r.GET("/v1/metrics/top-routes", metricsAuth(handlers.TopRoutes(store)))
+	r.GET("/v1/metrics/bandwidth", metricsAuth(handlers.BandwidthSeries(store)))
+	r.GET("/v1/metrics/heaviest-routes", metricsAuth(handlers.HeaviestRoutes(store)))
+	r.GET("/v1/metrics/recent", metricsAuth(handlers.RecentEvents(store)))
+	r.GET("/v1/metrics/event/{id}", metricsAuth(handlers.EventDetail(sqlDB)))
+	r.GET("/v1/metrics/trace/{trace_id}", metricsAuth(handlers.TraceView(sqlDB)))
+
+	server := &fasthttp.Server{
+		Handler: handler,
+		// Uncompressed ingest bodies may be as large as the decompressed
+		// limit enforced by the ingest handlers.
+		MaxRequestBodySize: int(cfg.IngestMaxBodyBytes),
+	}
+	go func() {
+		log.Printf("apiinsight listening on %s", cfg.ListenAddr)
+		if err := server.ListenAndServe(cfg.ListenAddr); err != nil {
+			log.Fatalf("server error: %v", err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	// Stop taking requests first, then drain events already answered
+	// with 202 so nothing accepted is lost.
+	log.Printf("shutting down (timeout %s)", cfg.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := server.ShutdownWithContext(ctx); err != nil {
+		log.Printf("http shutdown: %v", err)
+	}
+	if err := internalSink.Close(ctx); err != nil {
+		log.Printf("internal reporting drain incomplete: %v", err)
+	}
+	if err := pipeline.Close(ctx); err != nil {
+		log.Printf("ingest drain incomplete: %v (%d events not written)", err, pipeline.Pending())
+	}
+	if err := limiter.Flush(); err != nil {
+		log.Printf("rate limit usage flush: %v", err)
 	}
 }
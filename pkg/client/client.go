@@ -0,0 +1,393 @@
+// Package client is the Go SDK for sending request events to API Insight.
+//
+// A Reporter queues events in memory (bounded, so a slow or unreachable
+// server never grows the host process without limit), sends them in
+// compressed batches and retries transient failures. Ready-made middleware
+// for net/http, fasthttp and fasthttp/router records one event per request:
+//
+//	rep, err := client.New(client.Config{
+//		Endpoint: "https://insight.example.com",
+//		APIKey:   os.Getenv("APIINSIGHT_API_KEY"),
+//	})
+//	...
+//	defer rep.Close(context.Background())
+//	http.ListenAndServe(":8080", rep.Middleware(mux, client.HTTPOptions{}))
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event is a single request as sent to /v1/events.
+type Event struct {
+	Timestamp  time.Time      `json:"timestamp"`
+	Path       string         `json:"path"`
+	Route      string         `json:"route,omitempty"`
+	Method     string         `json:"method,omitempty"`
+	Status     int            `json:"status,omitempty"`
+	DurationMs int64          `json:"duration_ms"`
+	RemoteIP   string         `json:"remote_ip,omitempty"`
+	UserAgent  string         `json:"user_agent,omitempty"`
+	Attributes map[string]any `json:"attributes,omitempty"`
+
+	// EventID identifies the event so retried deliveries are stored once.
+	// Report fills in a random ID when it is empty.
+	EventID string `json:"event_id,omitempty"`
+
+	// SampleRate is the share of requests reported when the caller samples,
+	// e.g. 0.1 for one in ten; the server weights the event accordingly.
+	SampleRate float64 `json:"sample_rate,omitempty"`
+
+	// TraceID, SpanID and ParentSpanID place the request in a distributed
+	// trace (lowercase hex). The middlewares leave them empty and record
+	// the incoming traceparent header as an attribute instead, from which
+	// the server derives the trace and parent span.
+	TraceID      string `json:"trace_id,omitempty"`
+	SpanID       string `json:"span_id,omitempty"`
+	ParentSpanID string `json:"parent_span_id,omitempty"`
+
+	// RequestBytes and ResponseBytes are the body sizes, when known.
+	RequestBytes  int64 `json:"request_bytes,omitempty"`
+	ResponseBytes int64 `json:"response_bytes,omitempty"`
+}
+
+// setTraceparent records an incoming W3C traceparent header, unless the
+// caller's attributes already carry one.
+func (ev *Event) setTraceparent(tp string) {
+	if _, ok := ev.Attributes["traceparent"]; ok {
+		return
+	}
+	if ev.Attributes == nil {
+		ev.Attributes = map[string]any{}
+	}
+	ev.Attributes["traceparent"] = tp
+}
+
+// Config configures a Reporter. Only Endpoint and APIKey are required.
+type Config struct {
+	// Endpoint is the base URL of the API Insight server.
+	Endpoint string
+	// APIKey is a project key with the ingest scope.
+	APIKey string
+
+	// BatchSize is the maximum number of events per request (default 100).
+	BatchSize int
+	// FlushInterval bounds how long a partial batch is held (default 2s).
+	FlushInterval time.Duration
+	// MaxQueue is the maximum number of events waiting to be sent; events
+	// reported beyond it are dropped (default 10000).
+	MaxQueue int
+	// MaxRetries is how often a failed batch is retried before it is
+	// dropped (default 5; negative disables retries). Retries back off
+	// exponentially and honour Retry-After.
+	MaxRetries int
+
+	// Attributes are added to every event, e.g. {"service": "billing"}.
+	// Attributes set on an event take precedence.
+	Attributes map[string]any
+
+	// HTTPClient sends the requests (default: a client with a 10s timeout).
+	HTTPClient *http.Client
+	// OnError is called when a batch is dropped. It must not block.
+	OnError func(err error, events int)
+}
+
+// Stats counts what a Reporter did with reported events.
+type Stats struct {
+	Sent    uint64
+	Dropped uint64 // queue full, or batch failed after retries
+}
+
+// ErrClosed is returned by Flush after Close.
+var ErrClosed = errors.New("apiinsight: reporter is closed")
+
+// Reporter sends events to API Insight in the background. It is safe for
+// concurrent use.
+type Reporter struct {
+	cfg   Config
+	url   string
+	flush chan chan struct{}
+	done  chan struct{}
+	wg    sync.WaitGroup
+
+	// mu guards closed and the closing of queue against concurrent sends.
+	mu     sync.RWMutex
+	closed bool
+	queue  chan Event
+
+	sent    atomic.Uint64
+	dropped atomic.Uint64
+}
+
+// New validates cfg and starts the background sender.
+func New(cfg Config) (*Reporter, error) {
+	if cfg.Endpoint == "" || cfg.APIKey == "" {
+		return nil, errors.New("apiinsight: Endpoint and APIKey are required")
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = 2 * time.Second
+	}
+	if cfg.MaxQueue <= 0 {
+		cfg.MaxQueue = 10000
+	}
+	if cfg.MaxRetries < 0 {
+		cfg.MaxRetries = 0
+	} else if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = 5
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	r := &Reporter{
+		cfg:   cfg,
+		url:   strings.TrimRight(cfg.Endpoint, "/") + "/v1/events",
+		queue: make(chan Event, cfg.MaxQueue),
+		flush: make(chan chan struct{}),
+		done:  make(chan struct{}),
+	}
+	r.wg.Add(1)
+	go r.run()
+	return r, nil
+}
+
+// Report queues ev without blocking. It returns false if the event was
+// dropped because the queue is full or the reporter is closed.
+func (r *Reporter) Report(ev Event) bool {
+	if ev.Timestamp.IsZero() {
+		ev.Timestamp = time.Now()
+	}
+	if ev.EventID == "" {
+		ev.EventID = randomID()
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		r.dropped.Add(1)
+		return false
+	}
+	select {
+	case r.queue <- ev:
+		return true
+	default:
+		r.dropped.Add(1)
+		return false
+	}
+}
+
+// Flush sends every queued event and waits until that is done or ctx ends.
+func (r *Reporter) Flush(ctx context.Context) error {
+	ack := make(chan struct{})
+	select {
+	case r.flush <- ack:
+	case <-r.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-ack:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting events, sends what is queued and waits until that
+// is done or ctx ends.
+func (r *Reporter) Close(ctx context.Context) error {
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.queue)
+	}
+	r.mu.Unlock()
+	finished := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stats returns counters since the reporter was created.
+func (r *Reporter) Stats() Stats {
+	return Stats{Sent: r.sent.Load(), Dropped: r.dropped.Load()}
+}
+
+func (r *Reporter) run() {
+	defer r.wg.Done()
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Event, 0, r.cfg.BatchSize)
+	send := func() {
+		if len(batch) > 0 {
+			r.send(batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case ev, ok := <-r.queue:
+			if !ok {
+				send()
+				return
+			}
+			batch = append(batch, ev)
+			if len(batch) >= r.cfg.BatchSize {
+				send()
+			}
+		case ack := <-r.flush:
+			// Drain what was queued before the flush request.
+			for n := len(r.queue); n > 0; n-- {
+				ev, ok := <-r.queue
+				if !ok {
+					break
+				}
+				batch = append(batch, ev)
+				if len(batch) >= r.cfg.BatchSize {
+					send()
+				}
+			}
+			send()
+			close(ack)
+		case <-ticker.C:
+			send()
+		}
+	}
+}
+
+func (r *Reporter) send(events []Event) {
+	for i := range events {
+		if len(r.cfg.Attributes) == 0 {
+			break
+		}
+		attrs := make(map[string]any, len(r.cfg.Attributes)+len(events[i].Attributes))
+		for k, v := range r.cfg.Attributes {
+			attrs[k] = v
+		}
+		for k, v := range events[i].Attributes {
+			attrs[k] = v
+		}
+		events[i].Attributes = attrs
+	}
+
+	body, err := encode(events)
+	if err == nil {
+		err = r.post(body)
+	}
+	if err != nil {
+		r.dropped.Add(uint64(len(events)))
+		if r.cfg.OnError != nil {
+			r.cfg.OnError(err, len(events))
+		}
+		return
+	}
+	r.sent.Add(uint64(len(events)))
+}
+
+func encode(events []Event) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(struct {
+		Events []Event `json:"events"`
+	}{events}); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// retryableError is a failure worth retrying, with an optional server hint.
+type retryableError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+
+// post sends body, retrying with the same Idempotency-Key so a batch whose
+// response was lost is not stored twice.
+func (r *Reporter) post(body []byte) error {
+	key := randomID()
+	backoff := 500 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := r.postOnce(body, key)
+		var retry *retryableError
+		if err == nil || !errors.As(err, &retry) || attempt >= r.cfg.MaxRetries {
+			return err
+		}
+		wait := backoff
+		if retry.after > 0 {
+			wait = retry.after
+		}
+		time.Sleep(wait)
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+func (r *Reporter) postOnce(body []byte, idempotencyKey string) error {
+	req, err := http.NewRequest(http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+r.cfg.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Idempotency-Key", idempotencyKey)
+
+	resp, err := r.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return &retryableError{err: err}
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	switch {
+	case resp.StatusCode == http.StatusAccepted:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		var after time.Duration
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+			after = time.Duration(secs) * time.Second
+		}
+		return &retryableError{err: fmt.Errorf("apiinsight: status %d: %s", resp.StatusCode, bytes.TrimSpace(msg)), after: after}
+	default:
+		return fmt.Errorf("apiinsight: status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
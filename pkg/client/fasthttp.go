@@ -0,0 +1,84 @@
+package client
+
+import (
+	"time"
+
+	"github.com/fasthttp/router"
+	"github.com/valyala/fasthttp"
+)
+
+// FastHTTPOptions customizes the fasthttp middleware. The zero value is
+// ready to use.
+type FastHTTPOptions struct {
+	// Skip excludes requests from reporting, e.g. health checks.
+	Skip func(ctx *fasthttp.RequestCtx) bool
+	// Attributes returns extra attributes for a finished request.
+	Attributes func(ctx *fasthttp.RequestCtx) map[string]any
+	// RemoteIP extracts the client address. The default uses the
+	// connection address; set it when running behind a trusted proxy.
+	RemoteIP func(ctx *fasthttp.RequestCtx) string
+	// Route returns the route template of the request, or "" to let the
+	// server derive it from the path.
+	Route func(ctx *fasthttp.RequestCtx) string
+}
+
+// FastHTTPMiddleware reports every request served by next.
+func (rep *Reporter) FastHTTPMiddleware(next fasthttp.RequestHandler, opts FastHTTPOptions) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if opts.Skip != nil && opts.Skip(ctx) {
+			next(ctx)
+			return
+		}
+		start := time.Now()
+		next(ctx)
+
+		ev := Event{
+			Timestamp:  start,
+			Path:       string(ctx.Path()),
+			Method:     string(ctx.Method()),
+			Status:     ctx.Response.StatusCode(),
+			DurationMs: time.Since(start).Milliseconds(),
+			UserAgent:  string(ctx.UserAgent()),
+
+			RequestBytes:  int64(len(ctx.Request.Body())),
+			ResponseBytes: int64(len(ctx.Response.Body())),
+		}
+		if opts.Route != nil {
+			ev.Route = opts.Route(ctx)
+		}
+		if opts.RemoteIP != nil {
+			ev.RemoteIP = opts.RemoteIP(ctx)
+		} else {
+			ev.RemoteIP = ctx.RemoteIP().String()
+		}
+		if opts.Attributes != nil {
+			ev.Attributes = opts.Attributes(ctx)
+		}
+		if tp := ctx.Request.Header.Peek("traceparent"); len(tp) > 0 {
+			ev.setTraceparent(string(tp))
+		}
+		rep.Report(ev)
+	}
+}
+
+// NewRouter returns a fasthttp/router Router that records the matched
+// route, for use with RouterMiddleware.
+func NewRouter() *router.Router {
+	r := router.New()
+	r.SaveMatchedRoutePath = true
+	return r
+}
+
+// RouterMiddleware reports every request served by r, using the matched
+// route path (e.g. "/users/{id}") as the route template. r must have
+// SaveMatchedRoutePath set before routes are registered; NewRouter does
+// that.
+func (rep *Reporter) RouterMiddleware(r *router.Router, opts FastHTTPOptions) fasthttp.RequestHandler {
+	if opts.Route == nil {
+		opts.Route = func(ctx *fasthttp.RequestCtx) string {
+			route, _ := ctx.UserValue(router.MatchedRoutePathParam).(string)
+			return route
+		}
+	}
+	return rep.FastHTTPMiddleware(r.Handler, opts)
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HTTPOptions customizes the net/http middleware. The zero value is ready
+// to use.
+type HTTPOptions struct {
+	// Skip excludes requests from reporting, e.g. health checks.
+	Skip func(r *http.Request) bool
+	// Attributes returns extra attributes for a finished request, e.g. the
+	// authenticated customer or plan.
+	Attributes func(r *http.Request, status int) map[string]any
+	// RemoteIP extracts the client address. The default uses the
+	// connection address; set it when running behind a trusted proxy.
+	RemoteIP func(r *http.Request) string
+}
+
+// Middleware reports every request served by next. The route is taken from
+// the pattern matched by http.ServeMux (Go 1.22+), e.g. "/users/{id}";
+// other routers fall back to server-side route detection.
+func (rep *Reporter) Middleware(next http.Handler, opts HTTPOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if opts.Skip != nil && opts.Skip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		ev := Event{
+			Timestamp:  start,
+			Path:       r.URL.Path,
+			Route:      patternRoute(r.Pattern),
+			Method:     r.Method,
+			Status:     sw.status,
+			DurationMs: time.Since(start).Milliseconds(),
+			UserAgent:  r.UserAgent(),
+
+			ResponseBytes: sw.bytes,
+		}
+		if r.ContentLength > 0 {
+			ev.RequestBytes = r.ContentLength
+		}
+		if opts.RemoteIP != nil {
+			ev.RemoteIP = opts.RemoteIP(r)
+		} else if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			ev.RemoteIP = host
+		}
+		if opts.Attributes != nil {
+			ev.Attributes = opts.Attributes(r, sw.status)
+		}
+		if tp := r.Header.Get("traceparent"); tp != "" {
+			ev.setTraceparent(tp)
+		}
+		rep.Report(ev)
+	})
+}
+
+// patternRoute strips the optional method and host from a ServeMux pattern
+// ("GET example.com/users/{id}" becomes "/users/{id}") and drops the "..."
+// of wildcard segments.
+func patternRoute(pattern string) string {
+	if i := strings.IndexByte(pattern, ' '); i >= 0 {
+		pattern = strings.TrimSpace(pattern[i+1:])
+	}
+	if i := strings.IndexByte(pattern, '/'); i > 0 {
+		pattern = pattern[i:]
+	}
+	return strings.ReplaceAll(pattern, "...}", "}")
+}
+
+// statusWriter records the status code and body size written by a
+// handler.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	bytes       int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = code, true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach Flush, Hijack and friends.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}